@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type adminInflight struct {
+	inflightObject
+	Elapsed float64 `json:"elapsed"`
+}
+
+type adminStatus struct {
+	RunID         string  `json:"run_id"`
+	Elapsed       float64 `json:"elapsed"`
+	Total         int     `json:"total"`
+	Requeued      int     `json:"requeued"`
+	Finished      int     `json:"finished"`
+	Pass          int     `json:"pass"`
+	Fail          int     `json:"fail"`
+	NotAttempted  int     `json:"not_attempted"`
+	Bytes         int64   `json:"bytes"`
+	Throughput    float64 `json:"throughput_bps"`
+	Workers       int     `json:"workers"`
+	Running       int     `json:"running"`
+	Inflight      int     `json:"inflight"`
+	Paused        bool    `json:"paused"`
+	Draining      bool    `json:"draining"`
+	Done          bool    `json:"done"`
+	Aborted       string  `json:"aborted,omitempty"`
+	ObjectsPerSec float64 `json:"objects_per_sec"`
+	BytesPerSec   float64 `json:"bytes_per_sec"`
+}
+
+func (t *runControl) status() adminStatus {
+	objRate, byteRate := t.objects.getRate(), t.bytes.getRate()
+	inflightCount := len(inflight.snapshot(t))
+	t.Lock()
+	defer t.Unlock()
+	elapsed := time.Since(t.start).Seconds()
+	return adminStatus{
+		RunID:         runID,
+		Elapsed:       elapsed,
+		Total:         t.total,
+		Requeued:      t.extra,
+		Finished:      t.finished,
+		Pass:          t.pass,
+		Fail:          t.fail,
+		NotAttempted:  t.notAttempted,
+		Bytes:         t.size,
+		Throughput:    float64(t.size) / elapsed,
+		Workers:       t.workers,
+		Running:       len(t.running),
+		Inflight:      inflightCount,
+		Paused:        t.paused,
+		Draining:      t.draining,
+		Done:          t.done,
+		Aborted:       t.abort,
+		ObjectsPerSec: objRate,
+		BytesPerSec:   byteRate,
+	}
+}
+
+type workersRequest struct {
+	Workers int `json:"workers"`
+}
+
+type rateRequest struct {
+	ObjectsPerSec *float64 `json:"objects_per_sec"`
+	BytesPerSec   *float64 `json:"bytes_per_sec"`
+}
+
+type requeueRequest struct {
+	OID string `json:"oid"`
+}
+
+// ServeHTTP is the admin api of a run:
+//
+//	GET /status, /inflight, /errors
+//	POST /pause, /resume, /drain
+//	POST /workers {"workers": 8}
+//	POST /ratelimit {"objects_per_sec": 50, "bytes_per_sec": 10485760}
+//	POST /requeue {"oid": "..."}
+func (t *runControl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		switch r.URL.Path {
+		case "/status":
+			writeJSON(w, t.status())
+		case "/inflight":
+			now := time.Now()
+			objs := []adminInflight{}
+			for _, o := range inflight.snapshot(t) {
+				objs = append(objs, adminInflight{inflightObject: o, Elapsed: now.Sub(o.Start).Seconds()})
+			}
+			writeJSON(w, objs)
+		case "/errors":
+			writeJSON(w, t.recentErrors())
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case "/pause":
+		t.setPaused(true)
+	case "/resume":
+		t.setPaused(false)
+	case "/drain":
+		t.drain()
+	case "/workers":
+		var req workersRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Workers <= 0 {
+			http.Error(w, "invalid worker count", http.StatusBadRequest)
+			return
+		}
+		t.setWorkers(req.Workers)
+	case "/ratelimit":
+		var req rateRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.ObjectsPerSec != nil {
+			t.objects.setRate(*req.ObjectsPerSec)
+		}
+		if req.BytesPerSec != nil {
+			t.bytes.setRate(*req.BytesPerSec)
+		}
+		log.Infof("rate limits set to %g objects/s, %g bytes/s", t.objects.getRate(), t.bytes.getRate())
+	case "/requeue":
+		var req requeueRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.OID == "" {
+			http.Error(w, "missing oid", http.StatusBadRequest)
+			return
+		}
+		if !t.requeue(req.OID) {
+			http.Error(w, "run over or requeue queue full", http.StatusConflict)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, t.status())
+}
+
+// serveAdmin serves the admin api of ctl on listen until the returned
+// function is called
+func serveAdmin(listen string, ctl *runControl) func() {
+	server := &http.Server{Addr: listen, Handler: ctl}
+	go func() {
+		log.Infof("Admin api on %s", listen)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("admin api failed: %s", err.Error())
+		}
+	}()
+	return func() {
+		server.Shutdown(context.Background())
+	}
+}
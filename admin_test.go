@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"s3sync/storage"
+)
+
+func adminCall(t *testing.T, method, url, body string) (adminStatus, bool) {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("admin %s %s failed: %s", method, url, err.Error())
+		return adminStatus{}, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("admin %s %s: %s", method, url, resp.Status)
+		return adminStatus{}, false
+	}
+	var s adminStatus
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		t.Errorf("invalid admin status: %s", err.Error())
+		return adminStatus{}, false
+	}
+	return s, true
+}
+
+func TestAdminControl(t *testing.T) {
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	keys := []string{"k1", "k2", "k3"}
+	wos := setupWosServer(t, keys)
+	defer wos.Close()
+	dest := storage.NewS3Storage(s3Server.URL, "u1", "s1", bucket)
+	source := storage.NewWosStorage(strings.TrimPrefix(wos.URL, "http://"))
+
+	ctl := newRunControl(1)
+	ctl.setPaused(true)
+	admin := httptest.NewServer(ctl)
+	defer admin.Close()
+
+	report := &memWriter{}
+	done := make(chan struct{})
+	go func() {
+		runMigration(ctl, dest, source, &csvReporter{w: bufio.NewWriter(report)},
+			&listEnumerator{r: strings.NewReader("k1\nk2\nk3\n")})
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	s, ok := adminCall(t, "GET", admin.URL+"/status", "")
+	if !ok {
+		return
+	}
+	if !s.Paused || s.Finished != 0 || s.Workers != 1 {
+		t.Errorf("unexpected paused status: %+v", s)
+		return
+	}
+	if _, ok := adminCall(t, "POST", admin.URL+"/requeue", `{"oid": "k2"}`); !ok {
+		return
+	}
+	if _, ok := adminCall(t, "POST", admin.URL+"/workers", `{"workers": 3}`); !ok {
+		return
+	}
+	if _, ok := adminCall(t, "POST", admin.URL+"/ratelimit", `{"objects_per_sec": 100}`); !ok {
+		return
+	}
+	if _, ok := adminCall(t, "POST", admin.URL+"/resume", ""); !ok {
+		return
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Errorf("migration didn't complete")
+		return
+	}
+	s, ok = adminCall(t, "GET", admin.URL+"/status", "")
+	if !ok {
+		return
+	}
+	if !s.Done || s.Total != 3 || s.Requeued != 1 || s.Finished != 4 || s.Pass != 4 ||
+		s.Workers != 3 || s.ObjectsPerSec != 100 {
+		t.Errorf("unexpected final status: %+v", s)
+		return
+	}
+	if strings.Count(string(report.data), ",k2") != 2 {
+		t.Errorf("requeued k2 not migrated twice: %s", report.data)
+		return
+	}
+	resp, err := http.Post(admin.URL+"/requeue", "application/json", strings.NewReader(`{"oid": "k1"}`))
+	if err != nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("requeue after the run: %v, %v", resp, err)
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	wos := setupWosServer(t, []string{"k1", "k2", "k3"})
+	defer wos.Close()
+	dest := storage.NewS3Storage(s3Server.URL, "u1", "s1", bucket)
+	source := storage.NewWosStorage(strings.TrimPrefix(wos.URL, "http://"))
+
+	// one object every 200ms, the run is drained after the first ones
+	ctl := newRunControl(1)
+	ctl.objects.setRate(5)
+	report := &memWriter{}
+	done := make(chan struct{})
+	go func() {
+		runMigration(ctl, dest, source, &csvReporter{w: bufio.NewWriter(report)},
+			&listEnumerator{r: strings.NewReader("k1\nk2\nk3\n")})
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	ctl.drain()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Errorf("drained migration didn't stop")
+		return
+	}
+	s := ctl.status()
+	if !s.Draining || s.Done || s.Running != 0 || s.Finished == 0 || s.Finished == 3 {
+		t.Errorf("unexpected drained status: %+v", s)
+	}
+	if strings.Count(string(report.data), "\n") != s.Finished+s.NotAttempted ||
+		strings.Count(string(report.data), "not attempted") != s.NotAttempted {
+		t.Errorf("report doesn't match %d finished objects: %s", s.Finished, report.data)
+	}
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"s3sync/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// discrepancy kinds found by an audit
+const (
+	auditMissingSource = "missing_source"
+	auditMissingDest   = "missing_dest"
+	auditSizeMismatch  = "size_mismatch"
+	auditMD5Mismatch   = "md5_mismatch"
+	auditSourceError   = "source_error"
+	auditDestError     = "dest_error"
+)
+
+// audit modes, full compares the checksums by reading both copies, size
+// only compares the sizes
+const (
+	auditFull = "full"
+	auditSize = "size"
+)
+
+type auditOptions struct {
+	mode       string
+	sample     float64
+	confidence float64
+	margin     float64
+	seed       string
+}
+
+// auditLine is a line of the audit report, either a discrepancy or the
+// summary closing the report
+type auditLine struct {
+	Type       string `json:"type"`
+	OID        string `json:"oid,omitempty"`
+	Dest       string `json:"dest,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	SourceSize *int64 `json:"source_size,omitempty"`
+	DestSize   *int64 `json:"dest_size,omitempty"`
+	SourceMD5  string `json:"source_md5,omitempty"`
+	DestMD5    string `json:"dest_md5,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	Summary *auditSummary `json:"summary,omitempty"`
+}
+
+type auditSummary struct {
+	RunID         string         `json:"run_id"`
+	Time          string         `json:"time"`
+	Mode          string         `json:"mode"`
+	Seed          string         `json:"seed"`
+	Population    int            `json:"population,omitempty"`
+	SampleRate    float64        `json:"sample_rate"`
+	Confidence    float64        `json:"confidence,omitempty"`
+	Margin        float64        `json:"margin,omitempty"`
+	Checked       int            `json:"checked"`
+	Matched       int            `json:"matched"`
+	Discrepancies map[string]int `json:"discrepancies"`
+	Rate          float64        `json:"discrepancy_rate"`
+	// RateUpperBound is the upper bound of the discrepancy rate of the
+	// whole set at the confidence level
+	RateUpperBound float64 `json:"discrepancy_rate_upper_bound,omitempty"`
+}
+
+// auditor compares the migrated objects between wos and s3, writing the
+// discrepancies to a report signed with hmac-sha256
+type auditor struct {
+	sync.Mutex
+	opts   auditOptions
+	source storage.StorSrc
+	names  []string
+	dests  []storage.StorDest
+
+	w       *bufio.Writer
+	mac     hash.Hash
+	checked int
+	matched int
+	kinds   map[string]int
+}
+
+func newAuditor(opts auditOptions, source storage.StorSrc, dest storage.StorDest, w io.Writer, key []byte) *auditor {
+	a := &auditor{
+		opts:   opts,
+		source: source,
+		w:      bufio.NewWriter(w),
+		mac:    hmac.New(sha256.New, key),
+		kinds:  map[string]int{},
+	}
+	if multi, ok := dest.(*storage.MultiStorage); ok {
+		a.names = multi.Names
+		a.dests = multi.Dests
+	} else {
+		a.names = []string{""}
+		a.dests = []storage.StorDest{dest}
+	}
+	return a
+}
+
+// write writes a line of the report and adds it to the signature
+func (t *auditor) write(l auditLine) {
+	data, err := json.Marshal(l)
+	if err != nil {
+		log.Errorf("failed to encode audit line: %s", err.Error())
+		return
+	}
+	data = append(data, '\n')
+	t.w.Write(data)
+	t.mac.Write(data)
+}
+
+// objectCheck is the size and checksum of a copy, md5 being empty in size
+// mode
+type objectCheck struct {
+	size int64
+	md5  string
+	// decompressed tells the copy was decompressed by the transform, its
+	// checksum being the one of the decompressed source
+	decompressed bool
+}
+
+// check audits the object key, packed at loc when it isn't nil
+func (t *auditor) check(key string, loc *bundleLocation) {
+	var found []auditLine
+	src, err := t.readSource(key, false)
+	if err != nil {
+		kind := auditSourceError
+		if isNotFound(err) {
+			kind = auditMissingSource
+		}
+		found = append(found, auditLine{Type: "discrepancy", OID: key, Kind: kind, Error: err.Error()})
+	}
+
+	if src != nil {
+		// plain is the decompressed source, read once for the decompressed
+		// copies
+		var plain *objectCheck
+		for i, dest := range t.dests {
+			var dst *objectCheck
+			if loc != nil {
+				dst, err = t.readPackedDest(dest, *loc)
+			} else {
+				dst, err = t.readDest(dest, destKey(key))
+			}
+			want := src
+			if err == nil && dst.decompressed && t.opts.mode != auditSize {
+				if plain == nil {
+					if plain, err = t.readSource(key, true); err != nil {
+						found = append(found, auditLine{Type: "discrepancy", OID: key, Kind: auditSourceError, Error: err.Error()})
+						break
+					}
+				}
+				want = plain
+			}
+			l := auditLine{Type: "discrepancy", OID: key, Dest: t.names[i],
+				SourceSize: &want.size, SourceMD5: want.md5}
+			switch {
+			case err != nil && isNotFound(err):
+				l.Kind = auditMissingDest
+			case err != nil:
+				l.Kind = auditDestError
+				l.Error = err.Error()
+			case dst.size != want.size:
+				l.Kind = auditSizeMismatch
+			case dst.md5 != want.md5:
+				l.Kind = auditMD5Mismatch
+			default:
+				continue
+			}
+			if dst != nil {
+				l.DestSize = &dst.size
+				l.DestMD5 = dst.md5
+			}
+			found = append(found, l)
+		}
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.checked++
+	if len(found) == 0 {
+		t.matched++
+	}
+	for _, l := range found {
+		log.Warnf("audit found %s of %s %s", l.Kind, key, l.Error)
+		t.kinds[l.Kind]++
+		t.write(l)
+	}
+}
+
+// readSource checks the source object key, decompressed when it's gzip or
+// zstd compressed if decompressed is set
+func (t *auditor) readSource(key string, decompressed bool) (*objectCheck, error) {
+	obj, err := t.source.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	body := obj.GetBody()
+	defer body.Close()
+	if t.opts.mode == auditSize && obj.GetContentLength() >= 0 {
+		return &objectCheck{size: obj.GetContentLength()}, nil
+	}
+	if !decompressed {
+		return checksum(body)
+	}
+	br := bufio.NewReader(body)
+	magic, _ := br.Peek(4)
+	format := compression(magic)
+	if format == "" {
+		return checksum(br)
+	}
+	zr, err := decompress(format, br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s object: %s", format, err.Error())
+	}
+	defer zr.Close()
+	return checksum(zr)
+}
+
+func (t *auditor) readDest(dest storage.StorDest, key string) (*objectCheck, error) {
+	if t.opts.mode == auditSize {
+		if s, ok := dest.(storage.Statter); ok {
+			info, err := s.Stat(key)
+			if err != nil {
+				return nil, err
+			}
+			return &objectCheck{size: originalSize(info.Metadata, info.Size)}, nil
+		}
+	}
+	obj, err := dest.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	body := obj.GetBody()
+	defer body.Close()
+	// a transformed copy is compared to its source by its original size and
+	// content
+	meta := storage.Metadata(obj)
+	if t.opts.mode == auditSize {
+		return &objectCheck{size: originalSize(meta, obj.GetContentLength())}, nil
+	}
+	restored, err := restoreBody(meta, body)
+	if err != nil {
+		return nil, err
+	}
+	defer restored.Close()
+	c, err := checksum(restored)
+	if err != nil {
+		return nil, err
+	}
+	c.decompressed = isDecompressed(meta)
+	return c, nil
+}
+
+// readPackedDest checks the copy packed at loc, read by range
+func (t *auditor) readPackedDest(dest storage.StorDest, loc bundleLocation) (*objectCheck, error) {
+	obj, err := readBundled(dest, loc)
+	if err != nil {
+		return nil, err
+	}
+	body := obj.GetBody()
+	defer body.Close()
+	if t.opts.mode == auditSize {
+		return &objectCheck{size: obj.GetContentLength()}, nil
+	}
+	return checksum(body)
+}
+
+// checksum reads r to compute its size and md5, quoted like storage.CalcMD5
+func checksum(r io.Reader) (*objectCheck, error) {
+	h := md5.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	return &objectCheck{size: n, md5: fmt.Sprintf("\"%x\"", h.Sum(nil))}, nil
+}
+
+// isNotFound tells whether err is a missing object of wos or s3
+func isNotFound(err error) bool {
+	return errors.Is(err, storage.ErrNotFound)
+}
+
+// close writes the summary and returns the hex signature of the report
+func (t *auditor) close(population int, rate float64) (*auditSummary, string, error) {
+	t.Lock()
+	defer t.Unlock()
+	s := &auditSummary{
+		RunID:         runID,
+		Time:          time.Now().UTC().Format(time.RFC3339),
+		Mode:          t.opts.mode,
+		Seed:          t.opts.seed,
+		Population:    population,
+		SampleRate:    rate,
+		Confidence:    t.opts.confidence,
+		Margin:        t.opts.margin,
+		Checked:       t.checked,
+		Matched:       t.matched,
+		Discrepancies: t.kinds,
+	}
+	if t.checked > 0 {
+		s.Rate = float64(t.checked-t.matched) / float64(t.checked)
+		if t.opts.confidence > 0 {
+			s.RateUpperBound = wilsonUpper(t.checked-t.matched, t.checked, zScore(t.opts.confidence))
+		}
+	}
+	t.write(auditLine{Type: "summary", Summary: s})
+	if err := t.w.Flush(); err != nil {
+		return nil, "", err
+	}
+	return s, hex.EncodeToString(t.mac.Sum(nil)), nil
+}
+
+// zScore returns the two-sided normal quantile of a confidence level
+func zScore(confidence float64) float64 {
+	return math.Sqrt2 * math.Erfinv(confidence)
+}
+
+// sampleSize returns how many objects out of population are to be checked
+// to estimate the discrepancy rate within margin at the confidence level,
+// the worst case p = 0.5 with the finite population correction
+func sampleSize(population int, confidence, margin float64) int {
+	if population <= 0 {
+		return 0
+	}
+	z := zScore(confidence)
+	n0 := z * z * 0.25 / (margin * margin)
+	n := n0 / (1 + (n0-1)/float64(population))
+	return int(math.Min(math.Ceil(n), float64(population)))
+}
+
+// wilsonUpper returns the upper bound of the wilson score interval of k
+// successes out of n
+func wilsonUpper(k, n int, z float64) float64 {
+	p := float64(k) / float64(n)
+	nf := float64(n)
+	d := 1 + z*z/nf
+	c := p + z*z/(2*nf)
+	m := z * math.Sqrt(p*(1-p)/nf+z*z/(4*nf*nf))
+	return math.Min(1, (c+m)/d)
+}
+
+// sampled tells whether key is part of the sample, the selection being
+// reproducible with the same seed
+func sampled(key, seed string, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	h.Write([]byte(key))
+	return float64(h.Sum64())/float64(math.MaxUint64) < rate
+}
+
+// keyLister calls fn with the migrated keys, with their bundle when they were
+// packed
+type keyLister func(fn func(key string, loc *bundleLocation)) error
+
+// reportKeys lists the keys of the report at path
+func reportKeys(path string) keyLister {
+	return func(fn func(key string, loc *bundleLocation)) error {
+		return migratedKeys(path, fn)
+	}
+}
+
+// stateKeys lists the verified objects of the state store whose source
+// isn't deleted, the packed ones not being recorded there
+func stateKeys(store *stateStore) keyLister {
+	return func(fn func(key string, loc *bundleLocation)) error {
+		after := ""
+		for {
+			objs, err := store.undeleted(after, math.MaxInt64, ListPageSize)
+			if err != nil {
+				return fmt.Errorf("failed to read state store: %s", err.Error())
+			}
+			for _, o := range objs {
+				fn(o.oid, nil)
+			}
+			if len(objs) < ListPageSize {
+				return nil
+			}
+			after = objs[len(objs)-1].oid
+		}
+	}
+}
+
+// migratedKeys calls fn with the keys migrated successfully according to a
+// csv or json lines report, with their bundle when they were packed
+func migratedKeys(path string, fn func(key string, loc *bundleLocation)) error {
+	in, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return readLines(in, func(line string) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return
+		}
+		e, l, err := parseAnyReportLine(line)
+		if err != nil {
+			log.Errorf("invalid report line %s: %s", line, err.Error())
+			return
+		}
+		if e.status != "ok" || !e.verified {
+			return
+		}
+		if l != nil {
+			fn(e.key, l.Bundle)
+		} else {
+			fn(e.key, nil)
+		}
+	})
+}
+
+// runAudit checks the migrated objects listed by keys, returning the summary
+// and the signature of the discrepancy report. keys is listed twice with a
+// confidence target.
+func runAudit(keys keyLister, opts auditOptions, source storage.StorSrc, dest storage.StorDest,
+	w io.Writer, key []byte) (*auditSummary, string, error) {
+	rate := opts.sample
+	population := 0
+	if opts.confidence > 0 {
+		if err := keys(func(string, *bundleLocation) { population++ }); err != nil {
+			return nil, "", err
+		}
+		if population > 0 {
+			n := sampleSize(population, opts.confidence, opts.margin)
+			rate = math.Max(rate, float64(n)/float64(population))
+		}
+		log.Infof("Auditing ~%.0f of %d objects for a %.3g confidence within %.3g",
+			rate*float64(population), population, opts.confidence, opts.margin)
+	}
+
+	a := newAuditor(opts, source, dest, w, key)
+	type migrated struct {
+		key string
+		loc *bundleLocation
+	}
+	checks := make(chan migrated, SyncWorkerCnt)
+	var wg sync.WaitGroup
+	for i := 0; i < SyncWorkerCnt; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range checks {
+				a.check(k.key, k.loc)
+			}
+		}()
+	}
+	err := keys(func(k string, loc *bundleLocation) {
+		if sampled(k, opts.seed, rate) {
+			checks <- migrated{k, loc}
+		}
+	})
+	close(checks)
+	wg.Wait()
+	if err != nil {
+		return nil, "", err
+	}
+	return a.close(population, rate)
+}
+
+// verifyAudit checks the signature of an audit report
+func verifyAudit(path, sigPath string, key []byte) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sig, err := ioutil.ReadFile(sigPath)
+	if err != nil {
+		return err
+	}
+	want, err := hex.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return fmt.Errorf("invalid signature: %s", err.Error())
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	if !hmac.Equal(mac.Sum(nil), want) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// auditCommand audits a finished migration:
+//
+//	audit -report report.csv -o audit.jsonl -hmackey key ... [-sample 0.01] [-confidence 0.99 -margin 0.01]
+//	audit -state state.db -o audit.jsonl -hmackey key ...
+//	audit -verify audit.jsonl -hmackey key
+func auditCommand(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	cfg := addConfigFlags(fs)
+	input := fs.String("report", "", "report of the migration, csv or jsonl, - for stdin")
+	statePath := fs.String("state", "", "state store of the migration, instead of its report")
+	out := fs.String("o", "", "discrepancy report, signed in <o>.sig")
+	keyFile := fs.String("hmackey", "", "file holding the signing key")
+	verify := fs.String("verify", "", "verify the signature of this audit report")
+	opts := auditOptions{}
+	fs.StringVar(&opts.mode, "mode", auditFull, "full compares checksums, size only sizes")
+	fs.Float64Var(&opts.sample, "sample", 1, "rate of the objects checked")
+	fs.Float64Var(&opts.confidence, "confidence", 0, "confidence level of the discrepancy rate, raising the sample rate as needed")
+	fs.Float64Var(&opts.margin, "margin", 0.01, "error margin of the discrepancy rate")
+	fs.StringVar(&opts.seed, "seed", runID, "sample selection seed")
+	storOpts := storOptions{}
+	addStorFlags(fs, &storOpts)
+	encOpts := encryptionOptions{}
+	addKeyFlags(fs, &encOpts)
+	fs.Parse(args)
+	if err := cfg.load(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := setupEncryption(encOpts); err != nil {
+		fs.Usage()
+		log.Fatal(err.Error())
+	}
+
+	if *keyFile == "" {
+		fs.Usage()
+		log.Fatal("missing hmac key file")
+	}
+	key, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		log.Fatalf("failed to read hmac key: %s", err.Error())
+	}
+	key = []byte(strings.TrimSpace(string(key)))
+
+	if *verify != "" {
+		if err := verifyAudit(*verify, *verify+".sig", key); err != nil {
+			log.Fatalf("audit report %s: %s", *verify, err.Error())
+		}
+		log.Infof("audit report %s: signature ok", *verify)
+		return
+	}
+
+	if (*input == "") == (*statePath == "") || *out == "" || !storOpts.complete() {
+		fs.Usage()
+		log.Fatal("missing report or state store, output, access key, secret key, endpoint, bucket or dest host")
+	}
+	if opts.confidence > 0 && *input == "-" {
+		log.Fatal("a confidence target needs a report file, not stdin")
+	}
+	if opts.mode != auditFull && opts.mode != auditSize {
+		log.Fatalf("unknown audit mode: %s", opts.mode)
+	}
+	if opts.sample <= 0 || opts.sample > 1 || opts.confidence < 0 || opts.confidence >= 1 || opts.margin <= 0 {
+		log.Fatal("sample rate must be in (0, 1], confidence in [0, 1) and margin positive")
+	}
+
+	dest, err := storOpts.dest()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	source, err := storOpts.source()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("failed to create audit report(%s): %s", *out, err.Error())
+	}
+	defer f.Close()
+
+	keys := reportKeys(*input)
+	if *statePath != "" {
+		store, err := openStateStore(*statePath)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		defer store.Close()
+		keys = stateKeys(store)
+	}
+
+	log.Infof("Run %s", runID)
+	s, sig, err := runAudit(keys, opts, source, dest, f, key)
+	if err != nil {
+		log.Fatalf("audit failed: %s", err.Error())
+	}
+	if err := ioutil.WriteFile(*out+".sig", []byte(sig+"\n"), 0644); err != nil {
+		log.Fatalf("failed to write signature: %s", err.Error())
+	}
+	log.Infof("Audit Completed: %d/%d matched, discrepancies %v", s.Matched, s.Checked, s.Discrepancies)
+}
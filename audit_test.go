@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"s3sync/storage"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestAudit(t *testing.T) {
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	keys := []string{"k1", "k2", "k3", "k4"}
+	wos := setupWosServer(t, keys)
+	defer wos.Close()
+
+	dest := storage.NewS3Storage(s3Server.URL, "u1", "s1", bucket)
+	source := storage.NewWosStorage(strings.TrimPrefix(wos.URL, "http://"))
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Errorf("failed to create temp dir: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+	store, err := openStateStore(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Errorf("failed to open state store: %s", err.Error())
+		return
+	}
+	defer store.Close()
+	report := &memWriter{}
+	migrate(dest, source, &stateReporter{reporter: &csvReporter{w: bufio.NewWriter(report)}, store: store},
+		&listEnumerator{r: strings.NewReader("k1\nk2\nk3\nk4\nmissing\n")})
+
+	// weeks later k2 is overwritten and k3 is gone
+	svc := s3.New(session.New(dest.Config))
+	if _, err := svc.PutObject(&s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String("k2"),
+		Body: strings.NewReader("k2 contenu")}); err != nil {
+		t.Errorf("failed to overwrite k2: %s", err.Error())
+		return
+	}
+	if err := dest.Delete("k3"); err != nil {
+		t.Errorf("failed to delete k3: %s", err.Error())
+		return
+	}
+
+	input := filepath.Join(dir, "report.csv")
+	ioutil.WriteFile(input, report.data, 0644)
+
+	// the state store lists the same verified objects as the report
+	inputs := map[string]keyLister{auditFull: reportKeys(input), auditSize: stateKeys(store)}
+	for _, mode := range []string{auditFull, auditSize} {
+		var out bytes.Buffer
+		opts := auditOptions{mode: mode, sample: 1, confidence: 0.95, margin: 0.05, seed: "s"}
+		s, sig, err := runAudit(inputs[mode], opts, source, dest, &out, []byte("secret"))
+		if err != nil {
+			t.Errorf("audit failed: %s", err.Error())
+			return
+		}
+		// "k2 contenu" has the size of "k2 content"
+		wantK2, wantMatched := auditMD5Mismatch, 2
+		if mode == auditSize {
+			wantK2, wantMatched = "", 3
+		}
+		if s.Population != 4 || s.Checked != 4 || s.Matched != wantMatched || s.RateUpperBound < s.Rate {
+			t.Errorf("unexpected %s audit summary: %+v", mode, s)
+		}
+
+		kinds := map[string]string{}
+		for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var line auditLine
+			if err := json.Unmarshal([]byte(l), &line); err != nil {
+				t.Errorf("invalid audit line %s: %s", l, err.Error())
+				continue
+			}
+			if line.Type == "discrepancy" {
+				kinds[line.OID] = line.Kind
+			}
+		}
+		if kinds["k2"] != wantK2 || kinds["k3"] != auditMissingDest {
+			t.Errorf("unexpected %s discrepancies: %v", mode, kinds)
+		}
+
+		path := filepath.Join(dir, mode+".jsonl")
+		ioutil.WriteFile(path, out.Bytes(), 0644)
+		ioutil.WriteFile(path+".sig", []byte(sig), 0644)
+		if err := verifyAudit(path, path+".sig", []byte("secret")); err != nil {
+			t.Errorf("failed to verify %s audit: %s", mode, err.Error())
+		}
+		ioutil.WriteFile(path, bytes.Replace(out.Bytes(), []byte("k3"), []byte("k5"), 1), 0644)
+		if err := verifyAudit(path, path+".sig", []byte("secret")); err == nil {
+			t.Errorf("tampered %s audit verified", mode)
+		}
+	}
+}
+
+func TestAuditSampling(t *testing.T) {
+	if n := sampleSize(1000000, 0.95, 0.01); n < 9500 || n > 9700 {
+		t.Errorf("unexpected sample size: %d", n)
+	}
+	if n := sampleSize(100, 0.99, 0.01); n > 100 || n < 90 {
+		t.Errorf("unexpected sample size: %d", n)
+	}
+
+	selected := 0
+	for i := 0; i < 10000; i++ {
+		key := string(rune('a'+i%26)) + strings.Repeat("x", i%7) + string(rune(i))
+		if sampled(key, "seed", 0.1) != sampled(key, "seed", 0.1) {
+			t.Errorf("sampling of %s isn't reproducible", key)
+			return
+		}
+		if sampled(key, "seed", 0.1) {
+			selected++
+		}
+	}
+	if selected < 800 || selected > 1200 {
+		t.Errorf("unexpected sample of 10000 at 10%%: %d", selected)
+	}
+}
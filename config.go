@@ -0,0 +1,537 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"s3sync/storage"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// configFile is a yaml config file, the defaults applying to every profile
+type configFile struct {
+	DefaultProfile string                    `yaml:"default_profile"`
+	Defaults       profileConfig             `yaml:"defaults"`
+	Profiles       map[string]*profileConfig `yaml:"profiles"`
+}
+
+type profileConfig struct {
+	Source       sourceConfig     `yaml:"source"`
+	Destinations []destConfig     `yaml:"destinations"`
+	Policy       string           `yaml:"policy"`
+	Workers      int              `yaml:"workers"`
+	Timeout      string           `yaml:"timeout"`
+	LogLevel     string           `yaml:"log_level"`
+	Log          logConfig        `yaml:"log"`
+	KeyPrefix    string           `yaml:"key_prefix"`
+	Mismatch     string           `yaml:"mismatch"`
+	Quarantine   string           `yaml:"quarantine"`
+	Transform    transformConfig  `yaml:"transform"`
+	Pack         packConfig       `yaml:"pack"`
+	Dedup        dedupConfig      `yaml:"dedup"`
+	Protect      protectConfig    `yaml:"protect"`
+	Preflight    preflightConfig  `yaml:"preflight"`
+	Encryption   encryptionConfig `yaml:"encryption"`
+	Admin        string           `yaml:"admin"`
+	Notify       notifyConfig     `yaml:"notify"`
+	Report       reportConfig     `yaml:"report"`
+	Delete       deleteConfig     `yaml:"delete"`
+}
+
+type sourceConfig struct {
+	Wos     string `yaml:"wos"`
+	OIDFile string `yaml:"oidfile"`
+	Enum    string `yaml:"enum"`
+	// Kind is wos or s3, an s3 source restoring the copies under Prefix
+	Kind   string      `yaml:"kind"`
+	S3     *destConfig `yaml:"s3"`
+	Prefix string      `yaml:"prefix"`
+}
+
+// destConfig is an s3 destination, the credentials being given as is or
+// referenced by an environment variable or a file
+type destConfig struct {
+	Endpoint      string `yaml:"endpoint"`
+	Bucket        string `yaml:"bucket"`
+	AccessKey     string `yaml:"access_key"`
+	AccessKeyEnv  string `yaml:"access_key_env"`
+	AccessKeyFile string `yaml:"access_key_file"`
+	SecretKey     string `yaml:"secret_key"`
+	SecretKeyEnv  string `yaml:"secret_key_env"`
+	SecretKeyFile string `yaml:"secret_key_file"`
+}
+
+type logConfig struct {
+	Format  string `yaml:"format"`
+	File    string `yaml:"file"`
+	MaxSize int64  `yaml:"max_size"`
+	MaxAge  string `yaml:"max_age"`
+	Backups int    `yaml:"backups"`
+}
+
+// transformConfig selects the objects transformed, by content type prefix,
+// minimum size and oid pattern
+type transformConfig struct {
+	Mode         string `yaml:"mode"`
+	ContentTypes string `yaml:"content_types"`
+	MinSize      int64  `yaml:"min_size"`
+	Keys         string `yaml:"keys"`
+}
+
+// packConfig packs the objects smaller than max_size in bundles of size
+// bytes
+type packConfig struct {
+	Format  string `yaml:"format"`
+	MaxSize int64  `yaml:"max_size"`
+	Size    int64  `yaml:"size"`
+	Prefix  string `yaml:"prefix"`
+}
+
+// dedupConfig stores the objects by content under prefix. The booleans of
+// the config are strings parsed by strconv.ParseBool, so that false
+// overrides a true default.
+type dedupConfig struct {
+	Content string `yaml:"content"`
+	Prefix  string `yaml:"prefix"`
+}
+
+// protectConfig refuses the overwrites of a different content and locks the
+// uploads for lock_days in lock_mode
+type protectConfig struct {
+	NoOverwrite string `yaml:"no_overwrite"`
+	LockMode    string `yaml:"lock_mode"`
+	LockDays    int    `yaml:"lock_days"`
+	LegalHold   string `yaml:"legal_hold"`
+}
+
+// preflightConfig configures the checks run before a migration
+type preflightConfig struct {
+	Skip         string `yaml:"skip"`
+	MaxClockSkew string `yaml:"max_clock_skew"`
+	MinDiskFree  int64  `yaml:"min_disk_free"`
+}
+
+// encryptionConfig is the master key, a key file or a kms key, the kms
+// credentials being given like the destination ones
+type encryptionConfig struct {
+	Encrypt       string `yaml:"encrypt"`
+	KeyFile       string `yaml:"key_file"`
+	KMSKeyID      string `yaml:"kms_key_id"`
+	KMSEndpoint   string `yaml:"kms_endpoint"`
+	KMSRegion     string `yaml:"kms_region"`
+	KMSAccessKey  string `yaml:"kms_access_key"`
+	KMSSecretKey  string `yaml:"kms_secret_key"`
+	KMSSecretEnv  string `yaml:"kms_secret_key_env"`
+	KMSSecretFile string `yaml:"kms_secret_key_file"`
+}
+
+type notifyConfig struct {
+	Webhook    string     `yaml:"webhook"`
+	Slack      string     `yaml:"slack"`
+	SMTP       smtpConfig `yaml:"smtp"`
+	Milestones string     `yaml:"milestones"`
+	ErrorRate  string     `yaml:"error_rate"`
+	Stall      string     `yaml:"stall"`
+}
+
+type smtpConfig struct {
+	Addr         string `yaml:"addr"`
+	From         string `yaml:"from"`
+	To           string `yaml:"to"`
+	User         string `yaml:"user"`
+	Password     string `yaml:"password"`
+	PasswordEnv  string `yaml:"password_env"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+type reportConfig struct {
+	File    string `yaml:"file"`
+	Format  string `yaml:"format"`
+	Summary string `yaml:"summary"`
+	State   string `yaml:"state"`
+}
+
+// deleteConfig configures the deletion of the verified sources
+type deleteConfig struct {
+	Holdback string `yaml:"holdback"`
+	Reverify string `yaml:"reverify"`
+	Log      string `yaml:"log"`
+}
+
+// credential resolves a credential given as is, by environment variable or
+// by file
+func credential(name, value, env, file string) (string, error) {
+	switch {
+	case value != "":
+		return value, nil
+	case env != "":
+		v := os.Getenv(env)
+		if v == "" {
+			return "", fmt.Errorf("%s environment variable %s is empty", name, env)
+		}
+		return v, nil
+	case file != "":
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s file: %s", name, err.Error())
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", nil
+}
+
+// values returns the flag values set by the profile
+func (t *profileConfig) values() (map[string]string, error) {
+	v := map[string]string{}
+	set := func(name, value string) {
+		if value != "" {
+			v[name] = value
+		}
+	}
+	var boolErr error
+	setBool := func(name, key, value string) {
+		if value == "" {
+			return
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			if boolErr == nil {
+				boolErr = fmt.Errorf("invalid %s: %s", key, value)
+			}
+			return
+		}
+		v[name] = strconv.FormatBool(b)
+	}
+	set("wos", t.Source.Wos)
+	set("oidfile", t.Source.OIDFile)
+	set("enum", t.Source.Enum)
+	set("source", t.Source.Kind)
+	set("srcprefix", t.Source.Prefix)
+	if s := t.Source.S3; s != nil {
+		ak, err := credential("source access key", s.AccessKey, s.AccessKeyEnv, s.AccessKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		sk, err := credential("source secret key", s.SecretKey, s.SecretKeyEnv, s.SecretKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		set("srcendpoint", s.Endpoint)
+		set("srcbucket", s.Bucket)
+		set("srcak", ak)
+		set("srcsk", sk)
+	}
+	set("policy", t.Policy)
+	if t.Workers != 0 {
+		set("workers", strconv.Itoa(t.Workers))
+	}
+	set("timeout", t.Timeout)
+	set("loglevel", t.LogLevel)
+	set("logformat", t.Log.Format)
+	set("logfile", t.Log.File)
+	if t.Log.MaxSize != 0 {
+		set("logmaxsize", strconv.FormatInt(t.Log.MaxSize, 10))
+	}
+	set("logmaxage", t.Log.MaxAge)
+	if t.Log.Backups != 0 {
+		set("logbackups", strconv.Itoa(t.Log.Backups))
+	}
+	set("keyprefix", t.KeyPrefix)
+	set("mismatch", t.Mismatch)
+	set("quarantine", t.Quarantine)
+	set("transform", t.Transform.Mode)
+	set("transformtypes", t.Transform.ContentTypes)
+	if t.Transform.MinSize != 0 {
+		set("transformminsize", strconv.FormatInt(t.Transform.MinSize, 10))
+	}
+	set("transformkeys", t.Transform.Keys)
+	set("pack", t.Pack.Format)
+	if t.Pack.MaxSize != 0 {
+		set("packmaxsize", strconv.FormatInt(t.Pack.MaxSize, 10))
+	}
+	if t.Pack.Size != 0 {
+		set("packsize", strconv.FormatInt(t.Pack.Size, 10))
+	}
+	set("packprefix", t.Pack.Prefix)
+	setBool("dedupcontent", "dedup.content", t.Dedup.Content)
+	set("contentprefix", t.Dedup.Prefix)
+	setBool("nooverwrite", "protect.no_overwrite", t.Protect.NoOverwrite)
+	set("lockmode", t.Protect.LockMode)
+	if t.Protect.LockDays != 0 {
+		set("lockdays", strconv.Itoa(t.Protect.LockDays))
+	}
+	setBool("legalhold", "protect.legal_hold", t.Protect.LegalHold)
+	setBool("nopreflight", "preflight.skip", t.Preflight.Skip)
+	set("maxclockskew", t.Preflight.MaxClockSkew)
+	if t.Preflight.MinDiskFree != 0 {
+		set("mindiskfree", strconv.FormatInt(t.Preflight.MinDiskFree, 10))
+	}
+	setBool("encrypt", "encryption.encrypt", t.Encryption.Encrypt)
+	set("keyfile", t.Encryption.KeyFile)
+	set("kmskeyid", t.Encryption.KMSKeyID)
+	set("kmsendpoint", t.Encryption.KMSEndpoint)
+	set("kmsregion", t.Encryption.KMSRegion)
+	set("kmsak", t.Encryption.KMSAccessKey)
+	kmsSk, err := credential("kms secret key", t.Encryption.KMSSecretKey, t.Encryption.KMSSecretEnv, t.Encryption.KMSSecretFile)
+	if err != nil {
+		return nil, err
+	}
+	set("kmssk", kmsSk)
+	set("admin", t.Admin)
+	set("notifywebhook", t.Notify.Webhook)
+	set("notifyslack", t.Notify.Slack)
+	set("notifysmtp", t.Notify.SMTP.Addr)
+	set("notifyfrom", t.Notify.SMTP.From)
+	set("notifyto", t.Notify.SMTP.To)
+	set("notifysmtpuser", t.Notify.SMTP.User)
+	set("notifymilestones", t.Notify.Milestones)
+	set("notifyerrorrate", t.Notify.ErrorRate)
+	set("notifystall", t.Notify.Stall)
+	password, err := credential("smtp password", t.Notify.SMTP.Password, t.Notify.SMTP.PasswordEnv, t.Notify.SMTP.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	set("notifysmtppassword", password)
+	set("report", t.Report.File)
+	set("reportformat", t.Report.Format)
+	set("summary", t.Report.Summary)
+	set("state", t.Report.State)
+	set("holdback", t.Delete.Holdback)
+	setBool("reverify", "delete.reverify", t.Delete.Reverify)
+	set("log", t.Delete.Log)
+	if boolErr != nil {
+		return nil, boolErr
+	}
+
+	if len(t.Destinations) > 0 {
+		dests := make([]destSpec, len(t.Destinations))
+		for i, d := range t.Destinations {
+			ak, err := credential("access key", d.AccessKey, d.AccessKeyEnv, d.AccessKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("destination %d: %s", i, err.Error())
+			}
+			sk, err := credential("secret key", d.SecretKey, d.SecretKeyEnv, d.SecretKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("destination %d: %s", i, err.Error())
+			}
+			dests[i] = destSpec{Endpoint: d.Endpoint, Bucket: d.Bucket, AccessKey: ak, SecretKey: sk}
+		}
+		// the destinations go as a list, the credentials may hold commas
+		data, err := json.Marshal(dests)
+		if err != nil {
+			return nil, err
+		}
+		set("destinations", string(data))
+	}
+	return v, nil
+}
+
+// loadProfile returns the flag values of a profile of the config file at
+// path, the defaults only when profile and the default profile are empty
+func loadProfile(path, profile string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file(%s): %s", path, err.Error())
+	}
+	var c configFile
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid config file(%s): %s", path, err.Error())
+	}
+
+	v, err := c.Defaults.values()
+	if err != nil {
+		return nil, fmt.Errorf("defaults: %s", err.Error())
+	}
+	if profile == "" {
+		profile = c.DefaultProfile
+	}
+	if profile == "" {
+		return v, nil
+	}
+	p, ok := c.Profiles[profile]
+	if !ok || p == nil {
+		return nil, fmt.Errorf("profile %s not found in %s", profile, path)
+	}
+	pv, err := p.values()
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %s", profile, err.Error())
+	}
+	for name, value := range pv {
+		v[name] = value
+	}
+	return v, nil
+}
+
+// envSettings are the environment variables overriding the config file,
+// with their flags
+var envSettings = []struct {
+	env  string
+	flag string
+	// conv converts the variable to the flag value
+	conv func(string) string
+}{
+	{"S3SYNC_CONFIG", "config", nil},
+	{"S3SYNC_PROFILE", "profile", nil},
+	{"APP_WORKER", "workers", nil},
+	{"APP_TIMEOUT", "timeout", func(v string) string {
+		// seconds, as before durations
+		if _, err := strconv.Atoi(v); err == nil {
+			return v + "s"
+		}
+		return v
+	}},
+	{"APP_LEVEL", "loglevel", nil},
+	{"S3SYNC_LOG_FORMAT", "logformat", nil},
+	{"S3SYNC_LOG_FILE", "logfile", nil},
+}
+
+// settings are the config file and runtime flags shared by the commands.
+// The value of a flag comes from, by precedence: the command line, the
+// environment, the profile, the defaults of the config file, the flag default.
+type settings struct {
+	fs       *flag.FlagSet
+	config   string
+	profile  string
+	workers  int
+	timeout  time.Duration
+	logLevel string
+	log      logOptions
+	// origins tells where each flag value comes from
+	origins map[string]string
+}
+
+func addConfigFlags(fs *flag.FlagSet) *settings {
+	t := &settings{fs: fs}
+	fs.StringVar(&t.config, "config", "", "yaml config file")
+	fs.StringVar(&t.profile, "profile", "", "profile of the config file")
+	fs.IntVar(&t.workers, "workers", SyncWorkerCnt, "sync worker count")
+	fs.DurationVar(&t.timeout, "timeout", storage.WosReadTimeout, "wos request timeout")
+	fs.StringVar(&t.logLevel, "loglevel", "info", "log level: debug, info, warn or error")
+	fs.StringVar(&t.log.format, "logformat", "text", "log format: text or json")
+	fs.StringVar(&t.log.file, "logfile", "", "log file instead of stdout")
+	fs.Int64Var(&t.log.maxSize, "logmaxsize", 100, "MiB the log file is rotated at, 0 for no limit")
+	fs.DurationVar(&t.log.maxAge, "logmaxage", 24*time.Hour, "age the log file is rotated at, 0 for no limit")
+	fs.IntVar(&t.log.backups, "logbackups", 7, "rotated log files kept, 0 to keep all")
+	return t
+}
+
+// load applies the environment and the config file to the flags not set on
+// the command line, then applies the runtime settings
+func (t *settings) load() error {
+	t.origins = map[string]string{}
+	t.fs.Visit(func(f *flag.Flag) {
+		t.origins[f.Name] = "flag"
+	})
+	for _, e := range envSettings {
+		v := os.Getenv(e.env)
+		if v == "" || t.origins[e.flag] != "" {
+			continue
+		}
+		if e.conv != nil {
+			v = e.conv(v)
+		}
+		if err := t.fs.Set(e.flag, v); err != nil {
+			return fmt.Errorf("invalid %s: %s", e.env, err.Error())
+		}
+		t.origins[e.flag] = "env " + e.env
+	}
+
+	if t.config != "" {
+		values, err := loadProfile(t.config, t.profile)
+		if err != nil {
+			return err
+		}
+		for name, v := range values {
+			// the file may configure flags of other commands
+			if t.origins[name] != "" || t.fs.Lookup(name) == nil {
+				continue
+			}
+			if err := t.fs.Set(name, v); err != nil {
+				return fmt.Errorf("invalid %s in %s: %s", name, t.config, err.Error())
+			}
+			t.origins[name] = "file " + t.config
+		}
+	}
+
+	if t.workers <= 0 {
+		return fmt.Errorf("invalid worker count: %d", t.workers)
+	}
+	level, err := log.ParseLevel(t.logLevel)
+	if err != nil {
+		return err
+	}
+	if err := setupLogging(t.log); err != nil {
+		return err
+	}
+	SyncWorkerCnt = t.workers
+	storage.WosReadTimeout = t.timeout
+	storage.WosWriteTimeout = t.timeout
+	log.SetLevel(level)
+	return nil
+}
+
+// secretFlags aren't printed, the webhook urls carrying their token
+var secretFlags = map[string]bool{"ak": true, "sk": true, "srcak": true, "srcsk": true,
+	"notifysmtppassword": true, "notifywebhook": true, "notifyslack": true, "kmssk": true}
+
+// print writes the flag values with their origin
+func (t *settings) print(w io.Writer) {
+	var lines []string
+	t.fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secretFlags[f.Name] && v != "" {
+			v = "<redacted>"
+		}
+		origin := t.origins[f.Name]
+		if origin == "" {
+			origin = "default"
+		}
+		lines = append(lines, fmt.Sprintf("%s: %q # %s", f.Name, v, origin))
+	})
+	sort.Strings(lines)
+	fmt.Fprintln(w, strings.Join(lines, "\n"))
+}
+
+// configCommand checks or prints the settings of a migration run:
+//
+//	config validate -config s3sync.yaml -profile dc1-to-aws [flags of the run]
+//	config print -config s3sync.yaml -profile dc1-to-aws [flags of the run]
+func configCommand(args []string) {
+	if len(args) == 0 || (args[0] != "validate" && args[0] != "print") {
+		log.Fatal("usage: config validate|print -config file [-profile name] [flags]")
+	}
+	fs := flag.NewFlagSet("config "+args[0], flag.ExitOnError)
+	opts := addRunFlags(fs)
+	fs.Parse(args[1:])
+	err := opts.cfg.load()
+	if err == nil {
+		err = opts.validate()
+	}
+
+	switch args[0] {
+	case "print":
+		opts.cfg.print(os.Stdout)
+		if err != nil {
+			log.Warnf("invalid settings: %s", err.Error())
+		}
+	case "validate":
+		if err != nil {
+			log.Fatalf("invalid settings: %s", err.Error())
+		}
+		log.Info("settings ok")
+	}
+}
+
+// errMissingSettings is returned by the validation of incomplete settings
+var errMissingSettings = errors.New("missing access key, secret key, endpoint, bucket, source, report file or plan file")
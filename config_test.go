@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"s3sync/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const testConfig = `
+default_profile: dc1-to-aws
+defaults:
+  workers: 8
+  timeout: 60s
+  report:
+    format: jsonl
+  preflight:
+    skip: true
+profiles:
+  dc1-to-aws:
+    source:
+      wos: 10.0.0.2
+      oidfile: oid.list
+    destinations:
+      - endpoint: s3.dc1:9000
+        bucket: archive
+        access_key: ak1
+        secret_key_env: S3SYNC_TEST_SK
+      - endpoint: s3.aws
+        bucket: archive-dr
+        access_key: ak2
+        secret_key_file: %s
+    policy: quorum
+    workers: 32
+    key_prefix: wos/
+    mismatch: quarantine
+    preflight:
+      skip: false
+    report:
+      file: report.jsonl
+  dc2-to-aws:
+    source:
+      wos: 10.0.1.2
+  restore:
+    source:
+      kind: s3
+      prefix: wos/
+      s3:
+        endpoint: s3.aws
+        bucket: archive-dr
+        access_key: ak2
+        secret_key_env: S3SYNC_TEST_SK
+    destinations:
+      - endpoint: s3.dc1:9000
+        bucket: restored
+        access_key: ak1
+        secret_key: sk1
+    report:
+      file: restore.jsonl
+`
+
+func TestConfigProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Errorf("failed to create temp dir: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+	skFile := filepath.Join(dir, "sk2")
+	ioutil.WriteFile(skFile, []byte("sk,2\n"), 0600)
+	path := filepath.Join(dir, "s3sync.yaml")
+	ioutil.WriteFile(path, []byte(strings.Replace(testConfig, "%s", skFile, 1)), 0644)
+
+	defer func(workers int, policy, prefix string, timeout time.Duration, level log.Level) {
+		SyncWorkerCnt, MismatchPolicy, KeyPrefix = workers, policy, prefix
+		storage.WosReadTimeout, storage.WosWriteTimeout = timeout, timeout
+		log.SetLevel(level)
+	}(SyncWorkerCnt, MismatchPolicy, KeyPrefix, storage.WosReadTimeout, log.GetLevel())
+	os.Setenv("S3SYNC_TEST_SK", "sk1")
+	defer os.Unsetenv("S3SYNC_TEST_SK")
+	os.Setenv("APP_WORKER", "24")
+	defer os.Unsetenv("APP_WORKER")
+
+	// flags win over the environment, which wins over the file
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	opts := addRunFlags(fs)
+	slack := "https://hooks.slack.com/services/T0/B0/token"
+	if err := fs.Parse([]string{"-config", path, "-policy", "all", "-notifyslack", slack}); err != nil {
+		t.Errorf("failed to parse flags: %s", err.Error())
+		return
+	}
+	if err := opts.cfg.load(); err != nil {
+		t.Errorf("failed to load config: %s", err.Error())
+		return
+	}
+	if err := opts.validate(); err != nil {
+		t.Errorf("invalid settings: %s", err.Error())
+		return
+	}
+	s := opts.stor
+	wantDests := destList{
+		{Endpoint: "s3.dc1:9000", Bucket: "archive", AccessKey: "ak1", SecretKey: "sk1"},
+		{Endpoint: "s3.aws", Bucket: "archive-dr", AccessKey: "ak2", SecretKey: "sk,2"},
+	}
+	if s.wosHost != "10.0.0.2" || !reflect.DeepEqual(s.dests, wantDests) || s.endpoint != "" ||
+		s.policy != "all" || KeyPrefix != "wos/" || opts.preflight.skip ||
+		MismatchPolicy != mismatchQuarantine || opts.reportFile != "report.jsonl" ||
+		opts.reportFormat != "jsonl" || opts.enum.file != "oid.list" {
+		t.Errorf("unexpected settings: %+v %s %s", s, KeyPrefix, MismatchPolicy)
+	}
+	dest, err := s.dest()
+	if multi, ok := dest.(*storage.MultiStorage); err != nil || !ok || len(multi.Dests) != 2 ||
+		multi.Dests[1].(*storage.S3Storage).Bucket != "archive-dr" {
+		t.Errorf("unexpected destination: %#v %v", dest, err)
+	}
+	if SyncWorkerCnt != 24 || storage.WosReadTimeout.Seconds() != 60 {
+		t.Errorf("unexpected runtime settings: %d %s", SyncWorkerCnt, storage.WosReadTimeout)
+	}
+
+	var out bytes.Buffer
+	opts.cfg.print(&out)
+	for _, want := range []string{
+		`policy: "all" # flag`,
+		`workers: "24" # env APP_WORKER`,
+		`wos: "10.0.0.2" # file ` + path,
+		`destinations: "s3.dc1:9000/archive,s3.aws/archive-dr" # file ` + path,
+		`dryrun: "false" # default`,
+		`notifyslack: "<redacted>" # flag`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("config print misses %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), slack) {
+		t.Errorf("config print shows the slack url:\n%s", out.String())
+	}
+
+	// an incomplete profile doesn't validate
+	fs = flag.NewFlagSet("run", flag.ContinueOnError)
+	opts = addRunFlags(fs)
+	fs.Parse([]string{"-config", path, "-profile", "dc2-to-aws"})
+	if err := opts.cfg.load(); err != nil {
+		t.Errorf("failed to load config: %s", err.Error())
+		return
+	}
+	if err := opts.validate(); err != errMissingSettings {
+		t.Errorf("incomplete profile validated: %v", err)
+	}
+
+	// a restore profile reads the copies of an s3 source
+	fs = flag.NewFlagSet("run", flag.ContinueOnError)
+	opts = addRunFlags(fs)
+	fs.Parse([]string{"-config", path, "-profile", "restore"})
+	if err := opts.cfg.load(); err != nil {
+		t.Errorf("failed to load config: %s", err.Error())
+		return
+	}
+	if err := opts.validate(); err != nil {
+		t.Errorf("invalid restore settings: %s", err.Error())
+		return
+	}
+	source, err := opts.stor.source()
+	if rs, ok := source.(*restoringSource); err != nil || !ok || rs.prefix != "wos/" ||
+		rs.StorSrc.(*storage.S3Storage).Bucket != "archive-dr" || opts.stor.srcSK != "sk1" {
+		t.Errorf("unexpected restore source: %#v %v", source, err)
+	}
+
+	if _, err := loadProfile(path, "unknown"); err == nil {
+		t.Errorf("loaded an unknown profile")
+	}
+	ioutil.WriteFile(path, []byte("defaults:\n  delete:\n    reverify: maybe\n"), 0644)
+	if _, err := loadProfile(path, ""); err == nil {
+		t.Errorf("loaded config with an invalid boolean")
+	}
+	ioutil.WriteFile(path, []byte("defaults:\n  wokers: 8\n"), 0644)
+	if _, err := loadProfile(path, ""); err == nil {
+		t.Errorf("loaded config with an unknown setting")
+	}
+}
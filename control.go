@@ -0,0 +1,365 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// AdminRecentErrors is how many of the last failures the admin api keeps
+	AdminRecentErrors = 100
+	// AdminRequeueSize is how many requeued objects may wait for a worker
+	AdminRequeueSize = 1000
+)
+
+// adminError is a recent failure
+type adminError struct {
+	Time   string `json:"time"`
+	OID    string `json:"oid"`
+	Worker string `json:"worker"`
+	Class  string `json:"class"`
+	Error  string `json:"error"`
+}
+
+// limiter spaces events at rate units per second, 0 being unlimited
+type limiter struct {
+	sync.Mutex
+	rate float64
+	next time.Time
+}
+
+func (t *limiter) setRate(rate float64) {
+	t.Lock()
+	defer t.Unlock()
+	t.rate = rate
+	t.next = time.Time{}
+}
+
+func (t *limiter) getRate() float64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.rate
+}
+
+// wait sleeps until the limiter allows an event, then books n units
+func (t *limiter) wait(n float64) {
+	t.Lock()
+	if t.rate <= 0 {
+		t.Unlock()
+		return
+	}
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	d := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(n / t.rate * float64(time.Second)))
+	t.Unlock()
+	time.Sleep(d)
+}
+
+// runControl is shared by the goroutines of a migration. It tracks the
+// objects whose result is pending, telling the workers when the run is over,
+// counts the results, and lets the admin api pause, resize, slow down or
+// drain the run.
+type runControl struct {
+	sync.Mutex
+	cond *sync.Cond
+	// wake is closed on every change, waking the idle workers up
+	wake     chan struct{}
+	paused   bool
+	draining bool
+	workers  int
+	running  map[int]bool
+	spawn    func(i int)
+	// group counts the running workers, the results being closed after them
+	group sync.WaitGroup
+	// quit is closed when the run is drained or aborted
+	quit chan struct{}
+	// aborted is closed when the run is given up
+	aborted chan struct{}
+	abort   string
+
+	// producing is true until every enumerated object was dispatched
+	producing bool
+	// outstanding counts the dispatched objects without a result
+	outstanding int
+	// dispatched counts the enumerated objects handed to the workers
+	dispatched int
+	// idle is closed once producing is over and nothing is outstanding
+	idle     chan struct{}
+	requeued chan syncObjItem
+	// extra counts the objects requeued by the admin api
+	extra int
+
+	objects limiter
+	bytes   limiter
+
+	start    time.Time
+	total    int
+	finished int
+	pass     int
+	fail     int
+	// notAttempted counts the objects left queued by a drain or an abort
+	notAttempted int
+	size         int64
+	errors       []adminError
+	done         bool
+}
+
+func newRunControl(workers int) *runControl {
+	t := &runControl{
+		wake:      make(chan struct{}),
+		workers:   workers,
+		running:   map[int]bool{},
+		quit:      make(chan struct{}),
+		aborted:   make(chan struct{}),
+		producing: true,
+		idle:      make(chan struct{}),
+		requeued:  make(chan syncObjItem, AdminRequeueSize),
+		start:     time.Now(),
+		total:     -1,
+	}
+	t.cond = sync.NewCond(t)
+	return t
+}
+
+// changed must be called with the lock held
+func (t *runControl) changed() {
+	close(t.wake)
+	t.wake = make(chan struct{})
+	t.cond.Broadcast()
+}
+
+// over tells whether the workers must exit, called with the lock held
+func (t *runControl) over() bool {
+	return t.done || t.draining || t.abort != ""
+}
+
+// startWorkers starts the workers with spawn
+func (t *runControl) startWorkers(spawn func(i int)) {
+	t.Lock()
+	defer t.Unlock()
+	t.spawn = spawn
+	t.startMissing()
+}
+
+// startMissing must be called with the lock held. No worker is started once
+// the run is over, so that the group isn't added to after it's waited for.
+func (t *runControl) startMissing() {
+	if t.spawn == nil || t.over() {
+		return
+	}
+	for i := 0; i < t.workers; i++ {
+		if !t.running[i] {
+			t.running[i] = true
+			t.group.Add(1)
+			go func(i int) {
+				defer t.exit(i)
+				t.spawn(i)
+			}(i)
+		}
+	}
+}
+
+func (t *runControl) exit(i int) {
+	t.Lock()
+	delete(t.running, i)
+	t.Unlock()
+	t.group.Done()
+}
+
+// wait blocks worker i while the run is paused, returning false when the
+// worker must exit, else a channel closed on the next change
+func (t *runControl) wait(i int) (bool, <-chan struct{}) {
+	t.Lock()
+	defer t.Unlock()
+	for t.paused && !t.over() && i < t.workers {
+		t.cond.Wait()
+	}
+	if t.over() || i >= t.workers {
+		return false, nil
+	}
+	return true, t.wake
+}
+
+func (t *runControl) setPaused(paused bool) {
+	t.Lock()
+	defer t.Unlock()
+	if t.paused != paused {
+		log.Infof("migration %s", map[bool]string{true: "paused", false: "resumed"}[paused])
+	}
+	t.paused = paused
+	t.changed()
+}
+
+func (t *runControl) setWorkers(n int) {
+	t.Lock()
+	defer t.Unlock()
+	log.Infof("worker count set to %d", n)
+	t.workers = n
+	t.changed()
+	t.startMissing()
+}
+
+// drain stops dispatching objects, the run ending once the objects being
+// migrated are done
+func (t *runControl) drain() {
+	t.Lock()
+	defer t.Unlock()
+	if t.over() {
+		return
+	}
+	log.Infof("draining migration")
+	t.draining = true
+	close(t.quit)
+	t.changed()
+}
+
+// giveUp aborts the run for reason, the watchdog cancelling the transfers
+func (t *runControl) giveUp(reason string) {
+	t.Lock()
+	defer t.Unlock()
+	if t.abort != "" || t.done {
+		return
+	}
+	log.Errorf("aborting migration: %s", reason)
+	t.abort = reason
+	if !t.draining {
+		close(t.quit)
+	}
+	close(t.aborted)
+	t.changed()
+}
+
+// dispatch counts an enumerated object as outstanding, false when the run is
+// draining or aborted
+func (t *runControl) dispatch() bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.over() {
+		return false
+	}
+	t.outstanding++
+	t.dispatched++
+	return true
+}
+
+// produced ends the enumeration of total objects, the run is never done
+// when a drain or an abort cut it short
+func (t *runControl) produced(total int, complete bool) {
+	t.Lock()
+	defer t.Unlock()
+	t.producing = !complete
+	t.total = total
+	t.checkIdle()
+}
+
+// resolve ends an outstanding object, its result being sent
+func (t *runControl) resolve() {
+	t.Lock()
+	defer t.Unlock()
+	t.outstanding--
+	t.checkIdle()
+}
+
+// drop ends an outstanding object no worker took, the run isn't done
+// without it
+func (t *runControl) drop() {
+	t.Lock()
+	defer t.Unlock()
+	t.outstanding--
+}
+
+// checkIdle must be called with the lock held
+func (t *runControl) checkIdle() {
+	if t.producing || t.outstanding > 0 || t.done {
+		return
+	}
+	t.done = true
+	close(t.idle)
+	t.changed()
+}
+
+// requeue migrates oid once more, false when the run is over or the queue
+// is full
+func (t *runControl) requeue(oid string) bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.over() {
+		return false
+	}
+	select {
+	case t.requeued <- syncObjItem{key: oid}:
+		t.outstanding++
+		t.extra++
+		log.Infof("requeued object %s", oid)
+		return true
+	default:
+		return false
+	}
+}
+
+// retry requeues an outstanding object, false when the run is ending or the
+// queue is full
+func (t *runControl) retry(item syncObjItem) bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.over() {
+		return false
+	}
+	select {
+	case t.requeued <- item:
+		return true
+	default:
+		return false
+	}
+}
+
+// record counts the result of an object
+func (t *runControl) record(r *syncResult) {
+	t.Lock()
+	defer t.Unlock()
+	if r.errClass == errClassNotAttempted {
+		t.notAttempted++
+		return
+	}
+	t.finished++
+	if r.err == nil && (r.verified || DryRun) {
+		t.pass++
+		t.size += r.size
+		return
+	}
+	t.fail++
+	e := adminError{
+		Time:   time.Now().UTC().Format(time.RFC3339),
+		OID:    r.oldKey,
+		Worker: r.worker,
+		Class:  r.errClass,
+	}
+	if r.err != nil {
+		e.Error = r.err.Error()
+	} else {
+		e.Error = "not verified"
+	}
+	t.errors = append(t.errors, e)
+	if len(t.errors) > AdminRecentErrors {
+		t.errors = t.errors[len(t.errors)-AdminRecentErrors:]
+	}
+}
+
+// recentErrors returns the last failures of the run
+func (t *runControl) recentErrors() []adminError {
+	t.Lock()
+	defer t.Unlock()
+	return append([]adminError{}, t.errors...)
+}
+
+// progress returns the objects dispatched and the ones finished
+func (t *runControl) progress() (dispatched, finished int) {
+	t.Lock()
+	defer t.Unlock()
+	return t.dispatched, t.finished
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// wire types of the coordinator api, all requests are POSTed JSON:
+//   /lease   leaseRequest -> leaseResponse, 204 when nothing is available
+//            yet, 410 once the migration is over
+//   /renew   renewRequest, 409 when the lease expired
+//   /results resultRequest, 409 when the lease expired
+//   /status  (GET) coordinatorStatus
+
+type wireObject struct {
+	Key      string   `json:"key"`
+	Dests    []string `json:"dests,omitempty"`
+	Attempts int      `json:"attempts,omitempty"`
+}
+
+type wireDest struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	MD5     string `json:"md5,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+type wireResult struct {
+	Key      string     `json:"key"`
+	Verified bool       `json:"verified"`
+	Dests    []wireDest `json:"dests,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	ErrClass string     `json:"error_class,omitempty"`
+	ErrCode  string     `json:"error_code,omitempty"`
+
+	Bucket      string `json:"bucket,omitempty"`
+	DestKey     string `json:"dest_key,omitempty"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	SrcMD5      string `json:"src_md5,omitempty"`
+	DstMD5      string `json:"dst_md5,omitempty"`
+	Verify      string `json:"verify,omitempty"`
+	Transform   string `json:"transform,omitempty"`
+	StoredSize  int64  `json:"stored_size,omitempty"`
+	Encrypted   bool   `json:"encrypted,omitempty"`
+	// Bundle is where a packed object lies
+	Bundle     *bundleLocation `json:"bundle,omitempty"`
+	ContentKey string          `json:"content_key,omitempty"`
+	Deduped    bool            `json:"deduped,omitempty"`
+	VersionID  string          `json:"version_id,omitempty"`
+	Unchanged  bool            `json:"unchanged,omitempty"`
+	Attempts   int             `json:"attempts"`
+	Worker     string          `json:"worker,omitempty"`
+
+	ReadTime   time.Duration `json:"read_time"`
+	WriteTime  time.Duration `json:"write_time"`
+	VerifyTime time.Duration `json:"verify_time"`
+	TotalTime  time.Duration `json:"total_time"`
+}
+
+// wireError keeps the code of an error passed over the wire
+type wireError struct {
+	msg  string
+	code string
+}
+
+func (e *wireError) Error() string {
+	return e.msg
+}
+
+func (e *wireError) Code() string {
+	return e.code
+}
+
+type leaseRequest struct {
+	Worker string `json:"worker"`
+	Max    int    `json:"max"`
+}
+
+type leaseResponse struct {
+	Lease   string       `json:"lease"`
+	TTL     float64      `json:"ttl"`
+	Objects []wireObject `json:"objects"`
+}
+
+type renewRequest struct {
+	Lease string `json:"lease"`
+}
+
+type resultRequest struct {
+	Lease   string       `json:"lease"`
+	Worker  string       `json:"worker"`
+	Results []wireResult `json:"results"`
+}
+
+type coordinatorStatus struct {
+	Total    int            `json:"total"`
+	Finished int            `json:"finished"`
+	Pass     int            `json:"pass"`
+	Leases   int            `json:"leases"`
+	Leased   int            `json:"leased"`
+	Requeued int            `json:"requeued"`
+	Workers  map[string]int `json:"workers"`
+	Done     bool           `json:"done"`
+	// ReportFormat tells the packing workers whether the report keeps
+	// their bundles
+	ReportFormat string `json:"report_format"`
+}
+
+func toWireResult(r syncResult) wireResult {
+	w := wireResult{
+		Key:         r.oldKey,
+		Verified:    r.verified,
+		ErrClass:    r.errClass,
+		Bucket:      r.bucket,
+		DestKey:     r.destKey,
+		Size:        r.size,
+		ContentType: r.contentType,
+		SrcMD5:      r.srcMD5,
+		DstMD5:      r.dstMD5,
+		Verify:      r.verify,
+		Transform:   r.transform,
+		StoredSize:  r.storedSize,
+		Encrypted:   r.encrypted,
+		Bundle:      r.bundle,
+		ContentKey:  r.contentKey,
+		Deduped:     r.deduped,
+		VersionID:   r.versionID,
+		Unchanged:   r.unchanged,
+		Attempts:    r.attempts,
+		Worker:      r.worker,
+		ReadTime:    r.readTime,
+		WriteTime:   r.writeTime,
+		VerifyTime:  r.verifyTime,
+		TotalTime:   r.totalTime,
+	}
+	for _, d := range r.dests {
+		w.Dests = append(w.Dests, wireDest{Name: d.name, Status: d.status, MD5: d.md5, Version: d.version})
+	}
+	if r.err != nil {
+		w.Error = r.err.Error()
+		w.ErrCode = errorCode(r.err)
+	}
+	return w
+}
+
+func (t *wireResult) syncResult() syncResult {
+	r := syncResult{
+		oldKey:      t.Key,
+		verified:    t.Verified,
+		errClass:    t.ErrClass,
+		bucket:      t.Bucket,
+		destKey:     t.DestKey,
+		size:        t.Size,
+		contentType: t.ContentType,
+		srcMD5:      t.SrcMD5,
+		dstMD5:      t.DstMD5,
+		verify:      t.Verify,
+		transform:   t.Transform,
+		storedSize:  t.StoredSize,
+		encrypted:   t.Encrypted,
+		bundle:      t.Bundle,
+		contentKey:  t.ContentKey,
+		deduped:     t.Deduped,
+		versionID:   t.VersionID,
+		unchanged:   t.Unchanged,
+		attempts:    t.Attempts,
+		worker:      t.Worker,
+		readTime:    t.ReadTime,
+		writeTime:   t.WriteTime,
+		verifyTime:  t.VerifyTime,
+		totalTime:   t.TotalTime,
+	}
+	for _, d := range t.Dests {
+		r.dests = append(r.dests, destResult{name: d.Name, status: d.Status, md5: d.MD5, version: d.Version})
+	}
+	if t.Error != "" {
+		r.err = &wireError{msg: t.Error, code: t.ErrCode}
+	}
+	return r
+}
+
+// lease is a batch of objects handed to a worker until it expires
+type lease struct {
+	id      string
+	worker  string
+	expires time.Time
+	items   map[string]syncObjItem
+}
+
+// coordinator owns the object queue of a distributed migration. Workers
+// lease batches of objects and report the results back, the objects of an
+// expired lease are handed out again.
+type coordinator struct {
+	sync.Mutex
+	leaseTTL   time.Duration
+	toSyncObjs chan syncObjItem
+	requeued   []syncObjItem
+	leases     map[string]*lease
+	workers    map[string]time.Time
+	rep        reporter
+	// reportFormat is the format rep writes
+	reportFormat string
+
+	total    int
+	finished int
+	pass     int
+	done     chan struct{}
+	// enumErr stopped the enumeration, the run being partial
+	enumErr error
+}
+
+func newCoordinator(enum enumerator, rep reporter, leaseTTL time.Duration) *coordinator {
+	t := &coordinator{
+		leaseTTL:   leaseTTL,
+		toSyncObjs: make(chan syncObjItem, ListPageSize),
+		leases:     map[string]*lease{},
+		workers:    map[string]time.Time{},
+		rep:        rep,
+		total:      -1,
+		done:       make(chan struct{}),
+	}
+	go t.produce(enum)
+	go t.expireLoop()
+	return t
+}
+
+// produce queues the objects of enum for the leases, the total is known
+// once the enumeration is over
+func (t *coordinator) produce(enum enumerator) {
+	total, err := enumerateItems(enum, func(item syncObjItem) bool {
+		t.toSyncObjs <- item
+		return true
+	})
+	if err != nil {
+		log.Errorf("failed to enumerate objects: %s", err.Error())
+	} else {
+		log.Infof("Total objects to be migrated: %d", total)
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.total = total
+	t.enumErr = err
+	if total == 0 && err == nil {
+		log.Warnf("No objects to be migrated")
+	}
+	t.checkDone()
+}
+
+// Done is closed once every object has a result
+func (t *coordinator) Done() <-chan struct{} {
+	return t.done
+}
+
+// checkDone must be called with the lock held
+func (t *coordinator) checkDone() {
+	if t.total < 0 || t.finished < t.total {
+		return
+	}
+	select {
+	case <-t.done:
+	default:
+		if t.enumErr != nil {
+			log.Errorf("Migration stopped by the enumeration: %d/%d", t.pass, t.finished)
+		} else {
+			log.Infof("Migration Completed: %d/%d", t.pass, t.finished)
+		}
+		close(t.done)
+	}
+}
+
+// Err returns the error stopping the enumeration, once Done is closed
+func (t *coordinator) Err() error {
+	t.Lock()
+	defer t.Unlock()
+	return t.enumErr
+}
+
+func (t *coordinator) expireLoop() {
+	tick := time.NewTicker(t.leaseTTL / 4)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			t.expireLeases(now)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// expireLeases requeues the objects of the leases expired at now
+func (t *coordinator) expireLeases(now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	for id, l := range t.leases {
+		if now.Before(l.expires) {
+			continue
+		}
+		log.Warnf("lease %s of worker %s expired, requeuing %d objects", id, l.worker, len(l.items))
+		for _, item := range l.items {
+			item.attempts++
+			t.requeued = append(t.requeued, item)
+		}
+		delete(t.leases, id)
+	}
+}
+
+func (t *coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" && r.URL.Path == "/status" {
+		writeJSON(w, t.status())
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case "/lease":
+		var req leaseRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		resp, status := t.lease(req)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		writeJSON(w, resp)
+	case "/renew":
+		var req renewRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if !t.renew(req.Lease) {
+			http.Error(w, "lease expired", http.StatusConflict)
+		}
+	case "/results":
+		var req resultRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if !t.results(req) {
+			http.Error(w, "lease expired", http.StatusConflict)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (t *coordinator) lease(req leaseRequest) (leaseResponse, int) {
+	t.Lock()
+	defer t.Unlock()
+	t.workers[req.Worker] = time.Now()
+	select {
+	case <-t.done:
+		return leaseResponse{}, http.StatusGone
+	default:
+	}
+
+	max := req.Max
+	if max <= 0 {
+		max = 1
+	}
+	l := &lease{
+		id:      uuid.New().String(),
+		worker:  req.Worker,
+		expires: time.Now().Add(t.leaseTTL),
+		items:   map[string]syncObjItem{},
+	}
+	resp := leaseResponse{Lease: l.id, TTL: t.leaseTTL.Seconds()}
+	add := func(item syncObjItem) {
+		l.items[item.key] = item
+		resp.Objects = append(resp.Objects, wireObject{Key: item.key, Dests: item.dests, Attempts: item.attempts})
+	}
+	for len(t.requeued) > 0 && len(resp.Objects) < max {
+		add(t.requeued[0])
+		t.requeued = t.requeued[1:]
+	}
+fill:
+	for len(resp.Objects) < max {
+		select {
+		case item := <-t.toSyncObjs:
+			if _, ok := l.items[item.key]; ok {
+				// same object twice in a batch, keep it for later
+				t.requeued = append(t.requeued, item)
+				break fill
+			}
+			add(item)
+		default:
+			break fill
+		}
+	}
+	if len(resp.Objects) == 0 {
+		return resp, http.StatusNoContent
+	}
+	t.leases[l.id] = l
+	log.Debugf("leased %d objects to %s: %s", len(resp.Objects), req.Worker, l.id)
+	return resp, http.StatusOK
+}
+
+func (t *coordinator) renew(id string) bool {
+	t.Lock()
+	defer t.Unlock()
+	l, ok := t.leases[id]
+	if !ok {
+		return false
+	}
+	l.expires = time.Now().Add(t.leaseTTL)
+	t.workers[l.worker] = time.Now()
+	return true
+}
+
+// results records the results of a lease, results of an expired lease are
+// dropped as its objects were handed out again
+func (t *coordinator) results(req resultRequest) bool {
+	t.Lock()
+	defer t.Unlock()
+	l, ok := t.leases[req.Lease]
+	if !ok {
+		log.Warnf("dropping %d results of expired lease %s from %s",
+			len(req.Results), req.Lease, req.Worker)
+		return false
+	}
+	t.workers[l.worker] = time.Now()
+	for _, wr := range req.Results {
+		if _, ok := l.items[wr.Key]; !ok {
+			log.Warnf("unexpected result of %s in lease %s, skip", wr.Key, l.id)
+			continue
+		}
+		delete(l.items, wr.Key)
+		r := wr.syncResult()
+		t.rep.record(&r)
+		if r.err == nil && r.verified {
+			t.pass++
+		}
+		t.finished++
+	}
+	if len(l.items) == 0 {
+		delete(t.leases, l.id)
+	} else {
+		l.expires = time.Now().Add(t.leaseTTL)
+	}
+	t.checkDone()
+	return true
+}
+
+func (t *coordinator) status() coordinatorStatus {
+	t.Lock()
+	defer t.Unlock()
+	s := coordinatorStatus{
+		Total:    t.total,
+		Finished: t.finished,
+		Pass:     t.pass,
+		Leases:   len(t.leases),
+		Requeued: len(t.requeued),
+		Workers:  map[string]int{},
+
+		ReportFormat: t.reportFormat,
+	}
+	for w := range t.workers {
+		s.Workers[w] = 0
+	}
+	for _, l := range t.leases {
+		s.Leased += len(l.items)
+		s.Workers[l.worker] += len(l.items)
+	}
+	select {
+	case <-t.done:
+		s.Done = true
+	default:
+	}
+	return s
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// coordinatorCommand runs the coordinator of a distributed migration:
+//
+//	coordinator -listen :8080 -report report.csv -oidfile oid.list
+func coordinatorCommand(args []string) {
+	fs := flag.NewFlagSet("coordinator", flag.ExitOnError)
+	cfg := addConfigFlags(fs)
+	listen := fs.String("listen", ":8080", "listen address")
+	reportFile := fs.String("report", "", "sync report")
+	reportFormat := fs.String("reportformat", "csv", "report format: csv or jsonl")
+	summaryFile := fs.String("summary", "", "write the run summary to this path with .json and .txt suffixes")
+	statePath := fs.String("state", "", "state store recording the verified copies")
+	leaseTTL := fs.Duration("leasettl", 5*time.Minute, "lease expiration without renewal")
+	enumOpts := enumOptions{}
+	addEnumFlags(fs, &enumOpts)
+	fs.Parse(args)
+	if err := cfg.load(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if *reportFile == "" {
+		fs.Usage()
+		log.Fatal("missing report file")
+	}
+
+	enum, err := newEnumerator(enumOpts)
+	if err != nil {
+		fs.Usage()
+		log.Fatal(err.Error())
+	}
+	defer enum.Close()
+
+	file, err := os.OpenFile(*reportFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalf("failed to open report file(%s): %s", *reportFile, err.Error())
+	}
+	defer file.Close()
+
+	rep, err := newReporter(*reportFormat, bufio.NewWriter(file))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if *statePath != "" {
+		store, err := openStateStore(*statePath)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		defer store.Close()
+		rep = &stateReporter{reporter: rep, store: store}
+	}
+	log.Infof("Run %s", runID)
+	summary := newSummaryReporter(rep)
+	c := newCoordinator(enum, summary, *leaseTTL)
+	c.reportFormat = *reportFormat
+	server := &http.Server{Addr: *listen, Handler: c}
+	go func() {
+		<-c.Done()
+		// keep answering for a while so the workers learn it's over
+		time.Sleep(*leaseTTL / 4)
+		server.Shutdown(context.Background())
+	}()
+	log.Infof("Coordinating migration on %s", *listen)
+	err = server.ListenAndServe()
+	writeSummary(summary.summary(enum.rejects, enum.prescan), *summaryFile)
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("coordinator failed: %s", err.Error())
+	}
+	if err := c.Err(); err != nil {
+		log.Fatal(err.Error())
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"flag"
+
+	"s3sync/storage"
+)
+
+var (
+	// DedupContent stores the objects by content hash, the oid keys being
+	// pointers to their content
+	DedupContent = false
+	// ContentPrefix is the key prefix of the contents, following KeyPrefix
+	ContentPrefix = "content/"
+)
+
+func addDedupFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&DedupContent, "dedupcontent", DedupContent, "store the objects by content hash, the contents already stored not being stored again though still uploaded")
+	fs.StringVar(&ContentPrefix, "contentprefix", ContentPrefix, "key prefix of the contents, after the key prefix")
+}
+
+// setupDedup checks the dedup flags, once the encryption is set up
+func setupDedup() error {
+	if DedupContent && encryptObjects {
+		return errors.New("encrypted objects can't be deduplicated, each having its own key")
+	}
+	return nil
+}
+
+// setContentPrefix makes the s3 destinations of dest store the objects by
+// content when DedupContent is set
+func setContentPrefix(dest storage.StorDest) {
+	if !DedupContent {
+		return
+	}
+	dests := []storage.StorDest{dest}
+	if multi, ok := dest.(*storage.MultiStorage); ok {
+		dests = multi.Dests
+	}
+	for _, d := range dests {
+		if s3, ok := d.(*storage.S3Storage); ok {
+			s3.ContentPrefix = KeyPrefix + ContentPrefix
+		}
+	}
+}
+
+// writeObject writes r to key of target, recording in res how a content
+// writer stored it
+func writeObject(target storage.StorDest, key string, r storage.SyncObject, res *syncResult) (string, error) {
+	cw, ok := target.(storage.ContentWriter)
+	if !ok {
+		return target.Write(key, r)
+	}
+	info, err := cw.WriteContent(key, r)
+	if err != nil {
+		return "", err
+	}
+	res.contentKey = info.ContentKey
+	res.deduped = info.Deduped
+	res.versionID = info.VersionID
+	return info.MD5, nil
+}
+
+// setMultiContent records how the destinations stored the object, deduped
+// when every written destination already had its content
+func (t *syncResult) setMultiContent(statuses []storage.DestStatus) {
+	written := 0
+	deduped := 0
+	for _, st := range statuses {
+		if st.Err != nil || st.Content == nil {
+			continue
+		}
+		written++
+		if t.contentKey == "" {
+			t.contentKey = st.Content.ContentKey
+		}
+		if st.Content.Deduped {
+			deduped++
+		}
+	}
+	t.deduped = written > 0 && deduped == written
+}
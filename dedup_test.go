@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"s3sync/storage"
+)
+
+// dedupRun migrates oids to dest, each expected to be ok
+func dedupRun(t *testing.T, dest storage.StorDest, source storage.StorSrc, oids ...string) (map[string]jsonReportLine, *runSummary) {
+	lines, s := jsonRun(t, dest, source, oids...)
+	if s.OK != len(oids) {
+		t.Errorf("unexpected report: %+v", lines)
+	}
+	return lines, s
+}
+
+func TestDedupContent(t *testing.T) {
+	workers := SyncWorkerCnt
+	// one worker stores the first of the identical objects
+	SyncWorkerCnt = 1
+	defer func() {
+		SyncWorkerCnt = workers
+		DedupContent, KeyPrefix = false, ""
+	}()
+
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	DedupContent, KeyPrefix = true, "dedup/"
+	dest := storage.NewS3Storage(s3Server.URL, "u1", "s1", bucket)
+	setContentPrefix(dest)
+	if dest.ContentPrefix != "dedup/content/" {
+		t.Errorf("unexpected content prefix: %s", dest.ContentPrefix)
+		return
+	}
+
+	same := []byte(strings.Repeat("same content", 100))
+	source := newMemStorage(0)
+	source.objects["a"] = same
+	source.objects["b"] = same
+	source.objects["c"] = []byte("other content")
+
+	lines, s := dedupRun(t, dest, source, "a", "b", "c")
+	a, b, c := lines["a"], lines["b"], lines["c"]
+	if a.ContentKey == "" || a.ContentKey != b.ContentKey || c.ContentKey == a.ContentKey ||
+		!strings.HasPrefix(a.ContentKey, "dedup/content/") || a.Deduped || !b.Deduped || c.Deduped {
+		t.Errorf("unexpected dedup: %+v", lines)
+		return
+	}
+	if s.Deduped == nil || s.Deduped.Objects != 1 || s.Deduped.SkippedBytes != int64(len(same)) ||
+		!strings.Contains(s.String(), "Deduplicated: 1 objects") {
+		t.Errorf("unexpected summary: %+v", s.Deduped)
+	}
+
+	// the oid keys are pointers read as their content
+	for _, oid := range []string{"a", "b", "c"} {
+		obj, err := dest.Read("dedup/" + oid)
+		if err != nil {
+			t.Errorf("failed to read %s: %s", oid, err.Error())
+			return
+		}
+		data, _ := ioutil.ReadAll(obj.GetBody())
+		meta := storage.Metadata(obj)
+		if !bytes.Equal(data, source.objects[oid]) || meta[storage.MetaContentKey] != lines[oid].ContentKey {
+			t.Errorf("unexpected copy of %s: %q, %v", oid, data, meta)
+		}
+		info, err := dest.Stat("dedup/" + oid)
+		if err != nil || info.Size != int64(len(source.objects[oid])) {
+			t.Errorf("unexpected stat of %s: %+v, %v", oid, info, err)
+		}
+	}
+	obj, err := dest.ReadRange("dedup/b", 4, 8)
+	if err != nil {
+		t.Errorf("failed to read range: %s", err.Error())
+		return
+	}
+	if data, _ := ioutil.ReadAll(obj.GetBody()); string(data) != " content" {
+		t.Errorf("unexpected range: %q", data)
+	}
+
+	// a content damaged since is uploaded again
+	plain := storage.NewS3Storage(s3Server.URL, "u1", "s1", bucket)
+	if _, err := plain.Write(c.ContentKey, &memObject{data: []byte("damaged content")}); err != nil {
+		t.Errorf("failed to damage content: %s", err.Error())
+		return
+	}
+	lines, s = dedupRun(t, dest, source, "a", "b", "c")
+	if !lines["a"].Deduped || !lines["b"].Deduped || lines["c"].Deduped || s.Deduped.Objects != 2 {
+		t.Errorf("unexpected dedup of the second run: %+v", lines)
+	}
+	obj, err = dest.Read("dedup/c")
+	if err != nil {
+		t.Errorf("failed to read c: %s", err.Error())
+		return
+	}
+	if data, _ := ioutil.ReadAll(obj.GetBody()); !bytes.Equal(data, source.objects["c"]) {
+		t.Errorf("unexpected repaired content: %q", data)
+	}
+
+	// a content stored without its sha256, whatever its etag, is copied
+	// again
+	if _, err := plain.Write(a.ContentKey, &memObject{data: same}); err != nil {
+		t.Errorf("failed to rewrite content: %s", err.Error())
+		return
+	}
+	lines, _ = dedupRun(t, dest, source, "a", "b")
+	if lines["a"].Deduped || !lines["b"].Deduped {
+		t.Errorf("unexpected dedup of a content without sha256: %+v", lines)
+	}
+	staged := 0
+	dest.List("dedup/content/staging/", "", func(key string, info *storage.ObjectInfo) bool {
+		staged++
+		return true
+	})
+	if staged != 0 {
+		t.Errorf("%d staging objects left", staged)
+	}
+
+	// the fan-out destinations each store the content
+	dr, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer dr.Close()
+	multi, err := newDest(s3Server.URL+","+dr.URL, "u1", "s1", bucket, "all")
+	if err != nil {
+		t.Errorf("failed to create destinations: %s", err.Error())
+		return
+	}
+	setContentPrefix(multi)
+	lines, _ = dedupRun(t, multi, source, "a")
+	if lines["a"].ContentKey != a.ContentKey || lines["a"].Deduped {
+		t.Errorf("unexpected fan-out dedup: %+v", lines["a"])
+	}
+	lines, _ = dedupRun(t, multi, source, "b")
+	if !lines["b"].Deduped {
+		t.Errorf("unexpected fan-out dedup: %+v", lines["b"])
+	}
+
+	encryptObjects = true
+	defer func() { encryptObjects = false }()
+	if err := setupDedup(); err == nil {
+		t.Errorf("dedup accepted with encryption")
+	}
+}
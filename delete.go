@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"s3sync/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DeletePageSize is how many objects of the state store are deleted at once
+var DeletePageSize = 1000
+
+type deleteOptions struct {
+	holdback time.Duration
+	dryRun   bool
+	reverify bool
+}
+
+type deleteStats struct {
+	candidates int
+	deleted    int
+	dryRun     int
+	skipped    int
+	failed     int
+}
+
+func (t deleteStats) String() string {
+	return fmt.Sprintf("%d candidates, %d deleted, %d dry run, %d skipped, %d failed",
+		t.candidates, t.deleted, t.dryRun, t.skipped, t.failed)
+}
+
+// deletableSource is a source read again before its objects are deleted
+type deletableSource interface {
+	storage.StorSrc
+	storage.Deleter
+}
+
+// sourceDeleter deletes the sources of the verified copies of a state store,
+// writing every decision to the deletion log
+type sourceDeleter struct {
+	sync.Mutex
+	opts   deleteOptions
+	store  *stateStore
+	source deletableSource
+	dest   storage.StorDest
+	w      *bufio.Writer
+	stats  deleteStats
+}
+
+// record writes a deletion log line
+// format: ts, action, oid, md5[, detail]
+func (t *sourceDeleter) record(action string, o stateObject, detail string) {
+	t.Lock()
+	defer t.Unlock()
+	switch action {
+	case "delete":
+		t.stats.deleted++
+	case "dryrun":
+		t.stats.dryRun++
+	case "skip":
+		t.stats.skipped++
+	case "fail":
+		t.stats.failed++
+	}
+	line := fmt.Sprintf("%d,%s,%s,%s", time.Now().Unix(), action, quoteReportField(o.oid), o.srcMD5)
+	if detail != "" {
+		line += "," + strings.ReplaceAll(detail, "\n", " ")
+	}
+	t.w.WriteString(line + "\n")
+	t.w.Flush()
+}
+
+// check returns why the source of o mustn't be deleted, empty when it can
+func (t *sourceDeleter) check(o stateObject) string {
+	if o.verify != verifyMD5 && o.verify != verifyDecompressed {
+		return fmt.Sprintf("verification %s isn't deep", o.verify)
+	}
+	if o.srcMD5 == "" || o.dstMD5 == "" {
+		return "no checksum recorded"
+	}
+	copies := parseCopyMD5s(o.dstMD5)
+	if len(copies) == 0 {
+		copies[""] = o.dstMD5
+	} else {
+		// every destination the fan-out copy was sent to must hold it,
+		// with or without a reread
+		names := parseDestNames(o.dests)
+		if len(names) == 0 {
+			return "no destinations recorded"
+		}
+		for _, name := range names {
+			if _, ok := copies[name]; !ok {
+				return "no checksum recorded on " + name
+			}
+		}
+	}
+	if multi, ok := t.dest.(*storage.MultiStorage); ok {
+		for _, name := range multi.Names {
+			if _, ok := copies[name]; !ok {
+				return "no checksum recorded on " + name
+			}
+		}
+	}
+	if o.verify == verifyDecompressed {
+		// the copies can't match the compressed source bytes, the source
+		// is read again to check its md5 and the one of its content
+		if reason := t.checkSource(o, copies); reason != "" {
+			return reason
+		}
+	} else {
+		for name, md5 := range copies {
+			if md5 != o.srcMD5 {
+				return strings.TrimPrefix(fmt.Sprintf("%s: recorded checksums differ: %s, %s", name, o.srcMD5, md5), ": ")
+			}
+		}
+	}
+	if !t.opts.reverify {
+		return ""
+	}
+
+	names, dests := []string{""}, []storage.StorDest{t.dest}
+	if multi, ok := t.dest.(*storage.MultiStorage); ok {
+		names, dests = multi.Names, multi.Dests
+	}
+	for i, dest := range dests {
+		if reason := checkCopy(dest, o, copies[names[i]]); reason != "" {
+			return strings.TrimPrefix(names[i]+": "+reason, ": ")
+		}
+	}
+	return ""
+}
+
+// checkSource reads the source of a decompressed copy of o again, returning
+// why its md5 isn't the recorded one or its content doesn't match copies
+func (t *sourceDeleter) checkSource(o stateObject, copies map[string]string) string {
+	obj, err := t.source.Read(o.oid)
+	if err != nil {
+		return "failed to read the source: " + err.Error()
+	}
+	body := obj.GetBody()
+	defer body.Close()
+	raw, content, err := sourceChecksums(body)
+	if err != nil {
+		return "failed to read the source: " + err.Error()
+	}
+	if strings.Trim(raw, "\"") != o.srcMD5 {
+		return fmt.Sprintf("source changed since the copy: md5 %s", raw)
+	}
+	for name, md5 := range copies {
+		if md5 != strings.Trim(content, "\"") {
+			return strings.TrimPrefix(fmt.Sprintf("%s: recorded checksum differs from the decompressed source: %s, %s",
+				name, content, md5), ": ")
+		}
+	}
+	return ""
+}
+
+// checkCopy reads the copy of o back, decrypted and decompressed, returning
+// why it doesn't match its recorded md5
+func checkCopy(dest storage.StorDest, o stateObject, md5 string) string {
+	obj, err := dest.Read(destKey(o.oid))
+	if err != nil {
+		return "failed to read the copy: " + err.Error()
+	}
+	meta := storage.Metadata(obj)
+	body, err := restoreBody(meta, obj.GetBody())
+	if err != nil {
+		obj.GetBody().Close()
+		return "failed to read the copy: " + err.Error()
+	}
+	defer body.Close()
+	c, err := checksum(body)
+	if err != nil {
+		return "failed to read the copy: " + err.Error()
+	}
+	// a decompressed copy is larger than its source
+	if (c.size != o.size && !isDecompressed(meta)) || strings.Trim(c.md5, "\"") != md5 {
+		return fmt.Sprintf("copy doesn't match: size %d, md5 %s", c.size, c.md5)
+	}
+	return ""
+}
+
+func (t *sourceDeleter) delete(o stateObject) {
+	if reason := t.check(o); reason != "" {
+		log.Warnf("skip deleting source of %s: %s", o.oid, reason)
+		t.record("skip", o, reason)
+		return
+	}
+	if t.opts.dryRun {
+		t.record("dryrun", o, "")
+		return
+	}
+
+	// the tombstone comes first so that no deletion goes unrecorded
+	if err := t.store.tombstone(o.oid, time.Now().Unix()); err != nil {
+		log.Errorf("failed to write tombstone of %s: %s", o.oid, err.Error())
+		t.record("fail", o, "tombstone: "+err.Error())
+		return
+	}
+	detail := ""
+	if err := t.source.Delete(o.oid); err != nil {
+		if !isNotFound(err) {
+			log.Errorf("failed to delete source of %s: %s", o.oid, err.Error())
+			t.record("fail", o, err.Error())
+			return
+		}
+		detail = "already gone"
+	}
+	if err := t.store.deleted(o.oid, time.Now().Unix()); err != nil {
+		log.Errorf("failed to record deletion of %s: %s", o.oid, err.Error())
+		detail = strings.TrimPrefix(detail+", failed to record deletion: "+err.Error(), ", ")
+	}
+	t.record("delete", o, detail)
+}
+
+// deleteSources deletes from the source the objects of store verified more
+// than holdback ago
+func deleteSources(store *stateStore, source deletableSource,
+	dest storage.StorDest, opts deleteOptions, w io.Writer) (deleteStats, error) {
+	d := &sourceDeleter{opts: opts, store: store, source: source, dest: dest, w: bufio.NewWriter(w)}
+	before := time.Now().Add(-opts.holdback).Unix()
+	after := ""
+	for {
+		objs, err := store.undeleted(after, before, DeletePageSize)
+		if err != nil {
+			return d.stats, err
+		}
+		if len(objs) == 0 {
+			return d.stats, nil
+		}
+		d.stats.candidates += len(objs)
+
+		items := make(chan stateObject)
+		var wg sync.WaitGroup
+		for i := 0; i < SyncWorkerCnt; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for o := range items {
+					d.delete(o)
+				}
+			}()
+		}
+		for _, o := range objs {
+			items <- o
+		}
+		close(items)
+		wg.Wait()
+		after = objs[len(objs)-1].oid
+	}
+}
+
+// deleteCommand deletes the wos objects whose copies were verified:
+//
+//	delete -state state.db -log deletions.log -holdback 168h [-dryrun] -ak ... -wos ...
+func deleteCommand(args []string) {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	cfg := addConfigFlags(fs)
+	statePath := fs.String("state", "", "state store of the migration")
+	logPath := fs.String("log", "", "deletion log")
+	opts := deleteOptions{}
+	fs.DurationVar(&opts.holdback, "holdback", 7*24*time.Hour, "only delete objects verified this long ago")
+	fs.BoolVar(&opts.dryRun, "dryrun", false, "log the deletions without deleting")
+	fs.BoolVar(&opts.reverify, "reverify", true, "read the copy back and check its md5 before deleting")
+	storOpts := storOptions{}
+	addStorFlags(fs, &storOpts)
+	encOpts := encryptionOptions{}
+	addKeyFlags(fs, &encOpts)
+	fs.Parse(args)
+	if err := cfg.load(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := setupEncryption(encOpts); err != nil {
+		fs.Usage()
+		log.Fatal(err.Error())
+	}
+	if *statePath == "" || *logPath == "" || storOpts.wosHost == "" ||
+		(opts.reverify && !storOpts.complete()) {
+		fs.Usage()
+		log.Fatal("missing state store, deletion log, dest host or s3 destination")
+	}
+
+	if _, err := os.Stat(*statePath); err != nil {
+		log.Fatalf("failed to open state store(%s): %s", *statePath, err.Error())
+	}
+	store, err := openStateStore(*statePath)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer store.Close()
+	file, err := os.OpenFile(*logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalf("failed to open deletion log(%s): %s", *logPath, err.Error())
+	}
+	defer file.Close()
+
+	var dest storage.StorDest
+	if opts.reverify {
+		dest, err = storOpts.dest()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	log.Infof("Run %s", runID)
+	log.Infof("Deleting sources verified before %s from %s (dry run: %t)...",
+		time.Now().Add(-opts.holdback).Format(time.RFC3339), storOpts.wosHost, opts.dryRun)
+	stats, err := deleteSources(store, storage.NewWosStorage(storOpts.wosHost), dest, opts, file)
+	if err != nil {
+		log.Fatalf("deletion failed: %s", err.Error())
+	}
+	log.Infof("Deletion Completed: %s", stats)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"s3sync/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeleteSources(t *testing.T) {
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	wos := setupWosServer(t, []string{"k1", "k2", "k3"})
+	defer wos.Close()
+
+	dir, err := ioutil.TempDir("", "delete")
+	if err != nil {
+		t.Errorf("failed to create temp dir: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+	store, err := openStateStore(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Errorf("failed to open state store: %s", err.Error())
+		return
+	}
+	defer store.Close()
+
+	dest := storage.NewS3Storage(s3Server.URL, "u1", "s1", bucket)
+	source := storage.NewWosStorage(strings.TrimPrefix(wos.URL, "http://"))
+	report := &memWriter{}
+	migrate(dest, source, &stateReporter{reporter: &csvReporter{w: bufio.NewWriter(report)}, store: store},
+		&listEnumerator{r: strings.NewReader("k1\nk2\nk3\nmissing\n")})
+
+	if o, err := store.get("missing"); err != nil || o != nil {
+		t.Errorf("failed object in state store: %+v %v", o, err)
+		return
+	}
+	// k3 was verified by size only, its source must stay
+	if _, err := store.db.Exec("UPDATE objects SET verify = 'size' WHERE oid = 'k3'"); err != nil {
+		t.Errorf("failed to update state store: %s", err.Error())
+		return
+	}
+	// the copy of k2 got lost since
+	if err := dest.Delete("k2"); err != nil {
+		t.Errorf("failed to delete k2: %s", err.Error())
+		return
+	}
+
+	var deletions bytes.Buffer
+	opts := deleteOptions{holdback: time.Hour, reverify: true}
+	stats, err := deleteSources(store, source, dest, opts, &deletions)
+	if err != nil || stats.candidates != 0 || deletions.Len() != 0 {
+		t.Errorf("deleted within the holdback: %s %v", stats, err)
+		return
+	}
+
+	opts = deleteOptions{holdback: -time.Hour, reverify: true, dryRun: true}
+	stats, err = deleteSources(store, source, dest, opts, &deletions)
+	if err != nil || stats.dryRun != 1 || stats.skipped != 2 {
+		t.Errorf("unexpected dry run: %s %v", stats, err)
+		return
+	}
+	if _, err := source.Read("k1"); err != nil {
+		t.Errorf("dry run deleted k1: %s", err.Error())
+		return
+	}
+
+	deletions.Reset()
+	opts.dryRun = false
+	stats, err = deleteSources(store, source, dest, opts, &deletions)
+	if err != nil || stats.deleted != 1 || stats.skipped != 2 {
+		t.Errorf("unexpected deletion: %s %v", stats, err)
+		return
+	}
+	if _, err := source.Read("k1"); !isNotFound(err) {
+		t.Errorf("k1 wasn't deleted: %v", err)
+		return
+	}
+	for _, key := range []string{"k2", "k3"} {
+		if _, err := source.Read(key); err != nil {
+			t.Errorf("unsafe deletion of %s: %s", key, err.Error())
+			return
+		}
+	}
+	o, err := store.get("k1")
+	if err != nil || o == nil || o.tombstone == 0 || o.deletedAt == 0 || o.srcMD5 == "" {
+		t.Errorf("unexpected state of k1: %+v %v", o, err)
+		return
+	}
+
+	log := deletions.String()
+	if !strings.Contains(log, ",delete,k1,"+o.srcMD5+"\n") ||
+		!strings.Contains(log, ",skip,k2,") || !strings.Contains(log, ",skip,k3,") {
+		t.Errorf("unexpected deletion log:\n%s", log)
+		return
+	}
+
+	// deleted sources aren't candidates anymore
+	stats, err = deleteSources(store, source, dest, opts, &deletions)
+	if err != nil || stats.candidates != 2 || stats.deleted != 0 {
+		t.Errorf("unexpected second deletion: %s %v", stats, err)
+	}
+}
+
+func TestStateReporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Errorf("failed to create temp dir: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+	store, err := openStateStore(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Errorf("failed to open state store: %s", err.Error())
+		return
+	}
+	defer store.Close()
+	rep := &stateReporter{reporter: &csvReporter{w: bufio.NewWriter(&memWriter{})}, store: store}
+
+	// a copy without dest md5 or verification is left out
+	rep.record(&syncResult{oldKey: "k1", verified: true, srcMD5: `"aa"`, verify: verifyMD5})
+	rep.record(&syncResult{oldKey: "k2", verified: true, srcMD5: `"aa"`, dstMD5: `"aa"`})
+	for _, oid := range []string{"k1", "k2"} {
+		if o, err := store.get(oid); err != nil || o != nil {
+			t.Errorf("unexpected state of %s: %+v %v", oid, o, err)
+		}
+	}
+
+	// a fan-out write failing the policy is left out
+	rep.record(&syncResult{oldKey: "k4", srcMD5: `"aa"`, verify: verifyMD5, err: errors.New("all policy not met"),
+		dests: []destResult{{name: "0", status: destOK, md5: `"aa"`}, {name: "1", status: destFail}}})
+	if o, err := store.get("k4"); err != nil || o != nil {
+		t.Errorf("unexpected state of k4: %+v %v", o, err)
+	}
+
+	// the fan-out copies are recorded as they get verified
+	rep.record(&syncResult{oldKey: "k3", srcMD5: `"aa"`, verify: verifyMD5, dests: []destResult{
+		{name: "0", status: destOK, md5: `"aa"`}, {name: "1", status: destFail}}})
+	o, err := store.get("k3")
+	if err != nil || o == nil || o.dstMD5 != "0=aa" || o.dests != "0;1" || o.verify != verifyMD5 {
+		t.Errorf("unexpected state of the partial k3: %+v %v", o, err)
+		return
+	}
+	d := &sourceDeleter{dest: storage.NewMultiStorage(storage.PolicyAll, []string{"0", "1"},
+		[]storage.StorDest{newMemStorage(0), newMemStorage(0)})}
+	if reason := d.check(*o); reason != "no checksum recorded on 1" {
+		t.Errorf("unexpected check of the partial k3: %s", reason)
+	}
+	// without a reread the destinations are only known from the state
+	if reason := (&sourceDeleter{}).check(*o); reason != "no checksum recorded on 1" {
+		t.Errorf("unexpected check of the partial k3 without reread: %s", reason)
+	}
+	legacy := *o
+	legacy.dstMD5, legacy.dests = "0=aa;1=aa", ""
+	if reason := (&sourceDeleter{}).check(legacy); reason != "no destinations recorded" {
+		t.Errorf("unexpected check of a fan-out copy without destinations: %s", reason)
+	}
+	rep.record(&syncResult{oldKey: "k3", verified: true, srcMD5: `"aa"`, verify: verifyMD5, dests: []destResult{
+		{name: "1", status: destOK, md5: `"bb"`}}})
+	if o, err = store.get("k3"); err != nil || o == nil || o.dstMD5 != "0=aa;1=bb" || o.dests != "0;1" {
+		t.Errorf("unexpected state of the retried k3: %+v %v", o, err)
+		return
+	}
+	if reason := d.check(*o); reason != "1: recorded checksums differ: aa, bb" {
+		t.Errorf("unexpected check of the retried k3: %s", reason)
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// diskFree isn't available on windows
+func diskFree(dir string) (int64, error) {
+	return 0, errors.New("free disk space unavailable on windows")
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"s3sync/storage"
+)
+
+// TestWorkerProcess is the worker process started by TestDistributedMigration
+func TestWorkerProcess(t *testing.T) {
+	if os.Getenv("S3SYNC_TEST_COORDINATOR") == "" {
+		return
+	}
+	WorkerPollInterval = 50 * time.Millisecond
+	SyncWorkerCnt = 2
+	dest := storage.NewS3Storage(os.Getenv("S3SYNC_TEST_S3"), "u1", "s1", "bucket1")
+	source := storage.NewWosStorage(os.Getenv("S3SYNC_TEST_WOS"))
+	c := newWorkerClient(os.Getenv("S3SYNC_TEST_COORDINATOR"), os.Getenv("S3SYNC_TEST_WORKER"))
+	if err := runWorker(c, 3, dest, source); err != nil {
+		fmt.Fprintf(os.Stderr, "worker failed: %s\n", err.Error())
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestDistributedMigration(t *testing.T) {
+	var keys []string
+	var list strings.Builder
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("k%02d", i))
+		fmt.Fprintln(&list, keys[i])
+	}
+	bucket := "bucket1"
+	s3, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3.Close()
+	wos := setupWosServer(t, keys)
+	defer wos.Close()
+
+	report := &memWriter{}
+	c := newCoordinator(&listEnumerator{r: strings.NewReader(list.String())},
+		&csvReporter{w: bufio.NewWriter(report)}, time.Second)
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	// a worker dying with its lease, the objects must be handed out again
+	dead := newWorkerClient(server.URL, "dead")
+	var l leaseResponse
+	for {
+		status, err := dead.post("/lease", leaseRequest{Worker: "dead", Max: 5}, &l)
+		if err != nil {
+			t.Errorf("failed to lease: %s", err.Error())
+			return
+		}
+		if status == http.StatusOK {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(l.Objects) == 0 {
+		t.Errorf("dead worker got nothing leased")
+		return
+	}
+
+	var workers []*exec.Cmd
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestWorkerProcess$")
+		cmd.Env = append(os.Environ(),
+			"S3SYNC_TEST_COORDINATOR="+server.URL,
+			"S3SYNC_TEST_S3="+s3.URL,
+			"S3SYNC_TEST_WOS="+strings.TrimPrefix(wos.URL, "http://"),
+			fmt.Sprintf("S3SYNC_TEST_WORKER=w%d", i))
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			t.Errorf("failed to start worker: %s", err.Error())
+			return
+		}
+		workers = append(workers, cmd)
+	}
+
+	select {
+	case <-c.Done():
+	case <-time.After(30 * time.Second):
+		t.Errorf("migration didn't complete: %+v", c.status())
+	}
+	for _, w := range workers {
+		if err := w.Wait(); err != nil {
+			t.Errorf("worker failed: %s", err.Error())
+		}
+	}
+
+	if status := c.status(); status.Finished != len(keys) || status.Pass != len(keys) {
+		t.Errorf("unexpected coordinator status: %+v", status)
+	}
+	verifyReport(t, string(report.data), keys)
+
+	// results of the expired lease come too late
+	if c.results(resultRequest{Lease: l.Lease, Worker: "dead",
+		Results: []wireResult{{Key: l.Objects[0].Key}}}) {
+		t.Errorf("results of an expired lease should be dropped")
+	}
+}
+
+func TestWorkerLeases(t *testing.T) {
+	defer func(interval time.Duration) { WorkerPollInterval, Pack = interval, "" }(WorkerPollInterval)
+	WorkerPollInterval = 10 * time.Millisecond
+	var keys []string
+	var list strings.Builder
+	for i := 0; i < 9; i++ {
+		keys = append(keys, fmt.Sprintf("k%02d", i))
+		fmt.Fprintln(&list, keys[i])
+	}
+	bucket := "bucket1"
+	s3, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3.Close()
+	wos := setupWosServer(t, keys)
+	defer wos.Close()
+	dest := storage.NewS3Storage(s3.URL, "u1", "s1", bucket)
+	source := storage.NewWosStorage(strings.TrimPrefix(wos.URL, "http://"))
+
+	// the objects of every lease share the bundles of the worker
+	Pack = packTar
+	c := newCoordinator(&listEnumerator{r: strings.NewReader(list.String())},
+		&jsonReporter{w: bufio.NewWriter(&memWriter{})}, time.Second)
+	c.reportFormat = "jsonl"
+	server := httptest.NewServer(c)
+	defer server.Close()
+	if err := runWorker(newWorkerClient(server.URL, "w0"), 3, dest, source); err != nil {
+		t.Errorf("worker failed: %s", err.Error())
+		return
+	}
+	if status := c.status(); status.Finished != len(keys) || status.Pass != len(keys) {
+		t.Errorf("unexpected coordinator status: %+v", status)
+	}
+	var bundles []string
+	dest.List(PackPrefix, "", func(key string, info *storage.ObjectInfo) bool {
+		bundles = append(bundles, key)
+		return true
+	})
+	if len(bundles) != 2 {
+		t.Errorf("unexpected bundles: %v", bundles)
+	}
+
+	// a packing worker doesn't lease from a coordinator writing a csv report
+	c = newCoordinator(&listEnumerator{r: strings.NewReader(list.String())},
+		&csvReporter{w: bufio.NewWriter(&memWriter{})}, time.Second)
+	c.reportFormat = "csv"
+	csvServer := httptest.NewServer(c)
+	defer csvServer.Close()
+	if err := runWorker(newWorkerClient(csvServer.URL, "w0"), 3, dest, source); err == nil ||
+		!strings.Contains(err.Error(), "jsonl") {
+		t.Errorf("packing worker ran with a csv report: %v", err)
+		return
+	}
+	if status := c.status(); status.Finished != 0 || status.Leased != 0 {
+		t.Errorf("unexpected coordinator status: %+v", status)
+	}
+	Pack = ""
+
+	// a lease the coordinator revoked is dropped by the worker
+	c = newCoordinator(&listEnumerator{r: strings.NewReader(list.String())},
+		&csvReporter{w: bufio.NewWriter(&memWriter{})}, 300*time.Millisecond)
+	revoked := httptest.NewServer(c)
+	defer revoked.Close()
+	client := newWorkerClient(revoked.URL, "w1")
+	var l leaseResponse
+	for {
+		status, err := client.post("/lease", leaseRequest{Worker: "w1", Max: 3}, &l)
+		if err != nil {
+			t.Errorf("failed to lease: %s", err.Error())
+			return
+		}
+		if status == http.StatusOK {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	leases := newWorkerLeases(client)
+	defer leases.close()
+	wl := leases.add(l)
+	c.expireLeases(time.Now().Add(time.Hour))
+	select {
+	case <-wl.done:
+	case <-time.After(2 * time.Second):
+		t.Errorf("revoked lease %s wasn't dropped", l.Lease)
+		return
+	}
+	if results := processLease("w1", leases, wl, l, nil, dest, source); len(results) != 0 {
+		t.Errorf("objects of a revoked lease were migrated: %d", len(results))
+	}
+}
+
+func TestCoordinatorEnumerationError(t *testing.T) {
+	bucket := "bucket1"
+	s3, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3.Close()
+	dest := storage.NewS3Storage(s3.URL, "u1", "s1", bucket)
+
+	c := newCoordinator(&sliceEnumerator{n: 2, err: errors.New("listing failed")},
+		&csvReporter{w: bufio.NewWriter(&memWriter{})}, time.Second)
+	server := httptest.NewServer(c)
+	defer server.Close()
+	if err := runWorker(newWorkerClient(server.URL, "w0"), 3, dest, newMemStorage(2)); err != nil {
+		t.Errorf("worker failed: %s", err.Error())
+		return
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(2 * time.Second):
+		t.Errorf("coordinator not done")
+		return
+	}
+	if err := c.Err(); err == nil || err.Error() != "listing failed" {
+		t.Errorf("unexpected enumeration error: %v", err)
+	}
+	if status := c.status(); status.Finished != 2 {
+		t.Errorf("unexpected coordinator status: %+v", status)
+	}
+}
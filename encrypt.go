@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"s3sync/storage"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	log "github.com/sirupsen/logrus"
+)
+
+// encryptionScheme encrypts an object in chunks of EncryptChunkSize bytes
+// with AES-256-GCM, the nonce of a chunk being a random prefix, the chunk
+// index and a last chunk flag, so that a truncated, reordered or extended
+// object fails to decrypt
+const encryptionScheme = "aes-256-gcm-stream"
+
+// metadata of an encrypted object
+const (
+	metaEncryption = "s3sync-encryption"
+	metaKeyID      = "s3sync-key-id"
+	metaWrappedKey = "s3sync-wrapped-key"
+	metaNonce      = "s3sync-nonce"
+	metaChunkSize  = "s3sync-chunk-size"
+)
+
+const (
+	nonceSize       = 12
+	noncePrefixSize = 7
+	// maxChunkSize bounds the chunk size read from the metadata
+	maxChunkSize = 16 << 20
+)
+
+var (
+	// EncryptChunkSize is the plaintext size of an encrypted chunk
+	EncryptChunkSize = 64 << 10
+
+	// masterKey wraps and unwraps the data keys, nil without one
+	masterKey keyWrapper
+	// encryptObjects encrypts the migrated objects
+	encryptObjects bool
+)
+
+// keyWrapper creates the data keys of the objects, wrapped by a master key
+type keyWrapper interface {
+	// id identifies the master key
+	id() string
+	// dataKey returns a new data key and the same key wrapped
+	dataKey() (key, wrapped []byte, err error)
+	// unwrap returns the data key of wrapped
+	unwrap(wrapped []byte) ([]byte, error)
+}
+
+// fileKey is a master key read from a local key file
+type fileKey struct {
+	aead  cipher.AEAD
+	keyID string
+}
+
+// readKeyFile reads a 32 bytes master key given as is, in hex or in base64
+func readKeyFile(path string) (*fileKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file(%s): %s", path, err.Error())
+	}
+	key := data
+	if len(key) != 32 {
+		s := strings.TrimSpace(string(data))
+		if k, err := hex.DecodeString(s); err == nil {
+			key = k
+		} else if k, err := base64.StdEncoding.DecodeString(s); err == nil {
+			key = k
+		}
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key file(%s): want a 32 bytes key, raw, hex or base64", path)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &fileKey{aead: aead, keyID: "keyfile:" + hex.EncodeToString(sum[:8])}, nil
+}
+
+func (t *fileKey) id() string {
+	return t.keyID
+}
+
+func (t *fileKey) dataKey() ([]byte, []byte, error) {
+	key := make([]byte, 32)
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return key, t.aead.Seal(nonce, nonce, key, []byte(t.keyID)), nil
+}
+
+func (t *fileKey) unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < nonceSize {
+		return nil, errors.New("wrapped key too short")
+	}
+	key, err := t.aead.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], []byte(t.keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %s", err.Error())
+	}
+	return key, nil
+}
+
+// kmsKey is a master key of a KMS compatible api
+type kmsKey struct {
+	svc   *kms.KMS
+	keyID string
+}
+
+func (t *kmsKey) id() string {
+	return t.keyID
+}
+
+func (t *kmsKey) dataKey() ([]byte, []byte, error) {
+	out, err := t.svc.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(t.keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key: %s", err.Error())
+	}
+	if len(out.Plaintext) != 32 {
+		return nil, nil, fmt.Errorf("invalid data key of %d bytes", len(out.Plaintext))
+	}
+	return out.Plaintext, out.CiphertextBlob, nil
+}
+
+func (t *kmsKey) unwrap(wrapped []byte) ([]byte, error) {
+	out, err := t.svc.Decrypt(&kms.DecryptInput{CiphertextBlob: wrapped})
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %s", err.Error())
+	}
+	return out.Plaintext, nil
+}
+
+// encryptionOptions configures the master key and the encryption of the
+// migrated objects
+type encryptionOptions struct {
+	encrypt     bool
+	keyFile     string
+	kmsKeyID    string
+	kmsEndpoint string
+	kmsRegion   string
+	kmsAk       string
+	kmsSk       string
+}
+
+// addKeyFlags adds the flags of the master key decrypting the objects
+func addKeyFlags(fs *flag.FlagSet, o *encryptionOptions) {
+	fs.StringVar(&o.keyFile, "keyfile", "", "master key file: 32 bytes, raw, hex or base64")
+	fs.StringVar(&o.kmsKeyID, "kmskeyid", "", "master key id of a kms compatible api")
+	fs.StringVar(&o.kmsEndpoint, "kmsendpoint", "", "kms endpoint, aws when empty")
+	fs.StringVar(&o.kmsRegion, "kmsregion", "us-east-1", "kms region")
+	fs.StringVar(&o.kmsAk, "kmsak", "", "kms access key, the aws credential chain when empty")
+	fs.StringVar(&o.kmsSk, "kmssk", "", "kms secret key")
+}
+
+// addEncryptionFlags adds the flags encrypting the migrated objects
+func addEncryptionFlags(fs *flag.FlagSet, o *encryptionOptions) {
+	fs.BoolVar(&o.encrypt, "encrypt", false, "encrypt the objects with data keys wrapped by the master key")
+	addKeyFlags(fs, o)
+}
+
+// setupEncryption checks the options and sets the master key and whether
+// the objects are encrypted
+func setupEncryption(o encryptionOptions) error {
+	masterKey, encryptObjects = nil, false
+	switch {
+	case o.keyFile != "" && o.kmsKeyID != "":
+		return errors.New("both a key file and a kms key given")
+	case o.keyFile != "":
+		k, err := readKeyFile(o.keyFile)
+		if err != nil {
+			return err
+		}
+		masterKey = k
+	case o.kmsKeyID != "":
+		c := &aws.Config{Region: aws.String(o.kmsRegion)}
+		if o.kmsEndpoint != "" {
+			c.Endpoint = aws.String(o.kmsEndpoint)
+		}
+		if o.kmsAk != "" {
+			c = c.WithCredentials(credentials.NewStaticCredentials(o.kmsAk, o.kmsSk, ""))
+		}
+		masterKey = &kmsKey{svc: kms.New(session.New(c)), keyID: o.kmsKeyID}
+	case o.encrypt:
+		return errors.New("encryption needs a key file or a kms key")
+	}
+	encryptObjects = o.encrypt
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of chunk index
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, nonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], index)
+	if last {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
+
+// encryptObject returns obj encrypted with a new data key, nil when the
+// objects aren't encrypted
+func encryptObject(obj storage.SyncObject) (*encryptedObject, error) {
+	if !encryptObjects {
+		return nil, nil
+	}
+	key, wrapped, err := masterKey.dataKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	meta := map[string]string{}
+	for k, v := range storage.Metadata(obj) {
+		meta[k] = v
+	}
+	meta[metaEncryption] = encryptionScheme
+	meta[metaKeyID] = masterKey.id()
+	meta[metaWrappedKey] = base64.StdEncoding.EncodeToString(wrapped)
+	meta[metaNonce] = base64.StdEncoding.EncodeToString(prefix)
+	meta[metaChunkSize] = strconv.Itoa(EncryptChunkSize)
+
+	body := obj.GetBody()
+	return &encryptedObject{
+		SyncObject: obj,
+		meta:       meta,
+		body: &encryptReader{
+			src:    bufio.NewReader(body),
+			closer: body,
+			aead:   aead,
+			prefix: prefix,
+			sum:    md5.New(),
+			plain:  make([]byte, EncryptChunkSize),
+			out:    make([]byte, 0, EncryptChunkSize+aead.Overhead()),
+		},
+	}, nil
+}
+
+// encryptedObject is an object encrypted on its way to the destination
+type encryptedObject struct {
+	storage.SyncObject
+	meta map[string]string
+	body *encryptReader
+}
+
+// GetContentLength is the plaintext size and the tags of its chunks
+func (t *encryptedObject) GetContentLength() int64 {
+	n := t.SyncObject.GetContentLength()
+	if n < 0 {
+		return -1
+	}
+	chunks := (n + int64(EncryptChunkSize) - 1) / int64(EncryptChunkSize)
+	if chunks == 0 {
+		chunks = 1
+	}
+	return n + chunks*int64(t.body.aead.Overhead())
+}
+
+func (t *encryptedObject) GetBody() io.ReadCloser {
+	return t.body
+}
+
+func (t *encryptedObject) GetMetadata() map[string]string {
+	return t.meta
+}
+
+// md5 returns the md5 of the plaintext, quoted like storage.CalcMD5, once
+// the object was read through
+func (t *encryptedObject) md5() string {
+	return fmt.Sprintf("\"%x\"", t.body.sum.Sum(nil))
+}
+
+// encryptReader encrypts src in chunks
+type encryptReader struct {
+	src    *bufio.Reader
+	closer io.Closer
+	aead   cipher.AEAD
+	prefix []byte
+	// sum hashes the plaintext
+	sum   hash.Hash
+	index uint32
+	plain []byte
+	out   []byte
+	// sealed is the encrypted chunk left to read
+	sealed []byte
+	done   bool
+}
+
+func (t *encryptReader) Read(p []byte) (int, error) {
+	for len(t.sealed) == 0 {
+		if t.done {
+			return 0, io.EOF
+		}
+		if err := t.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, t.sealed)
+	t.sealed = t.sealed[n:]
+	return n, nil
+}
+
+// next encrypts the next chunk, the last one being the first one short of
+// a full chunk or followed by the end of src
+func (t *encryptReader) next() error {
+	n, err := io.ReadFull(t.src, t.plain)
+	last := false
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	case nil:
+		if _, err := t.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	if t.index == ^uint32(0) && !last {
+		return errors.New("object too large to encrypt")
+	}
+	t.sum.Write(t.plain[:n])
+	t.sealed = t.aead.Seal(t.out[:0], chunkNonce(t.prefix, t.index, last), t.plain[:n], nil)
+	t.index++
+	t.done = last
+	return nil
+}
+
+func (t *encryptReader) Close() error {
+	return t.closer.Close()
+}
+
+// decryptBody returns the plaintext of body, an object encrypted with the
+// parameters of meta
+func decryptBody(meta map[string]string, body io.ReadCloser) (io.ReadCloser, error) {
+	if scheme := meta[metaEncryption]; scheme != encryptionScheme {
+		return nil, fmt.Errorf("unknown encryption: %s", scheme)
+	}
+	if masterKey == nil {
+		return nil, fmt.Errorf("object encrypted with %s, no master key given", meta[metaKeyID])
+	}
+	// a kms key may be named by an alias or an arn, its blobs telling the key
+	if _, ok := masterKey.(*fileKey); ok && meta[metaKeyID] != masterKey.id() {
+		return nil, fmt.Errorf("object encrypted with %s, not %s", meta[metaKeyID], masterKey.id())
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(meta[metaWrappedKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %s", err.Error())
+	}
+	prefix, err := base64.StdEncoding.DecodeString(meta[metaNonce])
+	if err != nil || len(prefix) != noncePrefixSize {
+		return nil, fmt.Errorf("invalid nonce: %s", meta[metaNonce])
+	}
+	chunkSize, err := strconv.Atoi(meta[metaChunkSize])
+	if err != nil || chunkSize <= 0 || chunkSize > maxChunkSize {
+		return nil, fmt.Errorf("invalid chunk size: %s", meta[metaChunkSize])
+	}
+	key, err := masterKey.unwrap(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		src:    bufio.NewReader(body),
+		closer: body,
+		aead:   aead,
+		prefix: prefix,
+		sealed: make([]byte, chunkSize+aead.Overhead()),
+	}, nil
+}
+
+// decryptReader decrypts the chunks of src
+type decryptReader struct {
+	src    *bufio.Reader
+	closer io.Closer
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+	sealed []byte
+	// plain is the decrypted chunk left to read
+	plain []byte
+	done  bool
+}
+
+func (t *decryptReader) Read(p []byte) (int, error) {
+	for len(t.plain) == 0 {
+		if t.done {
+			return 0, io.EOF
+		}
+		if err := t.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, t.plain)
+	t.plain = t.plain[n:]
+	return n, nil
+}
+
+func (t *decryptReader) next() error {
+	n, err := io.ReadFull(t.src, t.sealed)
+	last := false
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	case nil:
+		if _, err := t.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	plain, err := t.aead.Open(t.sealed[:0], chunkNonce(t.prefix, t.index, last), t.sealed[:n], nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt chunk %d: %s", t.index, err.Error())
+	}
+	t.plain = plain
+	t.index++
+	t.done = last
+	return nil
+}
+
+func (t *decryptReader) Close() error {
+	return t.closer.Close()
+}
+
+// restoringSource reads the original content of the objects of a
+// destination, decrypted and decompressed, as the source of a restore run,
+// the oids following prefix
+type restoringSource struct {
+	storage.StorSrc
+	prefix string
+}
+
+func (t *restoringSource) Read(key string) (storage.SyncObject, error) {
+	obj, err := t.StorSrc.Read(t.prefix + key)
+	if err != nil {
+		return nil, err
+	}
+	meta := storage.Metadata(obj)
+	body, err := restoreBody(meta, obj.GetBody())
+	if err != nil {
+		obj.GetBody().Close()
+		return nil, err
+	}
+	return &restoredObject{SyncObject: obj, body: body, size: originalSize(meta, obj.GetContentLength())}, nil
+}
+
+type restoredObject struct {
+	storage.SyncObject
+	body io.ReadCloser
+	size int64
+}
+
+func (t *restoredObject) GetContentLength() int64 {
+	return t.size
+}
+
+func (t *restoredObject) GetBody() io.ReadCloser {
+	return t.body
+}
+
+// decryptCommand writes the original content of an s3 object:
+//
+//	decrypt -key oid -o file -keyfile master.key -ak ... -endpoint ... -bucket ...
+func decryptCommand(args []string) {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	cfg := addConfigFlags(fs)
+	key := fs.String("key", "", "oid of the object, the key prefix added")
+	fs.StringVar(&KeyPrefix, "keyprefix", KeyPrefix, "prefix of the s3 keys, the wos oid following")
+	out := fs.String("o", "-", "output file, - for stdout")
+	storOpts := storOptions{}
+	addStorFlags(fs, &storOpts)
+	encOpts := encryptionOptions{}
+	addKeyFlags(fs, &encOpts)
+	fs.Parse(args)
+	if err := cfg.load(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if *key == "" || !storOpts.hasDest() {
+		fs.Usage()
+		log.Fatal("missing key, access key, secret key, endpoint or bucket")
+	}
+	if err := setupEncryption(encOpts); err != nil {
+		fs.Usage()
+		log.Fatal(err.Error())
+	}
+
+	dest, err := storOpts.dest()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	obj, err := (&restoringSource{StorSrc: dest, prefix: KeyPrefix}).Read(*key)
+	if err != nil {
+		log.Fatalf("failed to read %s: %s", *key, err.Error())
+	}
+	body := obj.GetBody()
+	defer body.Close()
+	w := os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("failed to create %s: %s", *out, err.Error())
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := io.Copy(w, body)
+	if err != nil {
+		log.Fatalf("failed to decrypt %s: %s", *key, err.Error())
+	}
+	log.Infof("wrote %d bytes of %s", n, *key)
+}
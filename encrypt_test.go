@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"s3sync/storage"
+)
+
+// setupKMSServer serves GenerateDataKey and Decrypt of a kms compatible
+// api, the blobs being the keys in clear
+func setupKMSServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			KeyId          string
+			CiphertextBlob []byte
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GenerateDataKey":
+			key := bytes.Repeat([]byte{byte(len(req.KeyId))}, 32)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"KeyId": req.KeyId, "Plaintext": key, "CiphertextBlob": append([]byte("blob:"), key...)})
+		case "TrentService.Decrypt":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"Plaintext": bytes.TrimPrefix(req.CiphertextBlob, []byte("blob:"))})
+		default:
+			t.Errorf("unexpected kms call: %s", r.Header.Get("X-Amz-Target"))
+			http.Error(w, "unknown", http.StatusBadRequest)
+		}
+	}))
+}
+
+func writeKeyFile(t *testing.T, dir, name string, key []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, key, 0600); err != nil {
+		t.Fatalf("failed to write key file: %s", err.Error())
+	}
+	return path
+}
+
+func TestEncryptStream(t *testing.T) {
+	chunkSize := EncryptChunkSize
+	EncryptChunkSize = 16
+	defer func() {
+		EncryptChunkSize = chunkSize
+		setupEncryption(encryptionOptions{})
+	}()
+	dir, err := ioutil.TempDir("", "encrypt")
+	if err != nil {
+		t.Errorf("failed to create temp dir: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+	key := writeKeyFile(t, dir, "master.key", []byte(strings.Repeat("ab", 32)+"\n"))
+	other := writeKeyFile(t, dir, "other.key", []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))))
+	if err := setupEncryption(encryptionOptions{encrypt: true, keyFile: key}); err != nil {
+		t.Errorf("failed to set up encryption: %s", err.Error())
+		return
+	}
+
+	for _, n := range []int{0, 1, 15, 16, 17, 48} {
+		data := bytes.Repeat([]byte("x"), n)
+		enc, err := encryptObject(&memObject{data: data})
+		if err != nil {
+			t.Errorf("failed to encrypt %d bytes: %s", n, err.Error())
+			return
+		}
+		sealed, err := ioutil.ReadAll(enc.GetBody())
+		if err != nil || int64(len(sealed)) != enc.GetContentLength() {
+			t.Errorf("%d bytes: %d bytes encrypted, want %d: %v", n, len(sealed), enc.GetContentLength(), err)
+			return
+		}
+		meta := enc.GetMetadata()
+		plain, err := restoreBody(meta, ioutil.NopCloser(bytes.NewReader(sealed)))
+		if err != nil {
+			t.Errorf("%d bytes: failed to decrypt: %s", n, err.Error())
+			return
+		}
+		if got, err := ioutil.ReadAll(plain); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: decrypted %d bytes: %v", n, len(got), err)
+			return
+		}
+
+		// truncated, extended or altered objects fail to decrypt
+		tampered := [][]byte{
+			sealed[:len(sealed)-1],
+			append(append([]byte{}, sealed...), sealed[len(sealed)-16:]...),
+			append([]byte{sealed[0] ^ 1}, sealed[1:]...),
+		}
+		if len(sealed) > 32 {
+			tampered = append(tampered, sealed[:32])
+		}
+		for i, b := range tampered {
+			plain, err := restoreBody(meta, ioutil.NopCloser(bytes.NewReader(b)))
+			if err == nil {
+				_, err = ioutil.ReadAll(plain)
+			}
+			if err == nil {
+				t.Errorf("%d bytes: tampered object %d decrypted", n, i)
+			}
+		}
+	}
+
+	enc, _ := encryptObject(&memObject{data: []byte("secret")})
+	meta := enc.GetMetadata()
+	setupEncryption(encryptionOptions{keyFile: other})
+	if _, err := restoreBody(meta, enc.GetBody()); err == nil || !strings.Contains(err.Error(), "not keyfile:") {
+		t.Errorf("object decrypted with the wrong key: %v", err)
+	}
+	if err := setupEncryption(encryptionOptions{encrypt: true}); err == nil {
+		t.Errorf("encryption accepted without a master key")
+	}
+}
+
+func TestEncryptMigrate(t *testing.T) {
+	defer func() {
+		Transform, KeyPrefix = "", ""
+		setupTransform()
+		setupEncryption(encryptionOptions{})
+	}()
+
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	kms := setupKMSServer(t)
+	defer kms.Close()
+	dir, err := ioutil.TempDir("", "encrypt")
+	if err != nil {
+		t.Errorf("failed to create temp dir: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+	keyFile := writeKeyFile(t, dir, "master.key", bytes.Repeat([]byte{7}, 32))
+
+	dest := storage.NewS3Storage(s3Server.URL, "u1", "s1", bucket)
+	logs := []byte(strings.Repeat("GET /index.html 200\n", 10000))
+	source := newMemStorage(0)
+	source.objects["log"] = logs
+	source.objects["empty"] = []byte{}
+	input := filepath.Join(dir, "report.csv")
+	ioutil.WriteFile(input, []byte("1,ok,true,log\n1,ok,true,empty\n"), 0644)
+
+	keys := []encryptionOptions{
+		{encrypt: true, keyFile: keyFile},
+		{encrypt: true, kmsKeyID: "alias/s3sync", kmsEndpoint: kms.URL, kmsRegion: "us-east-1", kmsAk: "u1", kmsSk: "s1"},
+	}
+	for i, opts := range keys {
+		// the objects are compressed then encrypted
+		Transform, KeyPrefix = transformGzip, []string{"file/", "kms/"}[i]
+		setupTransform()
+		if err := setupEncryption(opts); err != nil {
+			t.Errorf("failed to set up encryption: %s", err.Error())
+			return
+		}
+		report := &memWriter{}
+		migrate(dest, source, &jsonReporter{w: bufio.NewWriter(report)},
+			&listEnumerator{r: strings.NewReader("log\nempty\n")})
+		for _, l := range strings.Split(strings.TrimSpace(string(report.data)), "\n") {
+			var line jsonReportLine
+			if err := json.Unmarshal([]byte(l), &line); err != nil || line.Status != "ok" ||
+				!line.Verified || !line.Encrypted || line.Transform != transformGzip {
+				t.Errorf("%s: unexpected report line: %s", KeyPrefix, l)
+				return
+			}
+		}
+
+		obj, err := dest.Read(KeyPrefix + "log")
+		if err != nil {
+			t.Errorf("%s: failed to read log: %s", KeyPrefix, err.Error())
+			return
+		}
+		meta := storage.Metadata(obj)
+		sealed, _ := ioutil.ReadAll(obj.GetBody())
+		if meta[metaEncryption] != encryptionScheme || meta[metaKeyID] == "" || meta[metaWrappedKey] == "" ||
+			meta[metaTransform] != transformGzip || bytes.Contains(sealed, []byte("GET /index.html")) {
+			t.Errorf("%s: unexpected stored object: %v", KeyPrefix, meta)
+			return
+		}
+
+		// the restoring source reads the original content back
+		restored, err := (&restoringSource{StorSrc: dest, prefix: KeyPrefix}).Read("log")
+		if err != nil {
+			t.Errorf("%s: failed to restore log: %s", KeyPrefix, err.Error())
+			return
+		}
+		data, err := ioutil.ReadAll(restored.GetBody())
+		restored.GetBody().Close()
+		if err != nil || !bytes.Equal(data, logs) || restored.GetContentLength() != int64(len(logs)) {
+			t.Errorf("%s: unexpected restored log: %d bytes, %v", KeyPrefix, len(data), err)
+			return
+		}
+
+		var out bytes.Buffer
+		opts := auditOptions{mode: auditFull, sample: 1, confidence: 0.95, margin: 0.05, seed: "s"}
+		s, _, err := runAudit(reportKeys(input), opts, source, dest, &out, []byte("secret"))
+		if err != nil || s.Matched != 2 {
+			t.Errorf("%s: unexpected audit: %+v, %v\n%s", KeyPrefix, s, err, out.String())
+		}
+		if reason := checkCopy(dest, stateObject{oid: "log", size: int64(len(logs))},
+			"fef0b2e36ea16bd30de5a5ffb8e0cc0c"); !strings.Contains(reason, "copy doesn't match") {
+			t.Errorf("%s: unexpected reverify of a wrong checksum: %s", KeyPrefix, reason)
+		}
+	}
+
+	// a restore run migrates the original content of the copies back
+	Transform, KeyPrefix = "", ""
+	setupTransform()
+	if err := setupEncryption(encryptionOptions{keyFile: keyFile}); err != nil {
+		t.Errorf("failed to set up decryption: %s", err.Error())
+		return
+	}
+	storOpts := storOptions{sourceKind: "s3", srcEndpoint: s3Server.URL, srcBucket: bucket,
+		srcAK: "u1", srcSK: "s1", srcPrefix: "file/"}
+	restoreSource, err := storOpts.source()
+	if err != nil {
+		t.Errorf("failed to create the restore source: %s", err.Error())
+		return
+	}
+	restored := newMemStorage(0)
+	report := &memWriter{}
+	migrate(restored, restoreSource, &csvReporter{w: bufio.NewWriter(report)},
+		&listEnumerator{r: strings.NewReader("log\nempty\n")})
+	if strings.Count(string(report.data), ",ok,true,") != 2 || !bytes.Equal(restored.objects["log"], logs) ||
+		len(restored.objects["empty"]) != 0 {
+		t.Errorf("unexpected restore run: %s", report.data)
+	}
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+)
+
+// enumerator produces the stream of objects to be migrated
+type enumerator interface {
+	// enumerate calls emit for every object found, stopping without an
+	// error once emit returns false
+	enumerate(emit func(syncObjItem) bool) error
+}
+
+// enumOptions selects and configures the enumerator
+type enumOptions struct {
+	kind      string
+	file      string
+	column    string
+	header    bool
+	field     string
+	sqlDriver string
+	sqlDSN    string
+	sqlQuery  string
+	searchURL string
+
+	rejectFile string
+
+	shard      string
+	include    string
+	exclude    string
+	dedup      bool
+	oidPattern string
+	tmpDir     string
+}
+
+// closingEnumerator releases the input of an enumerator once the run is over
+type closingEnumerator struct {
+	enumerator
+	rejects *rejectWriter
+	prescan *prescanStats
+	closers []io.Closer
+}
+
+func (t *closingEnumerator) Close() error {
+	var err error
+	for _, c := range t.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// newEnumerator creates the enumerator of opts.kind:
+//
+//	file: an oid list or a previous report, told apart by the first line
+//	list: one oid per line
+//	report: a previous report, retrying what isn't ok
+//	csv, tsv: a column selected by header name or index
+//	jsonl: a field of JSON lines
+//	sql: the first column of a query result
+//	search: a wos metadata search service
+//
+// Input files may be gzip or zstd compressed, "-" reads stdin. Dedup and oid
+// validation prescan the whole input before returning.
+func newEnumerator(opts enumOptions) (*closingEnumerator, error) {
+	ce := &closingEnumerator{}
+	fail := func(err error) (*closingEnumerator, error) {
+		ce.Close()
+		return nil, err
+	}
+
+	if opts.rejectFile != "" {
+		f, err := os.OpenFile(opts.rejectFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open reject file(%s): %s", opts.rejectFile, err.Error())
+		}
+		ce.closers = append(ce.closers, f)
+		ce.rejects = newRejectWriter(f)
+	} else {
+		ce.rejects = newRejectWriter(nil)
+	}
+
+	var enum enumerator
+	switch opts.kind {
+	case "", "file", "list", "report", "plan", "csv", "tsv", "jsonl":
+		if opts.file == "" {
+			return fail(fmt.Errorf("missing oid file"))
+		}
+		in, err := openInput(opts.file)
+		if err != nil {
+			return fail(err)
+		}
+		ce.closers = append(ce.closers, in)
+		if enum, err = fileEnumerator(opts, in, ce.rejects); err != nil {
+			return fail(err)
+		}
+	case "sql":
+		if opts.sqlDSN == "" || opts.sqlQuery == "" {
+			return fail(fmt.Errorf("missing sql dsn or query"))
+		}
+		enum = &sqlEnumerator{driver: opts.sqlDriver, dsn: opts.sqlDSN, query: opts.sqlQuery}
+	case "search":
+		if opts.searchURL == "" || opts.field == "" {
+			return fail(fmt.Errorf("missing search url or field"))
+		}
+		enum = &searchEnumerator{url: opts.searchURL, field: opts.field,
+			pageSize: ListPageSize, rejects: ce.rejects}
+	default:
+		return fail(fmt.Errorf("unknown enumerator: %s", opts.kind))
+	}
+
+	if opts.include != "" || opts.exclude != "" {
+		filter, err := newObjFilter(opts.include, opts.exclude)
+		if err != nil {
+			return fail(err)
+		}
+		enum = &filteredEnumerator{enumerator: enum, filter: filter}
+	}
+
+	if opts.shard != "" {
+		index, count, err := parseShard(opts.shard)
+		if err != nil {
+			return fail(err)
+		}
+		log.Infof("Migrating shard %d of %d", index, count)
+		enum = &shardEnumerator{enumerator: enum, index: index, count: count}
+	}
+
+	if opts.dedup || opts.oidPattern != "" {
+		popts := prescanOptions{dedup: opts.dedup, tmpDir: opts.tmpDir}
+		if opts.oidPattern != "" {
+			var err error
+			if popts.pattern, err = regexp.Compile(opts.oidPattern); err != nil {
+				return fail(fmt.Errorf("invalid oid pattern %s: %s", opts.oidPattern, err.Error()))
+			}
+		}
+		spool, stats, err := prescan(enum, popts, ce.rejects)
+		if err != nil {
+			return fail(err)
+		}
+		ce.closers = append(ce.closers, spool)
+		ce.prescan = &stats
+		enum = spool
+	}
+	ce.enumerator = enum
+	return ce, nil
+}
+
+// fileEnumerator creates the enumerator of the input file kinds reading r
+func fileEnumerator(opts enumOptions, r io.Reader, rejects *rejectWriter) (enumerator, error) {
+	switch opts.kind {
+	case "csv", "tsv":
+		if opts.column == "" {
+			return nil, fmt.Errorf("missing column for %s enumerator", opts.kind)
+		}
+		comma := ','
+		if opts.kind == "tsv" {
+			comma = '\t'
+		}
+		return &csvEnumerator{r: r, comma: comma, column: opts.column,
+			header: opts.header, rejects: rejects}, nil
+	case "jsonl":
+		if opts.field == "" {
+			return nil, fmt.Errorf("missing field for jsonl enumerator")
+		}
+		return &jsonlEnumerator{r: r, field: opts.field, rejects: rejects}, nil
+	case "list":
+		return &listEnumerator{r: r}, nil
+	case "report":
+		return &reportEnumerator{r: r, rejects: rejects}, nil
+	case "plan":
+		return &planEnumerator{r: r, rejects: rejects}, nil
+	}
+	return &autoEnumerator{r: r, rejects: rejects}, nil
+}
+
+// objFilter selects the objects produced by any enumerator
+type objFilter struct {
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+
+	excluded int
+}
+
+func newObjFilter(include, exclude string) (*objFilter, error) {
+	f := &objFilter{}
+	var err error
+	if include != "" {
+		if f.include, err = regexp.Compile(include); err != nil {
+			return nil, fmt.Errorf("invalid include pattern %s: %s", include, err.Error())
+		}
+	}
+	if exclude != "" {
+		if f.exclude, err = regexp.Compile(exclude); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %s: %s", exclude, err.Error())
+		}
+	}
+	return f, nil
+}
+
+func (t *objFilter) accept(key string) bool {
+	if (t.include != nil && !t.include.MatchString(key)) ||
+		(t.exclude != nil && t.exclude.MatchString(key)) {
+		log.Debugf("excluded object %s, skip", key)
+		t.excluded++
+		return false
+	}
+	return true
+}
+
+// filteredEnumerator applies a filter on top of another enumerator
+type filteredEnumerator struct {
+	enumerator
+	filter *objFilter
+}
+
+func (t *filteredEnumerator) enumerate(emit func(syncObjItem) bool) error {
+	err := t.enumerator.enumerate(func(item syncObjItem) bool {
+		return !t.filter.accept(item.key) || emit(item)
+	})
+	if t.filter.excluded > 0 {
+		log.Infof("Skipped %d excluded objects", t.filter.excluded)
+	}
+	return err
+}
+
+// shardEnumerator keeps the objects of one shard out of count, picked by
+// hash of the oid so every process of a sharded run gets a disjoint subset
+type shardEnumerator struct {
+	enumerator
+	index int
+	count int
+}
+
+// parseShard parses a "i/N" shard spec, i being 0-based
+func parseShard(spec string) (int, int, error) {
+	parts := strings.Split(spec, "/")
+	if len(parts) == 2 {
+		i, err1 := strconv.Atoi(parts[0])
+		n, err2 := strconv.Atoi(parts[1])
+		if err1 == nil && err2 == nil && n > 0 && i >= 0 && i < n {
+			return i, n, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid shard %s, expecting i/N with 0 <= i < N", spec)
+}
+
+func shardOf(key string, count int) int {
+	h := fnv.New64a()
+	h.Write([]byte(strings.TrimSpace(key)))
+	return int(h.Sum64() % uint64(count))
+}
+
+func (t *shardEnumerator) enumerate(emit func(syncObjItem) bool) error {
+	return t.enumerator.enumerate(func(item syncObjItem) bool {
+		return shardOf(item.key, t.count) != t.index || emit(item)
+	})
+}
+
+// enumerateItems passes the objects of enum to emit, skipping the empty
+// keys, and returns how many emit accepted. The enumeration stops at the
+// first object emit refuses.
+func enumerateItems(enum enumerator, emit func(syncObjItem) bool) (int, error) {
+	total := 0
+	err := enum.enumerate(func(item syncObjItem) bool {
+		item.key = strings.TrimSpace(item.key)
+		if item.key == "" {
+			log.Errorf("emtpy object name, skip")
+			return true
+		}
+		if !emit(item) {
+			return false
+		}
+		total++
+		return true
+	})
+	return total, err
+}
+
+// listEnumerator reads an oid list, one oid per line
+type listEnumerator struct {
+	r io.Reader
+}
+
+func (t *listEnumerator) enumerate(emit func(syncObjItem) bool) error {
+	if t.r == nil {
+		return fmt.Errorf("no oid file provided")
+	}
+	return readLinesUntil(t.r, func(line string) bool {
+		item, ok := parseListLine(line)
+		return !ok || emit(item)
+	})
+}
+
+func parseListLine(line string) (syncObjItem, bool) {
+	key := strings.TrimSpace(line)
+	return syncObjItem{key: key}, key != ""
+}
+
+// reportEnumerator reads a previous csv or jsonl report and retries what
+// isn't ok and verified
+type reportEnumerator struct {
+	r       io.Reader
+	rejects *rejectWriter
+}
+
+func (t *reportEnumerator) enumerate(emit func(syncObjItem) bool) error {
+	return readLinesUntil(t.r, func(line string) bool {
+		item, ok := t.parse(line)
+		return !ok || emit(item)
+	})
+}
+
+func (t *reportEnumerator) parse(line string) (syncObjItem, bool) {
+	if strings.TrimSpace(line) == "" {
+		return syncObjItem{}, false
+	}
+	//1577092932,ok,false,file_mpu10,7852f675-458e-49ea-a4b2-e8477b715d1b
+	// or {"run_id":...,"oid":"7852f675-...","status":"ok","verified":false,...}
+	e, _, err := parseAnyReportLine(line)
+	if err != nil {
+		t.rejects.reject(line, err)
+		return syncObjItem{}, false
+	}
+	// ok but unverified lines are mismatches of older runs
+	if e.status == "ok" && e.verified {
+		log.Debugf("migrated object %s, skip", e.key)
+		return syncObjItem{}, false
+	}
+	return syncObjItem{key: e.key, dests: failedDests(e.dests)}, true
+}
+
+// autoEnumerator reads an oid list, a previous report or a plan, the format
+// being decided by the first line
+type autoEnumerator struct {
+	r       io.Reader
+	rejects *rejectWriter
+}
+
+func (t *autoEnumerator) enumerate(emit func(syncObjItem) bool) error {
+	if t.r == nil {
+		return fmt.Errorf("no oid file provided")
+	}
+	var parse func(string) (syncObjItem, bool)
+	return readLinesUntil(t.r, func(line string) bool {
+		if parse == nil {
+			if strings.TrimSpace(line) == "" {
+				return true
+			}
+			if strings.HasPrefix(line, `{"type":`) {
+				log.Infof("Reading a plan")
+				parse = (&planEnumerator{rejects: t.rejects}).parse
+			} else if _, _, err := parseAnyReportLine(line); err == nil {
+				log.Infof("Reading a previous report")
+				parse = (&reportEnumerator{rejects: t.rejects}).parse
+			} else {
+				parse = parseListLine
+			}
+		}
+		item, ok := parse(line)
+		return !ok || emit(item)
+	})
+}
+
+// csvEnumerator selects one column of a csv or tsv file, column is either a
+// header name or a 1-based column index. Records are one line each.
+type csvEnumerator struct {
+	r       io.Reader
+	comma   rune
+	column  string
+	header  bool
+	rejects *rejectWriter
+}
+
+func (t *csvEnumerator) enumerate(emit func(syncObjItem) bool) error {
+	col := -1
+	if i, err := strconv.Atoi(t.column); err == nil {
+		if i < 1 {
+			return fmt.Errorf("invalid column index: %d", i)
+		}
+		col = i - 1
+	}
+	needHeader := col < 0 || t.header
+
+	return readLinesUntil(t.r, func(line string) bool {
+		if strings.TrimSpace(line) == "" {
+			return true
+		}
+		rd := csv.NewReader(strings.NewReader(line))
+		rd.Comma = t.comma
+		rd.LazyQuotes = t.comma == '\t'
+		record, err := rd.Read()
+		if err != nil {
+			t.rejects.reject(line, err)
+			return true
+		}
+		if needHeader {
+			needHeader = false
+			if col >= 0 {
+				return true
+			}
+			for i, h := range record {
+				if strings.TrimSpace(h) == t.column {
+					col = i
+					return true
+				}
+			}
+			// no way to go on, everything is rejected
+			t.rejects.reject(line, fmt.Errorf("column %s not found in header", t.column))
+			col = -1
+			return true
+		}
+		if col < 0 || col >= len(record) {
+			t.rejects.reject(line, fmt.Errorf("missing column %s", t.column))
+			return true
+		}
+		return emit(syncObjItem{key: record[col]})
+	})
+}
+
+// jsonlEnumerator reads one JSON document per line and picks the field at a
+// dotted path, e.g. "object.oid" or "replicas.0.oid"
+type jsonlEnumerator struct {
+	r       io.Reader
+	field   string
+	rejects *rejectWriter
+}
+
+func (t *jsonlEnumerator) enumerate(emit func(syncObjItem) bool) error {
+	path := strings.Split(t.field, ".")
+	return readLinesUntil(t.r, func(line string) bool {
+		if strings.TrimSpace(line) == "" {
+			return true
+		}
+		key, err := jsonField([]byte(line), path)
+		if err != nil {
+			t.rejects.reject(line, err)
+			return true
+		}
+		return emit(syncObjItem{key: key})
+	})
+}
+
+// jsonField returns the string or number at path in a JSON document
+func jsonField(data []byte, path []string) (string, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return "", err
+	}
+	for _, p := range path {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = c[p]; !ok {
+				return "", fmt.Errorf("field %s not found", p)
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(c) {
+				return "", fmt.Errorf("invalid index %s", p)
+			}
+			v = c[i]
+		default:
+			return "", fmt.Errorf("field %s not found", p)
+		}
+	}
+	switch s := v.(type) {
+	case string:
+		return s, nil
+	case json.Number:
+		return s.String(), nil
+	}
+	return "", fmt.Errorf("field %s is not a string", strings.Join(path, "."))
+}
+
+// sqlEnumerator runs a query against a database, the first column of every
+// row is the object name. driver is sqlite3 or postgres.
+type sqlEnumerator struct {
+	driver string
+	dsn    string
+	query  string
+}
+
+func (t *sqlEnumerator) enumerate(emit func(syncObjItem) bool) error {
+	db, err := sql.Open(t.driver, t.dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(t.query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]sql.RawBytes, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		if !emit(syncObjItem{key: string(values[0])}) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+// searchEnumerator pages through a wos metadata search service. Every page
+// is requested with the marker and limit query parameters and answered with
+// JSON lines, the marker being the last object of the previous page. A page
+// shorter than limit, in lines, ends the listing.
+type searchEnumerator struct {
+	url      string
+	field    string
+	pageSize int
+	rejects  *rejectWriter
+}
+
+func (t *searchEnumerator) enumerate(emit func(syncObjItem) bool) error {
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: 300 * time.Second}
+	path := strings.Split(t.field, ".")
+	marker := ""
+	rejected := map[string]bool{}
+	for {
+		q := u.Query()
+		q.Set("marker", marker)
+		q.Set("limit", strconv.Itoa(t.pageSize))
+		u.RawQuery = q.Encode()
+
+		resp, err := client.Get(u.String())
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return fmt.Errorf("search error: http failed code: %d", resp.StatusCode)
+		}
+		// the page is counted in raw lines, rejected ones included, and
+		// the marker is the last oid read. The rejected lines ending a
+		// page are served again after that marker, they're only rejected
+		// once.
+		start, n := marker, 0
+		tail := map[string]bool{}
+		stopped := false
+		err = readLinesUntil(resp.Body, func(line string) bool {
+			if strings.TrimSpace(line) == "" {
+				return true
+			}
+			n++
+			key, err := jsonField([]byte(line), path)
+			if err != nil {
+				if !rejected[line] {
+					t.rejects.reject(line, err)
+				}
+				tail[line] = true
+				return true
+			}
+			tail = map[string]bool{}
+			marker = key
+			stopped = !emit(syncObjItem{key: key})
+			return !stopped
+		})
+		resp.Body.Close()
+		rejected = tail
+		if err != nil || stopped {
+			return err
+		}
+		if n < t.pageSize {
+			return nil
+		}
+		if marker == start {
+			return fmt.Errorf("search error: no readable %s in the page after %q", t.field, start)
+		}
+	}
+}
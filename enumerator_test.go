@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func collectKeys(t *testing.T, enum enumerator) []string {
+	var keys []string
+	if err := enum.enumerate(func(item syncObjItem) bool {
+		keys = append(keys, item.key)
+		return true
+	}); err != nil {
+		t.Errorf("failed to enumerate: %s", err.Error())
+	}
+	return keys
+}
+
+func TestCSVEnumerator(t *testing.T) {
+	input := "name,oid,size\nf1,\"oid,1\",10\nf2,oid2,20\nbroken\n"
+	keys := collectKeys(t, &csvEnumerator{r: strings.NewReader(input), comma: ',', column: "oid"})
+	if want := []string{"oid,1", "oid2"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("csv keys got %v;want %v", keys, want)
+	}
+
+	input = "f1\toid1\nf2\toid2\n"
+	keys = collectKeys(t, &csvEnumerator{r: strings.NewReader(input), comma: '\t', column: "2"})
+	if want := []string{"oid1", "oid2"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("tsv keys got %v;want %v", keys, want)
+	}
+}
+
+func TestJSONLEnumerator(t *testing.T) {
+	input := `{"object":{"oid":"oid1"}}
+{"object":{"oid":"oid2","size":3}}
+not json
+{"object":{}}
+
+{"object":{"oid":"oid3"}}
+`
+	keys := collectKeys(t, &jsonlEnumerator{r: strings.NewReader(input), field: "object.oid"})
+	if want := []string{"oid1", "oid2", "oid3"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("jsonl keys got %v;want %v", keys, want)
+	}
+}
+
+func TestSQLEnumerator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlenum")
+	if err != nil {
+		t.Errorf("failed to create temp dir: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+	dsn := filepath.Join(dir, "app.db")
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Errorf("failed to open db: %s", err.Error())
+		return
+	}
+	for _, stmt := range []string{
+		"create table docs (id integer, oid text, deleted integer)",
+		"insert into docs values (1, 'oid1', 0), (2, 'oid2', 1), (3, 'oid3', 0)",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Errorf("failed to prepare db: %s", err.Error())
+			return
+		}
+	}
+	db.Close()
+
+	keys := collectKeys(t, &sqlEnumerator{
+		driver: "sqlite3",
+		dsn:    dsn,
+		query:  "select oid, id from docs where deleted = 0 order by id",
+	})
+	if want := []string{"oid1", "oid3"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("sql keys got %v;want %v", keys, want)
+	}
+}
+
+func TestSearchEnumerator(t *testing.T) {
+	oids := []string{"oid1", "oid2", "oid3", "oid4", "oid5"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		marker := r.URL.Query().Get("marker")
+		n := 0
+		for _, oid := range oids {
+			if oid <= marker || n >= limit {
+				continue
+			}
+			w.Write([]byte(`{"oid":"` + oid + `"}` + "\n"))
+			n++
+		}
+	}))
+	defer server.Close()
+
+	keys := collectKeys(t, &searchEnumerator{url: server.URL + "/search", field: "oid", pageSize: 2})
+	if !reflect.DeepEqual(keys, oids) {
+		t.Errorf("search keys got %v;want %v", keys, oids)
+	}
+
+	// the rejected lines count in their page, one ending a page being
+	// served again without being rejected twice
+	entries := []struct{ sort, line string }{
+		{"oid1", `{"oid":"oid1"}`},
+		{"oid2", `{"oid":"oid2"}`},
+		{"oid2a", `{"id":"oid2a"}`},
+		{"oid3", `{"oid":"oid3"}`},
+		{"oid4", `{"oid":"oid4"}`},
+		{"oid4a", `{"id":"oid4a"}`},
+		{"oid5", `{"oid":"oid5"}`},
+	}
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		marker := r.URL.Query().Get("marker")
+		n := 0
+		for _, e := range entries {
+			if e.sort <= marker || n >= limit {
+				continue
+			}
+			w.Write([]byte(e.line + "\n"))
+			n++
+		}
+	}))
+	defer server.Close()
+	rejects := newRejectWriter(nil)
+	keys = collectKeys(t, &searchEnumerator{url: server.URL + "/search", field: "oid", pageSize: 2, rejects: rejects})
+	if !reflect.DeepEqual(keys, oids) || rejects.rejected() != 2 {
+		t.Errorf("search keys got %v, %d rejected;want %v, 2 rejected", keys, rejects.rejected(), oids)
+	}
+}
+
+func TestFilteredEnumerator(t *testing.T) {
+	filter, err := newObjFilter("^oid", "tmp$")
+	if err != nil {
+		t.Errorf("failed to create filter: %s", err.Error())
+		return
+	}
+	input := "oid1\noid2\nx3\noid1\noid4.tmp\noid5\n"
+	keys := collectKeys(t, &filteredEnumerator{
+		enumerator: &listEnumerator{r: strings.NewReader(input)},
+		filter:     filter,
+	})
+	if want := []string{"oid1", "oid2", "oid1", "oid5"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("filtered keys got %v;want %v", keys, want)
+	}
+	if filter.excluded != 2 {
+		t.Errorf("filter excluded got %d;want 2", filter.excluded)
+	}
+}
+
+func TestPrescan(t *testing.T) {
+	DedupPartitions = 4
+	defer func() { DedupPartitions = 256 }()
+
+	var input strings.Builder
+	var want []string
+	for i := 0; i < 100; i++ {
+		oid := fmt.Sprintf("%032x", i)
+		want = append(want, oid)
+		fmt.Fprintln(&input, oid)
+		if i%10 == 0 {
+			fmt.Fprintln(&input, oid)
+		}
+	}
+	input.WriteString("not-an-oid\n")
+	input.WriteString("0000\x01\n")
+
+	var rejected bytes.Buffer
+	spool, stats, err := prescan(&listEnumerator{r: strings.NewReader(input.String())},
+		prescanOptions{dedup: true, pattern: regexp.MustCompile("^[0-9a-f]{32}$")},
+		newRejectWriter(&rejected))
+	if err != nil {
+		t.Errorf("failed to prescan: %s", err.Error())
+		return
+	}
+	defer spool.Close()
+
+	if stats != (prescanStats{total: 112, invalid: 2, duplicates: 10, queued: 100}) {
+		t.Errorf("unexpected prescan stats: %+v", stats)
+	}
+	if rejected.String() != "not-an-oid\n0000\x01\n" {
+		t.Errorf("unexpected rejects: %q", rejected.String())
+	}
+	keys := collectKeys(t, spool)
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("prescanned keys got %v;want %v", keys, want)
+	}
+}
+
+func TestReportEnumerator(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	(&syncResult{oldKey: "oid,1", err: errors.New("read error: a, b")}).record(w)
+	(&syncResult{oldKey: "oid2", verified: true}).record(w)
+	(&syncResult{oldKey: `oid"3`, err: errors.New("EOF")}).record(w)
+	buf.WriteString("garbage line\n")
+	buf.WriteString("1577358017,ok,false,oid5\n")
+	buf.WriteString("1577358017,fail,false,oid4")
+
+	var rejected bytes.Buffer
+	rejects := newRejectWriter(&rejected)
+	keys := collectKeys(t, &reportEnumerator{r: &buf, rejects: rejects})
+	if want := []string{"oid,1", `oid"3`, "oid5", "oid4"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("report keys got %v;want %v", keys, want)
+	}
+	if rejects.rejected() != 1 || rejected.String() != "garbage line\n" {
+		t.Errorf("unexpected rejects: %d %q", rejects.rejected(), rejected.String())
+	}
+
+	// a jsonl report, found by the auto enumerator too
+	buf.Reset()
+	jw := &jsonReporter{w: bufio.NewWriter(&buf)}
+	jw.record(&syncResult{oldKey: "oid1", err: errors.New("EOF")})
+	jw.record(&syncResult{oldKey: "oid2", verified: true})
+	jw.record(&syncResult{oldKey: "oid3"})
+	jw.record(&syncResult{oldKey: "oid4", verified: true, dests: []destResult{
+		{name: "0", status: destOK}, {name: "1", status: destFail}}, err: errors.New("quorum policy not met")})
+	var retried []syncObjItem
+	err := (&autoEnumerator{r: &buf, rejects: rejects}).enumerate(func(item syncObjItem) bool {
+		retried = append(retried, item)
+		return true
+	})
+	if err != nil {
+		t.Errorf("failed to read jsonl report: %s", err.Error())
+		return
+	}
+	if len(retried) != 3 || retried[0].key != "oid1" || retried[1].key != "oid3" ||
+		retried[2].key != "oid4" || !reflect.DeepEqual(retried[2].dests, []string{"1"}) {
+		t.Errorf("unexpected jsonl retries: %+v", retried)
+	}
+
+	e, err := parseReportLine(`1577358017,fail,false,"a,""b",0=ok:abc;1=fail,quorum policy not met (1/2): 1: x, y`)
+	if err != nil {
+		t.Errorf("failed to parse report line: %s", err.Error())
+		return
+	}
+	if e.key != `a,"b` || len(e.dests) != 2 || e.errMsg != "quorum policy not met (1/2): 1: x, y" {
+		t.Errorf("unexpected report entry: %+v", e)
+	}
+}
+
+func TestCSVEnumeratorRejects(t *testing.T) {
+	input := "name,oid\nf1,oid1\nf2,\"oid2\nf3\nf4,oid4\n"
+	var rejected bytes.Buffer
+	keys := collectKeys(t, &csvEnumerator{r: strings.NewReader(input), comma: ',',
+		column: "oid", rejects: newRejectWriter(&rejected)})
+	if want := []string{"oid1", "oid4"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("csv keys got %v;want %v", keys, want)
+	}
+	if rejected.String() != "f2,\"oid2\nf3\n" {
+		t.Errorf("unexpected rejects: %q", rejected.String())
+	}
+}
+
+func TestOpenCompressedInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "input")
+	if err != nil {
+		t.Errorf("failed to create temp dir: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	content := "oid1\noid2\noid3"
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(content))
+	gw.Close()
+	var zs bytes.Buffer
+	zw, _ := zstd.NewWriter(&zs)
+	zw.Write([]byte(content))
+	zw.Close()
+
+	for name, data := range map[string][]byte{
+		"plain": []byte(content),
+		"gzip":  gz.Bytes(),
+		"zstd":  zs.Bytes(),
+	} {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, data, 0644)
+		in, err := openInput(path)
+		if err != nil {
+			t.Errorf("failed to open %s input: %s", name, err.Error())
+			continue
+		}
+		keys := collectKeys(t, &autoEnumerator{r: in})
+		in.Close()
+		if want := []string{"oid1", "oid2", "oid3"}; !reflect.DeepEqual(keys, want) {
+			t.Errorf("%s keys got %v;want %v", name, keys, want)
+		}
+	}
+}
+
+func TestShardEnumerator(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&input, "oid%d\n", i)
+	}
+
+	seen := map[string]int{}
+	for i := 0; i < 3; i++ {
+		keys := collectKeys(t, &shardEnumerator{
+			enumerator: &listEnumerator{r: strings.NewReader(input.String())},
+			index:      i,
+			count:      3,
+		})
+		if len(keys) < 250 {
+			t.Errorf("shard %d got only %d objects", i, len(keys))
+		}
+		for _, k := range keys {
+			seen[k]++
+		}
+	}
+	if len(seen) != 1000 {
+		t.Errorf("shards cover %d objects;want 1000", len(seen))
+	}
+	for k, n := range seen {
+		if n != 1 {
+			t.Errorf("object %s in %d shards", k, n)
+		}
+	}
+
+	for _, spec := range []string{"3/3", "-1/3", "1", "a/b", "0/0"} {
+		if _, _, err := parseShard(spec); err == nil {
+			t.Errorf("shard %s should be invalid", spec)
+		}
+	}
+}
@@ -7,7 +7,11 @@ require (
 	github.com/google/uuid v1.1.1
 	github.com/jmespath/go-jmespath v0.3.0 // indirect
 	github.com/johannesboyne/gofakes3 v0.0.0-20191029185751-e238f04965fe
+	github.com/klauspost/compress v1.10.3
+	github.com/lib/pq v1.3.0
+	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/sirupsen/logrus v1.4.2
+	gopkg.in/yaml.v2 v2.2.2
 )
 
 replace github.com/johannesboyne/gofakes3 => github.com/mars4myshare/gofakes3 v0.0.0-20191226083417-0737d882e413
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"s3sync/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// inflightObject is an object being migrated
+type inflightObject struct {
+	// read counts the bytes transferred, atomically updated
+	read int64
+
+	OID     string    `json:"oid"`
+	Worker  string    `json:"worker"`
+	Attempt int       `json:"attempt"`
+	Phase   string    `json:"phase"`
+	Start   time.Time `json:"start"`
+	Bytes   int64     `json:"bytes"`
+
+	key    inflightKey
+	source storage.StorSrc
+	ctx    context.Context
+	cancel func()
+	// reason tells why the watchdog cancelled the transfer
+	reason string
+	// samples are the byte counts seen by the watchdog, the oldest first
+	samples []progressSample
+}
+
+// inflightKey identifies a transfer, an oid being migrated at once by two
+// runs of the process or to two destinations
+type inflightKey struct {
+	run  *runControl
+	dest storage.StorDest
+	oid  string
+}
+
+// uses tells whether the storage s makes the requests of the transfer, as
+// its source or one of its destinations
+func (t *inflightObject) uses(s interface{}) bool {
+	if s == interface{}(t.source) || s == interface{}(t.key.dest) {
+		return true
+	}
+	if multi, ok := t.key.dest.(*storage.MultiStorage); ok {
+		for _, d := range multi.Dests {
+			if s == interface{}(d) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type progressSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// inflightRegistry tracks the objects being migrated, correlating the log
+// entries about an object with its worker and attempt, and letting the
+// watchdog of their run cancel their transfers
+type inflightRegistry struct {
+	sync.Mutex
+	objects map[inflightKey]*inflightObject
+}
+
+var inflight = &inflightRegistry{objects: map[inflightKey]*inflightObject{}}
+
+// start registers the transfer of oid from source to dest by run, the last
+// registration of an oid migrated twice at once by a run taking over
+func (t *inflightRegistry) start(run *runControl, dest storage.StorDest, source storage.StorSrc,
+	oid, worker string, attempt int) *inflightObject {
+	t.Lock()
+	defer t.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &inflightObject{
+		OID:     oid,
+		Worker:  worker,
+		Attempt: attempt,
+		Start:   time.Now(),
+		key:     inflightKey{run: run, dest: dest, oid: oid},
+		source:  source,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	t.objects[o.key] = o
+	return o
+}
+
+// phase sets the phase of o, a nil o being an object not tracked
+func (t *inflightRegistry) phase(o *inflightObject, phase string) {
+	if o == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	o.Phase = phase
+}
+
+// retry sets the attempt of o copied again
+func (t *inflightRegistry) retry(o *inflightObject, attempt int) {
+	if o == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	o.Attempt = attempt
+}
+
+// done forgets o, returning why its transfer was cancelled if it was
+func (t *inflightRegistry) done(o *inflightObject) string {
+	t.Lock()
+	defer t.Unlock()
+	o.cancel()
+	if t.objects[o.key] == o {
+		delete(t.objects, o.key)
+	}
+	return o.reason
+}
+
+// snapshot returns the objects being migrated by run, the oldest first
+func (t *inflightRegistry) snapshot(run *runControl) []inflightObject {
+	t.Lock()
+	objs := make([]inflightObject, 0, len(t.objects))
+	for k, o := range t.objects {
+		if k.run != run {
+			continue
+		}
+		objs = append(objs, inflightObject{
+			OID:     o.OID,
+			Worker:  o.Worker,
+			Attempt: o.Attempt,
+			Phase:   o.Phase,
+			Start:   o.Start,
+			Bytes:   atomic.LoadInt64(&o.read),
+		})
+	}
+	t.Unlock()
+	sort.Slice(objs, func(i, j int) bool {
+		return objs[i].Start.Before(objs[j].Start)
+	})
+	return objs
+}
+
+// logger returns a log entry with the fields of the transfer o of oid
+func (t *inflightRegistry) logger(o *inflightObject, oid string) *log.Entry {
+	fields := log.Fields{"oid": oid}
+	if o != nil {
+		t.Lock()
+		fields["worker"] = o.Worker
+		fields["attempt"] = o.Attempt
+		t.Unlock()
+	}
+	return log.WithFields(fields)
+}
+
+// find returns the transfer the storage s requests key for, nil when none.
+// key is either an oid or an s3 key, must be called with the lock held.
+func (t *inflightRegistry) find(s interface{}, key string) *inflightObject {
+	oid := key
+	if KeyPrefix != "" && strings.HasPrefix(key, KeyPrefix) {
+		oid = strings.TrimPrefix(key, KeyPrefix)
+	}
+	var found *inflightObject
+	for k, o := range t.objects {
+		if (k.oid == key || k.oid == oid) && o.uses(s) {
+			// the oid itself wins over an oid found by its key prefix
+			if k.oid == key {
+				return o
+			}
+			found = o
+		}
+	}
+	return found
+}
+
+// requestLogger returns the log entry of the request of the storage s about
+// key, a wos oid or an s3 key
+func (t *inflightRegistry) requestLogger(s interface{}, key string) *log.Entry {
+	t.Lock()
+	o := t.find(s, key)
+	t.Unlock()
+	if o == nil {
+		return log.WithField("oid", key)
+	}
+	l := t.logger(o, o.OID)
+	if o.OID != key {
+		l = l.WithField("key", key)
+	}
+	return l
+}
+
+// context returns the context of the request of the storage s about key,
+// cancelled with the transfer of its object
+func (t *inflightRegistry) context(s interface{}, key string) context.Context {
+	t.Lock()
+	defer t.Unlock()
+	if o := t.find(s, key); o != nil {
+		return o.ctx
+	}
+	return context.Background()
+}
+
+// watch counts the bytes read from obj as the progress of o
+func (t *inflightRegistry) watch(o *inflightObject, obj storage.SyncObject) storage.SyncObject {
+	if o == nil {
+		return obj
+	}
+	return &watchedObject{SyncObject: obj, body: &progressReader{ReadCloser: obj.GetBody(), o: o}}
+}
+
+// cancel cancels the transfer o for reason
+func (t *inflightRegistry) cancel(o *inflightObject, reason string) {
+	t.Lock()
+	defer t.Unlock()
+	if o.reason == "" {
+		o.reason = reason
+		o.cancel()
+	}
+}
+
+// cancelRun cancels the transfers of run for reason
+func (t *inflightRegistry) cancelRun(run *runControl, reason string) {
+	t.Lock()
+	defer t.Unlock()
+	for k, o := range t.objects {
+		if k.run == run && o.reason == "" {
+			o.reason = reason
+			o.cancel()
+		}
+	}
+}
+
+type watchedObject struct {
+	storage.SyncObject
+	body io.ReadCloser
+}
+
+func (t *watchedObject) GetBody() io.ReadCloser {
+	return t.body
+}
+
+func (t *watchedObject) GetMetadata() map[string]string {
+	return storage.Metadata(t.SyncObject)
+}
+
+type progressReader struct {
+	io.ReadCloser
+	o *inflightObject
+}
+
+func (t *progressReader) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	atomic.AddInt64(&t.o.read, int64(n))
+	return n, err
+}
+
+func init() {
+	storage.ObjectContext = inflight.context
+}
+
+// runObject migrates, or plans, an object on behalf of a worker of run, nil
+// for a distributed worker. A transfer cancelled by the watchdog fails with
+// errClassStalled.
+func runObject(run *runControl, worker string, item syncObjItem, dest storage.StorDest, source storage.StorSrc) syncResult {
+	o := inflight.start(run, dest, source, item.key, worker, item.attempts+1)
+	item.transfer = o
+	var r syncResult
+	if DryRun {
+		r = planObject(item, dest, source)
+	} else {
+		r = syncObject(item, dest, source)
+	}
+	if reason := inflight.done(o); reason != "" && r.err != nil {
+		r.errClass = errClassStalled
+		r.verified = false
+		r.err = &stalledError{reason: reason, err: r.err}
+	}
+	r.worker = worker
+	return r
+}
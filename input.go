@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// input is an opened input file, decompressed if needed
+type input struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (t *input) Close() error {
+	var err error
+	for i := len(t.closers) - 1; i >= 0; i-- {
+		if e := t.closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// openInput opens path, "-" being stdin. gzip and zstd compressed content is
+// detected by its magic number and decompressed transparently.
+func openInput(path string) (*input, error) {
+	in := &input{}
+	var r io.Reader
+	if path == "-" {
+		r = os.Stdin
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %s", path, err.Error())
+		}
+		in.closers = append(in.closers, f)
+		r = f
+	}
+
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	format := compression(magic)
+	if format == "" {
+		in.Reader = br
+		return in, nil
+	}
+	zr, err := decompress(format, br)
+	if err != nil {
+		in.Close()
+		return nil, fmt.Errorf("failed to read %s %s: %s", format, path, err.Error())
+	}
+	in.closers = append(in.closers, zr)
+	in.Reader = zr
+	return in, nil
+}
+
+// compression returns the format of content starting with magic, gzip or
+// zstd, empty when it isn't compressed
+func compression(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(magic, zstdMagic):
+		return "zstd"
+	}
+	return ""
+}
+
+// decompress returns a reader of the content of r compressed with format
+func decompress(format string, r io.Reader) (io.ReadCloser, error) {
+	switch format {
+	case "gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr, nil
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown compression: %s", format)
+}
+
+// readLines calls fn for every line of r, the trailing newline removed. The
+// last line is returned even without a newline.
+func readLines(r io.Reader, fn func(line string)) error {
+	return readLinesUntil(r, func(line string) bool {
+		fn(line)
+		return true
+	})
+}
+
+// readLinesUntil is readLines stopping once fn returns false
+func readLinesUntil(r io.Reader, fn func(line string) bool) error {
+	rd := bufio.NewReader(r)
+	for {
+		line, err := rd.ReadString('\n')
+		if line != "" && !fn(strings.TrimRight(line, "\r\n")) {
+			return nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rejectWriter collects the input lines that couldn't be parsed, writing them
+// as is to the reject file when there is one
+type rejectWriter struct {
+	sync.Mutex
+	w     *bufio.Writer
+	count int
+	// kept holds the first SummaryRejects rejected lines and reasons
+	kept []string
+}
+
+func newRejectWriter(w io.Writer) *rejectWriter {
+	r := &rejectWriter{}
+	if w != nil {
+		r.w = bufio.NewWriter(w)
+	}
+	return r
+}
+
+func (t *rejectWriter) reject(line string, reason error) {
+	log.Errorf("rejected input %s: %s", line, reason.Error())
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.count++
+	if len(t.kept) < SummaryRejects {
+		t.kept = append(t.kept, fmt.Sprintf("%s: %s", line, reason.Error()))
+	}
+	if t.w != nil {
+		t.w.WriteString(line + "\n")
+		t.w.Flush()
+	}
+}
+
+func (t *rejectWriter) rejected() int {
+	if t == nil {
+		return 0
+	}
+	t.Lock()
+	defer t.Unlock()
+	return t.count
+}
+
+// lines returns the kept rejected lines with their reasons
+func (t *rejectWriter) lines() []string {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	return append([]string{}, t.kept...)
+}
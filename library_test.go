@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"s3sync/storage"
+)
+
+func TestStorageLibrary(t *testing.T) {
+	wos := setupWosServer(t, []string{"k0", "k1"})
+	defer wos.Close()
+	src, err := storage.Open("wos://" + strings.TrimPrefix(wos.URL, "http://"))
+	if err != nil {
+		t.Errorf("failed to open wos: %s", err.Error())
+		return
+	}
+	w, ok := src.(*storage.WosStorage)
+	if !ok {
+		t.Errorf("unexpected wos storage: %T", src)
+		return
+	}
+	info, err := w.Stat("k0")
+	if err != nil || info.Size != int64(len("k0 content")) || info.ContentType != "application/octet-stream" ||
+		!reflect.DeepEqual(info.Metadata, map[string]string{"oid": "k0"}) {
+		t.Errorf("unexpected stat: %+v, %v", info, err)
+	}
+	if ok, err := w.Exists("k0"); !ok || err != nil {
+		t.Errorf("k0 not found: %v", err)
+	}
+	if ok, err := w.Exists("missing"); ok || err != nil {
+		t.Errorf("missing found: %v", err)
+	}
+	_, err = w.Read("missing")
+	var wosErr *storage.WosStatusError
+	if !errors.Is(err, storage.ErrNotFound) || !errors.As(err, &wosErr) || wosErr.Code() != "205" {
+		t.Errorf("unexpected error of a missing object: %v", err)
+	}
+	if err := w.Delete("k1"); err != nil {
+		t.Errorf("failed to delete k1: %s", err.Error())
+	}
+	if ok, _ := w.Exists("k1"); ok {
+		t.Errorf("k1 not deleted")
+	}
+	if _, ok := src.(storage.Lister); ok {
+		t.Errorf("wos can't list")
+	}
+
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	dst, err := storage.Open("s3://u1:s1@" + bucket + "?endpoint=" + s3Server.URL)
+	if err != nil {
+		t.Errorf("failed to open s3: %s", err.Error())
+		return
+	}
+	s, ok := dst.(*storage.S3Storage)
+	if !ok {
+		t.Errorf("unexpected s3 storage: %T", dst)
+		return
+	}
+	for _, key := range []string{"a/1", "a/2", "a/3", "b/1"} {
+		if _, err := s.Write(key, &memObject{data: []byte(key)}); err != nil {
+			t.Errorf("failed to write %s: %s", key, err.Error())
+			return
+		}
+	}
+	var keys []string
+	err = s.List("a/", "a/1", func(key string, info *storage.ObjectInfo) bool {
+		keys = append(keys, key)
+		return info.Size == 3 && len(keys) < 2
+	})
+	if err != nil || !reflect.DeepEqual(keys, []string{"a/2", "a/3"}) {
+		t.Errorf("unexpected listing: %v, %v", keys, err)
+	}
+
+	if err := s.Copy("a/1", "c/1", map[string]string{"k": "v"}); err != nil {
+		t.Errorf("failed to copy: %s", err.Error())
+		return
+	}
+	info, err = s.Stat("c/1")
+	if err != nil || info.Size != 3 || info.Metadata["k"] != "v" {
+		t.Errorf("unexpected copy: %+v, %v", info, err)
+	}
+	if err := s.Copy("missing", "c/2", nil); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("unexpected copy of a missing object: %v", err)
+	}
+	if err := s.Delete("c/1"); err != nil {
+		t.Errorf("failed to delete: %s", err.Error())
+	}
+	if ok, err := s.Exists("c/1"); ok || err != nil {
+		t.Errorf("c/1 not deleted: %v", err)
+	}
+	_, err = s.Read("c/1")
+	if !errors.Is(err, storage.ErrNotFound) || errorCode(err) != "NoSuchKey" {
+		t.Errorf("unexpected error of a missing object: %v", err)
+	}
+	obj, err := s.Read("b/1")
+	if err != nil {
+		t.Errorf("failed to read b/1: %s", err.Error())
+		return
+	}
+	if data, _ := ioutil.ReadAll(obj.GetBody()); string(data) != "b/1" {
+		t.Errorf("unexpected content: %q", data)
+	}
+
+	ak, sk := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	defer func() {
+		os.Setenv("AWS_ACCESS_KEY_ID", ak)
+		os.Setenv("AWS_SECRET_ACCESS_KEY", sk)
+	}()
+	os.Unsetenv("AWS_ACCESS_KEY_ID")
+	os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	for _, spec := range []string{"ftp://host", "wos://", "s3://", "s3://" + bucket, "%"} {
+		if _, err := storage.Open(spec); err == nil {
+			t.Errorf("%s opened", spec)
+		}
+	}
+	os.Setenv("AWS_ACCESS_KEY_ID", "u1")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "s1")
+	if st, err := storage.Open("s3://" + bucket + "?region=eu-west-1"); err != nil ||
+		*st.(*storage.S3Storage).Config.Region != "eu-west-1" {
+		t.Errorf("failed to open s3 with the environment credentials: %v", err)
+	}
+	if schemes := storage.Schemes(); !reflect.DeepEqual(schemes, []string{"s3", "wos"}) {
+		t.Errorf("unexpected schemes: %v", schemes)
+	}
+}
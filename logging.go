@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"s3sync/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// phaseFields are the fields of a log entry ending a phase, the duration
+// being in seconds
+func phaseFields(phase string, bytes int64, d time.Duration) log.Fields {
+	return log.Fields{"phase": phase, "bytes": bytes, "duration": d.Seconds()}
+}
+
+// runIDHook adds the run id to every log entry
+type runIDHook struct{}
+
+func (runIDHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (runIDHook) Fire(e *log.Entry) error {
+	if _, ok := e.Data["run_id"]; !ok {
+		e.Data["run_id"] = runID
+	}
+	return nil
+}
+
+func init() {
+	log.AddHook(runIDHook{})
+	storage.ObjectLogger = inflight.requestLogger
+}
+
+type logOptions struct {
+	format  string
+	file    string
+	maxSize int64
+	maxAge  time.Duration
+	backups int
+}
+
+// setupLogging sets the log format and output
+func setupLogging(o logOptions) error {
+	switch o.format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format: %s", o.format)
+	}
+	if o.file == "" {
+		log.SetOutput(os.Stdout)
+		return nil
+	}
+	w, err := newRotatingWriter(o.file, o.maxSize<<20, o.maxAge, o.backups)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(w)
+	return nil
+}
+
+// rotatingWriter writes a log file, renaming it with a timestamp suffix when
+// it grows over maxSize bytes or gets older than maxAge, and keeping the last
+// backups renamed files. Zero disables each limit.
+type rotatingWriter struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	backups int
+
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingWriter(path string, maxSize int64, maxAge time.Duration, backups int) (*rotatingWriter, error) {
+	w := &rotatingWriter{path: path, maxSize: maxSize, maxAge: maxAge, backups: backups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (t *rotatingWriter) open() error {
+	f, err := os.OpenFile(t.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file(%s): %s", t.path, err.Error())
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	t.f = f
+	t.size = info.Size()
+	t.opened = time.Now()
+	return nil
+}
+
+func (t *rotatingWriter) Write(p []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.size > 0 && ((t.maxSize > 0 && t.size+int64(len(p)) > t.maxSize) ||
+		(t.maxAge > 0 && time.Since(t.opened) > t.maxAge)) {
+		if err := t.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate log file %s: %s\n", t.path, err.Error())
+		}
+	}
+	n, err := t.f.Write(p)
+	t.size += int64(n)
+	return n, err
+}
+
+func (t *rotatingWriter) rotate() error {
+	t.f.Close()
+	backup := t.path + "." + time.Now().Format(backupLayout)
+	if err := os.Rename(t.path, backup); err != nil {
+		if oerr := t.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	if err := t.open(); err != nil {
+		return err
+	}
+	if t.backups <= 0 {
+		return nil
+	}
+	old, err := t.listBackups()
+	if err != nil {
+		return err
+	}
+	for len(old) > t.backups {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+	return nil
+}
+
+// backupLayout is the timestamp suffix of the renamed files
+const backupLayout = "20060102T150405.000000000"
+
+// listBackups returns the files renamed by rotate, oldest first, leaving out
+// the other files named after the log
+func (t *rotatingWriter) listBackups() ([]string, error) {
+	dir, base := filepath.Split(t.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), base+".") {
+			continue
+		}
+		suffix := strings.TrimPrefix(e.Name(), base+".")
+		if _, err := time.Parse(backupLayout, suffix); err != nil || len(suffix) != len(backupLayout) {
+			continue
+		}
+		backups = append(backups, filepath.Join(dir, e.Name()))
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func (t *rotatingWriter) Close() error {
+	t.Lock()
+	defer t.Unlock()
+	return t.f.Close()
+}
+
+var _ io.WriteCloser = (*rotatingWriter)(nil)
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"s3sync/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestObjectLogFields(t *testing.T) {
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	wos := setupWosServer(t, []string{"k1", "k2"})
+	defer wos.Close()
+
+	var out bytes.Buffer
+	log.SetFormatter(&log.JSONFormatter{})
+	log.SetOutput(&out)
+	log.SetLevel(log.DebugLevel)
+	KeyPrefix = "p/"
+	defer func() {
+		log.SetFormatter(&log.TextFormatter{})
+		log.SetOutput(os.Stdout)
+		log.SetLevel(log.InfoLevel)
+		KeyPrefix = ""
+	}()
+
+	dest := storage.NewS3Storage(s3Server.URL, "u1", "s1", bucket)
+	source := storage.NewWosStorage(strings.TrimPrefix(wos.URL, "http://"))
+	migrate(dest, source, &csvReporter{w: bufio.NewWriter(&memWriter{})},
+		&listEnumerator{r: strings.NewReader("k1\nk2\n")})
+	log.SetOutput(os.Stdout)
+
+	messages := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Errorf("invalid json log line %q: %s", line, err.Error())
+			return
+		}
+		if e["run_id"] != runID {
+			t.Errorf("missing run id: %s", line)
+			return
+		}
+		if e["oid"] == nil {
+			continue
+		}
+		if e["worker"] == nil || e["attempt"] != float64(1) {
+			t.Errorf("missing object fields: %s", line)
+			return
+		}
+		if e["duration"] != nil && (e["phase"] == nil || e["bytes"] == nil) {
+			t.Errorf("missing phase fields: %s", line)
+			return
+		}
+		messages[e["msg"].(string)]++
+	}
+	for _, msg := range []string{"retrieved object", "wos get headers", "uploaded", "verified object"} {
+		if messages[msg] != 2 {
+			t.Errorf("want 2 %q log entries, got %d", msg, messages[msg])
+		}
+	}
+}
+
+func TestRotatingWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3sync-log")
+	if err != nil {
+		t.Errorf("failed to create temp dir: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "s3sync.log")
+	// a file named after the log is not a backup
+	if err := ioutil.WriteFile(path+".csv", []byte("report"), 0644); err != nil {
+		t.Errorf("failed to write report: %s", err.Error())
+		return
+	}
+	w, err := newRotatingWriter(path, 10, 0, 2)
+	if err != nil {
+		t.Errorf("failed to open log file: %s", err.Error())
+		return
+	}
+	for _, line := range []string{"line one\n", "line two\n", "line three\n", "line four\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Errorf("failed to write log: %s", err.Error())
+			return
+		}
+	}
+	w.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil || string(data) != "line four\n" {
+		t.Errorf("unexpected log file: %q, %v", data, err)
+		return
+	}
+	backups, _ := filepath.Glob(path + ".2*")
+	if len(backups) != 2 {
+		t.Errorf("want 2 backups, got %v", backups)
+		return
+	}
+	data, _ = ioutil.ReadFile(backups[1])
+	if string(data) != "line three\n" {
+		t.Errorf("unexpected last backup: %q", data)
+		return
+	}
+	if data, err := ioutil.ReadFile(path + ".csv"); err != nil || string(data) != "report" {
+		t.Errorf("unrelated file pruned: %q, %v", data, err)
+	}
+}
@@ -2,74 +2,503 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
 	"s3sync/storage"
-	"strconv"
+	"strings"
 
+	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	SyncWorkerCnt = 16
 	ListPageSize  = 1000
+
+	// runID identifies this run in the reports
+	runID = uuid.New().String()
 )
 
 func main() {
-	ak := flag.String("ak", "", "access key")
-	sk := flag.String("sk", "", "secret key")
-	endpoint := flag.String("endpoint", "", "secret key")
-	bucket := flag.String("bucket", "", "source bucket")
-	wosHost := flag.String("wos", "", "dest storage")
-	reportFile := flag.String("report", "", "sync report")
-	oidFile := flag.String("oidfile", "", "oid file or previous report file when retry")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "report":
+			reportCommand(os.Args[2:])
+			return
+		case "coordinator":
+			coordinatorCommand(os.Args[2:])
+			return
+		case "worker":
+			workerCommand(os.Args[2:])
+			return
+		case "audit":
+			auditCommand(os.Args[2:])
+			return
+		case "delete":
+			deleteCommand(os.Args[2:])
+			return
+		case "config":
+			configCommand(os.Args[2:])
+			return
+		case "decrypt":
+			decryptCommand(os.Args[2:])
+			return
+		case "check":
+			checkCommand(os.Args[2:])
+			return
+		}
+	}
+
+	opts := addRunFlags(flag.CommandLine)
 	flag.Parse()
-	if *ak == "" ||
-		*sk == "" ||
-		*endpoint == "" ||
-		*bucket == "" ||
-		*wosHost == "" ||
-		*oidFile == "" ||
-		*reportFile == "" {
+	if err := opts.cfg.load(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := opts.validate(); err != nil {
+		flag.Usage()
+		log.Fatal(err.Error())
+	}
+	storOpts := opts.stor
+
+	enum, err := newEnumerator(opts.enum)
+	if err != nil {
 		flag.Usage()
-		log.Fatal("missing access key, secret key, endpoint, bucket, dest host, oid list or report file")
+		log.Fatal(err.Error())
+	}
+	defer enum.Close()
+
+	ctl := newRunControl(SyncWorkerCnt)
+	if opts.adminListen != "" {
+		defer serveAdmin(opts.adminListen, ctl)()
+	}
+	defer startWatchdog(opts.watchdog, ctl)()
+
+	if DryRun {
+		PlanThroughput = opts.throughput * 1024 * 1024
+		runPlan(ctl, storOpts, opts.planFile, enum)
+		return
 	}
 
-	file, err := os.OpenFile(*reportFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	file, err := os.OpenFile(opts.reportFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Fatalf("failed to open report file(%s): %s", *reportFile, err.Error())
+		log.Fatalf("failed to open report file(%s): %s", opts.reportFile, err.Error())
 	}
-	reportWriter := bufio.NewWriter(file)
 	defer file.Close()
-	log.Infof("Migrating data from %s to %s/%s with %d worker...",
-		*wosHost, *endpoint, *bucket, SyncWorkerCnt)
-	dest := storage.NewS3Storage(*endpoint, *ak, *sk, *bucket)
-	source := storage.NewWosStorage(*wosHost)
+	rep, err := newReporter(opts.reportFormat, bufio.NewWriter(file))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Infof("Migrating data from %s to %s with %d worker...",
+		storOpts.sourceName(), storOpts.destName(), SyncWorkerCnt)
+	dest, err := storOpts.dest()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	source, err := storOpts.source()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if !opts.preflight.skip {
+		dirs := append(fileDirs(opts.reportFile, opts.statePath, opts.summaryFile), spoolDirs(opts.enum)...)
+		checks := runPreflight(opts.preflight, opts.enum, source, dest, dirs)
+		checks.log()
+		if n := checks.failed(); n > 0 {
+			log.Fatalf("%d pre-flight checks failed, -nopreflight skips them", n)
+		}
+	}
+	setContentPrefix(dest)
+	setProtection(dest)
+	if opts.statePath != "" {
+		store, err := openStateStore(opts.statePath)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		defer store.Close()
+		rep = &stateReporter{reporter: rep, store: store}
+	}
+	log.Infof("Run %s", runID)
+	notes, notifyEnd := startNotifications(opts.notify, ctl, fmt.Sprintf("migrating data from %s to %s",
+		storOpts.sourceName(), storOpts.destName()))
+	if notes != nil {
+		rep = &notifyReporter{reporter: rep, n: notes, ctl: ctl}
+	}
+	summary := newSummaryReporter(rep)
+	err = runMigration(ctl, dest, source, summary, enum)
+	notifyEnd()
+	writeSummary(summary.summary(enum.rejects, enum.prescan), opts.summaryFile)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if reason := ctl.status().Aborted; reason != "" {
+		log.Fatalf("migration aborted: %s", reason)
+	}
+}
+
+// runOptions configures a migration run
+type runOptions struct {
+	cfg          *settings
+	stor         storOptions
+	enum         enumOptions
+	reportFile   string
+	reportFormat string
+	planFile     string
+	throughput   float64
+	statePath    string
+	summaryFile  string
+	adminListen  string
+	notify       notifyOptions
+	watchdog     watchdogOptions
+	encryption   encryptionOptions
+	preflight    preflightOptions
+}
 
-	oidFH, err := os.Open(*oidFile)
+func addRunFlags(fs *flag.FlagSet) *runOptions {
+	o := &runOptions{cfg: addConfigFlags(fs)}
+	addStorFlags(fs, &o.stor)
+	fs.StringVar(&o.reportFile, "report", "", "sync report")
+	fs.StringVar(&o.reportFormat, "reportformat", "csv", "report format: csv or jsonl")
+	fs.StringVar(&o.planFile, "plan", "", "with -dryrun, plan file reusable as the oid file of the run")
+	fs.BoolVar(&DryRun, "dryrun", false, "only look the objects up and write a plan")
+	fs.Float64Var(&o.throughput, "throughput", 100, "with -dryrun, MiB/s the duration is estimated at")
+	fs.StringVar(&o.statePath, "state", "", "state store recording the verified copies")
+	fs.StringVar(&o.summaryFile, "summary", "", "write the run summary to this path with .json and .txt suffixes")
+	fs.StringVar(&o.adminListen, "admin", "", "listen address of the admin api, none when empty")
+	addEnumFlags(fs, &o.enum)
+	addMismatchFlags(fs)
+	addTransformFlags(fs)
+	addPackFlags(fs)
+	addDedupFlags(fs)
+	addProtectFlags(fs)
+	addEncryptionFlags(fs, &o.encryption)
+	addNotifyFlags(fs, &o.notify)
+	addWatchdogFlags(fs, &o.watchdog)
+	fs.BoolVar(&o.preflight.skip, "nopreflight", false, "skip the checks run before the migration")
+	addPreflightFlags(fs, &o.preflight)
+	return o
+}
+
+// validate checks the options without touching the storages
+func (o *runOptions) validate() error {
+	if !o.stor.complete() || (o.reportFile == "" && !DryRun) || (o.planFile == "" && DryRun) {
+		return errMissingSettings
+	}
+	if k := o.stor.sourceKind; k != "" && k != "wos" && k != "s3" {
+		return fmt.Errorf("unknown source: %s", k)
+	}
+	if _, err := storage.ParseMultiPolicy(o.stor.policy); err != nil {
+		return err
+	}
+	if _, err := parseMismatchPolicy(MismatchPolicy); err != nil {
+		return err
+	}
+	if o.reportFormat != "csv" && o.reportFormat != "jsonl" {
+		return fmt.Errorf("unknown report format: %s", o.reportFormat)
+	}
+	if o.enum.shard != "" {
+		if _, _, err := parseShard(o.enum.shard); err != nil {
+			return err
+		}
+	}
+	if err := setupTransform(); err != nil {
+		return err
+	}
+	if err := setupEncryption(o.encryption); err != nil {
+		return err
+	}
+	if err := setupPacking(); err != nil {
+		return err
+	}
+	if err := setupDedup(); err != nil {
+		return err
+	}
+	if err := setupProtection(); err != nil {
+		return err
+	}
+	if err := checkPackReport(o.reportFormat); err != nil {
+		return err
+	}
+	if o.watchdog.minRate > 0 && o.watchdog.window <= 0 {
+		return fmt.Errorf("invalid rate window: %s", o.watchdog.window)
+	}
+	return o.notify.validate()
+}
+
+// checkPackReport refuses packing with a report that can't tell where the
+// packed objects lie
+func checkPackReport(format string) error {
+	if Pack != "" && format != "jsonl" {
+		return fmt.Errorf("packing needs the jsonl report, not %s", format)
+	}
+	return nil
+}
+
+// runPlan looks the objects up without migrating them, writing the plan
+func runPlan(ctl *runControl, storOpts storOptions, planFile string, enum *closingEnumerator) {
+	file, err := os.Create(planFile)
 	if err != nil {
-		log.Fatalf("failed to open %s: %s", *oidFile, err.Error())
+		log.Fatalf("failed to create plan file(%s): %s", planFile, err.Error())
+	}
+	defer file.Close()
+	dest, err := storOpts.dest()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	source, err := storOpts.source()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Infof("Run %s", runID)
+	log.Infof("Planning migration from %s to %s with %d worker...",
+		storOpts.sourceName(), storOpts.destName(), SyncWorkerCnt)
+	plan := newPlanReporter(file)
+	migrateErr := runMigration(ctl, dest, source, plan, enum)
+	s, err := plan.close()
+	if err != nil {
+		log.Fatalf("failed to write plan file(%s): %s", planFile, err.Error())
+	}
+	log.Info(s.String())
+	if migrateErr != nil {
+		log.Fatal(migrateErr.Error())
 	}
-	defer oidFH.Close()
-	migrate(dest, source, reportWriter, oidFH)
 }
 
-func init() {
-	log.SetOutput(os.Stdout)
-	logLevel := os.Getenv("APP_LEVEL")
-	if logLevel == "DEBUG" {
-		log.SetLevel(log.DebugLevel)
-	} else {
-		log.SetLevel(log.InfoLevel)
+// storOptions configures the wos source and the s3 destinations, given by
+// the flags or by the destinations of the config file. A restore run reads
+// the copies of an earlier migration from an s3 source instead of wos.
+type storOptions struct {
+	ak       string
+	sk       string
+	endpoint string
+	bucket   string
+	policy   string
+	wosHost  string
+	dests    destList
+
+	sourceKind  string
+	srcEndpoint string
+	srcBucket   string
+	srcAK       string
+	srcSK       string
+	srcPrefix   string
+}
+
+func addStorFlags(fs *flag.FlagSet, o *storOptions) {
+	fs.StringVar(&o.ak, "ak", "", "access key, comma separated per destination")
+	fs.StringVar(&o.sk, "sk", "", "secret key, comma separated per destination")
+	fs.StringVar(&o.endpoint, "endpoint", "", "s3 endpoint, comma separated for multiple destinations")
+	fs.StringVar(&o.bucket, "bucket", "", "dest bucket, comma separated per destination")
+	fs.StringVar(&o.policy, "policy", "all", "multiple destinations write policy: all or quorum")
+	fs.StringVar(&o.wosHost, "wos", "", "dest storage")
+	fs.Var(&o.dests, "destinations", "json list of the destinations, set by the config file, -endpoint replacing them")
+	fs.StringVar(&KeyPrefix, "keyprefix", KeyPrefix, "prefix of the s3 keys, the wos oid following")
+	fs.StringVar(&o.sourceKind, "source", "wos", "source: wos, or s3 to restore the copies of an earlier migration")
+	fs.StringVar(&o.srcEndpoint, "srcendpoint", "", "s3 source endpoint")
+	fs.StringVar(&o.srcBucket, "srcbucket", "", "s3 source bucket")
+	fs.StringVar(&o.srcAK, "srcak", "", "s3 source access key")
+	fs.StringVar(&o.srcSK, "srcsk", "", "s3 source secret key")
+	fs.StringVar(&o.srcPrefix, "srcprefix", "", "prefix of the s3 source keys, the oid following")
+}
+
+func (o *storOptions) complete() bool {
+	return o.hasDest() && o.hasSource()
+}
+
+// hasSource tells whether the wos or s3 source is configured
+func (o *storOptions) hasSource() bool {
+	if o.sourceKind == "s3" {
+		return o.srcEndpoint != "" && o.srcBucket != "" && o.srcAK != "" && o.srcSK != ""
+	}
+	return o.wosHost != ""
+}
+
+// sourceName names the source in the logs
+func (o *storOptions) sourceName() string {
+	if o.sourceKind == "s3" {
+		return o.srcEndpoint + "/" + o.srcBucket + "/" + o.srcPrefix
+	}
+	return o.wosHost
+}
+
+// source creates the source of the flags, an s3 source serving the
+// original content of its copies, decrypted and decompressed
+func (o *storOptions) source() (storage.StorSrc, error) {
+	switch o.sourceKind {
+	case "", "wos":
+		return storage.NewWosStorage(o.wosHost), nil
+	case "s3":
+		return &restoringSource{StorSrc: storage.NewS3Storage(o.srcEndpoint, o.srcAK, o.srcSK, o.srcBucket),
+			prefix: o.srcPrefix}, nil
+	}
+	return nil, fmt.Errorf("unknown source: %s", o.sourceKind)
+}
+
+// hasDest tells whether the s3 destinations are configured
+func (o *storOptions) hasDest() bool {
+	if o.endpoint == "" && len(o.dests) > 0 {
+		return true
+	}
+	return o.ak != "" && o.sk != "" && o.endpoint != "" && o.bucket != ""
+}
+
+// destName names the s3 destinations in the logs
+func (o *storOptions) destName() string {
+	if o.endpoint == "" && len(o.dests) > 0 {
+		return o.dests.String()
+	}
+	return o.endpoint + "/" + o.bucket
+}
+
+// dest creates the s3 destination of the flags, or of the config file
+// destinations when no endpoint is given on the command line
+func (o *storOptions) dest() (storage.StorDest, error) {
+	if o.endpoint != "" || len(o.dests) == 0 {
+		return newDest(o.endpoint, o.ak, o.sk, o.bucket, o.policy)
+	}
+	if len(o.dests) == 1 {
+		d := o.dests[0]
+		return storage.NewS3Storage(d.Endpoint, d.AccessKey, d.SecretKey, d.Bucket), nil
+	}
+	p, err := storage.ParseMultiPolicy(o.policy)
+	if err != nil {
+		return nil, err
 	}
+	names := make([]string, len(o.dests))
+	dests := make([]storage.StorDest, len(o.dests))
+	for i, d := range o.dests {
+		names[i] = fanoutName(d.Endpoint, d.Bucket)
+		dests[i] = storage.NewS3Storage(d.Endpoint, d.AccessKey, d.SecretKey, d.Bucket)
+	}
+	return newMultiDest(p, names, dests)
+}
+
+// fanoutName names a fan-out destination by its endpoint and bucket. The
+// names are recorded in the reports and the state, a later run finding the
+// same destination under the same name whatever their order.
+func fanoutName(endpoint, bucket string) string {
+	return endpoint + "/" + bucket
+}
+
+// newMultiDest creates a fan-out destination, refusing a destination given
+// twice
+func newMultiDest(p storage.MultiPolicy, names []string, dests []storage.StorDest) (storage.StorDest, error) {
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate destination: %s", name)
+		}
+		seen[name] = true
+	}
+	return storage.NewMultiStorage(p, names, dests), nil
+}
 
-	workerCnt := os.Getenv("APP_WORKER")
-	if workerCnt != "" {
-		i, err := strconv.Atoi(workerCnt)
+// destSpec is an s3 destination of the config file, its credentials resolved
+type destSpec struct {
+	Endpoint  string `json:"endpoint"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+}
+
+// destList is the -destinations flag, keeping the destinations of the config
+// file apart so that their credentials may hold any character
+type destList []destSpec
+
+// String names the destinations, without their credentials
+func (t *destList) String() string {
+	names := make([]string, len(*t))
+	for i, d := range *t {
+		names[i] = d.Endpoint + "/" + d.Bucket
+	}
+	return strings.Join(names, ",")
+}
+
+func (t *destList) Set(s string) error {
+	var dests []destSpec
+	if err := json.Unmarshal([]byte(s), &dests); err != nil {
+		return err
+	}
+	for i, d := range dests {
+		if d.Endpoint == "" || d.Bucket == "" || d.AccessKey == "" || d.SecretKey == "" {
+			return fmt.Errorf("destination %d: missing endpoint, bucket, access key or secret key", i)
+		}
+	}
+	*t = dests
+	return nil
+}
+
+func addMismatchFlags(fs *flag.FlagSet) {
+	fs.StringVar(&MismatchPolicy, "mismatch", MismatchPolicy, "verify mismatch policy: fail, delete or quarantine")
+	fs.StringVar(&QuarantinePrefix, "quarantine", QuarantinePrefix, "key prefix of quarantined objects")
+	fs.IntVar(&MismatchRetries, "mismatchretries", MismatchRetries, "copies again of a mismatched object within the run")
+}
+
+func addEnumFlags(fs *flag.FlagSet, o *enumOptions) {
+	fs.StringVar(&o.file, "oidfile", "", "oid file or previous report file when retry, - for stdin")
+	fs.StringVar(&o.kind, "enum", "file", "object enumerator: file, list, report, plan, csv, tsv, jsonl, sql or search")
+	fs.StringVar(&o.rejectFile, "rejectfile", "", "file collecting unparsable input lines")
+	fs.StringVar(&o.column, "column", "", "csv/tsv column name or 1-based index")
+	fs.BoolVar(&o.header, "header", false, "csv/tsv file has a header line")
+	fs.StringVar(&o.field, "field", "", "jsonl/search field path, e.g. object.oid")
+	fs.StringVar(&o.sqlDriver, "sqldriver", "sqlite3", "sql driver: sqlite3 or postgres")
+	fs.StringVar(&o.sqlDSN, "sqldsn", "", "sql data source name")
+	fs.StringVar(&o.sqlQuery, "sqlquery", "", "sql query, the first column is the oid")
+	fs.StringVar(&o.searchURL, "searchurl", "", "wos metadata search url")
+	fs.StringVar(&o.shard, "shard", "", "only migrate shard i/N (0 <= i < N) of the objects")
+	fs.StringVar(&o.include, "include", "", "only migrate oids matching this regexp")
+	fs.StringVar(&o.exclude, "exclude", "", "skip oids matching this regexp")
+	fs.BoolVar(&o.dedup, "dedup", false, "skip duplicated oids, prescanning the input")
+	fs.StringVar(&o.oidPattern, "oidpattern", "", "reject oids not matching this regexp, prescanning the input")
+	fs.StringVar(&o.tmpDir, "tmpdir", "", "directory for prescan temporary files")
+}
+
+// newDest creates the s3 destination, or a fan-out destination when several
+// endpoints are given. ak, sk and bucket are either given once for all
+// endpoints or once per endpoint.
+func newDest(endpoint, ak, sk, bucket, policy string) (storage.StorDest, error) {
+	endpoints := strings.Split(endpoint, ",")
+	if len(endpoints) == 1 {
+		return storage.NewS3Storage(endpoint, ak, sk, bucket), nil
+	}
+
+	p, err := storage.ParseMultiPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+	pick := func(name, value string, i int) (string, error) {
+		values := strings.Split(value, ",")
+		if len(values) == 1 {
+			return values[0], nil
+		}
+		if len(values) != len(endpoints) {
+			return "", fmt.Errorf("%s count(%d) doesn't match endpoint count(%d)",
+				name, len(values), len(endpoints))
+		}
+		return values[i], nil
+	}
+
+	names := make([]string, len(endpoints))
+	dests := make([]storage.StorDest, len(endpoints))
+	for i, e := range endpoints {
+		a, err := pick("access key", ak, i)
 		if err != nil {
-			log.Errorf("invalid worker count: %s, skip", workerCnt)
-		} else {
-			SyncWorkerCnt = i
+			return nil, err
 		}
+		s, err := pick("secret key", sk, i)
+		if err != nil {
+			return nil, err
+		}
+		b, err := pick("bucket", bucket, i)
+		if err != nil {
+			return nil, err
+		}
+		names[i] = fanoutName(e, b)
+		dests[i] = storage.NewS3Storage(e, a, s, b)
 	}
+	return newMultiDest(p, names, dests)
+}
+
+func init() {
+	log.SetOutput(os.Stdout)
 }
@@ -2,10 +2,13 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"reflect"
 	"s3sync/storage"
@@ -76,6 +79,7 @@ func setupWosServer(t *testing.T, oids []string) *httptest.Server {
 			if data, ok := db.read(oid); ok {
 				w.Header().Set("x-ddn-status", "0 ok")
 				w.Header().Set("x-ddn-oid", oid)
+				w.Header().Set("x-ddn-meta", `"oid":"`+oid+`"`)
 				w.Write(data)
 			} else {
 				w.Header().Set("x-ddn-status", "205 InvalidObjId")
@@ -91,6 +95,16 @@ func setupWosServer(t *testing.T, oids []string) *httptest.Server {
 }
 
 func wosServePost(t *testing.T, w http.ResponseWriter, r *http.Request, db DB) {
+	if r.URL.String() == "/cmd/delete" {
+		oid := r.Header.Get("x-ddn-oid")
+		if _, ok := db.read(oid); !ok {
+			w.Header().Set("x-ddn-status", "205 InvalidObjId")
+			return
+		}
+		delete(db.data, oid)
+		w.Header().Set("x-ddn-status", "0 ok")
+		return
+	}
 	if r.URL.String() != "/cmd/put" {
 		t.Errorf("unsupported post request: %s", r.URL.String())
 		http.Error(w, "", http.StatusBadRequest)
@@ -120,7 +134,14 @@ func wosServePost(t *testing.T, w http.ResponseWriter, r *http.Request, db DB) {
 func setupS3Server(bucket string) (*httptest.Server, error) {
 	backend := s3mem.New()
 	faker := gofakes3.New(backend)
-	ts := httptest.NewServer(faker.Server())
+	handler := faker.Server()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if src := r.Header.Get("X-Amz-Copy-Source"); r.Method == "PUT" && src != "" {
+			serveS3Copy(w, r, backend, src)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
 
 	// configure S3 client
 	s3Config := &aws.Config{
@@ -145,6 +166,34 @@ func setupS3Server(bucket string) (*httptest.Server, error) {
 	return ts, nil
 }
 
+// serveS3Copy serves the copy requests gofakes3 doesn't support
+func serveS3Copy(w http.ResponseWriter, r *http.Request, backend gofakes3.Backend, src string) {
+	src, _ = url.PathUnescape(strings.TrimPrefix(src, "/"))
+	srcPath := strings.SplitN(src, "/", 2)
+	dstPath := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(srcPath) != 2 || len(dstPath) != 2 {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	obj, err := backend.GetObject(srcPath[0], srcPath[1], nil)
+	if err != nil {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+	defer obj.Contents.Close()
+	meta := map[string]string{}
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			meta[k] = v[0]
+		}
+	}
+	if _, err := backend.PutObject(dstPath[0], dstPath[1], meta, obj.Contents, obj.Size); err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(`<CopyObjectResult><ETag>"0"</ETag></CopyObjectResult>`))
+}
+
 // func TestMigrate(t *testing.T) {
 // 	bucket := "bucket1"
 // 	keys := []string{"k1", "k2", "k3", "k4"}
@@ -315,7 +364,7 @@ func runMigrateTest(t *testing.T, s3Endpoint, ak, sk, bucket string,
 	source := storage.NewWosStorage(wosEndpoint)
 	report := &memWriter{}
 	reportWriter := bufio.NewWriter(report)
-	migrate(dest, source, reportWriter, retryF)
+	migrate(dest, source, &csvReporter{w: reportWriter}, &autoEnumerator{r: retryF})
 
 	verifyReport(t, string(report.data), expectedKeys)
 }
@@ -343,3 +392,332 @@ func generateOidFileContent(w *bufio.Writer) {
 		"f423580f-cb2c-40b5-96db-a03553ab70b5")
 	w.Flush()
 }
+
+func TestMigrateMultiDest(t *testing.T) {
+	bucket := "bucket1"
+	keys := []string{"k1", "k2", "k3"}
+	primary, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer primary.Close()
+	dr, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer dr.Close()
+
+	wos := setupWosServer(t, keys)
+	defer wos.Close()
+
+	file, err := ioutil.TempFile("", "oidfile")
+	if err != nil {
+		t.Errorf("failed to create oid file: %s", err.Error())
+		return
+	}
+	defer os.Remove(file.Name())
+	w := bufio.NewWriter(file)
+	for _, k := range keys {
+		fmt.Fprintln(w, k)
+	}
+	w.Flush()
+	file.Seek(0, 0)
+
+	dest, err := newDest(primary.URL+","+dr.URL, "u1", "s1", bucket, "all")
+	if err != nil {
+		t.Errorf("failed to create destinations: %s", err.Error())
+		return
+	}
+	report := &memWriter{}
+	migrate(dest, storage.NewWosStorage(strings.TrimPrefix(wos.URL, "http://")),
+		&csvReporter{w: bufio.NewWriter(report)}, &autoEnumerator{r: file})
+
+	entries := strings.Split(strings.TrimSpace(string(report.data)), "\n")
+	if len(entries) != len(keys) {
+		t.Errorf("report size got %d;want %d:\n %s", len(entries), len(keys), report.data)
+		return
+	}
+	for _, e := range entries {
+		items := strings.Split(e, ",")
+		if len(items) != 5 || items[1] != "ok" || items[2] != "true" {
+			t.Errorf("unexpected report entry: %s", e)
+			continue
+		}
+		results, ok := parseDestColumn(items[4])
+		if !ok || len(results) != 2 {
+			t.Errorf("unexpected dest column: %s", e)
+			continue
+		}
+		for _, r := range results {
+			if r.status != destOK || r.md5 == "" {
+				t.Errorf("unexpected dest status: %s", e)
+			}
+		}
+	}
+
+	for _, url := range []string{primary.URL, dr.URL} {
+		s3 := storage.NewS3Storage(url, "u1", "s1", bucket)
+		for _, k := range keys {
+			if _, err := s3.Read(k); err != nil {
+				t.Errorf("object %s missing on %s: %s", k, url, err.Error())
+			}
+		}
+	}
+}
+
+func TestMigrateMultiDestRetry(t *testing.T) {
+	bucket := "bucket1"
+	primary, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer primary.Close()
+	dr, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer dr.Close()
+
+	wos := setupWosServer(t, []string{"k1", "k2"})
+	defer wos.Close()
+
+	file, err := ioutil.TempFile("", "retryfile")
+	if err != nil {
+		t.Errorf("failed to create retry file: %s", err.Error())
+		return
+	}
+	defer os.Remove(file.Name())
+	// the destinations are named by endpoint and bucket, listed here in
+	// another order than in the report
+	p, d := primary.URL+"/"+bucket, dr.URL+"/"+bucket
+	fmt.Fprintf(file, "1577358017,partial,true,k1,%s=ok:0d8b9b5d7c0b3e0a;%s=fail\n", p, d)
+	fmt.Fprintf(file, "1577358017,fail,false,k2,%s=fail;%s=fail,quorum policy not met (0/2)\n", p, d)
+	file.Seek(0, 0)
+
+	if _, err := newDest(dr.URL+","+dr.URL, "u1", "s1", bucket, "quorum"); err == nil {
+		t.Errorf("duplicate destination accepted")
+	}
+	dest, err := newDest(dr.URL+","+primary.URL, "u1", "s1", bucket, "quorum")
+	if err != nil {
+		t.Errorf("failed to create destinations: %s", err.Error())
+		return
+	}
+	report := &memWriter{}
+	migrate(dest, storage.NewWosStorage(strings.TrimPrefix(wos.URL, "http://")),
+		&csvReporter{w: bufio.NewWriter(report)}, &autoEnumerator{r: file})
+
+	entries := strings.Split(strings.TrimSpace(string(report.data)), "\n")
+	sort.Strings(entries)
+	if len(entries) != 2 {
+		t.Errorf("report size got %d;want 2:\n %s", len(entries), report.data)
+		return
+	}
+	if !strings.Contains(entries[0], ",ok,true,k1,"+d+"=ok:") || strings.Contains(entries[0], p) {
+		t.Errorf("k1 should only be resent to dr: %s", entries[0])
+	}
+	if !strings.Contains(entries[1], ",ok,true,k2,") || !strings.Contains(entries[1], d+"=ok:") ||
+		!strings.Contains(entries[1], p+"=ok:") {
+		t.Errorf("k2 should be resent to both: %s", entries[1])
+	}
+
+	if _, err := storage.NewS3Storage(primary.URL, "u1", "s1", bucket).Read("k1"); err == nil {
+		t.Errorf("k1 should not be resent to primary")
+	}
+}
+
+// jsonRun migrates oids to dest with a json lines report, returning its
+// lines by oid and the run summary
+func jsonRun(t *testing.T, dest storage.StorDest, source storage.StorSrc, oids ...string) (map[string]jsonReportLine, *runSummary) {
+	report := &memWriter{}
+	summary := newSummaryReporter(&jsonReporter{w: bufio.NewWriter(report), runID: runID})
+	migrate(dest, source, summary, &listEnumerator{r: strings.NewReader(strings.Join(oids, "\n"))})
+	return readJSONReport(t, report.data), summary.summary(nil, nil)
+}
+
+// readJSONReport returns the lines of a json lines report by oid
+func readJSONReport(t *testing.T, data []byte) map[string]jsonReportLine {
+	lines := map[string]jsonReportLine{}
+	for _, l := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var line jsonReportLine
+		if err := json.Unmarshal([]byte(l), &line); err != nil {
+			t.Errorf("invalid report line %s: %s", l, err.Error())
+			continue
+		}
+		lines[line.OID] = line
+	}
+	return lines
+}
+
+func TestMigrateJSONReport(t *testing.T) {
+	bucket := "bucket1"
+	s3, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3.Close()
+	wos := setupWosServer(t, []string{"k1"})
+	defer wos.Close()
+
+	dest := storage.NewS3Storage(s3.URL, "u1", "s1", bucket)
+	source := storage.NewWosStorage(strings.TrimPrefix(wos.URL, "http://"))
+	lines, _ := jsonRun(t, dest, source, "k1", "missing")
+
+	ok := lines["k1"]
+	if ok.RunID != runID || ok.Status != "ok" || !ok.Verified || ok.Bucket != bucket ||
+		ok.Key != "k1" || ok.Size != int64(len("k1 content")) ||
+		ok.ContentType != "application/octet-stream" || ok.SourceMD5 == "" ||
+		ok.SourceMD5 != ok.DestMD5 || ok.Attempts != 1 || ok.Worker == "" || ok.Error != nil {
+		t.Errorf("unexpected report of k1: %+v", ok)
+	}
+	for _, phase := range []string{"read", "write", "verify", "total"} {
+		if _, found := ok.DurationsMs[phase]; !found {
+			t.Errorf("missing %s duration: %+v", phase, ok)
+		}
+	}
+
+	fail := lines["missing"]
+	if fail.Status != "fail" || fail.Error == nil || fail.Error.Class != errClassRead ||
+		fail.Error.Code != "205" || fail.Error.Message == "" {
+		t.Errorf("unexpected report of missing: %+v %+v", fail, fail.Error)
+	}
+}
+
+// corruptingStorage corrupts the objects it reads back
+type corruptingStorage struct {
+	*storage.S3Storage
+}
+
+type corruptObject struct {
+	storage.SyncObject
+	body io.ReadCloser
+}
+
+func (t *corruptObject) GetBody() io.ReadCloser {
+	return t.body
+}
+
+func (t *corruptingStorage) Read(key string) (storage.SyncObject, error) {
+	obj, err := t.S3Storage.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	obj.GetBody().Close()
+	return &corruptObject{SyncObject: obj, body: ioutil.NopCloser(strings.NewReader("corrupted"))}, nil
+}
+
+func TestMigrateMismatchQuarantine(t *testing.T) {
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	wos := setupWosServer(t, []string{"k1"})
+	defer wos.Close()
+
+	defer func(policy string) { MismatchPolicy = policy }(MismatchPolicy)
+	MismatchPolicy = mismatchQuarantine
+
+	dest := storage.NewS3Storage(s3Server.URL, "u1", "s1", bucket)
+	source := storage.NewWosStorage(strings.TrimPrefix(wos.URL, "http://"))
+	report := &memWriter{}
+	summary := newSummaryReporter(&csvReporter{w: bufio.NewWriter(report)})
+	migrate(&corruptingStorage{dest}, source, summary, &listEnumerator{r: strings.NewReader("k1\n")})
+
+	e, err := parseReportLine(strings.TrimSpace(string(report.data)))
+	if err != nil || e.status != "fail" || !strings.Contains(e.errMsg, "quarantined to quarantine/k1") {
+		t.Errorf("unexpected report: %s %v", report.data, err)
+		return
+	}
+	if s := summary.summary(nil, nil); s.Mismatch != 1 || s.Fail != 0 {
+		t.Errorf("unexpected summary: %+v", s)
+		return
+	}
+
+	svc := s3.New(session.New(dest.Config))
+	if _, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String("k1")}); err == nil {
+		t.Errorf("mismatched object k1 wasn't removed")
+		return
+	}
+	head, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String("quarantine/k1")})
+	if err != nil {
+		t.Errorf("failed to stat quarantined object: %s", err.Error())
+		return
+	}
+	if aws.StringValue(head.Metadata["Source-Md5"]) == "" || aws.StringValue(head.Metadata["Dest-Md5"]) == "" {
+		t.Errorf("missing checksums in quarantine metadata: %v", head.Metadata)
+		return
+	}
+
+	// a rerun on the report picks the mismatched object up
+	rerun := &memWriter{}
+	migrate(dest, source, &csvReporter{w: bufio.NewWriter(rerun)},
+		&autoEnumerator{r: strings.NewReader(string(report.data))})
+	verifyReport(t, string(rerun.data), []string{"k1"})
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	wos := setupWosServer(t, []string{"k1", "k2", "k3", "k4"})
+	defer wos.Close()
+
+	dest := storage.NewS3Storage(s3Server.URL, "u1", "s1", bucket)
+	source := storage.NewWosStorage(strings.TrimPrefix(wos.URL, "http://"))
+	migrate(dest, source, &csvReporter{w: bufio.NewWriter(&memWriter{})},
+		&listEnumerator{r: strings.NewReader("k1\n")})
+
+	// k4 times out during the dry run
+	DryRun = true
+	defer func() { DryRun = false }()
+	planFile := &memWriter{}
+	plan := newPlanReporter(planFile)
+	migrate(dest, &failingSource{StorSrc: source, key: "k4"}, plan,
+		&listEnumerator{r: strings.NewReader("k1\nk2\nk3\nk4\nmissing\n")})
+	s, err := plan.close()
+	if err != nil {
+		t.Errorf("failed to close plan: %s", err.Error())
+		return
+	}
+	size := int64(len("k1 content"))
+	if s.Objects != 5 || s.Missing != 1 || s.Errors != 1 || s.Present != 1 || s.ToCopy != 2 ||
+		s.Bytes != 3*size || s.ToCopyBytes != 2*size || s.Sizes["<4KiB"].Objects != 3 ||
+		s.EstimatedHours <= 0 {
+		t.Errorf("unexpected plan: %+v", s)
+		return
+	}
+	if _, err := dest.Stat("k2"); !isNotFound(err) {
+		t.Errorf("dry run copied k2: %v", err)
+		return
+	}
+	DryRun = false
+
+	report := &memWriter{}
+	migrate(dest, source, &csvReporter{w: bufio.NewWriter(report)},
+		&autoEnumerator{r: strings.NewReader(string(planFile.data))})
+	verifyReport(t, string(report.data), []string{"k2", "k3", "k4"})
+}
+
+// failingSource fails to read key with an error other than not found
+type failingSource struct {
+	storage.StorSrc
+	key string
+}
+
+func (t *failingSource) Read(key string) (storage.SyncObject, error) {
+	if key == t.key {
+		return nil, fmt.Errorf("read %s: i/o timeout", key)
+	}
+	return t.StorSrc.Read(key)
+}
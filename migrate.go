@@ -2,9 +2,10 @@ package main
 
 import (
 	"bufio"
+	"crypto/md5"
+	"errors"
 	"fmt"
-	"io"
-	"os"
+	"io/ioutil"
 	"strings"
 	"time"
 
@@ -15,175 +16,691 @@ import (
 
 type syncObjItem struct {
 	key string
+	// dests limits a fan-out write to these destinations, all when empty
+	dests []string
+	// attempts is how many times the object was tried before
+	attempts int
+	// stalls is how many times the watchdog requeued the object
+	stalls int
+	// overwrite lets the write replace a different copy, the object's own
+	// mismatched one
+	overwrite bool
+	// transfer is the object in the inflight registry, nil when untracked
+	transfer *inflightObject
+}
+
+// error classes of a failed sync, telling which phase failed
+const (
+	errClassRead   = "source_read"
+	errClassWrite  = "dest_write"
+	errClassVerify = "verify"
+	// errClassMismatch is a copy whose checksum differs from the source
+	errClassMismatch = "verify_mismatch"
+	// errClassStalled is a transfer cancelled by the watchdog
+	errClassStalled = "stalled"
+	// errClassTransform is a source object the transform failed to read
+	errClassTransform = "transform"
+	// errClassEncrypt is an object whose data key couldn't be created
+	errClassEncrypt = "encrypt"
+	// errClassNotAttempted is an object dispatched to the workers of a run
+	// drained or aborted before one took it
+	errClassNotAttempted = "not_attempted"
+)
+
+// mismatch policies, what's done with a destination object failing the
+// checksum verification
+const (
+	mismatchFail       = "fail"
+	mismatchDelete     = "delete"
+	mismatchQuarantine = "quarantine"
+)
+
+var (
+	// KeyPrefix maps the wos oids to s3 keys
+	KeyPrefix = ""
+
+	MismatchPolicy   = mismatchFail
+	QuarantinePrefix = "quarantine/"
+	// MismatchRetries is how many times a mismatched object is copied again
+	// within the run
+	MismatchRetries = 1
+)
+
+func parseMismatchPolicy(s string) (string, error) {
+	switch s {
+	case mismatchFail, mismatchDelete, mismatchQuarantine:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown mismatch policy: %s", s)
+}
+
+// mismatchError fails the sync of an object whose copy doesn't match the
+// source checksum
+type mismatchError struct {
+	srcMD5 string
+	dstMD5 string
+	action string
+}
+
+func (t *mismatchError) Error() string {
+	msg := fmt.Sprintf("md5 mismatch: source %s, dest %s", t.srcMD5, t.dstMD5)
+	if t.action != "" {
+		msg += ", " + t.action
+	}
+	return msg
+}
+
+func (t *mismatchError) Code() string {
+	return "md5_mismatch"
+}
+
+// handleMismatch applies MismatchPolicy to key on dest, returning what was
+// done with it
+func handleMismatch(dest storage.StorDest, key, srcMD5, dstMD5 string) string {
+	if MismatchPolicy == mismatchFail {
+		return ""
+	}
+	d, ok := dest.(interface {
+		storage.Deleter
+		storage.Copier
+	})
+	if !ok {
+		log.Errorf("failed to %s object %s: unsupported destination", MismatchPolicy, key)
+		return MismatchPolicy + " unsupported"
+	}
+
+	if MismatchPolicy == mismatchQuarantine {
+		qKey := QuarantinePrefix + key
+		meta := map[string]string{
+			"source-md5": strings.Trim(srcMD5, "\""),
+			"dest-md5":   strings.Trim(dstMD5, "\""),
+			"run-id":     runID,
+		}
+		if err := d.Copy(key, qKey, meta); err != nil {
+			log.Errorf("failed to quarantine object %s: %s", key, err.Error())
+			return "quarantine failed: " + err.Error()
+		}
+		if err := d.Delete(key); err != nil {
+			log.Errorf("failed to delete quarantined object %s: %s", key, err.Error())
+			return "quarantined to " + qKey + ", delete failed: " + err.Error()
+		}
+		log.Warnf("quarantined mismatched object %s to %s", key, qKey)
+		return "quarantined to " + qKey
+	}
+
+	if err := d.Delete(key); err != nil {
+		log.Errorf("failed to delete mismatched object %s: %s", key, err.Error())
+		return "delete failed: " + err.Error()
+	}
+	log.Warnf("deleted mismatched object %s", key)
+	return "deleted"
 }
 
 type syncResult struct {
 	err      error
+	errClass string
 	verified bool
 	oldKey   string
+	dests    []destResult
+
+	bucket      string
+	destKey     string
+	size        int64
+	contentType string
+	srcMD5      string
+	dstMD5      string
+	// contentMD5 is the md5 of the content of a decompressed object, the
+	// copies being verified against it rather than the source md5
+	contentMD5 string
+	// verify is the verification the copies passed, empty when none ran
+	verify string
+	// transform is the transform applied to the stored object, storedSize
+	// its size once transformed
+	transform  string
+	storedSize int64
+	// encrypted tells the stored object is encrypted
+	encrypted bool
+	// bundle is where the packed object lies, pack its content until it's
+	// added to a bundle
+	bundle *bundleLocation
+	pack   []byte
+	// contentKey is where a deduplicated object's content is stored,
+	// deduped telling it was already stored
+	contentKey string
+	deduped    bool
+	// versionID is the version of the copy in a versioned bucket, unchanged
+	// telling the copy already held the content and wasn't written
+	versionID string
+	unchanged bool
+	attempts  int
+	worker    string
+	// present tells a dry run found the object on the destination
+	present bool
+
+	readTime   time.Duration
+	writeTime  time.Duration
+	verifyTime time.Duration
+	totalTime  time.Duration
 }
 
 // record
-// format: ts, sync status, verify status, old key[, error]
+// format: ts, sync status, verify status, old key[, dest status][, error]
+// the dest status column is only written for fan-out destinations
 func (t *syncResult) record(w *bufio.Writer) {
+	w.WriteString(formatReportLine(t.reportEntry()))
+	w.Flush()
+}
 
+func (t *syncResult) reportEntry() reportEntry {
+	e := reportEntry{
+		ts:       time.Now().Unix(),
+		status:   "ok",
+		verified: t.verified,
+		key:      t.oldKey,
+		dests:    t.dests,
+	}
+	for _, d := range t.dests {
+		if d.status != destOK {
+			e.status = "partial"
+		}
+	}
 	if t.err != nil {
-		w.WriteString(fmt.Sprintf("%d,fail,false,%s,%s\n",
-			time.Now().Unix(), t.oldKey, strings.ReplaceAll(t.err.Error(), "\n", " ")))
-	} else {
-		w.WriteString(fmt.Sprintf("%d,ok,%t,%s\n",
-			time.Now().Unix(), t.verified, t.oldKey))
+		e.status = "fail"
+		e.verified = false
+		e.errMsg = t.err.Error()
 	}
+	return e
+}
 
-	w.Flush()
+// destKey returns the s3 key of a wos oid
+func destKey(oid string) string {
+	return KeyPrefix + oid
 }
 
+// destBucket returns the bucket of an s3 destination
+func destBucket(dest storage.StorDest) string {
+	if b, ok := dest.(interface{ GetBucket() string }); ok {
+		return b.GetBucket()
+	}
+	return ""
+}
+
+// syncObject copies an object, copying it again up to MismatchRetries times
+// when the copy doesn't match the source
 func syncObject(syncObj syncObjItem, target storage.StorDest, source storage.StorSrc) syncResult {
-	log.Debugf("retriving object: %s", syncObj.key)
+	res := syncObjectOnce(syncObj, target, source)
+	for i := 0; i < MismatchRetries && res.errClass == errClassMismatch; i++ {
+		syncObj.attempts = res.attempts
+		syncObj.overwrite = true
+		inflight.retry(syncObj.transfer, syncObj.attempts+1)
+		inflight.logger(syncObj.transfer, syncObj.key).Warn("retrying mismatched object")
+		res = syncObjectOnce(syncObj, target, source)
+	}
+	return res
+}
+
+func syncObjectOnce(syncObj syncObjItem, target storage.StorDest, source storage.StorSrc) (res syncResult) {
+	res = syncResult{
+		oldKey:   syncObj.key,
+		destKey:  destKey(syncObj.key),
+		bucket:   destBucket(target),
+		attempts: syncObj.attempts + 1,
+	}
+	start := time.Now()
+	defer func() {
+		res.totalTime = time.Since(start)
+	}()
+	fail := func(class string, err error) syncResult {
+		res.err = err
+		res.errClass = class
+		res.verified = false
+		return res
+	}
+
+	l := inflight.logger(syncObj.transfer, syncObj.key)
+	inflight.phase(syncObj.transfer, "read")
+	l.WithField("phase", "read").Debug("retrieving object")
 	r, err := source.Read(syncObj.key)
+	res.readTime = time.Since(start)
 	if err != nil {
-		return syncResult{oldKey: syncObj.key, err: err}
+		l.WithFields(phaseFields("read", 0, res.readTime)).Errorf("failed to read object: %s", err.Error())
+		return fail(errClassRead, err)
+	}
+	r = inflight.watch(syncObj.transfer, r)
+	res.size = r.GetContentLength()
+	res.contentType = r.GetContentType()
+	l.WithFields(phaseFields("read", res.size, res.readTime)).Debug("retrieved object")
+	if packSelects(res.size) {
+		return packContent(syncObj.transfer, r, res, start)
+	}
+	if NoOverwrite && !syncObj.overwrite {
+		var class string
+		r, class, err = checkOverwrite(&syncObj, target, source, r, &res)
+		if err != nil {
+			l.WithFields(phaseFields("read", res.size, time.Since(start))).Errorf("failed to write object: %s", err.Error())
+			return fail(class, err)
+		}
+		if r == nil {
+			l.WithFields(phaseFields("verify", res.size, time.Since(start))).Debug("object already copied")
+			res.verified = true
+			res.verify = verifyETag
+			return res
+		}
+	}
+	tr, err := objectTransform.apply(syncObj.key, r)
+	if err != nil {
+		l.WithFields(phaseFields("read", res.size, time.Since(start))).Errorf("failed to transform object: %s", err.Error())
+		return fail(errClassTransform, err)
+	}
+	if tr != nil {
+		r = tr
+	}
+	enc, err := encryptObject(r)
+	if err != nil {
+		r.GetBody().Close()
+		l.WithFields(phaseFields("read", res.size, time.Since(start))).Errorf("failed to encrypt object: %s", err.Error())
+		return fail(errClassEncrypt, err)
+	}
+	if enc != nil {
+		r = enc
+	}
+	if NoOverwrite && !syncObj.overwrite {
+		r = &protectedObject{SyncObject: r, md5: res.srcMD5}
 	}
-	log.Debugf("retrived object: %s", syncObj.key)
 
-	log.Debugf("writing object: %s", syncObj.key)
-	originMD5, err := target.Write(syncObj.key, r)
+	if multi, ok := target.(*storage.MultiStorage); ok {
+		syncObjectMulti(syncObj, multi, r, tr, enc, &res)
+		return res
+	}
+
+	inflight.phase(syncObj.transfer, "write")
+	l.WithField("phase", "write").Debug("writing object")
+	phase := time.Now()
+	written, err := writeObject(target, res.destKey, r, &res)
+	res.writeTime = time.Since(phase)
+	res.srcMD5 = written
 	if err != nil {
-		log.Errorf("failed to write object %s: %s", syncObj.key, err.Error())
-		return syncResult{oldKey: syncObj.key, err: err}
+		l.WithFields(phaseFields("write", res.size, res.writeTime)).Errorf("failed to write object: %s", err.Error())
+		if errors.Is(err, storage.ErrExists) {
+			return fail(errClassConflict, &overwriteError{key: res.destKey, concurrent: true})
+		}
+		return fail(errClassWrite, err)
 	}
-	log.Debugf("wrote object: %s", syncObj.key)
+	res.setContent(tr, enc)
+	originMD5 := res.expectedMD5()
+	l.WithFields(phaseFields("write", res.size, res.writeTime)).Debug("wrote object")
 
-	log.Debugf("verifying object: %s", syncObj.key)
-	targetObj, err := target.Read(syncObj.key)
+	inflight.phase(syncObj.transfer, "verify")
+	l.WithField("phase", "verify").Debug("verifying object")
+	phase = time.Now()
+	defer func() {
+		res.verifyTime = time.Since(phase)
+	}()
+	targetObj, err := target.Read(res.destKey)
 	if err != nil {
-		return syncResult{oldKey: syncObj.key, err: err}
+		l.WithFields(phaseFields("verify", 0, time.Since(phase))).Errorf("failed to read copy: %s", err.Error())
+		return fail(errClassVerify, err)
 	}
-	targetMD5, err := storage.CalcMD5(targetObj.GetBody())
+	targetObj = inflight.watch(syncObj.transfer, targetObj)
+	targetMD5, err := copyMD5(targetObj)
 	if err != nil {
-		return syncResult{oldKey: syncObj.key, err: err}
+		l.WithFields(phaseFields("verify", 0, time.Since(phase))).Errorf("failed to read copy: %s", err.Error())
+		return fail(errClassVerify, err)
 	}
+	res.dstMD5 = targetMD5
 
 	if targetMD5 != originMD5 {
-		log.Debugf("failed to verify object %s md5: %s, %s", syncObj.key, originMD5, targetMD5)
-		return syncResult{verified: false, oldKey: syncObj.key}
+		l.WithFields(phaseFields("verify", res.size, time.Since(phase))).
+			Errorf("failed to verify object md5: %s, %s", originMD5, targetMD5)
+		action := handleMismatch(target, res.destKey, originMD5, targetMD5)
+		return fail(errClassMismatch, &mismatchError{srcMD5: originMD5, dstMD5: targetMD5, action: action})
 	}
-	return syncResult{verified: true, oldKey: syncObj.key}
+	l.WithFields(phaseFields("verify", res.size, time.Since(phase))).Debug("verified object")
+	res.verified = true
+	res.verify = res.verification()
+	return res
 }
 
-func migrate(
-	dest storage.StorDest,
-	source storage.StorSrc,
-	w *bufio.Writer,
-	oidFile *os.File) {
-	var stop = make(chan struct{})
-	var totalObjectsNum = make(chan int)
-	var result = make(chan syncResult, SyncWorkerCnt)
-	var toSyncObjs = make(chan syncObjItem, SyncWorkerCnt)
+// packContent reads the content of r for packing, the object being written
+// with its bundle
+func packContent(o *inflightObject, r storage.SyncObject, res syncResult, start time.Time) syncResult {
+	body := r.GetBody()
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	res.readTime = time.Since(start)
+	if err == nil && int64(len(data)) != res.size {
+		err = fmt.Errorf("read %d bytes of %d", len(data), res.size)
+	}
+	if err != nil {
+		inflight.logger(o, res.oldKey).WithFields(phaseFields("read", res.size, res.readTime)).
+			Errorf("failed to read object: %s", err.Error())
+		res.err = err
+		res.errClass = errClassRead
+		return res
+	}
+	res.pack = data
+	res.srcMD5 = fmt.Sprintf("\"%x\"", md5.Sum(data))
+	return res
+}
 
-	go getObjListFromFile(oidFile, totalObjectsNum, toSyncObjs)
+// setContent records the transform of tr and the encryption of enc, either
+// being nil, once the object is written. The source md5 becomes the md5 of
+// the content the copy is verified against rather than the bytes written.
+func (t *syncResult) setContent(tr *transformedObject, enc *encryptedObject) {
+	if tr != nil {
+		t.srcMD5 = tr.sourceMD5()
+		if tr.raw != nil {
+			t.contentMD5 = tr.md5()
+		}
+		if tr.op != "" {
+			t.transform = tr.op
+			t.storedSize = tr.storedSize()
+		}
+	} else if enc != nil {
+		t.srcMD5 = enc.md5()
+	}
+	t.encrypted = enc != nil
+}
 
-	for i := 0; i < SyncWorkerCnt; i++ {
-		go syncWorker(stop, result, toSyncObjs, dest, source)
+// expectedMD5 returns the md5 the copies are verified against
+func (t *syncResult) expectedMD5() string {
+	if t.contentMD5 != "" {
+		return t.contentMD5
 	}
-	go monitor(totalObjectsNum, result, stop, w)
+	return t.srcMD5
+}
 
-	<-stop
+// verification returns the verification a copy matching expectedMD5 passed
+func (t *syncResult) verification() string {
+	if t.contentMD5 != "" {
+		return verifyDecompressed
+	}
+	return verifyMD5
 }
 
-func getObjListFromFile(oidFile *os.File, totalNum chan<- int, toSyncObjs chan<- syncObjItem) {
-	if oidFile == nil {
-		log.Errorf("no oid file provided")
-		return
+// copyMD5 returns the md5 of the original content of a copy, decrypted and
+// decompressed as told by its metadata
+func copyMD5(obj storage.SyncObject) (string, error) {
+	body, err := restoreBody(storage.Metadata(obj), obj.GetBody())
+	if err != nil {
+		obj.GetBody().Close()
+		return "", err
 	}
-	total := 0
-	rd := bufio.NewReader(oidFile)
-	for {
-		line, err := rd.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				log.Infof("Total objects to be migrated: %d", total)
-				totalNum <- total
-				return
-			}
-			log.Errorf("failed to parse result file: %s", err.Error())
-			totalNum <- total
-			return
-		}
+	defer body.Close()
+	return storage.CalcMD5(body)
+}
+
+// syncObjectMulti writes the object, transformed by tr and encrypted by enc
+// when not nil, to every selected destination of multi and verifies each
+// copy on its own
+func syncObjectMulti(syncObj syncObjItem, multi *storage.MultiStorage, r storage.SyncObject,
+	tr *transformedObject, enc *encryptedObject, res *syncResult) {
+	l := inflight.logger(syncObj.transfer, syncObj.key)
+	inflight.phase(syncObj.transfer, "write")
+	l.WithField("phase", "write").Debugf("writing object to %d destinations", len(multi.Dests))
+	phase := time.Now()
+	originMD5, statuses, err := multi.WriteTo(res.destKey, r, syncObj.dests)
+	res.writeTime = time.Since(phase)
+	res.srcMD5 = originMD5
+	res.setMultiContent(statuses)
+	if originMD5 != "" {
+		res.setContent(tr, enc)
+		originMD5 = res.expectedMD5()
+	}
+	res.verified = true
+	l.WithFields(phaseFields("write", res.size, res.writeTime)).Debug("wrote object")
 
-		//1577092932,ok,false,file_mpu10,7852f675-458e-49ea-a4b2-e8477b715d1b
-		parts := strings.Split(line, ",")
-		var key string
-		if len(parts) == 1 {
-			// oid list
-			key = strings.TrimSpace(parts[0])
+	inflight.phase(syncObj.transfer, "verify")
+	phase = time.Now()
+	var conflict error
+	for _, st := range statuses {
+		d := destResult{name: st.Name, status: destOK, md5: st.MD5}
+		if st.Content != nil {
+			d.version = st.Content.VersionID
+		}
+		if st.Err != nil {
+			l.WithFields(phaseFields("write", res.size, res.writeTime)).
+				Errorf("failed to write object to %s: %s", st.Name, st.Err.Error())
+			d.status = destFail
+			d.md5 = ""
+			if errors.Is(st.Err, storage.ErrExists) {
+				conflict = &overwriteError{key: res.destKey, dest: st.Name, concurrent: true}
+			}
+		} else if originMD5 == "" {
+			d.status = destFail
+			d.md5 = ""
 		} else {
-			if len(parts) < 4 {
-				log.Errorf("failed to parse result entry: %s, skip", line)
-				continue
+			targetObj, rerr := multi.Dest(st.Name).Read(res.destKey)
+			var targetMD5 string
+			if rerr == nil {
+				targetObj = inflight.watch(syncObj.transfer, targetObj)
+				targetMD5, rerr = copyMD5(targetObj)
 			}
-			if parts[1] == "ok" {
-				log.Debugf("migrated object %s, skip", parts[3])
-				continue
+			if rerr != nil {
+				l.WithFields(phaseFields("verify", 0, time.Since(phase))).
+					Errorf("failed to verify object on %s: %s", st.Name, rerr.Error())
+				d.status = destFail
+			} else if targetMD5 != originMD5 {
+				l.WithFields(phaseFields("verify", res.size, time.Since(phase))).
+					Errorf("failed to verify object md5 on %s: %s, %s", st.Name, originMD5, targetMD5)
+				handleMismatch(multi.Dest(st.Name), res.destKey, originMD5, targetMD5)
+				d.status = destMismatch
+				d.md5 = targetMD5
+				res.verified = false
+			} else {
+				d.md5 = targetMD5
+				res.verify = res.verification()
 			}
-			key = strings.TrimSpace(parts[3])
 		}
+		res.dests = append(res.dests, d)
+	}
+	res.verifyTime = time.Since(phase)
+	switch {
+	case conflict != nil:
+		res.err = conflict
+		res.errClass = errClassConflict
+		res.verified = false
+	case err != nil:
+		res.err = err
+		res.errClass = errClassWrite
+		res.verified = false
+	}
+}
 
-		if key == "" {
-			log.Errorf("emtpy object name: %s, skip", line)
-			continue
+// AbortGrace is how long an aborted run waits for the workers to notice
+var AbortGrace = 30 * time.Second
+
+func migrate(
+	dest storage.StorDest,
+	source storage.StorSrc,
+	rep reporter,
+	enum enumerator) error {
+	return runMigration(newRunControl(SyncWorkerCnt), dest, source, rep, enum)
+}
+
+// runMigration migrates the objects of enum under the control of ctl. The
+// producer enumerates the objects into a channel it closes when done, the
+// workers exit once every object has a result or the run is drained or
+// aborted, and the collector records the results until the last worker is
+// gone. It returns the enumeration error, if any.
+func runMigration(
+	ctl *runControl,
+	dest storage.StorDest,
+	source storage.StorSrc,
+	rep reporter,
+	enum enumerator) error {
+	items := make(chan syncObjItem, SyncWorkerCnt)
+	results := make(chan syncResult, SyncWorkerCnt)
+	pk := newPacker(dest)
+
+	produced := make(chan error, 1)
+	go func() {
+		produced <- produce(ctl, enum, items)
+	}()
+	ctl.startWorkers(func(i int) {
+		syncWorker(ctl, i, items, results, dest, source, pk)
+	})
+	go func() {
+		ctl.group.Wait()
+		// the objects of the last bundle are resolved but not yet written
+		for _, r := range pk.flush() {
+			results <- r
+		}
+		for _, r := range notAttempted(ctl, items) {
+			results <- r
+		}
+		close(results)
+	}()
+	collected := make(chan struct{})
+	go func() {
+		collect(ctl, results, rep)
+		close(collected)
+	}()
+
+	select {
+	case <-collected:
+	case <-ctl.aborted:
+		select {
+		case <-collected:
+		case <-time.After(AbortGrace):
+			log.Errorf("workers still busy %s after the abort, giving up on them", AbortGrace)
+			return fmt.Errorf("migration aborted: %s", ctl.status().Aborted)
 		}
+	}
+	if err := <-produced; err != nil {
+		return fmt.Errorf("failed to enumerate objects: %s", err.Error())
+	}
+	return nil
+}
 
-		toSyncObjs <- syncObjItem{
-			key: key,
+// produce dispatches the objects of enum to items, closing it when done. The
+// enumeration stops once the run is drained or aborted.
+func produce(ctl *runControl, enum enumerator, items chan<- syncObjItem) error {
+	defer close(items)
+	stopped := false
+	total, err := enumerateItems(enum, func(item syncObjItem) bool {
+		if !ctl.dispatch() {
+			stopped = true
+			return false
 		}
-		total++
+		select {
+		case items <- item:
+			return true
+		case <-ctl.quit:
+			ctl.resolve()
+			stopped = true
+			return false
+		}
+	})
+	switch {
+	case err != nil:
+		log.Errorf("failed to enumerate objects: %s", err.Error())
+	case stopped:
+		log.Infof("Enumeration stopped after %d objects, the run is over", total)
+	default:
+		log.Infof("Total objects to be migrated: %d", total)
 	}
+	ctl.produced(total, !stopped)
+	return err
 }
 
 func syncWorker(
-	stop <-chan struct{},
-	result chan<- syncResult,
-	toSyncObjs <-chan syncObjItem,
+	ctl *runControl,
+	i int,
+	items <-chan syncObjItem,
+	results chan<- syncResult,
 	dest storage.StorDest,
 	source storage.StorSrc,
+	pk *packer,
 ) {
+	id := fmt.Sprintf("worker-%d", i)
 	for {
+		ok, wake := ctl.wait(i)
+		if !ok {
+			return
+		}
+		var t syncObjItem
 		select {
-		case t := <-toSyncObjs:
-			result <- syncObject(t, dest, source)
-		case <-stop:
+		case t, ok = <-items:
+			if !ok {
+				// the requeued objects may still come
+				items = nil
+				continue
+			}
+		case t = <-ctl.requeued:
+		case <-ctl.idle:
 			return
+		case <-wake:
+			continue
+		}
+		ctl.objects.wait(1)
+		ctl.bytes.wait(0)
+		r := runObject(ctl, id, t, dest, source)
+		ctl.bytes.wait(float64(r.size))
+		if r.errClass == errClassStalled && t.stalls < WatchdogRequeues {
+			t.attempts = r.attempts
+			t.stalls++
+			if ctl.retry(t) {
+				log.Warnf("requeued stalled object %s: %s", t.key, r.err.Error())
+				continue
+			}
 		}
+		// a packed object has its result once its bundle is written
+		for _, p := range pk.add(r) {
+			results <- p
+		}
+		ctl.resolve()
 	}
 }
 
-func monitor(totalNum <-chan int, result <-chan syncResult, stop chan<- struct{}, w *bufio.Writer) {
-	finished := 0
-	pass := 0
-	totalTasksNum := -1
-	for {
+// notAttempted resolves the objects left queued once the workers are gone,
+// their results failing so that a retry of the report picks them up. It
+// waits for the producer to close items.
+func notAttempted(ctl *runControl, items <-chan syncObjItem) []syncResult {
+	var left []syncObjItem
+	for item := range items {
+		left = append(left, item)
+	}
+	for more := true; more; {
 		select {
-		case r := <-result:
-			r.record(w)
-			if r.err == nil {
-				pass++
-			}
-			finished++
-			if totalTasksNum > 0 && finished >= totalTasksNum {
-				log.Infof("Migration Completed: %d/%d", pass, finished)
-				close(stop)
-			}
-		case totalTasksNum = <-totalNum:
-			if totalTasksNum == 0 {
-				log.Warnf("No objects to be migrated")
-				close(stop)
-				return
-			}
-			if totalTasksNum <= finished {
-				log.Infof("Migration Completed: %d/%d", pass, finished)
-				close(stop)
-			}
+		case item := <-ctl.requeued:
+			left = append(left, item)
+		default:
+			more = false
+		}
+	}
+	err := fmt.Errorf("not attempted: the run was drained")
+	if reason := ctl.status().Aborted; reason != "" {
+		err = fmt.Errorf("not attempted: the run was aborted: %s", reason)
+	}
+	var results []syncResult
+	for _, item := range left {
+		r := syncResult{oldKey: item.key, attempts: item.attempts, err: err, errClass: errClassNotAttempted}
+		// a retry of some destinations stays limited to them
+		for _, name := range item.dests {
+			r.dests = append(r.dests, destResult{name: name, status: destFail})
 		}
+		results = append(results, r)
+		ctl.drop()
+	}
+	return results
+}
+
+// collect records the results until the workers are gone
+func collect(ctl *runControl, results <-chan syncResult, rep reporter) {
+	for r := range results {
+		rep.record(&r)
+		ctl.record(&r)
+	}
+	s := ctl.status()
+	switch {
+	case s.Aborted != "":
+		log.Errorf("Migration Aborted: %d/%d, %d not attempted", s.Pass, s.Finished, s.NotAttempted)
+	case s.Draining:
+		log.Infof("Migration Drained: %d/%d, %d not attempted", s.Pass, s.Finished, s.NotAttempted)
+	case s.Finished == 0:
+		log.Warnf("No objects to be migrated")
+	default:
+		log.Infof("Migration Completed: %d/%d", s.Pass, s.Finished)
 	}
 }
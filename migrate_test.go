@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"s3sync/storage"
+)
+
+type memObject struct {
+	data []byte
+}
+
+func (t *memObject) GetContentType() string {
+	return "application/octet-stream"
+}
+
+func (t *memObject) GetContentLength() int64 {
+	return int64(len(t.data))
+}
+
+func (t *memObject) GetBody() io.ReadCloser {
+	return ioutil.NopCloser(bytes.NewReader(t.data))
+}
+
+// memStorage is an in memory source and destination, without goroutines
+type memStorage struct {
+	sync.Mutex
+	objects map[string][]byte
+	delay   time.Duration
+}
+
+func newMemStorage(n int) *memStorage {
+	t := &memStorage{objects: map[string][]byte{}}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("k%d", i)
+		t.objects[key] = []byte(key + " content")
+	}
+	return t
+}
+
+func (t *memStorage) Read(key string) (storage.SyncObject, error) {
+	time.Sleep(t.delay)
+	t.Lock()
+	defer t.Unlock()
+	data, ok := t.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", key)
+	}
+	return &memObject{data: data}, nil
+}
+
+func (t *memStorage) Write(key string, obj storage.SyncObject) (string, error) {
+	data, err := ioutil.ReadAll(obj.GetBody())
+	if err != nil {
+		return "", err
+	}
+	t.Lock()
+	t.objects[key] = data
+	t.Unlock()
+	return storage.CalcMD5(ioutil.NopCloser(bytes.NewReader(data)))
+}
+
+func (t *memStorage) Delete(key string) error {
+	t.Lock()
+	defer t.Unlock()
+	if _, ok := t.objects[key]; !ok {
+		return fmt.Errorf("%s not found", key)
+	}
+	delete(t.objects, key)
+	return nil
+}
+
+// countingReporter counts the results by key, slowly if delay is set
+type countingReporter struct {
+	sync.Mutex
+	keys  map[string]int
+	delay time.Duration
+}
+
+func (t *countingReporter) record(r *syncResult) {
+	time.Sleep(t.delay)
+	t.Lock()
+	defer t.Unlock()
+	t.keys[r.oldKey]++
+}
+
+// sliceEnumerator emits n keys then fails with err, counting the keys
+// emitted
+type sliceEnumerator struct {
+	n       int
+	err     error
+	emitted int
+}
+
+func (t *sliceEnumerator) enumerate(emit func(syncObjItem) bool) error {
+	for i := 0; i < t.n; i++ {
+		t.emitted++
+		if !emit(syncObjItem{key: fmt.Sprintf("k%d", i)}) {
+			return nil
+		}
+	}
+	return t.err
+}
+
+// checkGoroutines fails when more goroutines than before are still running
+func checkGoroutines(t *testing.T, before int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			n := runtime.Stack(buf, true)
+			t.Errorf("leaked %d goroutines:\n%s", runtime.NumGoroutine()-before, buf[:n])
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMigratePipeline(t *testing.T) {
+	workers := SyncWorkerCnt
+	SyncWorkerCnt = 8
+	defer func() { SyncWorkerCnt = workers }()
+
+	cases := []struct {
+		name    string
+		n       int
+		enumErr error
+		delay   time.Duration
+	}{
+		{"empty", 0, nil, 0},
+		{"many", 500, nil, 0},
+		// the workers block on the results while the collector is slow
+		{"slow collector", 50, nil, 5 * time.Millisecond},
+		// the objects enumerated before the failure are still migrated
+		{"input error", 30, errors.New("broken input"), 0},
+	}
+	for _, c := range cases {
+		before := runtime.NumGoroutine()
+		source := newMemStorage(c.n)
+		dest := newMemStorage(0)
+		rep := &countingReporter{keys: map[string]int{}, delay: c.delay}
+		err := migrate(dest, source, rep, &sliceEnumerator{n: c.n, err: c.enumErr})
+		if (err != nil) != (c.enumErr != nil) {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			return
+		}
+		if len(rep.keys) != c.n || len(dest.objects) != c.n {
+			t.Errorf("%s: want %d results, got %d, %d copies", c.name, c.n, len(rep.keys), len(dest.objects))
+			return
+		}
+		for k, count := range rep.keys {
+			if count != 1 {
+				t.Errorf("%s: %s recorded %d times", c.name, k, count)
+				return
+			}
+		}
+		checkGoroutines(t, before)
+	}
+}
+
+func TestMigratePipelineDrain(t *testing.T) {
+	before := runtime.NumGoroutine()
+	source := newMemStorage(100)
+	source.delay = 10 * time.Millisecond
+	dest := newMemStorage(0)
+	rep := &countingReporter{keys: map[string]int{}}
+
+	ctl := newRunControl(4)
+	enum := &sliceEnumerator{n: 100}
+	done := make(chan error)
+	go func() {
+		done <- runMigration(ctl, dest, source, rep, enum)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	ctl.drain()
+	ctl.setWorkers(8)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %s", err.Error())
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("drained migration didn't stop")
+		return
+	}
+	// the enumeration stops, the objects left queued are not attempted
+	s := ctl.status()
+	if len(rep.keys) == 0 || enum.emitted == 100 || s.Finished == 0 || s.NotAttempted == 0 ||
+		s.Finished+s.NotAttempted != len(rep.keys) || s.Running != 0 {
+		t.Errorf("unexpected drained run: %d emitted, %d results, %+v", enum.emitted, len(rep.keys), s)
+		return
+	}
+	checkGoroutines(t, before)
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// NotifyRetries is how many times a failed delivery is retried
+	NotifyRetries = 3
+	// NotifyBackoff is the delay before the first retry, doubled after each
+	NotifyBackoff = time.Second
+	// NotifyInterval is how often the progress of the run is checked
+	NotifyInterval = 10 * time.Second
+	// NotifyErrorMinObjects is how many results the error rate is computed on
+	NotifyErrorMinObjects = 20
+	// NotifyQueueSize is how many events may wait for delivery
+	NotifyQueueSize = 100
+)
+
+// notification events
+const (
+	eventStart     = "start"
+	eventComplete  = "complete"
+	eventDrained   = "drained"
+	eventAborted   = "aborted"
+	eventMilestone = "milestone"
+	eventErrorRate = "error_rate"
+	eventStall     = "stall"
+	eventMismatch  = "mismatch"
+)
+
+// notifyEvent is sent as is to the webhooks
+type notifyEvent struct {
+	Type      string  `json:"type"`
+	RunID     string  `json:"run_id"`
+	Time      string  `json:"time"`
+	Message   string  `json:"message"`
+	Total     int     `json:"total"`
+	Finished  int     `json:"finished"`
+	Pass      int     `json:"pass"`
+	Fail      int     `json:"fail"`
+	Milestone int     `json:"milestone,omitempty"`
+	ErrorRate float64 `json:"error_rate,omitempty"`
+	OID       string  `json:"oid,omitempty"`
+}
+
+func newNotifyEvent(typ string, s adminStatus, msg string) *notifyEvent {
+	return &notifyEvent{
+		Type:     typ,
+		RunID:    runID,
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		Message:  msg,
+		Total:    s.Total,
+		Finished: s.Finished,
+		Pass:     s.Pass,
+		Fail:     s.Fail,
+	}
+}
+
+// title is the one line summary of e
+func (t *notifyEvent) title() string {
+	return fmt.Sprintf("s3sync run %s %s: %s", t.RunID, t.Type, t.Message)
+}
+
+type notifier interface {
+	send(e *notifyEvent) error
+}
+
+// webhookNotifier posts the events as json
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (t *webhookNotifier) send(e *notifyEvent) error {
+	return postJSON(t.client, t.url, e)
+}
+
+// slackNotifier posts the events to a slack compatible incoming webhook
+type slackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (t *slackNotifier) send(e *notifyEvent) error {
+	text := e.title()
+	if e.Total >= 0 {
+		text += fmt.Sprintf("\n%d/%d finished, %d failed", e.Finished, e.Total, e.Fail)
+	}
+	return postJSON(t.client, t.url, map[string]string{"text": text})
+}
+
+func postJSON(client *http.Client, url string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
+
+// smtpNotifier mails the events
+type smtpNotifier struct {
+	addr     string
+	from     string
+	to       []string
+	user     string
+	password string
+}
+
+func (t *smtpNotifier) send(e *notifyEvent) error {
+	var auth smtp.Auth
+	if t.user != "" {
+		host, _, err := net.SplitHostPort(t.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", t.user, t.password, host)
+	}
+	details, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", t.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(t.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", e.title())
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\n", e.Message)
+	msg.WriteString(strings.Replace(string(details), "\n", "\r\n", -1))
+	msg.WriteString("\r\n")
+	return smtp.SendMail(t.addr, auth, t.from, t.to, msg.Bytes())
+}
+
+// notifications delivers the events to every notifier in the background,
+// retrying the failed deliveries
+type notifications struct {
+	notifiers []notifier
+	queue     chan *notifyEvent
+	wg        sync.WaitGroup
+}
+
+func newNotifications(notifiers []notifier) *notifications {
+	t := &notifications{
+		notifiers: notifiers,
+		queue:     make(chan *notifyEvent, NotifyQueueSize),
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		for e := range t.queue {
+			for _, n := range t.notifiers {
+				deliver(n, e)
+			}
+		}
+	}()
+	return t
+}
+
+func deliver(n notifier, e *notifyEvent) {
+	backoff := NotifyBackoff
+	var err error
+	for i := 0; i <= NotifyRetries; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = n.send(e); err == nil {
+			return
+		}
+		log.Warnf("failed to send %s notification: %s", e.Type, err.Error())
+	}
+	log.Errorf("gave up sending %s notification: %s", e.Type, err.Error())
+}
+
+// notify queues e, dropping it when the queue is full. It's a no-op on nil.
+func (t *notifications) notify(e *notifyEvent) {
+	if t == nil {
+		return
+	}
+	select {
+	case t.queue <- e:
+	default:
+		log.Warnf("notification queue full, dropping %s notification", e.Type)
+	}
+}
+
+// close delivers the queued events
+func (t *notifications) close() {
+	if t == nil {
+		return
+	}
+	close(t.queue)
+	t.wg.Wait()
+}
+
+// notifyReporter notifies the verify mismatches
+type notifyReporter struct {
+	reporter
+	n   *notifications
+	ctl *runControl
+}
+
+func (t *notifyReporter) record(r *syncResult) {
+	t.reporter.record(r)
+	var mismatched []string
+	for _, d := range r.dests {
+		if d.status == destMismatch {
+			mismatched = append(mismatched, d.name)
+		}
+	}
+	if r.errClass != errClassMismatch && len(mismatched) == 0 {
+		return
+	}
+	msg := fmt.Sprintf("object %s copy doesn't match the source", r.oldKey)
+	if len(mismatched) > 0 {
+		msg = fmt.Sprintf("object %s copy on %s doesn't match the source", r.oldKey, strings.Join(mismatched, ", "))
+	}
+	if r.err != nil {
+		msg += ": " + r.err.Error()
+	}
+	e := newNotifyEvent(eventMismatch, t.ctl.status(), msg)
+	e.OID = r.oldKey
+	t.n.notify(e)
+}
+
+// notifyWatcher checks the progress of a run for milestones, error rates
+// and stalls
+type notifyWatcher struct {
+	milestones []int
+	errorRate  float64
+	stall      time.Duration
+
+	// next is the index of the next milestone
+	next int
+	// the error rate is computed from windowFinished and windowFail on
+	windowFinished int
+	windowFail     int
+	rateAlerted    bool
+	lastFinished   int
+	lastProgress   time.Time
+	stallAlerted   bool
+}
+
+// check returns the events of the run status s at now
+func (t *notifyWatcher) check(s adminStatus, now time.Time) []*notifyEvent {
+	var events []*notifyEvent
+	if t.lastProgress.IsZero() || s.Finished != t.lastFinished {
+		t.lastFinished = s.Finished
+		t.lastProgress = now
+		t.stallAlerted = false
+	}
+
+	if s.Total > 0 {
+		pct := s.Finished * 100 / s.Total
+		reached := 0
+		for t.next < len(t.milestones) && t.milestones[t.next] <= pct {
+			reached = t.milestones[t.next]
+			t.next++
+		}
+		if reached > 0 {
+			e := newNotifyEvent(eventMilestone, s, fmt.Sprintf("%d%% of the objects migrated", reached))
+			e.Milestone = reached
+			events = append(events, e)
+		}
+	}
+
+	if t.errorRate > 0 && s.Finished-t.windowFinished >= NotifyErrorMinObjects {
+		rate := float64(s.Fail-t.windowFail) / float64(s.Finished-t.windowFinished)
+		if rate > t.errorRate && !t.rateAlerted {
+			e := newNotifyEvent(eventErrorRate, s,
+				fmt.Sprintf("%.1f%% of the last %d objects failed", rate*100, s.Finished-t.windowFinished))
+			e.ErrorRate = rate
+			events = append(events, e)
+		}
+		t.rateAlerted = rate > t.errorRate
+		t.windowFinished = s.Finished
+		t.windowFail = s.Fail
+	}
+
+	if t.stall > 0 && !s.Paused && !s.Done && !t.stallAlerted && now.Sub(t.lastProgress) >= t.stall {
+		events = append(events, newNotifyEvent(eventStall, s,
+			fmt.Sprintf("no object finished for %s", now.Sub(t.lastProgress).Round(time.Second))))
+		t.stallAlerted = true
+	}
+	return events
+}
+
+// watch notifies the events of ctl until stop is closed
+func (t *notifyWatcher) watch(ctl *runControl, n *notifications, stop <-chan struct{}) {
+	tick := time.NewTicker(NotifyInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			for _, e := range t.check(ctl.status(), now) {
+				n.notify(e)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// startNotifications notifies the start of the run controlled by ctl and
+// watches its progress, the returned function notifying its end. Both are
+// nil without notifier.
+func startNotifications(o notifyOptions, ctl *runControl, desc string) (*notifications, func()) {
+	ns, err := o.notifiers()
+	if err != nil || len(ns) == 0 {
+		return nil, func() {}
+	}
+	w, err := o.watcher()
+	if err != nil {
+		return nil, func() {}
+	}
+	n := newNotifications(ns)
+	n.notify(newNotifyEvent(eventStart, ctl.status(), desc))
+	stop := make(chan struct{})
+	go w.watch(ctl, n, stop)
+	return n, func() {
+		close(stop)
+		s := ctl.status()
+		typ, msg := eventComplete, fmt.Sprintf("%d/%d objects migrated", s.Pass, s.Finished)
+		switch {
+		case s.Aborted != "":
+			typ, msg = eventAborted, msg+", "+s.Aborted
+		case s.Draining && !s.Done:
+			typ = eventDrained
+		}
+		n.notify(newNotifyEvent(typ, s, msg))
+		n.close()
+	}
+}
+
+// notifyOptions configures the notifications of a run
+type notifyOptions struct {
+	webhook      string
+	slack        string
+	smtpAddr     string
+	smtpFrom     string
+	smtpTo       string
+	smtpUser     string
+	smtpPassword string
+	milestones   string
+	errorRate    float64
+	stall        time.Duration
+}
+
+func addNotifyFlags(fs *flag.FlagSet, o *notifyOptions) {
+	fs.StringVar(&o.webhook, "notifywebhook", "", "url the notifications are posted to as json")
+	fs.StringVar(&o.slack, "notifyslack", "", "slack compatible incoming webhook url")
+	fs.StringVar(&o.smtpAddr, "notifysmtp", "", "smtp server host:port the notifications are mailed with")
+	fs.StringVar(&o.smtpFrom, "notifyfrom", "s3sync", "notification mail sender")
+	fs.StringVar(&o.smtpTo, "notifyto", "", "notification mail recipients, comma separated")
+	fs.StringVar(&o.smtpUser, "notifysmtpuser", "", "smtp user, no authentication when empty")
+	fs.StringVar(&o.smtpPassword, "notifysmtppassword", "", "smtp password")
+	fs.StringVar(&o.milestones, "notifymilestones", "25,50,75", "percentages of the objects migrated notified, comma separated")
+	fs.Float64Var(&o.errorRate, "notifyerrorrate", 0.05, "failure rate notified, 0 to disable")
+	fs.DurationVar(&o.stall, "notifystall", 10*time.Minute, "time without finished object notified as a stall, 0 to disable")
+}
+
+// notifiers returns the configured notifiers, none when nothing is
+func (o *notifyOptions) notifiers() ([]notifier, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	var ns []notifier
+	if o.webhook != "" {
+		ns = append(ns, &webhookNotifier{url: o.webhook, client: client})
+	}
+	if o.slack != "" {
+		ns = append(ns, &slackNotifier{url: o.slack, client: client})
+	}
+	if o.smtpAddr != "" {
+		if _, _, err := net.SplitHostPort(o.smtpAddr); err != nil {
+			return nil, fmt.Errorf("invalid smtp address: %s", err.Error())
+		}
+		if o.smtpTo == "" {
+			return nil, fmt.Errorf("missing notification mail recipients")
+		}
+		ns = append(ns, &smtpNotifier{
+			addr:     o.smtpAddr,
+			from:     o.smtpFrom,
+			to:       strings.Split(o.smtpTo, ","),
+			user:     o.smtpUser,
+			password: o.smtpPassword,
+		})
+	}
+	return ns, nil
+}
+
+func (o *notifyOptions) watcher() (*notifyWatcher, error) {
+	w := &notifyWatcher{errorRate: o.errorRate, stall: o.stall}
+	for _, m := range strings.Split(o.milestones, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		pct, err := strconv.Atoi(m)
+		if err != nil || pct <= 0 || pct > 100 {
+			return nil, fmt.Errorf("invalid milestone: %s", m)
+		}
+		w.milestones = append(w.milestones, pct)
+	}
+	sort.Ints(w.milestones)
+	return w, nil
+}
+
+// validate checks the options without sending anything
+func (o *notifyOptions) validate() error {
+	if _, err := o.notifiers(); err != nil {
+		return err
+	}
+	_, err := o.watcher()
+	return err
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setupSMTPServer accepts mails, sending each to the returned channel
+func setupSMTPServer(t *testing.T) (net.Listener, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	mails := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, mails)
+		}
+	}()
+	return ln, mails
+}
+
+func serveSMTP(conn net.Conn, mails chan<- string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("220 localhost ESMTP\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			conn.Write([]byte("250 localhost\r\n"))
+		case strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"):
+			conn.Write([]byte("250 ok\r\n"))
+		case cmd == "DATA":
+			conn.Write([]byte("354 go ahead\r\n"))
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			mails <- data.String()
+			conn.Write([]byte("250 ok\r\n"))
+		case cmd == "QUIT":
+			conn.Write([]byte("221 bye\r\n"))
+			return
+		default:
+			conn.Write([]byte("500 unknown command\r\n"))
+		}
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	backoff := NotifyBackoff
+	NotifyBackoff = 10 * time.Millisecond
+	defer func() { NotifyBackoff = backoff }()
+
+	var mu sync.Mutex
+	var webhook, slack []string
+	calls := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		webhook = append(webhook, string(data))
+	}))
+	defer hook.Close()
+	slackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		data, _ := ioutil.ReadAll(r.Body)
+		slack = append(slack, string(data))
+	}))
+	defer slackServer.Close()
+	smtpServer, mails := setupSMTPServer(t)
+	defer smtpServer.Close()
+
+	opts := notifyOptions{
+		webhook:  hook.URL,
+		slack:    slackServer.URL,
+		smtpAddr: smtpServer.Addr().String(),
+		smtpFrom: "s3sync@example.com",
+		smtpTo:   "oncall@example.com",
+	}
+	ns, err := opts.notifiers()
+	if err != nil || len(ns) != 3 {
+		t.Errorf("unexpected notifiers: %v, %v", ns, err)
+		return
+	}
+	n := newNotifications(ns)
+	ctl := newRunControl(1)
+	rep := &notifyReporter{reporter: &csvReporter{w: bufio.NewWriter(&memWriter{})}, n: n, ctl: ctl}
+	rep.record(&syncResult{oldKey: "k1", verified: true})
+	rep.record(&syncResult{oldKey: "k2", errClass: errClassMismatch,
+		err: &mismatchError{srcMD5: "a", dstMD5: "b", action: "deleted"}})
+	n.close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 || len(webhook) != 1 {
+		t.Errorf("webhook not retried: %d calls, %v", calls, webhook)
+		return
+	}
+	var e notifyEvent
+	if err := json.Unmarshal([]byte(webhook[0]), &e); err != nil || e.Type != eventMismatch ||
+		e.OID != "k2" || e.RunID != runID || !strings.Contains(e.Message, "deleted") {
+		t.Errorf("unexpected webhook event: %s, %v", webhook[0], err)
+		return
+	}
+	if len(slack) != 1 || !strings.Contains(slack[0], `"text":"s3sync run `) ||
+		!strings.Contains(slack[0], "mismatch: object k2") {
+		t.Errorf("unexpected slack payload: %v", slack)
+		return
+	}
+	select {
+	case mail := <-mails:
+		if !strings.Contains(mail, "To: oncall@example.com") ||
+			!strings.Contains(mail, "Subject: s3sync run "+runID+" mismatch: object k2") {
+			t.Errorf("unexpected mail: %s", mail)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("no mail sent")
+	}
+}
+
+func TestNotifyWatcher(t *testing.T) {
+	min := NotifyErrorMinObjects
+	NotifyErrorMinObjects = 10
+	defer func() { NotifyErrorMinObjects = min }()
+
+	w, err := (&notifyOptions{milestones: "50,25,75", errorRate: 0.2, stall: time.Minute}).watcher()
+	if err != nil {
+		t.Errorf("failed to create watcher: %s", err.Error())
+		return
+	}
+	now := time.Now()
+	steps := []struct {
+		s    adminStatus
+		at   time.Duration
+		want []string
+	}{
+		{adminStatus{Total: -1}, 0, nil},
+		{adminStatus{Total: 100, Finished: 30, Fail: 1}, 10 * time.Second, []string{eventMilestone}},
+		{adminStatus{Total: 100, Finished: 40, Fail: 5}, 20 * time.Second, []string{eventErrorRate}},
+		// the error rate is only notified once while over the threshold
+		{adminStatus{Total: 100, Finished: 60, Fail: 10}, 30 * time.Second, []string{eventMilestone}},
+		{adminStatus{Total: 100, Finished: 60, Fail: 10}, 2 * time.Minute, []string{eventStall}},
+		{adminStatus{Total: 100, Finished: 60, Fail: 10}, 3 * time.Minute, nil},
+		{adminStatus{Total: 100, Finished: 70, Fail: 10}, 4 * time.Minute, nil},
+		{adminStatus{Total: 100, Finished: 70, Fail: 10, Paused: true}, 10 * time.Minute, nil},
+		{adminStatus{Total: 100, Finished: 100, Fail: 10}, 11 * time.Minute, []string{eventMilestone}},
+	}
+	for i, step := range steps {
+		events := w.check(step.s, now.Add(step.at))
+		var got []string
+		for _, e := range events {
+			got = append(got, e.Type)
+		}
+		if strings.Join(got, ",") != strings.Join(step.want, ",") {
+			t.Errorf("step %d: want events %v, got %v", i, step.want, got)
+			return
+		}
+	}
+	if w.next != 3 {
+		t.Errorf("milestones not all reached: %d", w.next)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"s3sync/storage"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// bundle formats the small objects are packed in
+const (
+	packTar = "tar"
+	packZip = "zip"
+)
+
+var (
+	// Pack is the bundle format of the packed objects, none when empty
+	Pack = ""
+	// PackMaxSize packs the objects smaller than this many bytes
+	PackMaxSize int64 = 1 << 20
+	// PackSize is the size a bundle is written at
+	PackSize int64 = 64 << 20
+	// PackPrefix is the key prefix of the bundles, following KeyPrefix
+	PackPrefix = "bundles/"
+)
+
+func addPackFlags(fs *flag.FlagSet) {
+	fs.StringVar(&Pack, "pack", Pack, "pack the small objects in bundles: tar or zip, none when empty")
+	fs.Int64Var(&PackMaxSize, "packmaxsize", PackMaxSize, "pack the objects smaller than this many bytes")
+	fs.Int64Var(&PackSize, "packsize", PackSize, "bundle size in bytes")
+	fs.StringVar(&PackPrefix, "packprefix", PackPrefix, "key prefix of the bundles, after the key prefix")
+}
+
+// setupPacking checks the packing flags, once the transform and the
+// encryption are set up
+func setupPacking() error {
+	switch Pack {
+	case "":
+		return nil
+	case packTar, packZip:
+	default:
+		return fmt.Errorf("unknown bundle format: %s", Pack)
+	}
+	if PackMaxSize <= 0 || PackSize <= 0 {
+		return errors.New("the pack max size and bundle size must be positive")
+	}
+	if objectTransform != nil || encryptObjects {
+		return errors.New("packing can't be combined with a transform or encryption")
+	}
+	return nil
+}
+
+// packSelects tells whether an object of size is packed
+func packSelects(size int64) bool {
+	return Pack != "" && size >= 0 && size < PackMaxSize
+}
+
+// bundleLocation is where a packed object lies in its bundle
+type bundleLocation struct {
+	Key    string `json:"key"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// bundleIndex maps the oids of a bundle to their location, stored along
+// with the bundle at indexKey
+type bundleIndex struct {
+	Bundle  string        `json:"bundle"`
+	Format  string        `json:"format"`
+	Objects []bundleEntry `json:"objects"`
+}
+
+type bundleEntry struct {
+	OID         string `json:"oid"`
+	Offset      int64  `json:"offset"`
+	Length      int64  `json:"length"`
+	MD5         string `json:"md5"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// indexKey returns the key of the index of bundle
+func indexKey(bundle string) string {
+	return bundle + ".index.json"
+}
+
+// archiveWriter writes the entries of a bundle
+type archiveWriter interface {
+	// add writes an entry, returning the offset of its data
+	add(name string, data []byte) (int64, error)
+	Close() error
+}
+
+type tarArchive struct {
+	buf *bytes.Buffer
+	tw  *tar.Writer
+}
+
+func (t *tarArchive) add(name string, data []byte) (int64, error) {
+	err := t.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	offset := int64(t.buf.Len())
+	_, err = t.tw.Write(data)
+	return offset, err
+}
+
+func (t *tarArchive) Close() error {
+	return t.tw.Close()
+}
+
+// zipArchive stores the entries uncompressed so they can be read by range
+type zipArchive struct {
+	buf *bytes.Buffer
+	zw  *zip.Writer
+}
+
+func (t *zipArchive) add(name string, data []byte) (int64, error) {
+	w, err := t.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return 0, err
+	}
+	if err := t.zw.Flush(); err != nil {
+		return 0, err
+	}
+	offset := int64(t.buf.Len())
+	_, err = w.Write(data)
+	return offset, err
+}
+
+func (t *zipArchive) Close() error {
+	return t.zw.Close()
+}
+
+// bundle is a bundle being filled, with the results of its objects
+type bundle struct {
+	key     string
+	buf     bytes.Buffer
+	w       archiveWriter
+	index   bundleIndex
+	members []syncResult
+}
+
+func newBundle() *bundle {
+	b := &bundle{key: fmt.Sprintf("%s%s%s.%s", KeyPrefix, PackPrefix, uuid.New().String(), Pack)}
+	b.index = bundleIndex{Bundle: b.key, Format: Pack}
+	if Pack == packZip {
+		b.w = &zipArchive{buf: &b.buf, zw: zip.NewWriter(&b.buf)}
+	} else {
+		b.w = &tarArchive{buf: &b.buf, tw: tar.NewWriter(&b.buf)}
+	}
+	return b
+}
+
+// bundleObject is a bundle or index being written
+type bundleObject struct {
+	contentType string
+	data        []byte
+}
+
+func (t *bundleObject) GetContentType() string {
+	return t.contentType
+}
+
+func (t *bundleObject) GetContentLength() int64 {
+	return int64(len(t.data))
+}
+
+func (t *bundleObject) GetBody() io.ReadCloser {
+	return ioutil.NopCloser(bytes.NewReader(t.data))
+}
+
+// packer gathers the packed objects of a run in bundles, the result of an
+// object being known once its bundle is written
+type packer struct {
+	sync.Mutex
+	dest    storage.StorDest
+	current *bundle
+}
+
+// newPacker returns the packer of a run writing to dest, nil when the
+// objects aren't packed
+func newPacker(dest storage.StorDest) *packer {
+	if Pack == "" || DryRun {
+		return nil
+	}
+	return &packer{dest: dest}
+}
+
+// add adds the object of r to the current bundle when it was read for
+// packing, returning the results known so far: r itself when it isn't
+// packed, the results of the bundle it filled, or none.
+func (t *packer) add(r syncResult) []syncResult {
+	if t == nil || r.pack == nil {
+		return []syncResult{r}
+	}
+	data := r.pack
+	r.pack = nil
+
+	t.Lock()
+	if t.current == nil {
+		t.current = newBundle()
+	}
+	b := t.current
+	offset, err := b.w.add(r.oldKey, data)
+	if err != nil {
+		t.Unlock()
+		log.Errorf("failed to pack object %s: %s", r.oldKey, err.Error())
+		r.err = fmt.Errorf("failed to pack object: %s", err.Error())
+		r.errClass = errClassWrite
+		return []syncResult{r}
+	}
+	r.destKey = b.key
+	r.bundle = &bundleLocation{Key: b.key, Offset: offset, Length: int64(len(data))}
+	b.index.Objects = append(b.index.Objects, bundleEntry{
+		OID:         r.oldKey,
+		Offset:      offset,
+		Length:      int64(len(data)),
+		MD5:         strings.Trim(r.srcMD5, "\""),
+		ContentType: r.contentType,
+	})
+	b.members = append(b.members, r)
+	full := int64(b.buf.Len()) >= PackSize
+	if full {
+		t.current = nil
+	}
+	t.Unlock()
+
+	if !full {
+		return nil
+	}
+	return t.write(b)
+}
+
+// flush writes the bundle being filled, returning the results of its objects
+func (t *packer) flush() []syncResult {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	b := t.current
+	t.current = nil
+	t.Unlock()
+	if b == nil {
+		return nil
+	}
+	return t.write(b)
+}
+
+// write writes and verifies the bundle b then its index, returning the
+// results of its objects
+func (t *packer) write(b *bundle) []syncResult {
+	done := func(class string, err error, write, verify time.Duration) []syncResult {
+		for i := range b.members {
+			r := &b.members[i]
+			r.writeTime = write
+			r.verifyTime = verify
+			r.totalTime += write + verify
+			if err != nil {
+				r.err = err
+				r.errClass = class
+				continue
+			}
+			r.dstMD5 = r.srcMD5
+			r.verified = true
+		}
+		return b.members
+	}
+	l := log.WithField("bundle", b.key)
+
+	start := time.Now()
+	if err := b.w.Close(); err != nil {
+		l.Errorf("failed to close bundle: %s", err.Error())
+		return done(errClassWrite, fmt.Errorf("failed to close bundle %s: %s", b.key, err.Error()), 0, 0)
+	}
+	written, err := t.dest.Write(b.key, &bundleObject{contentType: "application/" + Pack, data: b.buf.Bytes()})
+	write := time.Since(start)
+	if err != nil {
+		l.Errorf("failed to write bundle: %s", err.Error())
+		return done(errClassWrite, fmt.Errorf("failed to write bundle %s: %s", b.key, err.Error()), write, 0)
+	}
+
+	start = time.Now()
+	obj, err := t.dest.Read(b.key)
+	var copyMD5 string
+	if err == nil {
+		copyMD5, err = storage.CalcMD5(obj.GetBody())
+		obj.GetBody().Close()
+	}
+	verify := time.Since(start)
+	if err != nil {
+		l.Errorf("failed to read bundle copy: %s", err.Error())
+		return done(errClassVerify, fmt.Errorf("failed to verify bundle %s: %s", b.key, err.Error()), write, verify)
+	}
+	if copyMD5 != written {
+		l.Errorf("failed to verify bundle md5: %s, %s", written, copyMD5)
+		action := handleMismatch(t.dest, b.key, written, copyMD5)
+		return done(errClassMismatch, &mismatchError{srcMD5: written, dstMD5: copyMD5, action: action}, write, verify)
+	}
+
+	index, err := json.Marshal(b.index)
+	if err == nil {
+		_, err = t.dest.Write(indexKey(b.key), &bundleObject{contentType: "application/json", data: index})
+	}
+	write += time.Since(start) - verify
+	if err != nil {
+		l.Errorf("failed to write bundle index: %s", err.Error())
+		return done(errClassWrite, fmt.Errorf("failed to write index of bundle %s: %s", b.key, err.Error()), write, verify)
+	}
+	l.Infof("wrote bundle of %d objects, %d bytes", len(b.members), b.buf.Len())
+	return done("", nil, write, verify)
+}
+
+// readBundled returns the packed object at loc, with a ranged get when the
+// destination supports it
+func readBundled(dest storage.StorDest, loc bundleLocation) (storage.SyncObject, error) {
+	if r, ok := dest.(storage.RangeReader); ok {
+		return r.ReadRange(loc.Key, loc.Offset, loc.Length)
+	}
+	obj, err := dest.Read(loc.Key)
+	if err != nil {
+		return nil, err
+	}
+	body := obj.GetBody()
+	if _, err := io.CopyN(ioutil.Discard, body, loc.Offset); err != nil {
+		body.Close()
+		return nil, fmt.Errorf("failed to read bundle %s: %s", loc.Key, err.Error())
+	}
+	return &packedObject{
+		length: loc.Length,
+		body:   &input{Reader: io.LimitReader(body, loc.Length), closers: []io.Closer{body}},
+	}, nil
+}
+
+// packedObject is a packed object read from a whole bundle
+type packedObject struct {
+	length int64
+	body   io.ReadCloser
+}
+
+func (t *packedObject) GetContentType() string {
+	return ""
+}
+
+func (t *packedObject) GetContentLength() int64 {
+	return t.length
+}
+
+func (t *packedObject) GetBody() io.ReadCloser {
+	return t.body
+}
+
+// readIndex returns the index of the bundle key
+func readIndex(dest storage.StorDest, key string) (*bundleIndex, error) {
+	obj, err := dest.Read(indexKey(key))
+	if err != nil {
+		return nil, err
+	}
+	body := obj.GetBody()
+	defer body.Close()
+	var index bundleIndex
+	if err := json.NewDecoder(body).Decode(&index); err != nil {
+		return nil, fmt.Errorf("invalid index of bundle %s: %s", key, err.Error())
+	}
+	return &index, nil
+}
+
+// readPacked returns the object oid of the bundle key, looked up in the
+// bundle index
+func readPacked(dest storage.StorDest, key, oid string) (storage.SyncObject, error) {
+	index, err := readIndex(dest, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range index.Objects {
+		if e.OID == oid {
+			return readBundled(dest, bundleLocation{Key: key, Offset: e.Offset, Length: e.Length})
+		}
+	}
+	return nil, fmt.Errorf("object %s not in bundle %s", oid, key)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"s3sync/storage"
+)
+
+func TestPack(t *testing.T) {
+	defer func() {
+		Pack, PackMaxSize, PackSize, KeyPrefix = "", 1<<20, 64<<20, ""
+	}()
+
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	dest := storage.NewS3Storage(s3Server.URL, "u1", "s1", bucket)
+	dir, err := ioutil.TempDir("", "pack")
+	if err != nil {
+		t.Errorf("failed to create temp dir: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	source := newMemStorage(0)
+	var oids []string
+	for i := 0; i < 20; i++ {
+		oid := fmt.Sprintf("small-%d", i)
+		source.objects[oid] = bytes.Repeat([]byte{byte('a' + i)}, i*5)
+		oids = append(oids, oid)
+	}
+	source.objects["large"] = bytes.Repeat([]byte("l"), 1000)
+	oids = append(oids, "large")
+
+	for _, format := range []string{packTar, packZip} {
+		// the objects under 100 bytes are packed in bundles of ~500 bytes
+		Pack, PackMaxSize, PackSize, KeyPrefix = format, 100, 500, format+"/"
+		if err := setupPacking(); err != nil {
+			t.Errorf("failed to set up packing: %s", err.Error())
+			return
+		}
+		report := &memWriter{}
+		summary := newSummaryReporter(&jsonReporter{w: bufio.NewWriter(report)})
+		migrate(dest, source, summary, &listEnumerator{r: strings.NewReader(strings.Join(oids, "\n"))})
+
+		lines := strings.Split(strings.TrimSpace(string(report.data)), "\n")
+		if len(lines) != len(oids) {
+			t.Errorf("%s: %d report lines, want %d", format, len(lines), len(oids))
+			return
+		}
+		bundles := map[string]int{}
+		for _, l := range lines {
+			var line jsonReportLine
+			if err := json.Unmarshal([]byte(l), &line); err != nil || line.Status != "ok" || !line.Verified {
+				t.Errorf("%s: unexpected report line: %s", format, l)
+				return
+			}
+			data := source.objects[line.OID]
+			if line.OID == "large" {
+				if line.Bundle != nil || line.Key != KeyPrefix+"large" {
+					t.Errorf("%s: large object packed: %s", format, l)
+				}
+				continue
+			}
+			if line.Bundle == nil || line.Key != line.Bundle.Key || line.Bundle.Length != int64(len(data)) ||
+				!strings.HasPrefix(line.Key, KeyPrefix+PackPrefix) {
+				t.Errorf("%s: unexpected bundle of %s: %s", format, line.OID, l)
+				return
+			}
+			bundles[line.Bundle.Key]++
+
+			obj, err := readBundled(dest, *line.Bundle)
+			if err != nil {
+				t.Errorf("%s: failed to read %s: %s", format, line.OID, err.Error())
+				return
+			}
+			got, _ := ioutil.ReadAll(obj.GetBody())
+			obj.GetBody().Close()
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s: unexpected content of %s: %q", format, line.OID, got)
+			}
+			obj, err = readPacked(dest, line.Bundle.Key, line.OID)
+			if err != nil {
+				t.Errorf("%s: failed to look %s up: %s", format, line.OID, err.Error())
+				return
+			}
+			got, _ = ioutil.ReadAll(obj.GetBody())
+			obj.GetBody().Close()
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s: unexpected content of %s from the index: %q", format, line.OID, got)
+			}
+		}
+		s := summary.summary(nil, nil)
+		if len(bundles) < 2 || s.Packed == nil || s.Packed.Objects != 20 || s.Packed.Bundles != len(bundles) {
+			t.Errorf("%s: unexpected bundles %v, summary %+v", format, bundles, s.Packed)
+		}
+
+		// the bundles are regular archives holding the objects and their
+		// index lists them
+		for key, n := range bundles {
+			obj, err := dest.Read(key)
+			if err != nil {
+				t.Errorf("%s: failed to read bundle %s: %s", format, key, err.Error())
+				return
+			}
+			data, _ := ioutil.ReadAll(obj.GetBody())
+			entries, err := archiveEntries(format, data)
+			if err != nil || len(entries) != n {
+				t.Errorf("%s: bundle %s has %d entries, want %d: %v", format, key, len(entries), n, err)
+			}
+			for oid, content := range entries {
+				if !bytes.Equal(content, source.objects[oid]) {
+					t.Errorf("%s: unexpected entry %s of bundle %s", format, oid, key)
+				}
+			}
+			index, err := readIndex(dest, key)
+			if err != nil || index.Bundle != key || index.Format != format || len(index.Objects) != n {
+				t.Errorf("%s: unexpected index of %s: %+v, %v", format, key, index, err)
+			}
+		}
+
+		// the audit reads the packed copies by range
+		input := filepath.Join(dir, format+".jsonl")
+		ioutil.WriteFile(input, report.data, 0644)
+		for _, mode := range []string{auditFull, auditSize} {
+			opts := auditOptions{mode: mode, sample: 1, confidence: 0.95, margin: 0.05, seed: "s"}
+			var out bytes.Buffer
+			s, _, err := runAudit(reportKeys(input), opts, source, dest, &out, []byte("secret"))
+			if err != nil || s.Checked != len(oids) || s.Matched != len(oids) {
+				t.Errorf("%s: unexpected %s audit: %+v, %v\n%s", format, mode, s, err, out.String())
+			}
+		}
+	}
+}
+
+func archiveEntries(format string, data []byte) (map[string][]byte, error) {
+	entries := map[string][]byte{}
+	if format == packZip {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			r, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			entries[f.Name], err = ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return entries, nil
+	}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entries[h.Name], err = ioutil.ReadAll(tr); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func TestSetupPacking(t *testing.T) {
+	defer func() {
+		Pack, Transform, PackSize = "", "", 64<<20
+		setupTransform()
+	}()
+	cases := []struct {
+		pack      string
+		transform string
+		size      int64
+		ok        bool
+	}{
+		{"", transformGzip, 1, true},
+		{packTar, "", 1, true},
+		{packZip, "", 1, true},
+		{"7z", "", 1, false},
+		{packTar, "", 0, false},
+		{packTar, transformGzip, 1, false},
+	}
+	for _, c := range cases {
+		Pack, Transform, PackSize = c.pack, c.transform, c.size
+		setupTransform()
+		if err := setupPacking(); (err == nil) != c.ok {
+			t.Errorf("setupPacking(%s, %s, %d): %v", c.pack, c.transform, c.size, err)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"s3sync/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// DryRun only looks the objects up to plan the migration
+	DryRun = false
+	// PlanThroughput is the throughput in bytes/s the plan duration is
+	// estimated at
+	PlanThroughput = 100.0 * 1024 * 1024
+)
+
+// planSizeClasses are the upper bounds of the size distribution of a plan
+var planSizeClasses = []struct {
+	name  string
+	limit int64
+}{
+	{"<4KiB", 4 << 10},
+	{"<64KiB", 64 << 10},
+	{"<1MiB", 1 << 20},
+	{"<16MiB", 16 << 20},
+	{"<256MiB", 256 << 20},
+	{"<4GiB", 4 << 30},
+	{">=4GiB", -1},
+}
+
+// planObject looks an object up on the source and the destination without
+// transferring it. A copy of the same size counts as present, its content
+// isn't compared.
+func planObject(syncObj syncObjItem, target storage.StorDest, source storage.StorSrc) (res syncResult) {
+	res = syncResult{
+		oldKey:   syncObj.key,
+		destKey:  destKey(syncObj.key),
+		bucket:   destBucket(target),
+		attempts: syncObj.attempts,
+	}
+	start := time.Now()
+	defer func() {
+		res.totalTime = time.Since(start)
+	}()
+
+	info, err := statSource(source, syncObj.key)
+	res.readTime = time.Since(start)
+	if err != nil {
+		res.err = err
+		res.errClass = errClassRead
+		return res
+	}
+	res.size = info.Size
+	res.contentType = info.ContentType
+
+	dests := []storage.StorDest{target}
+	if multi, ok := target.(*storage.MultiStorage); ok {
+		dests = multi.Dests
+	}
+	res.present = true
+	for _, d := range dests {
+		s, ok := d.(storage.Statter)
+		if !ok {
+			res.present = false
+			break
+		}
+		dinfo, err := s.Stat(res.destKey)
+		if err != nil && !isNotFound(err) {
+			log.Warnf("failed to look %s up on the destination: %s", syncObj.key, err.Error())
+		}
+		if err != nil || dinfo.Size != info.Size {
+			res.present = false
+			break
+		}
+	}
+	return res
+}
+
+// statSource returns the size and content type of key, reading only the
+// headers when the source can't stat
+func statSource(source storage.StorSrc, key string) (*storage.ObjectInfo, error) {
+	if s, ok := source.(storage.Statter); ok {
+		return s.Stat(key)
+	}
+	obj, err := source.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	obj.GetBody().Close()
+	return &storage.ObjectInfo{Size: obj.GetContentLength(), ContentType: obj.GetContentType()}, nil
+}
+
+// planLine is a line of a plan, either an object or the summary closing it
+type planLine struct {
+	Type        string       `json:"type"`
+	OID         string       `json:"oid,omitempty"`
+	Size        int64        `json:"size,omitempty"`
+	ContentType string       `json:"content_type,omitempty"`
+	Present     bool         `json:"present,omitempty"`
+	Missing     bool         `json:"missing,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	Summary     *planSummary `json:"summary,omitempty"`
+}
+
+type planClass struct {
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+type planSummary struct {
+	RunID          string               `json:"run_id"`
+	Time           string               `json:"time"`
+	Objects        int                  `json:"objects"`
+	Bytes          int64                `json:"bytes"`
+	Missing        int                  `json:"missing"`
+	Errors         int                  `json:"errors"`
+	Present        int                  `json:"present"`
+	PresentBytes   int64                `json:"present_bytes"`
+	ToCopy         int                  `json:"to_copy"`
+	ToCopyBytes    int64                `json:"to_copy_bytes"`
+	Sizes          map[string]planClass `json:"sizes"`
+	Throughput     float64              `json:"throughput_bps"`
+	EstimatedHours float64              `json:"estimated_hours"`
+}
+
+func (t *planSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Plan %s: %d objects, %s\n", t.RunID, t.Objects, formatBytes(float64(t.Bytes)))
+	fmt.Fprintf(&b, "  missing on source: %d\n", t.Missing)
+	fmt.Fprintf(&b, "  source errors: %d\n", t.Errors)
+	fmt.Fprintf(&b, "  already present: %d, %s\n", t.Present, formatBytes(float64(t.PresentBytes)))
+	fmt.Fprintf(&b, "  to copy: %d, %s\n", t.ToCopy, formatBytes(float64(t.ToCopyBytes)))
+	b.WriteString("Sizes:\n")
+	for _, c := range planSizeClasses {
+		if s, ok := t.Sizes[c.name]; ok {
+			fmt.Fprintf(&b, "  %s: %d, %s\n", c.name, s.Objects, formatBytes(float64(s.Bytes)))
+		}
+	}
+	fmt.Fprintf(&b, "Estimated duration at %s/s: %s\n", formatBytes(t.Throughput),
+		time.Duration(t.EstimatedHours*float64(time.Hour)).Round(time.Second))
+	return b.String()
+}
+
+// planReporter writes the looked up objects to a plan
+type planReporter struct {
+	sync.Mutex
+	w *bufio.Writer
+	s planSummary
+}
+
+func newPlanReporter(w io.Writer) *planReporter {
+	return &planReporter{
+		w: bufio.NewWriter(w),
+		s: planSummary{RunID: runID, Sizes: map[string]planClass{}},
+	}
+}
+
+func (t *planReporter) write(l planLine) {
+	data, err := json.Marshal(l)
+	if err != nil {
+		log.Errorf("failed to encode plan line: %s", err.Error())
+		return
+	}
+	t.w.Write(append(data, '\n'))
+}
+
+func (t *planReporter) record(r *syncResult) {
+	t.Lock()
+	defer t.Unlock()
+	t.s.Objects++
+	if r.err != nil {
+		// an object failing to be looked up for another reason is kept in
+		// the plan's input
+		missing := isNotFound(r.err)
+		if missing {
+			t.s.Missing++
+		} else {
+			t.s.Errors++
+		}
+		t.write(planLine{Type: "object", OID: r.oldKey, Missing: missing, Error: r.err.Error()})
+		return
+	}
+
+	t.s.Bytes += r.size
+	for _, c := range planSizeClasses {
+		if c.limit < 0 || r.size < c.limit {
+			s := t.s.Sizes[c.name]
+			s.Objects++
+			s.Bytes += r.size
+			t.s.Sizes[c.name] = s
+			break
+		}
+	}
+	if r.present {
+		t.s.Present++
+		t.s.PresentBytes += r.size
+	} else {
+		t.s.ToCopy++
+		t.s.ToCopyBytes += r.size
+	}
+	t.write(planLine{Type: "object", OID: r.oldKey, Size: r.size, ContentType: r.contentType, Present: r.present})
+}
+
+// close writes the summary closing the plan
+func (t *planReporter) close() (*planSummary, error) {
+	t.Lock()
+	defer t.Unlock()
+	t.s.Time = time.Now().UTC().Format(time.RFC3339)
+	t.s.Throughput = PlanThroughput
+	if PlanThroughput > 0 {
+		t.s.EstimatedHours = float64(t.s.ToCopyBytes) / PlanThroughput / 3600
+	}
+	s := t.s
+	t.write(planLine{Type: "summary", Summary: &s})
+	return &s, t.w.Flush()
+}
+
+// planEnumerator reads a plan, skipping the objects already present and the
+// ones missing on the source, the ones failing to be looked up being kept
+type planEnumerator struct {
+	r       io.Reader
+	rejects *rejectWriter
+}
+
+func (t *planEnumerator) enumerate(emit func(syncObjItem) bool) error {
+	return readLinesUntil(t.r, func(line string) bool {
+		item, ok := t.parse(line)
+		return !ok || emit(item)
+	})
+}
+
+func (t *planEnumerator) parse(line string) (syncObjItem, bool) {
+	if strings.TrimSpace(line) == "" {
+		return syncObjItem{}, false
+	}
+	var l planLine
+	if err := json.Unmarshal([]byte(line), &l); err != nil {
+		t.rejects.reject(line, err)
+		return syncObjItem{}, false
+	}
+	if l.Type != "object" || l.Present || l.Missing {
+		return syncObjItem{}, false
+	}
+	if l.OID == "" {
+		t.rejects.reject(line, fmt.Errorf("missing oid"))
+		return syncObjItem{}, false
+	}
+	return syncObjItem{key: l.OID}, true
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"s3sync/storage"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// statuses of a pre-flight check
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+// PreflightSampleLines is how many lines of the input the format check reads
+var PreflightSampleLines = 1000
+
+// preflightOptions configures the checks run before a migration
+type preflightOptions struct {
+	skip    bool
+	maxSkew time.Duration
+	// minFree is the free disk in MiB needed by the reports and the state
+	minFree int64
+}
+
+func addPreflightFlags(fs *flag.FlagSet, o *preflightOptions) {
+	fs.DurationVar(&o.maxSkew, "maxclockskew", 5*time.Minute, "clock skew with the s3 servers failing the checks")
+	fs.Int64Var(&o.minFree, "mindiskfree", 1024, "free disk in MiB needed for the reports and the state")
+}
+
+// fileDirs returns the directories of the non-empty paths
+func fileDirs(paths ...string) []string {
+	var dirs []string
+	for _, p := range paths {
+		if p != "" {
+			dirs = append(dirs, filepath.Dir(p))
+		}
+	}
+	return dirs
+}
+
+// spoolDirs returns the directories the run spools to
+func spoolDirs(enumOpts enumOptions) []string {
+	var dirs []string
+	if enumOpts.dedup || enumOpts.oidPattern != "" {
+		dirs = append(dirs, enumOpts.tmpDir)
+	}
+	return dirs
+}
+
+// checkResult is the outcome of a pre-flight check
+type checkResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// preflight runs the checks, collecting their results
+type preflight struct {
+	opts    preflightOptions
+	results []checkResult
+}
+
+func (t *preflight) add(name, status, format string, args ...interface{}) {
+	t.results = append(t.results, checkResult{Name: name, Status: status, Detail: fmt.Sprintf(format, args...)})
+}
+
+// failed returns how many checks failed
+func (t *preflight) failed() int {
+	n := 0
+	for _, r := range t.results {
+		if r.Status == checkFail {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *preflight) String() string {
+	var b strings.Builder
+	for _, r := range t.results {
+		fmt.Fprintf(&b, "%-4s %-24s %s\n", r.Status, r.Name, r.Detail)
+	}
+	return b.String()
+}
+
+// log logs the results, the failed ones as errors
+func (t *preflight) log() {
+	for _, r := range t.results {
+		l := log.WithFields(log.Fields{"check": r.Name, "status": r.Status})
+		switch r.Status {
+		case checkFail:
+			l.Errorf("pre-flight check failed: %s", r.Detail)
+		case checkWarn:
+			l.Warnf("pre-flight check: %s", r.Detail)
+		default:
+			l.Infof("pre-flight check: %s", r.Detail)
+		}
+	}
+}
+
+// runPreflight checks the input, the source, the destinations and the disk
+// of dirs, any of them being skipped when not configured. The destinations
+// get a canary object, so the checks run before the objects are stored by
+// content or locked.
+func runPreflight(opts preflightOptions, enumOpts enumOptions, source storage.StorSrc,
+	dest storage.StorDest, dirs []string) *preflight {
+	t := &preflight{opts: opts}
+	sample := t.checkInput(enumOpts)
+	if source != nil {
+		t.checkSource(source, sample)
+	}
+	if dest != nil {
+		t.checkDest(dest)
+	}
+	t.checkDisk(dirs)
+	return t
+}
+
+// checkInput reads the first lines of the input file with its enumerator,
+// returning the first oid
+func (t *preflight) checkInput(opts enumOptions) string {
+	switch opts.kind {
+	case "", "file", "list", "report", "plan", "csv", "tsv", "jsonl":
+	case "sql":
+		db, err := sql.Open(opts.sqlDriver, opts.sqlDSN)
+		if err == nil {
+			err = db.Ping()
+			db.Close()
+		}
+		if err != nil {
+			t.add("input", checkFail, "failed to connect to the %s database: %s", opts.sqlDriver, err.Error())
+		} else {
+			t.add("input", checkOK, "connected to the %s database", opts.sqlDriver)
+		}
+		return ""
+	default:
+		t.add("input", checkSkip, "%s input not checked", opts.kind)
+		return ""
+	}
+	if opts.file == "" {
+		t.add("input", checkSkip, "no input file")
+		return ""
+	}
+	if opts.file == "-" {
+		t.add("input", checkSkip, "stdin not checked")
+		return ""
+	}
+
+	in, err := openInput(opts.file)
+	if err != nil {
+		t.add("input", checkFail, "%s", err.Error())
+		return ""
+	}
+	defer in.Close()
+	var head bytes.Buffer
+	br := bufio.NewReader(in)
+	lines := 0
+	for ; lines < PreflightSampleLines; lines++ {
+		line, err := br.ReadString('\n')
+		head.WriteString(line)
+		if err == io.EOF {
+			if line == "" {
+				break
+			}
+			lines++
+			break
+		}
+		if err != nil {
+			t.add("input", checkFail, "failed to read %s: %s", opts.file, err.Error())
+			return ""
+		}
+	}
+
+	rejects := newRejectWriter(nil)
+	enum, err := fileEnumerator(opts, &head, rejects)
+	if err != nil {
+		t.add("input", checkFail, "%s", err.Error())
+		return ""
+	}
+	var first string
+	objects, err := enumerateItems(enum, func(item syncObjItem) bool {
+		if first == "" {
+			first = item.key
+		}
+		return true
+	})
+	switch {
+	case err != nil:
+		t.add("input", checkFail, "failed to parse %s: %s", opts.file, err.Error())
+	case lines == 0:
+		t.add("input", checkWarn, "%s is empty", opts.file)
+	case rejects.rejected() > 0 && objects == 0:
+		t.add("input", checkFail, "%s: the first %d lines are all rejected, %s", opts.file, lines, rejects.lines()[0])
+	case rejects.rejected() > 0:
+		t.add("input", checkWarn, "%s: %d of the first %d lines rejected", opts.file, rejects.rejected(), lines)
+	default:
+		t.add("input", checkOK, "%s: %d objects in the first %d lines", opts.file, objects, lines)
+	}
+	return first
+}
+
+// checkSource reads the beginning of sample, a random oid telling whether
+// wos answers when there's no sample
+func (t *preflight) checkSource(source storage.StorSrc, sample string) {
+	if sample == "" {
+		oid := "s3sync-preflight-" + uuid.New().String()
+		_, err := statSource(source, oid)
+		switch {
+		case err == nil || isNotFound(err):
+			t.add("source", checkOK, "reachable")
+		default:
+			t.add("source", checkFail, "unreachable: %s", err.Error())
+		}
+		return
+	}
+	obj, err := source.Read(sample)
+	switch {
+	case isNotFound(err):
+		t.add("source", checkWarn, "reachable, sample %s not found", sample)
+		return
+	case err != nil:
+		t.add("source", checkFail, "failed to read sample %s: %s", sample, err.Error())
+		return
+	}
+	body := obj.GetBody()
+	defer body.Close()
+	n, err := io.CopyN(ioutil.Discard, body, 1<<20)
+	if err != nil && err != io.EOF {
+		t.add("source", checkFail, "failed to read sample %s: %s", sample, err.Error())
+		return
+	}
+	t.add("source", checkOK, "read %s of sample %s", formatBytes(float64(n)), sample)
+}
+
+// checkDest probes the bucket and the clock of each s3 destination and
+// writes, reads back and deletes a canary object on each destination
+func (t *preflight) checkDest(dest storage.StorDest) {
+	names := []string{""}
+	dests := []storage.StorDest{dest}
+	if multi, ok := dest.(*storage.MultiStorage); ok {
+		names, dests = multi.Names, multi.Dests
+	}
+	for i, d := range dests {
+		suffix := ""
+		if len(dests) > 1 {
+			suffix = " " + names[i]
+		}
+		if s3, ok := d.(*storage.S3Storage); ok {
+			if !t.checkBucket(s3, suffix) {
+				continue
+			}
+		}
+		t.checkCanary(d, suffix)
+	}
+}
+
+// checkBucket checks the bucket and the clock of an s3 destination,
+// returning whether the bucket is accessible
+func (t *preflight) checkBucket(s3 *storage.S3Storage, suffix string) bool {
+	serverTime, err := s3.Probe()
+	switch {
+	case err == nil:
+		t.add("bucket"+suffix, checkOK, "%s readable", s3.Bucket)
+	case isNotFound(err):
+		t.add("bucket"+suffix, checkFail, "%s not found", s3.Bucket)
+	case errorCode(err) == "Forbidden":
+		t.add("bucket"+suffix, checkFail, "%s forbidden, check the credentials and permissions", s3.Bucket)
+	default:
+		t.add("bucket"+suffix, checkFail, "%s: %s", s3.Bucket, err.Error())
+	}
+	if serverTime.IsZero() {
+		t.add("clock"+suffix, checkSkip, "no server time")
+		return err == nil
+	}
+	skew := time.Since(serverTime)
+	if skew < 0 {
+		skew = -skew
+	}
+	// the date header is to the second
+	skew = skew.Truncate(time.Second)
+	if skew > t.opts.maxSkew {
+		t.add("clock"+suffix, checkFail, "skew %s with %s, over %s", skew, s3.Endpoint, t.opts.maxSkew)
+	} else {
+		t.add("clock"+suffix, checkOK, "skew %s with %s", skew, s3.Endpoint)
+	}
+	return err == nil
+}
+
+// checkCanary writes a canary object, reads it back and deletes it
+func (t *preflight) checkCanary(d storage.StorDest, suffix string) {
+	key := KeyPrefix + ".s3sync-canary-" + runID
+	data := []byte("s3sync canary " + runID)
+	if _, err := d.Write(key, &bundleObject{contentType: "text/plain", data: data}); err != nil {
+		t.add("put"+suffix, checkFail, "failed to write %s: %s", key, err.Error())
+		return
+	}
+	t.add("put"+suffix, checkOK, "wrote %s", key)
+	obj, err := d.Read(key)
+	if err == nil {
+		var got []byte
+		got, err = ioutil.ReadAll(obj.GetBody())
+		obj.GetBody().Close()
+		if err == nil && !bytes.Equal(got, data) {
+			err = fmt.Errorf("read back %d bytes differing from the %d written", len(got), len(data))
+		}
+	}
+	if err != nil {
+		t.add("get"+suffix, checkFail, "failed to read %s: %s", key, err.Error())
+	} else {
+		t.add("get"+suffix, checkOK, "read %s back", key)
+	}
+	del, ok := d.(storage.Deleter)
+	if !ok {
+		t.add("delete"+suffix, checkSkip, "unsupported destination, %s left", key)
+		return
+	}
+	if err := del.Delete(key); err != nil {
+		t.add("delete"+suffix, checkFail, "failed to delete %s: %s", key, err.Error())
+		return
+	}
+	t.add("delete"+suffix, checkOK, "deleted %s", key)
+}
+
+// checkDisk checks the free space of the file systems of dirs, the system
+// temporary directory for an empty one
+func (t *preflight) checkDisk(dirs []string) {
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		free, err := diskFree(dir)
+		switch {
+		case err != nil:
+			t.add("disk "+dir, checkWarn, "%s", err.Error())
+		case free < t.opts.minFree<<20:
+			t.add("disk "+dir, checkFail, "%s free, under %d MiB", formatBytes(float64(free)), t.opts.minFree)
+		default:
+			t.add("disk "+dir, checkOK, "%s free", formatBytes(float64(free)))
+		}
+	}
+}
+
+// checkCommand runs the pre-flight checks of what's configured, exiting
+// with 1 when one fails:
+//
+//	check -oidfile oids.list -wos ... -ak ... -endpoint ... -report sync.report
+func checkCommand(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	cfg := addConfigFlags(fs)
+	reportFile := fs.String("report", "", "sync report whose disk is checked")
+	statePath := fs.String("state", "", "state store whose disk is checked")
+	summaryFile := fs.String("summary", "", "summary whose disk is checked")
+	asJSON := fs.Bool("json", false, "write the results as json lines")
+	storOpts := storOptions{}
+	addStorFlags(fs, &storOpts)
+	enumOpts := enumOptions{}
+	addEnumFlags(fs, &enumOpts)
+	addDedupFlags(fs)
+	opts := preflightOptions{}
+	addPreflightFlags(fs, &opts)
+	fs.Parse(args)
+	if err := cfg.load(); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	var source storage.StorSrc
+	if storOpts.hasSource() {
+		var err error
+		if source, err = storOpts.source(); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	var dest storage.StorDest
+	if storOpts.hasDest() {
+		var err error
+		if dest, err = storOpts.dest(); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	dirs := append(fileDirs(*reportFile, *statePath, *summaryFile), spoolDirs(enumOpts)...)
+	checks := runPreflight(opts, enumOpts, source, dest, dirs)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range checks.results {
+			enc.Encode(r)
+		}
+	} else {
+		fmt.Print(checks.String())
+	}
+	if n := checks.failed(); n > 0 {
+		log.Errorf("%d pre-flight checks failed", n)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"s3sync/storage"
+)
+
+// checkStatuses returns the status of each check by name
+func checkStatuses(p *preflight) map[string]string {
+	statuses := map[string]string{}
+	for _, r := range p.results {
+		statuses[r.Name] = r.Status
+	}
+	return statuses
+}
+
+func TestPreflight(t *testing.T) {
+	wos := setupWosServer(t, []string{"k0", "k1"})
+	defer wos.Close()
+	source := storage.NewWosStorage(strings.TrimPrefix(wos.URL, "http://"))
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	dest := storage.NewS3Storage(s3Server.URL, "u1", "s1", bucket)
+	dir, err := ioutil.TempDir("", "preflight")
+	if err != nil {
+		t.Errorf("failed to create temp dir: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+	oids := filepath.Join(dir, "oids.list")
+	ioutil.WriteFile(oids, []byte("k0\nk1\n"), 0644)
+
+	opts := preflightOptions{maxSkew: 5 * time.Minute}
+	enumOpts := enumOptions{kind: "file", file: oids}
+	p := runPreflight(opts, enumOpts, source, dest, []string{dir})
+	if p.failed() != 0 {
+		t.Errorf("unexpected failed checks:\n%s", p)
+		return
+	}
+	statuses := checkStatuses(p)
+	for _, name := range []string{"input", "source", "bucket", "clock", "put", "get", "delete", "disk " + dir} {
+		if statuses[name] != checkOK {
+			t.Errorf("unexpected %s check:\n%s", name, p)
+		}
+	}
+	if _, err := dest.Stat(".s3sync-canary-" + runID); !isNotFound(err) {
+		t.Errorf("canary left: %v", err)
+	}
+
+	// the sample of the input is missing from the source
+	ioutil.WriteFile(oids, []byte("missing\nk1\n"), 0644)
+	p = runPreflight(opts, enumOpts, source, nil, nil)
+	if checkStatuses(p)["source"] != checkWarn || p.failed() != 0 {
+		t.Errorf("unexpected checks of a missing sample:\n%s", p)
+	}
+
+	cases := []struct {
+		name     string
+		opts     preflightOptions
+		enumOpts enumOptions
+		source   storage.StorSrc
+		dest     storage.StorDest
+		failed   string
+	}{
+		{"missing bucket", opts, enumOptions{}, nil, storage.NewS3Storage(s3Server.URL, "u1", "s1", "nobucket"), "bucket"},
+		{"unreachable source", opts, enumOptions{}, storage.NewWosStorage("127.0.0.1:1"), nil, "source"},
+		{"missing input", opts, enumOptions{kind: "list", file: filepath.Join(dir, "none")}, nil, nil, "input"},
+		{"missing column", opts, enumOptions{kind: "csv", file: oids}, nil, nil, "input"},
+		{"unparsable input", opts, enumOptions{kind: "jsonl", file: oids, field: "oid"}, nil, nil, "input"},
+		{"full disk", preflightOptions{maxSkew: time.Minute, minFree: 1 << 40}, enumOptions{}, nil, nil, "disk " + dir},
+	}
+	for _, c := range cases {
+		p := runPreflight(c.opts, c.enumOpts, c.source, c.dest, []string{dir})
+		if checkStatuses(p)[c.failed] != checkFail || p.failed() != 1 {
+			t.Errorf("%s: unexpected checks:\n%s", c.name, p)
+		}
+	}
+
+	// a server clock an hour ahead fails the clock check
+	u, _ := url.Parse(s3Server.URL)
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		resp.Header.Set("Date", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+		return nil
+	}
+	skewed := httptest.NewServer(proxy)
+	defer skewed.Close()
+	p = runPreflight(opts, enumOptions{}, nil, storage.NewS3Storage(skewed.URL, "u1", "s1", bucket), nil)
+	if statuses := checkStatuses(p); statuses["clock"] != checkFail || statuses["bucket"] != checkOK || p.failed() != 1 {
+		t.Errorf("unexpected checks of a skewed clock:\n%s", p)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DedupPartitions is how many files the oids are spread over when deduping,
+// each partition has to fit in memory
+var DedupPartitions = 256
+
+type prescanOptions struct {
+	dedup   bool
+	pattern *regexp.Regexp
+	tmpDir  string
+}
+
+type prescanStats struct {
+	total      int
+	invalid    int
+	duplicates int
+	queued     int
+}
+
+// spoolItem is how a syncObjItem is kept on disk
+type spoolItem struct {
+	Key   string   `json:"k"`
+	Dests []string `json:"d,omitempty"`
+}
+
+// spoolEnumerator serves the objects left by prescan
+type spoolEnumerator struct {
+	dir  string
+	path string
+}
+
+func (t *spoolEnumerator) enumerate(emit func(syncObjItem) bool) error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return readLinesUntil(f, func(line string) bool {
+		var item spoolItem
+		if err := json.Unmarshal([]byte(line), &item); err != nil {
+			log.Errorf("corrupted spool entry: %s, skip", line)
+			return true
+		}
+		return emit(syncObjItem{key: item.Key, dests: item.Dests})
+	})
+}
+
+func (t *spoolEnumerator) Close() error {
+	return os.RemoveAll(t.dir)
+}
+
+// validateOID rejects empty keys, keys holding control characters and keys
+// not matching pattern
+func validateOID(key string, pattern *regexp.Regexp) error {
+	if key == "" {
+		return fmt.Errorf("empty oid")
+	}
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("control character in oid")
+		}
+	}
+	if pattern != nil && !pattern.MatchString(key) {
+		return fmt.Errorf("oid doesn't match %s", pattern.String())
+	}
+	return nil
+}
+
+// prescan runs enum to its end before anything is dispatched, rejecting the
+// invalid oids and dropping the duplicated ones, so the counts are known
+// before the run starts. The objects left are spooled to disk.
+//
+// Dedup doesn't hold every oid in memory: the oids are first spread by hash
+// over DedupPartitions files, then each file is deduped on its own. The
+// dispatch order follows the partitions, not the input.
+func prescan(enum enumerator, opts prescanOptions, rejects *rejectWriter) (*spoolEnumerator, prescanStats, error) {
+	var stats prescanStats
+	dir, err := ioutil.TempDir(opts.tmpDir, "s3sync-prescan")
+	if err != nil {
+		return nil, stats, err
+	}
+	spool := &spoolEnumerator{dir: dir, path: filepath.Join(dir, "spool")}
+	fail := func(err error) (*spoolEnumerator, prescanStats, error) {
+		spool.Close()
+		return nil, stats, err
+	}
+
+	out, err := newSpoolWriter(spool.path)
+	if err != nil {
+		return fail(err)
+	}
+	defer out.Close()
+
+	var parts []*spoolWriter
+	if opts.dedup {
+		parts = make([]*spoolWriter, DedupPartitions)
+		for i := range parts {
+			if parts[i], err = newSpoolWriter(filepath.Join(dir, fmt.Sprintf("part%04d", i))); err != nil {
+				for _, p := range parts[:i] {
+					p.Close()
+				}
+				return fail(err)
+			}
+		}
+	}
+
+	var writeErr error
+	err = enum.enumerate(func(item syncObjItem) bool {
+		stats.total++
+		item.key = strings.TrimSpace(item.key)
+		if err := validateOID(item.key, opts.pattern); err != nil {
+			stats.invalid++
+			rejects.reject(item.key, err)
+			return true
+		}
+		w := out
+		if opts.dedup {
+			h := fnv.New64a()
+			h.Write([]byte(item.key))
+			w = parts[h.Sum64()%uint64(len(parts))]
+		}
+		writeErr = w.write(item)
+		return writeErr == nil
+	})
+	for _, p := range parts {
+		if e := p.Close(); e != nil && writeErr == nil {
+			writeErr = e
+		}
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if writeErr != nil {
+		return fail(writeErr)
+	}
+
+	for _, p := range parts {
+		n, err := dedupPartition(p.path, out)
+		if err != nil {
+			return fail(err)
+		}
+		stats.duplicates += n
+		os.Remove(p.path)
+	}
+	if err := out.Close(); err != nil {
+		return fail(err)
+	}
+	stats.queued = stats.total - stats.invalid - stats.duplicates
+
+	log.Infof("Prescanned %d objects: %d invalid, %d duplicated, %d to be migrated",
+		stats.total, stats.invalid, stats.duplicates, stats.queued)
+	return spool, stats, nil
+}
+
+// dedupPartition copies the first occurrence of every oid of a partition to
+// out and returns how many duplicates were dropped
+func dedupPartition(path string, out *spoolWriter) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	dups := 0
+	seen := map[[md5.Size]byte]struct{}{}
+	err = readLines(f, func(line string) {
+		var item spoolItem
+		if err := json.Unmarshal([]byte(line), &item); err != nil {
+			return
+		}
+		fp := md5.Sum([]byte(item.Key))
+		if _, ok := seen[fp]; ok {
+			log.Debugf("duplicated object %s, skip", item.Key)
+			dups++
+			return
+		}
+		seen[fp] = struct{}{}
+		out.w.WriteString(line + "\n")
+	})
+	return dups, err
+}
+
+type spoolWriter struct {
+	path string
+	f    *os.File
+	w    *bufio.Writer
+}
+
+func newSpoolWriter(path string) (*spoolWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &spoolWriter{path: path, f: f, w: bufio.NewWriterSize(f, 32*1024)}, nil
+}
+
+func (t *spoolWriter) write(item syncObjItem) error {
+	data, err := json.Marshal(spoolItem{Key: item.key, Dests: item.dests})
+	if err != nil {
+		return err
+	}
+	t.w.Write(data)
+	return t.w.WriteByte('\n')
+}
+
+// Close flushes and closes the file, it's a no-op once closed
+func (t *spoolWriter) Close() error {
+	if t.f == nil {
+		return nil
+	}
+	err := t.w.Flush()
+	if e := t.f.Close(); e != nil && err == nil {
+		err = e
+	}
+	t.f = nil
+	return err
+}
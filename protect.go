@@ -0,0 +1,237 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"s3sync/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errClassConflict is an object whose key already holds a different content
+const errClassConflict = "conflict"
+
+var (
+	// NoOverwrite refuses to replace a destination object holding a
+	// different content, skipping the ones already holding the same
+	NoOverwrite = false
+	// LockMode, LockDays and LegalHold are the object lock of the uploads
+	LockMode  = ""
+	LockDays  = 0
+	LegalHold = false
+
+	objectLock *storage.ObjectLock
+)
+
+func addProtectFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&NoOverwrite, "nooverwrite", NoOverwrite, "refuse to overwrite a destination object with a different content")
+	fs.StringVar(&LockMode, "lockmode", LockMode, "object lock retention mode of the uploads: GOVERNANCE or COMPLIANCE")
+	fs.IntVar(&LockDays, "lockdays", LockDays, "object lock retention of the uploads, in days")
+	fs.BoolVar(&LegalHold, "legalhold", LegalHold, "put a legal hold on the uploads")
+}
+
+// setupProtection checks the object lock flags
+func setupProtection() error {
+	objectLock = nil
+	mode := strings.ToUpper(LockMode)
+	switch mode {
+	case "":
+		if LockDays != 0 {
+			return fmt.Errorf("lock days without a lock mode")
+		}
+	case "GOVERNANCE", "COMPLIANCE":
+		if LockDays <= 0 {
+			return fmt.Errorf("invalid lock days: %d", LockDays)
+		}
+	default:
+		return fmt.Errorf("unknown lock mode: %s", LockMode)
+	}
+	if mode != "" || LegalHold {
+		objectLock = &storage.ObjectLock{
+			Mode:      mode,
+			Retention: time.Duration(LockDays) * 24 * time.Hour,
+			LegalHold: LegalHold,
+		}
+	}
+	return nil
+}
+
+// setProtection applies the object lock to the s3 destinations of dest and
+// logs whether their buckets keep the versions of the overwritten objects
+func setProtection(dest storage.StorDest) {
+	dests := []storage.StorDest{dest}
+	if multi, ok := dest.(*storage.MultiStorage); ok {
+		dests = multi.Dests
+	}
+	for _, d := range dests {
+		s3, ok := d.(*storage.S3Storage)
+		if !ok {
+			continue
+		}
+		s3.Lock = objectLock
+		status, err := s3.Versioning()
+		switch {
+		case err != nil:
+			log.Warnf("failed to get the versioning of bucket %s: %s", s3.Bucket, err.Error())
+		case status == "Enabled":
+			log.Infof("bucket %s is versioned, the report records the version ids", s3.Bucket)
+		case objectLock != nil:
+			log.Warnf("bucket %s is not versioned, object lock needs versioning", s3.Bucket)
+		case !NoOverwrite:
+			log.Warnf("bucket %s is not versioned, overwritten objects are lost", s3.Bucket)
+		}
+	}
+}
+
+// metaMD5 is the md5 of the original content of a copy written with
+// -nooverwrite
+const metaMD5 = "s3sync-md5"
+
+// overwriteError fails the sync of an object whose key already holds a
+// different content, or was written by another writer during the sync
+type overwriteError struct {
+	key        string
+	dest       string
+	srcMD5     string
+	dstMD5     string
+	concurrent bool
+}
+
+func (t *overwriteError) Error() string {
+	at := t.key
+	if t.dest != "" {
+		at += " on " + t.dest
+	}
+	switch {
+	case t.concurrent:
+		return fmt.Sprintf("refused to overwrite %s: written concurrently", at)
+	case t.dstMD5 == "":
+		return fmt.Sprintf("refused to overwrite %s: source %s, dest without a recorded md5", at, t.srcMD5)
+	}
+	return fmt.Sprintf("refused to overwrite %s: source %s, dest %s", at, t.srcMD5, t.dstMD5)
+}
+
+func (t *overwriteError) Code() string {
+	return "overwrite_refused"
+}
+
+// protectedObject is written only when its key is free, with the md5 of its
+// original content in its metadata
+type protectedObject struct {
+	storage.SyncObject
+	md5 string
+}
+
+func (t *protectedObject) GetMetadata() map[string]string {
+	meta := map[string]string{metaMD5: strings.Trim(t.md5, "\"")}
+	for k, v := range storage.Metadata(t.SyncObject) {
+		meta[k] = v
+	}
+	return meta
+}
+
+func (t *protectedObject) Exclusive() bool {
+	return true
+}
+
+// existingCopy is a copy of key on a destination, missing when absent, with
+// the md5 of its original content when its head tells it
+type existingCopy struct {
+	name    string
+	md5     string
+	missing bool
+}
+
+// headMD5 returns the md5 of the original content of a copy from its head:
+// the recorded one, or the etag of a copy written as is in a single part
+func headMD5(info *storage.ObjectInfo) string {
+	if sum := info.Metadata[metaMD5]; sum != "" {
+		return "\"" + sum + "\""
+	}
+	if info.Metadata[metaTransform] != "" || info.Metadata[metaEncryption] != "" || strings.Contains(info.ETag, "-") {
+		return ""
+	}
+	return info.ETag
+}
+
+// statCopies looks the copies of key up on target, on the selected
+// destinations of a fan-out one, without reading them
+func statCopies(syncObj syncObjItem, target storage.StorDest, key string) ([]existingCopy, error) {
+	dests := map[string]storage.StorDest{"": target}
+	if multi, ok := target.(*storage.MultiStorage); ok {
+		dests = map[string]storage.StorDest{}
+		names := syncObj.dests
+		if len(names) == 0 {
+			names = multi.Names
+		}
+		for _, name := range names {
+			dests[name] = multi.Dest(name)
+		}
+	}
+	var copies []existingCopy
+	for name, d := range dests {
+		if d == nil {
+			return nil, fmt.Errorf("unknown destination: %s", name)
+		}
+		s, ok := d.(storage.Statter)
+		if !ok {
+			return nil, fmt.Errorf("destination %s can't look an object up", name)
+		}
+		info, err := s.Stat(key)
+		if isNotFound(err) {
+			copies = append(copies, existingCopy{name: name, missing: true})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		copies = append(copies, existingCopy{name: name, md5: headMD5(info)})
+	}
+	return copies, nil
+}
+
+// checkOverwrite compares the md5 of r with the ones of the copies already
+// on target, from their heads, before it's written. It returns the object to
+// write from a new read of the source, nil when every copy already holds the
+// content, with the destinations left to write on a fan-out target, or the
+// class of the error refusing the write. The source md5 is kept in res, the
+// object being written with it by a conditional put.
+func checkOverwrite(syncObj *syncObjItem, target storage.StorDest, source storage.StorSrc,
+	r storage.SyncObject, res *syncResult) (storage.SyncObject, string, error) {
+	srcMD5, err := storage.CalcMD5(r.GetBody())
+	r.GetBody().Close()
+	if err != nil {
+		return nil, errClassRead, err
+	}
+	copies, err := statCopies(*syncObj, target, res.destKey)
+	if err != nil {
+		return nil, errClassVerify, fmt.Errorf("failed to look the existing copy up: %s", err.Error())
+	}
+	var missing []string
+	for _, c := range copies {
+		switch {
+		case c.missing:
+			missing = append(missing, c.name)
+		case c.md5 != srcMD5:
+			return nil, errClassConflict, &overwriteError{key: res.destKey, dest: c.name, srcMD5: srcMD5, dstMD5: c.md5}
+		}
+	}
+	res.srcMD5 = srcMD5
+	if len(missing) == 0 {
+		res.unchanged = true
+		res.dstMD5 = srcMD5
+		return nil, "", nil
+	}
+
+	if len(missing) < len(copies) {
+		syncObj.dests = missing
+	}
+	obj, err := source.Read(syncObj.key)
+	if err != nil {
+		return nil, errClassRead, err
+	}
+	return inflight.watch(syncObj.transfer, obj), "", nil
+}
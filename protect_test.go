@@ -0,0 +1,246 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"s3sync/storage"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// lockRecorder proxies to an s3 server, recording the headers of the
+// uploads and the gets by key. It refuses the puts with If-None-Match to an
+// existing key, which the test server ignores.
+type lockRecorder struct {
+	sync.Mutex
+	puts map[string]http.Header
+	gets map[string]int
+	// afterHead is called with the path of each head once served
+	afterHead func(path string)
+}
+
+func (t *lockRecorder) serve(target string) (*httptest.Server, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && r.URL.Query().Get("versioning") == "" {
+			t.Lock()
+			t.puts[r.URL.Path] = r.Header.Clone()
+			t.Unlock()
+			if r.Header.Get("If-None-Match") == "*" {
+				if resp, err := http.Head(target + r.URL.Path); err == nil && resp.StatusCode == http.StatusOK {
+					w.WriteHeader(http.StatusPreconditionFailed)
+					w.Write([]byte("<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>"))
+					return
+				}
+			}
+		}
+		if r.Method == "GET" && r.URL.RawQuery == "" {
+			t.Lock()
+			t.gets[r.URL.Path]++
+			t.Unlock()
+		}
+		proxy.ServeHTTP(w, r)
+		if r.Method == "HEAD" && t.afterHead != nil {
+			t.afterHead(r.URL.Path)
+		}
+	})), nil
+}
+
+func TestProtection(t *testing.T) {
+	defer func() {
+		NoOverwrite, LockMode, LockDays, LegalHold = false, "", 0, false
+		setupProtection()
+	}()
+
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	recorder := &lockRecorder{puts: map[string]http.Header{}, gets: map[string]int{}}
+	proxy, err := recorder.serve(s3Server.URL)
+	if err != nil {
+		t.Errorf("failed to start proxy: %s", err.Error())
+		return
+	}
+	defer proxy.Close()
+
+	dest := storage.NewS3Storage(proxy.URL, "u1", "s1", bucket)
+	if status, err := dest.Versioning(); err != nil || status != "" {
+		t.Errorf("unexpected versioning: %q, %v", status, err)
+		return
+	}
+	svc := s3.New(session.New(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("u1", "s1", ""),
+		Endpoint:         aws.String(s3Server.URL),
+		Region:           aws.String("eu-central-1"),
+		DisableSSL:       aws.Bool(true),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+	_, err = svc.PutBucketVersioning(&s3.PutBucketVersioningInput{
+		Bucket:                  aws.String(bucket),
+		VersioningConfiguration: &s3.VersioningConfiguration{Status: aws.String(s3.BucketVersioningStatusEnabled)},
+	})
+	if err != nil {
+		t.Errorf("failed to enable versioning: %s", err.Error())
+		return
+	}
+	if status, err := dest.Versioning(); err != nil || status != "Enabled" {
+		t.Errorf("unexpected versioning: %q, %v", status, err)
+		return
+	}
+
+	NoOverwrite, LockMode, LockDays, LegalHold = true, "governance", 30, true
+	if err := setupProtection(); err != nil {
+		t.Errorf("failed to set up protection: %s", err.Error())
+		return
+	}
+	setProtection(dest)
+	if dest.Lock == nil || dest.Lock.Mode != "GOVERNANCE" {
+		t.Errorf("unexpected lock: %+v", dest.Lock)
+		return
+	}
+
+	source := newMemStorage(2)
+	lines, _ := jsonRun(t, dest, source, "k0", "k1")
+	versions := map[string]string{}
+	for _, oid := range []string{"k0", "k1"} {
+		l := lines[oid]
+		if l.Status != "ok" || !l.Verified || l.VersionID == "" || l.Unchanged {
+			t.Errorf("unexpected report of %s: %+v", oid, l)
+		}
+		versions[oid] = l.VersionID
+		h := recorder.puts["/"+bucket+"/"+oid]
+		if h.Get("X-Amz-Object-Lock-Mode") != "GOVERNANCE" || h.Get("X-Amz-Object-Lock-Legal-Hold") != "ON" ||
+			h.Get("X-Amz-Object-Lock-Retain-Until-Date") == "" {
+			t.Errorf("unexpected lock headers of %s: %v", oid, h)
+		}
+		if h.Get("If-None-Match") != "*" || h.Get("X-Amz-Meta-S3sync-Md5") == "" {
+			t.Errorf("unexpected conditional write of %s: %v", oid, h)
+		}
+	}
+
+	// the copies holding the content are left as they are, without reading
+	// them
+	recorder.puts = map[string]http.Header{}
+	recorder.gets = map[string]int{}
+	lines, _ = jsonRun(t, dest, source, "k0", "k1")
+	for _, oid := range []string{"k0", "k1"} {
+		if l := lines[oid]; l.Status != "ok" || !l.Verified || !l.Unchanged || l.SourceMD5 != l.DestMD5 {
+			t.Errorf("unexpected report of %s: %+v", oid, l)
+		}
+	}
+	if len(recorder.puts) != 0 || len(recorder.gets) != 0 {
+		t.Errorf("unchanged objects read or written: %v, %v", recorder.gets, recorder.puts)
+	}
+
+	// a different content is refused
+	source.objects["k1"] = []byte("other content")
+	lines, _ = jsonRun(t, dest, source, "k0", "k1")
+	if l := lines["k0"]; !l.Unchanged {
+		t.Errorf("unexpected report of k0: %+v", l)
+	}
+	l := lines["k1"]
+	if l.Status != "fail" || l.Error == nil || l.Error.Class != errClassConflict || l.Error.Code != "overwrite_refused" {
+		t.Errorf("overwrite not refused: %+v", l)
+	}
+	obj, err := dest.Read("k1")
+	if err != nil {
+		t.Errorf("failed to read k1: %s", err.Error())
+		return
+	}
+	if data, _ := ioutil.ReadAll(obj.GetBody()); string(data) != "k1 content" {
+		t.Errorf("k1 overwritten: %q", data)
+	}
+
+	// a key written by another writer between the check and the write is
+	// left to it
+	source.objects["k2"] = []byte("k2 content")
+	recorder.afterHead = func(path string) {
+		if path != "/"+bucket+"/k2" {
+			return
+		}
+		recorder.afterHead = nil
+		_, err := svc.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String("k2"),
+			Body:   strings.NewReader("concurrent content"),
+		})
+		if err != nil {
+			t.Errorf("failed to write k2: %s", err.Error())
+		}
+	}
+	lines, _ = jsonRun(t, dest, source, "k2")
+	l = lines["k2"]
+	if l.Status != "fail" || l.Error == nil || l.Error.Class != errClassConflict || l.Error.Code != "overwrite_refused" ||
+		!strings.Contains(l.Error.Message, "written concurrently") {
+		t.Errorf("concurrent write not refused: %+v", l)
+	}
+	obj, err = dest.Read("k2")
+	if err != nil {
+		t.Errorf("failed to read k2: %s", err.Error())
+		return
+	}
+	if data, _ := ioutil.ReadAll(obj.GetBody()); string(data) != "concurrent content" {
+		t.Errorf("k2 overwritten: %q", data)
+	}
+
+	// overwriting makes a new version
+	NoOverwrite = false
+	lines, _ = jsonRun(t, dest, source, "k1")
+	if l := lines["k1"]; l.Status != "ok" || !l.Verified || l.VersionID == "" || l.VersionID == versions["k1"] {
+		t.Errorf("unexpected overwrite of k1: %+v", l)
+	}
+
+	// a copy without a recorded md5 is compared by its etag
+	NoOverwrite = true
+	lines, _ = jsonRun(t, dest, source, "k1")
+	if l := lines["k1"]; l.Status != "ok" || !l.Unchanged {
+		t.Errorf("unexpected report of k1: %+v", l)
+	}
+}
+
+func TestSetupProtection(t *testing.T) {
+	defer func() {
+		LockMode, LockDays, LegalHold = "", 0, false
+		setupProtection()
+	}()
+	cases := []struct {
+		mode string
+		days int
+		hold bool
+		ok   bool
+		lock bool
+	}{
+		{"", 0, false, true, false},
+		{"", 0, true, true, true},
+		{"COMPLIANCE", 7, false, true, true},
+		{"governance", 1, true, true, true},
+		{"GOVERNANCE", 0, false, false, false},
+		{"", 7, false, false, false},
+		{"strict", 7, false, false, false},
+	}
+	for _, c := range cases {
+		LockMode, LockDays, LegalHold = c.mode, c.days, c.hold
+		err := setupProtection()
+		if (err == nil) != c.ok || (objectLock != nil) != c.lock {
+			t.Errorf("setupProtection(%s, %d, %v): %+v, %v", c.mode, c.days, c.hold, objectLock, err)
+		}
+	}
+}
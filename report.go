@@ -0,0 +1,648 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reporter writes the result of every object to the report
+type reporter interface {
+	record(r *syncResult)
+}
+
+func newReporter(format string, w *bufio.Writer) (reporter, error) {
+	switch format {
+	case "", "csv":
+		return &csvReporter{w: w}, nil
+	case "jsonl":
+		return &jsonReporter{w: w, runID: runID}, nil
+	}
+	return nil, fmt.Errorf("unknown report format: %s", format)
+}
+
+// csvReporter writes the csv report parsed back by parseReportLine
+type csvReporter struct {
+	w *bufio.Writer
+}
+
+func (t *csvReporter) record(r *syncResult) {
+	r.record(t.w)
+}
+
+// jsonReporter writes a JSON document per object with the full detail
+type jsonReporter struct {
+	w     *bufio.Writer
+	runID string
+}
+
+type jsonReportError struct {
+	Class   string `json:"class"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+type jsonReportDest struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	MD5       string `json:"md5,omitempty"`
+	VersionID string `json:"version_id,omitempty"`
+}
+
+type jsonReportLine struct {
+	RunID       string             `json:"run_id"`
+	Time        string             `json:"time"`
+	OID         string             `json:"oid"`
+	Status      string             `json:"status"`
+	Verified    bool               `json:"verified"`
+	Bucket      string             `json:"bucket,omitempty"`
+	Key         string             `json:"key"`
+	Size        int64              `json:"size"`
+	ContentType string             `json:"content_type,omitempty"`
+	SourceMD5   string             `json:"source_md5,omitempty"`
+	DestMD5     string             `json:"dest_md5,omitempty"`
+	Transform   string             `json:"transform,omitempty"`
+	StoredSize  int64              `json:"stored_size,omitempty"`
+	Encrypted   bool               `json:"encrypted,omitempty"`
+	Bundle      *bundleLocation    `json:"bundle,omitempty"`
+	ContentKey  string             `json:"content_key,omitempty"`
+	Deduped     bool               `json:"deduped,omitempty"`
+	VersionID   string             `json:"version_id,omitempty"`
+	Unchanged   bool               `json:"unchanged,omitempty"`
+	Dests       []jsonReportDest   `json:"dests,omitempty"`
+	Attempts    int                `json:"attempts"`
+	Worker      string             `json:"worker,omitempty"`
+	DurationsMs map[string]float64 `json:"durations_ms"`
+	Error       *jsonReportError   `json:"error,omitempty"`
+}
+
+func (t *jsonReporter) record(r *syncResult) {
+	e := r.reportEntry()
+	line := jsonReportLine{
+		RunID:       t.runID,
+		Time:        time.Unix(e.ts, 0).UTC().Format(time.RFC3339),
+		OID:         r.oldKey,
+		Status:      e.status,
+		Verified:    e.verified,
+		Bucket:      r.bucket,
+		Key:         r.destKey,
+		Size:        r.size,
+		ContentType: r.contentType,
+		SourceMD5:   strings.Trim(r.srcMD5, "\""),
+		DestMD5:     strings.Trim(r.dstMD5, "\""),
+		Transform:   r.transform,
+		StoredSize:  r.storedSize,
+		Encrypted:   r.encrypted,
+		Bundle:      r.bundle,
+		ContentKey:  r.contentKey,
+		Deduped:     r.deduped,
+		VersionID:   r.versionID,
+		Unchanged:   r.unchanged,
+		Attempts:    r.attempts,
+		Worker:      r.worker,
+		DurationsMs: map[string]float64{
+			"read":   durationMs(r.readTime),
+			"write":  durationMs(r.writeTime),
+			"verify": durationMs(r.verifyTime),
+			"total":  durationMs(r.totalTime),
+		},
+	}
+	for _, d := range r.dests {
+		line.Dests = append(line.Dests, jsonReportDest{
+			Name:      d.name,
+			Status:    d.status,
+			MD5:       strings.Trim(d.md5, "\""),
+			VersionID: d.version,
+		})
+	}
+	if r.err != nil {
+		line.Error = &jsonReportError{
+			Class:   r.errClass,
+			Code:    errorCode(r.err),
+			Message: r.err.Error(),
+		}
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		log.Errorf("failed to encode report of %s: %s", r.oldKey, err.Error())
+		return
+	}
+	t.w.Write(data)
+	t.w.WriteByte('\n')
+	t.w.Flush()
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// errorCode returns the wos x-ddn-status or http code, the s3 error code or
+// "timeout" for network timeouts
+func errorCode(err error) string {
+	// storage.WosStatusError and awserr.Error
+	var coded interface{ Code() string }
+	if errors.As(err, &coded) {
+		return coded.Code()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return ""
+}
+
+// destResult is the per-destination outcome of a fan-out write
+type destResult struct {
+	name   string
+	status string
+	md5    string
+	// version is the version id of the copy, not kept by the csv report
+	version string
+}
+
+// quoteReportField quotes s the csv way if it holds a separator
+func quoteReportField(s string) string {
+	if !strings.ContainsAny(s, ",\"\r\n") {
+		return s
+	}
+	return "\"" + strings.ReplaceAll(s, "\"", "\"\"") + "\""
+}
+
+// reportEntry is a line of a report written by syncResult.record
+type reportEntry struct {
+	ts       int64
+	status   string
+	verified bool
+	key      string
+	dests    []destResult
+	errMsg   string
+}
+
+// parseReportLine parses a report line. The key may be quoted and the error
+// is the rest of the line, commas included.
+func parseReportLine(line string) (reportEntry, error) {
+	var e reportEntry
+	parts := strings.SplitN(line, ",", 4)
+	if len(parts) < 4 {
+		return e, fmt.Errorf("expected at least 4 fields, got %d", len(parts))
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("invalid timestamp: %s", parts[0])
+	}
+	e.ts = ts
+	e.status = parts[1]
+	if e.status != "ok" && e.status != "partial" && e.status != "fail" {
+		return e, fmt.Errorf("invalid status: %s", parts[1])
+	}
+	if e.verified, err = strconv.ParseBool(parts[2]); err != nil {
+		return e, fmt.Errorf("invalid verify status: %s", parts[2])
+	}
+
+	rest := parts[3]
+	if strings.HasPrefix(rest, "\"") {
+		var b strings.Builder
+		i := 1
+		for {
+			if i >= len(rest) {
+				return e, fmt.Errorf("unterminated quoted key")
+			}
+			if rest[i] == '"' {
+				if i+1 < len(rest) && rest[i+1] == '"' {
+					b.WriteByte('"')
+					i += 2
+					continue
+				}
+				i++
+				break
+			}
+			b.WriteByte(rest[i])
+			i++
+		}
+		if i < len(rest) && rest[i] != ',' {
+			return e, fmt.Errorf("unexpected character after quoted key")
+		}
+		e.key = b.String()
+		rest = rest[i:]
+	} else if i := strings.IndexByte(rest, ','); i >= 0 {
+		e.key = rest[:i]
+		rest = rest[i:]
+	} else {
+		e.key = rest
+		rest = ""
+	}
+	if strings.TrimSpace(e.key) == "" {
+		return e, fmt.Errorf("empty key")
+	}
+
+	rest = strings.TrimPrefix(rest, ",")
+	if rest != "" {
+		col := rest
+		if i := strings.IndexByte(rest, ','); i >= 0 {
+			col = rest[:i]
+		}
+		if dests, ok := parseDestColumn(col); ok {
+			e.dests = dests
+			rest = strings.TrimPrefix(rest[len(col):], ",")
+		}
+		e.errMsg = rest
+	}
+	return e, nil
+}
+
+// parseJSONReportLine parses a line of a jsonl report
+func parseJSONReportLine(line string) (reportEntry, *jsonReportLine, error) {
+	var e reportEntry
+	var l jsonReportLine
+	if err := json.Unmarshal([]byte(line), &l); err != nil {
+		return e, nil, err
+	}
+	if strings.TrimSpace(l.OID) == "" {
+		return e, nil, fmt.Errorf("empty oid")
+	}
+	if l.Status != "ok" && l.Status != "partial" && l.Status != "fail" {
+		return e, nil, fmt.Errorf("invalid status: %s", l.Status)
+	}
+	ts, err := time.Parse(time.RFC3339, l.Time)
+	if err != nil {
+		return e, nil, fmt.Errorf("invalid time: %s", l.Time)
+	}
+	e = reportEntry{ts: ts.Unix(), status: l.Status, verified: l.Verified, key: l.OID}
+	for _, d := range l.Dests {
+		e.dests = append(e.dests, destResult{name: d.Name, status: d.Status, md5: d.MD5, version: d.VersionID})
+	}
+	if l.Error != nil {
+		e.errMsg = l.Error.Message
+	}
+	return e, &l, nil
+}
+
+// parseAnyReportLine parses a line of a csv or jsonl report, the jsonl line
+// being nil for a csv report
+func parseAnyReportLine(line string) (reportEntry, *jsonReportLine, error) {
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return parseJSONReportLine(line)
+	}
+	e, err := parseReportLine(line)
+	return e, nil, err
+}
+
+const (
+	destOK       = "ok"
+	destFail     = "fail"
+	destMismatch = "mismatch"
+)
+
+// formatDestColumn formats the dest statuses as name=status[:md5];...
+func formatDestColumn(dests []destResult) string {
+	parts := make([]string, len(dests))
+	for i, d := range dests {
+		parts[i] = d.name + "=" + d.status
+		if d.md5 != "" {
+			parts[i] += ":" + strings.Trim(d.md5, "\"")
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// parseDestColumn parses the column written by formatDestColumn, ok is false
+// if col is not a dest status column
+func parseDestColumn(col string) ([]destResult, bool) {
+	col = strings.TrimSpace(col)
+	if col == "" {
+		return nil, false
+	}
+	var dests []destResult
+	for _, part := range strings.Split(col, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || strings.Contains(kv[0], " ") {
+			return nil, false
+		}
+		sv := strings.SplitN(kv[1], ":", 2)
+		d := destResult{name: kv[0], status: sv[0]}
+		if d.status != destOK && d.status != destFail && d.status != destMismatch {
+			return nil, false
+		}
+		if len(sv) == 2 {
+			d.md5 = sv[1]
+		}
+		dests = append(dests, d)
+	}
+	return dests, true
+}
+
+// failedDests returns the destinations a retry has to resend to
+func failedDests(results []destResult) []string {
+	var dests []string
+	for _, d := range results {
+		if d.status != destOK {
+			dests = append(dests, d.name)
+		}
+	}
+	return dests
+}
+
+// formatReportLine formats e the way it's parsed by parseReportLine
+func formatReportLine(e reportEntry) string {
+	var destCol string
+	if len(e.dests) > 0 {
+		destCol = "," + formatDestColumn(e.dests)
+	}
+	line := fmt.Sprintf("%d,%s,%t,%s%s", e.ts, e.status, e.verified, quoteReportField(e.key), destCol)
+	if e.status == "fail" {
+		line += "," + strings.ReplaceAll(e.errMsg, "\n", " ")
+	}
+	return line + "\n"
+}
+
+// formatJSONReportLine formats the merged entry of a jsonl report, the
+// fields but the statuses being the ones of its latest line
+func formatJSONReportLine(m mergedEntry) (string, error) {
+	l := *m.line
+	l.Status, l.Verified = m.status, m.verified
+	l.Dests = nil
+	for _, d := range m.dests {
+		l.Dests = append(l.Dests, jsonReportDest{Name: d.name, Status: d.status, MD5: d.md5, VersionID: d.version})
+	}
+	if m.status == "ok" {
+		l.Error = nil
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n", nil
+}
+
+// reportCommand runs the report operations:
+//
+//	report merge -o merged.csv [-summary summary.txt] report1 report2...
+//
+// The reports are either all csv or all jsonl, the merged one having the
+// same format.
+func reportCommand(args []string) {
+	if len(args) == 0 || args[0] != "merge" {
+		fmt.Fprintf(os.Stderr, "usage: %s report merge -o output [-summary file] report...\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("report merge", flag.ExitOnError)
+	output := fs.String("o", "", "consolidated report")
+	summaryFile := fs.String("summary", "", "summary file, logged only when empty")
+	tmpDir := fs.String("tmpdir", "", "directory for temporary files")
+	fs.Parse(args[1:])
+	if *output == "" || fs.NArg() == 0 {
+		fs.Usage()
+		log.Fatal("missing output or report files")
+	}
+
+	out, err := os.Create(*output)
+	if err != nil {
+		log.Fatalf("failed to create %s: %s", *output, err.Error())
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	stats, err := mergeReports(fs.Args(), w, *tmpDir)
+	if err != nil {
+		log.Fatalf("failed to merge reports: %s", err.Error())
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("failed to write %s: %s", *output, err.Error())
+	}
+
+	summary := stats.String()
+	log.Info(summary)
+	if *summaryFile != "" {
+		if err := ioutil.WriteFile(*summaryFile, []byte(summary), 0644); err != nil {
+			log.Fatalf("failed to write %s: %s", *summaryFile, err.Error())
+		}
+	}
+}
+
+type mergeStats struct {
+	inputs     int
+	lines      int
+	rejected   int
+	objects    int
+	ok         int
+	unverified int
+	partial    int
+	fail       int
+}
+
+func (t *mergeStats) String() string {
+	return fmt.Sprintf("Merged %d reports: %d lines, %d rejected\n"+
+		"Objects: %d\n"+
+		"  ok: %d (unverified %d)\n"+
+		"  partial: %d\n"+
+		"  fail: %d\n",
+		t.inputs, t.lines, t.rejected, t.objects,
+		t.ok, t.unverified, t.partial, t.fail)
+}
+
+// mergeReports consolidates the reports of shards and of retries into one
+// entry per object, the latest entry of an object wins. For fan-out
+// destinations the latest status of every destination wins, so a retry
+// resending to the failed destinations completes the earlier entry.
+//
+// Entries are spread by key hash over partition files first, so only one
+// partition at a time is held in memory. csv and jsonl reports can't be
+// mixed, the merged report has the format of the inputs.
+func mergeReports(inputs []string, w io.Writer, tmpDir string) (mergeStats, error) {
+	stats := mergeStats{inputs: len(inputs)}
+	dir, err := ioutil.TempDir(tmpDir, "s3sync-merge")
+	if err != nil {
+		return stats, err
+	}
+	defer os.RemoveAll(dir)
+
+	parts := make([]*spoolWriter, DedupPartitions)
+	for i := range parts {
+		if parts[i], err = newSpoolWriter(filepath.Join(dir, fmt.Sprintf("part%04d", i))); err != nil {
+			for _, p := range parts[:i] {
+				p.Close()
+			}
+			return stats, err
+		}
+	}
+	closeParts := func() error {
+		var err error
+		for _, p := range parts {
+			if e := p.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+		return err
+	}
+
+	format := ""
+	for _, path := range inputs {
+		in, err := openInput(path)
+		if err != nil {
+			closeParts()
+			return stats, err
+		}
+		mixed := false
+		err = readLines(in, func(line string) {
+			if strings.TrimSpace(line) == "" || mixed {
+				return
+			}
+			stats.lines++
+			e, l, err := parseAnyReportLine(line)
+			if err != nil {
+				stats.rejected++
+				log.Errorf("rejected report line %s: %s", line, err.Error())
+				return
+			}
+			lineFormat := "csv"
+			if l != nil {
+				lineFormat = "jsonl"
+			}
+			if format == "" {
+				format = lineFormat
+			} else if lineFormat != format {
+				mixed = true
+				return
+			}
+			h := fnv.New64a()
+			h.Write([]byte(e.key))
+			p := parts[h.Sum64()%uint64(len(parts))]
+			p.w.WriteString(line + "\n")
+		})
+		in.Close()
+		if err == nil && mixed {
+			err = fmt.Errorf("mixes csv and jsonl reports")
+		}
+		if err != nil {
+			closeParts()
+			return stats, fmt.Errorf("failed to read %s: %s", path, err.Error())
+		}
+	}
+	if err := closeParts(); err != nil {
+		return stats, err
+	}
+
+	for _, p := range parts {
+		entries, err := mergePartition(p.path)
+		if err != nil {
+			return stats, err
+		}
+		for _, e := range entries {
+			stats.objects++
+			switch e.status {
+			case "ok":
+				stats.ok++
+				if !e.verified {
+					stats.unverified++
+				}
+			case "partial":
+				stats.partial++
+			default:
+				stats.fail++
+			}
+			line := formatReportLine(e.reportEntry)
+			if e.line != nil {
+				if line, err = formatJSONReportLine(e); err != nil {
+					return stats, err
+				}
+			}
+			if _, err := io.WriteString(w, line); err != nil {
+				return stats, err
+			}
+		}
+		os.Remove(p.path)
+	}
+	return stats, nil
+}
+
+// mergedEntry is the consolidated entry of an object, with the latest line
+// of a jsonl report
+type mergedEntry struct {
+	reportEntry
+	line *jsonReportLine
+}
+
+// mergePartition returns the consolidated entries of a partition file
+// sorted by key
+func mergePartition(path string) ([]mergedEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	merged := map[string]*mergedEntry{}
+	err = readLines(f, func(line string) {
+		re, l, err := parseAnyReportLine(line)
+		if err != nil {
+			return
+		}
+		e := mergedEntry{reportEntry: re, line: l}
+		prev, ok := merged[e.key]
+		if !ok {
+			merged[e.key] = &e
+			return
+		}
+		if e.ts < prev.ts {
+			e, *prev = *prev, e
+		}
+		if len(e.dests) > 0 && len(prev.dests) > 0 {
+			e.dests = mergeDests(prev.dests, e.dests)
+			e.status = "partial"
+			if len(failedDests(e.dests)) == 0 {
+				e.status = "ok"
+				e.verified = true
+				e.errMsg = ""
+			}
+		}
+		*prev = e
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]mergedEntry, 0, len(merged))
+	for _, e := range merged {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return entries, nil
+}
+
+// mergeDests overrides the dest statuses of older with the ones of newer
+func mergeDests(older, newer []destResult) []destResult {
+	merged := append([]destResult{}, older...)
+	for _, d := range newer {
+		found := false
+		for i := range merged {
+			if merged[i].name == d.name {
+				merged[i] = d
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, d)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].name < merged[j].name
+	})
+	return merged
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"s3sync/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeReports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge")
+	if err != nil {
+		t.Errorf("failed to create temp dir: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	shard0 := filepath.Join(dir, "shard0.csv")
+	ioutil.WriteFile(shard0, []byte(
+		"1577358017,fail,false,k1,wos read error k1: http failed code: 404\n"+
+			"1577358017,ok,true,k2\n"+
+			"1577358020,ok,true,k1\n"), 0644)
+	shard1 := filepath.Join(dir, "shard1.csv")
+	ioutil.WriteFile(shard1, []byte(
+		"1577358017,partial,true,k3,0=ok:aa;1=fail\n"+
+			"1577358017,fail,false,\"k,4\",EOF\n"+
+			"1577358017,ok,false,k5\n"+
+			"garbage\n"+
+			"1577358030,ok,true,k3,1=ok:aa\n"), 0644)
+
+	var out bytes.Buffer
+	stats, err := mergeReports([]string{shard0, shard1}, &out, dir)
+	if err != nil {
+		t.Errorf("failed to merge reports: %s", err.Error())
+		return
+	}
+
+	want := mergeStats{inputs: 2, lines: 8, rejected: 1, objects: 5,
+		ok: 4, unverified: 1, partial: 0, fail: 1}
+	if stats != want {
+		t.Errorf("merge stats got %+v;want %+v", stats, want)
+	}
+
+	entries := map[string]reportEntry{}
+	readLines(&out, func(line string) {
+		e, err := parseReportLine(line)
+		if err != nil {
+			t.Errorf("unexpected merged line %s: %s", line, err.Error())
+			return
+		}
+		if _, ok := entries[e.key]; ok {
+			t.Errorf("duplicated merged entry: %s", line)
+		}
+		entries[e.key] = e
+	})
+	if e := entries["k1"]; e.status != "ok" || e.ts != 1577358020 {
+		t.Errorf("k1 should be ok from the retry: %+v", e)
+	}
+	if e := entries["k3"]; e.status != "ok" || len(e.dests) != 2 || len(failedDests(e.dests)) != 0 {
+		t.Errorf("k3 should be ok on both destinations: %+v", e)
+	}
+	if e := entries["k,4"]; e.status != "fail" || e.errMsg != "EOF" {
+		t.Errorf("unexpected k,4 entry: %+v", e)
+	}
+
+	// jsonl partitions merge into a jsonl report keeping the latest fields
+	json0 := filepath.Join(dir, "shard0.jsonl")
+	ioutil.WriteFile(json0, []byte(
+		`{"time":"2019-12-26T10:00:17Z","oid":"k1","status":"fail","verified":false,"key":"k1","error":{"class":"source_read","message":"EOF"}}`+"\n"+
+			`{"time":"2019-12-26T10:00:17Z","oid":"k3","status":"partial","verified":true,"key":"k3","dests":[{"name":"0","status":"ok","md5":"aa"},{"name":"1","status":"fail"}]}`+"\n"), 0644)
+	json1 := filepath.Join(dir, "shard1.jsonl")
+	ioutil.WriteFile(json1, []byte(
+		`{"time":"2019-12-26T10:00:20Z","oid":"k1","status":"ok","verified":true,"key":"k1","bundle":{"key":"b1","offset":512,"length":3}}`+"\n"+
+			`{"time":"2019-12-26T10:00:30Z","oid":"k3","status":"ok","verified":true,"key":"k3","dests":[{"name":"1","status":"ok","md5":"aa","version_id":"v2"}]}`+"\n"), 0644)
+	out.Reset()
+	if stats, err = mergeReports([]string{json0, json1}, &out, dir); err != nil {
+		t.Errorf("failed to merge jsonl reports: %s", err.Error())
+		return
+	}
+	if stats.objects != 2 || stats.ok != 2 {
+		t.Errorf("unexpected jsonl merge stats: %+v", stats)
+	}
+	lines := readJSONReport(t, out.Bytes())
+	if l := lines["k1"]; l.Status != "ok" || l.Bundle == nil || l.Bundle.Key != "b1" || l.Error != nil {
+		t.Errorf("k1 should be ok from the retry with its bundle: %+v", l)
+	}
+	if l := lines["k3"]; l.Status != "ok" || len(l.Dests) != 2 || l.Dests[1].VersionID != "v2" {
+		t.Errorf("k3 should be ok on both destinations: %+v", l)
+	}
+
+	if _, err := mergeReports([]string{shard0, json1}, &out, dir); err == nil {
+		t.Errorf("csv and jsonl reports shouldn't be merged")
+	}
+}
+
+func TestRunSummary(t *testing.T) {
+	var out bytes.Buffer
+	rep := newSummaryReporter(&csvReporter{w: bufio.NewWriter(&out)})
+	rep.record(&syncResult{oldKey: "k1", verified: true, size: 1000, totalTime: time.Second})
+	rep.record(&syncResult{oldKey: "k2", verified: true, size: 4000, totalTime: 2 * time.Second})
+	rep.record(&syncResult{oldKey: "k3", verified: false, size: 10, totalTime: time.Millisecond})
+	rep.record(&syncResult{oldKey: "k4", verified: true, size: 10,
+		dests: []destResult{{name: "0", status: destOK}, {name: "1", status: destFail}}})
+	rep.record(&syncResult{oldKey: "k5", errClass: errClassRead,
+		err: &storage.WosStatusError{Op: "read", Key: "k5", HTTPCode: 404, DDNStatus: "205 NoSuchObject"}})
+	rep.record(&syncResult{oldKey: "k6", errClass: errClassWrite, err: errors.New("EOF")})
+
+	rejects := newRejectWriter(nil)
+	rejects.reject("garbage", errors.New("invalid line"))
+	s := rep.summary(rejects, &prescanStats{total: 8, invalid: 1, duplicates: 1, queued: 6})
+
+	if s.Total != 6 || s.OK != 2 || s.Mismatch != 1 || s.Partial != 1 || s.Fail != 2 {
+		t.Errorf("unexpected totals: %+v", s)
+		return
+	}
+	if s.Bytes != 5020 {
+		t.Errorf("unexpected bytes: %d", s.Bytes)
+		return
+	}
+	if len(s.Slowest) == 0 || s.Slowest[0].OID != "k2" {
+		t.Errorf("unexpected slowest objects: %+v", s.Slowest)
+		return
+	}
+	if p := s.ObjectBps["p50"]; p < 2000 || p > 2200 {
+		t.Errorf("unexpected p50 throughput: %f", p)
+		return
+	}
+	if s.ErrorsByClass[errClassRead] != 1 || s.ErrorsByClass[errClassWrite] != 1 ||
+		s.ErrorsByWosStatus["205"] != 1 || len(s.ErrorsByCode) != 0 {
+		t.Errorf("unexpected error histograms: %v %v %v",
+			s.ErrorsByClass, s.ErrorsByWosStatus, s.ErrorsByCode)
+		return
+	}
+	if s.Rejected != 1 || len(s.RejectedInputs) != 1 || s.RejectedInputs[0] != "garbage: invalid line" {
+		t.Errorf("unexpected rejects: %d %v", s.Rejected, s.RejectedInputs)
+		return
+	}
+	if s.Prescan == nil || s.Prescan.Duplicates != 1 {
+		t.Errorf("unexpected prescan stats: %+v", s.Prescan)
+		return
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 6 {
+		t.Errorf("expect 6 report lines, got %d", lines)
+		return
+	}
+
+	text := s.String()
+	for _, want := range []string{"verify mismatch: 1", "source_read: 1", "205: 1", "garbage: invalid line"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("summary text misses %q:\n%s", want, text)
+			return
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// verifications of a copy deep enough to delete its source
+const (
+	// verifyMD5 reads the copy back and compares its md5 to the source one
+	verifyMD5 = "md5"
+	// verifyDecompressed compares the md5 of a decompressed copy to the one
+	// of the decompressed source, the source md5 being the one of its raw
+	// bytes. The source is checked against both before it's deleted.
+	verifyDecompressed = "md5-decompressed"
+)
+
+// verifyETag compares the md5 of the source to the one recorded on a copy,
+// or its etag, without reading the copy. It isn't deep enough to delete the
+// source.
+const verifyETag = "etag"
+
+// stateStore keeps the verified copies of a migration in sqlite, with the
+// tombstones and deletions of their sources
+type stateStore struct {
+	db *sql.DB
+}
+
+// stateObject is an object of the state store, the times being unix
+// timestamps, 0 when unset. The dest md5 of a fan-out copy is the md5 of
+// every destination, formatted by formatCopyMD5s, and dests the names of
+// the destinations it was sent to, formatted by formatDestNames.
+type stateObject struct {
+	oid        string
+	size       int64
+	srcMD5     string
+	dstMD5     string
+	dests      string
+	verify     string
+	verifiedAt int64
+	tombstone  int64
+	deletedAt  int64
+}
+
+func openStateStore(path string) (*stateStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// one connection serializes the writers of sqlite
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS objects (
+		oid TEXT PRIMARY KEY,
+		size INTEGER NOT NULL,
+		src_md5 TEXT NOT NULL,
+		dst_md5 TEXT NOT NULL,
+		verify TEXT NOT NULL,
+		verified_at INTEGER NOT NULL,
+		tombstone_at INTEGER NOT NULL DEFAULT 0,
+		deleted_at INTEGER NOT NULL DEFAULT 0
+	)`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create state store %s: %s", path, err.Error())
+	}
+	// the stores of earlier versions lack the destinations of the copies
+	if _, err := db.Exec("SELECT dests FROM objects LIMIT 0"); err != nil {
+		if _, err := db.Exec("ALTER TABLE objects ADD COLUMN dests TEXT NOT NULL DEFAULT ''"); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to upgrade state store %s: %s", path, err.Error())
+		}
+	}
+	return &stateStore{db: db}, nil
+}
+
+func (t *stateStore) Close() error {
+	return t.db.Close()
+}
+
+// verified records a verified copy, keeping the tombstone and deletion of an
+// object copied again
+func (t *stateStore) verified(o stateObject) error {
+	_, err := t.db.Exec(`INSERT INTO objects (oid, size, src_md5, dst_md5, dests, verify, verified_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(oid) DO UPDATE SET size = excluded.size, src_md5 = excluded.src_md5,
+			dst_md5 = excluded.dst_md5, dests = excluded.dests, verify = excluded.verify,
+			verified_at = excluded.verified_at`,
+		o.oid, o.size, o.srcMD5, o.dstMD5, o.dests, o.verify, o.verifiedAt)
+	return err
+}
+
+// tombstone marks oid as about to be deleted from the source
+func (t *stateStore) tombstone(oid string, at int64) error {
+	return t.mark("tombstone_at", oid, at)
+}
+
+// deleted marks oid as deleted from the source
+func (t *stateStore) deleted(oid string, at int64) error {
+	return t.mark("deleted_at", oid, at)
+}
+
+func (t *stateStore) mark(column, oid string, at int64) error {
+	res, err := t.db.Exec("UPDATE objects SET "+column+" = ? WHERE oid = ?", at, oid)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n != 1 {
+		return fmt.Errorf("object %s not in state store", oid)
+	}
+	return nil
+}
+
+// get returns the state of oid, nil when unknown
+func (t *stateStore) get(oid string) (*stateObject, error) {
+	objs, err := t.query("WHERE oid = ?", oid)
+	if err != nil || len(objs) == 0 {
+		return nil, err
+	}
+	return &objs[0], nil
+}
+
+// undeleted returns up to limit objects after oid, in oid order, whose
+// source isn't deleted and which were verified before verifiedBefore
+func (t *stateStore) undeleted(after string, verifiedBefore int64, limit int) ([]stateObject, error) {
+	return t.query("WHERE oid > ? AND deleted_at = 0 AND verified_at <= ? ORDER BY oid LIMIT ?",
+		after, verifiedBefore, limit)
+}
+
+func (t *stateStore) query(where string, args ...interface{}) ([]stateObject, error) {
+	rows, err := t.db.Query(`SELECT oid, size, src_md5, dst_md5, dests, verify, verified_at,
+		tombstone_at, deleted_at FROM objects `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var objs []stateObject
+	for rows.Next() {
+		var o stateObject
+		if err := rows.Scan(&o.oid, &o.size, &o.srcMD5, &o.dstMD5, &o.dests, &o.verify, &o.verifiedAt,
+			&o.tombstone, &o.deletedAt); err != nil {
+			return nil, err
+		}
+		objs = append(objs, o)
+	}
+	return objs, rows.Err()
+}
+
+// stateReporter records the verified copies in the state store on their way
+// to the report
+type stateReporter struct {
+	reporter
+	store *stateStore
+}
+
+func (t *stateReporter) record(r *syncResult) {
+	t.reporter.record(r)
+	// a packed copy isn't at the key delete rereads, its source is kept
+	if r.verify == "" || r.bundle != nil {
+		return
+	}
+	o := stateObject{
+		oid:        r.oldKey,
+		size:       r.size,
+		srcMD5:     strings.Trim(r.srcMD5, "\""),
+		verify:     r.verify,
+		verifiedAt: time.Now().Unix(),
+	}
+	if len(r.dests) == 0 {
+		if r.err != nil || !r.verified {
+			return
+		}
+		o.dstMD5 = strings.Trim(r.dstMD5, "\"")
+	} else {
+		// a write failing the policy isn't recorded, its copies being
+		// resent by a retry
+		if r.err != nil {
+			return
+		}
+		// the verified fan-out copies are added to the ones of earlier
+		// runs, a retry only resending to the failed destinations. Every
+		// destination sent to is kept, a copy missing on one of them
+		// keeping the source from being deleted.
+		copies := map[string]string{}
+		names := map[string]bool{}
+		if prev, err := t.store.get(r.oldKey); err == nil && prev != nil && prev.srcMD5 == o.srcMD5 {
+			copies = parseCopyMD5s(prev.dstMD5)
+			for _, name := range parseDestNames(prev.dests) {
+				names[name] = true
+			}
+		}
+		for _, d := range r.dests {
+			names[d.name] = true
+			if d.status == destOK && d.md5 != "" {
+				copies[d.name] = strings.Trim(d.md5, "\"")
+			} else {
+				delete(copies, d.name)
+			}
+		}
+		o.dstMD5 = formatCopyMD5s(copies)
+		o.dests = formatDestNames(names)
+	}
+	if o.srcMD5 == "" || o.dstMD5 == "" {
+		return
+	}
+	if err := t.store.verified(o); err != nil {
+		log.Errorf("failed to record object %s in state store: %s", r.oldKey, err.Error())
+	}
+}
+
+// formatCopyMD5s formats the md5 of the fan-out copies as name=md5;...
+func formatCopyMD5s(copies map[string]string) string {
+	parts := make([]string, 0, len(copies))
+	for name, md5 := range copies {
+		parts = append(parts, name+"="+md5)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ";")
+}
+
+// formatDestNames formats the names of the destinations of a fan-out copy as
+// name;...
+func formatDestNames(names map[string]bool) string {
+	parts := make([]string, 0, len(names))
+	for name := range names {
+		parts = append(parts, name)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ";")
+}
+
+// parseDestNames parses the names formatted by formatDestNames
+func parseDestNames(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ";")
+}
+
+// parseCopyMD5s parses the md5 of the fan-out copies, empty for the md5 of a
+// single copy
+func parseCopyMD5s(s string) map[string]string {
+	copies := map[string]string{}
+	if !strings.Contains(s, "=") {
+		return copies
+	}
+	for _, part := range strings.Split(s, ";") {
+		if kv := strings.SplitN(part, "=", 2); len(kv) == 2 {
+			copies[kv[0]] = kv[1]
+		}
+	}
+	return copies
+}
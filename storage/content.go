@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// metadata of a content pointer, the object at a key whose content is
+// stored by hash
+const (
+	MetaContentKey    = "s3sync-content-key"
+	MetaContentSHA256 = "s3sync-content-sha256"
+)
+
+// ContentInfo is the outcome of a write, by content or not
+type ContentInfo struct {
+	MD5    string
+	SHA256 string
+	Size   int64
+	// ContentKey is where the content is stored, empty when the object was
+	// written as is
+	ContentKey string
+	// Deduped tells the content was already stored, its copy skipped
+	Deduped bool
+	// VersionID is the version of the written key in a versioned bucket
+	VersionID string
+}
+
+// ContentWriter is a StorDest telling how an object was stored
+type ContentWriter interface {
+	WriteContent(key string, obj SyncObject) (*ContentInfo, error)
+}
+
+// contentPointer is the body of a content pointer
+type contentPointer struct {
+	ContentKey string `json:"content_key"`
+	SHA256     string `json:"sha256"`
+	Size       int64  `json:"size"`
+}
+
+// WriteContent writes obj to key. With a ContentPrefix, the body is hashed
+// while uploaded to a staging key, copied to its content key unless it's
+// already there, and key becomes a pointer to it carrying the object
+// metadata. The whole body is uploaded either way, the hash being known
+// once it's read.
+func (t *S3Storage) WriteContent(key string, obj SyncObject) (*ContentInfo, error) {
+	if t.ContentPrefix == "" {
+		sum, version, err := t.upload(key, obj)
+		if err != nil {
+			return nil, err
+		}
+		return &ContentInfo{MD5: sum, VersionID: version, Size: obj.GetContentLength()}, nil
+	}
+	l := ObjectLogger(t, key).WithField("phase", "write")
+
+	// the staging object isn't locked, it's deleted once copied
+	staging := t.ContentPrefix + "staging/" + uuid.New().String()
+	body := obj.GetBody()
+	sha := sha256.New()
+	counter := &countingReader{r: io.TeeReader(body, sha)}
+	sum, _, err := t.uploadLocked(staging, &SyncObjectImp{
+		contentType: obj.GetContentType(),
+		length:      obj.GetContentLength(),
+		body:        &readCloser{Reader: counter, Closer: body},
+	}, nil)
+	defer func() {
+		if err := t.Delete(staging); err != nil && !errors.Is(err, ErrNotFound) {
+			l.Warnf("failed to delete staging object %s: %s", staging, err.Error())
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+	info := &ContentInfo{
+		MD5:    sum,
+		SHA256: hex.EncodeToString(sha.Sum(nil)),
+		Size:   counter.n,
+	}
+	info.ContentKey = t.ContentPrefix + info.SHA256
+
+	// the content is only trusted when it was stored with its sha256, an
+	// etag telling nothing of a multipart upload
+	existing, err := t.head(info.ContentKey)
+	switch {
+	case err == nil && existing.Size == info.Size && existing.Metadata[MetaContentSHA256] == info.SHA256:
+		info.Deduped = true
+		l.Debugf("content %s already stored", info.ContentKey)
+	case err != nil && !errors.Is(err, ErrNotFound):
+		return nil, fmt.Errorf("failed to look content %s up: %s", info.ContentKey, err.Error())
+	default:
+		meta := map[string]string{MetaContentSHA256: info.SHA256}
+		src := &ObjectInfo{Size: info.Size, ContentType: obj.GetContentType()}
+		if err := t.copyObject(staging, info.ContentKey, src, meta, t.Lock); err != nil {
+			return nil, fmt.Errorf("failed to store content %s: %s", info.ContentKey, err.Error())
+		}
+	}
+
+	meta := map[string]string{}
+	for k, v := range Metadata(obj) {
+		meta[k] = v
+	}
+	meta[MetaContentKey] = info.ContentKey
+	meta[MetaContentSHA256] = info.SHA256
+	pointer, err := json.Marshal(contentPointer{ContentKey: info.ContentKey, SHA256: info.SHA256, Size: info.Size})
+	if err != nil {
+		return nil, err
+	}
+	_, info.VersionID, err = t.upload(key, &SyncObjectImp{
+		contentType: "application/json",
+		length:      int64(len(pointer)),
+		body:        ioutil.NopCloser(strings.NewReader(string(pointer))),
+		metadata:    meta,
+		exclusive:   isExclusive(obj),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write pointer to %s: %w", info.ContentKey, err)
+	}
+	return info, nil
+}
+
+// readCloser reads from Reader and closes Closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
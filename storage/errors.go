@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// ErrNotFound is matched by errors.Is for the errors of a missing object or
+// bucket, whatever the backend
+var ErrNotFound = errors.New("not found")
+
+// ErrExists is matched by errors.Is for the errors of an exclusive write to
+// a key holding an object
+var ErrExists = errors.New("already exists")
+
+// Is tells a missing wos object apart, by its http code or its x-ddn-status
+func (e *WosStatusError) Is(target error) bool {
+	return target == ErrNotFound && (e.HTTPCode == 404 || e.Code() == "205")
+}
+
+// s3NotFoundError is an s3 request failing with 404, keeping its code and
+// status for the callers asserting awserr.RequestFailure
+type s3NotFoundError struct {
+	awserr.RequestFailure
+}
+
+func (e *s3NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+func (e *s3NotFoundError) Unwrap() error {
+	return e.RequestFailure
+}
+
+// s3ExistsError is a conditional s3 write refused as its key holds an object,
+// with 412, or 409 when another conditional write to the key is in progress
+type s3ExistsError struct {
+	awserr.RequestFailure
+}
+
+func (e *s3ExistsError) Is(target error) bool {
+	return target == ErrExists
+}
+
+func (e *s3ExistsError) Unwrap() error {
+	return e.RequestFailure
+}
+
+// s3Error returns err matching ErrNotFound when the request failed with 404,
+// and ErrExists when a conditional write was refused
+func s3Error(err error) error {
+	reqErr, ok := requestFailure(err)
+	if !ok {
+		return err
+	}
+	switch {
+	case reqErr.StatusCode() == 404:
+		return &s3NotFoundError{reqErr}
+	case reqErr.StatusCode() == 412, reqErr.Code() == "ConditionalRequestConflict":
+		return &s3ExistsError{reqErr}
+	}
+	return err
+}
+
+// requestFailure returns the failed request of err, the one under the error
+// of a multipart upload
+func requestFailure(err error) (awserr.RequestFailure, bool) {
+	for err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok {
+			return reqErr, true
+		}
+		awsErr, ok := err.(awserr.Error)
+		if !ok {
+			return nil, false
+		}
+		err = awsErr.OrigErr()
+	}
+	return nil, false
+}
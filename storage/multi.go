@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+var errNoDestLeft = errors.New("all destinations failed")
+
+// MultiPolicy decides when a fan-out write is considered successful
+type MultiPolicy int
+
+const (
+	// PolicyAll requires every destination to succeed
+	PolicyAll MultiPolicy = iota
+	// PolicyQuorum requires a majority of the destinations to succeed
+	PolicyQuorum
+)
+
+func ParseMultiPolicy(s string) (MultiPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "all":
+		return PolicyAll, nil
+	case "quorum":
+		return PolicyQuorum, nil
+	}
+	return PolicyAll, fmt.Errorf("unknown destination policy: %s", s)
+}
+
+func (p MultiPolicy) String() string {
+	if p == PolicyQuorum {
+		return "quorum"
+	}
+	return "all"
+}
+
+// DestStatus is the outcome of writing one object to one destination
+type DestStatus struct {
+	Name string
+	MD5  string
+	Err  error
+	// Content tells how a ContentWriter stored the object
+	Content *ContentInfo
+}
+
+// MultiStorage is a StorDest writing every object to several destinations
+// while reading the source body only once
+type MultiStorage struct {
+	Names  []string
+	Dests  []StorDest
+	Policy MultiPolicy
+}
+
+func NewMultiStorage(policy MultiPolicy, names []string, dests []StorDest) *MultiStorage {
+	return &MultiStorage{
+		Names:  names,
+		Dests:  dests,
+		Policy: policy,
+	}
+}
+
+// Dest returns the destination registered with name
+func (t *MultiStorage) Dest(name string) StorDest {
+	for i, n := range t.Names {
+		if n == name {
+			return t.Dests[i]
+		}
+	}
+	return nil
+}
+
+func (t *MultiStorage) Write(key string, obj SyncObject) (string, error) {
+	md5, _, err := t.WriteTo(key, obj, nil)
+	return md5, err
+}
+
+// WriteTo tees the object body to the named destinations, or to all of them
+// when names is empty. It returns the md5 of the source body and the status of
+// every destination; err is set when the policy is not met.
+func (t *MultiStorage) WriteTo(key string, obj SyncObject, names []string) (string, []DestStatus, error) {
+	body := obj.GetBody()
+	defer body.Close()
+
+	targets := make([]int, 0, len(t.Dests))
+	if len(names) == 0 {
+		for i := range t.Dests {
+			targets = append(targets, i)
+		}
+	} else {
+		for _, name := range names {
+			found := false
+			for i, n := range t.Names {
+				if n == name {
+					targets = append(targets, i)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return "", nil, fmt.Errorf("unknown destination: %s", name)
+			}
+		}
+	}
+
+	statuses := make([]DestStatus, len(targets))
+	writers := make([]*io.PipeWriter, len(targets))
+	var wg sync.WaitGroup
+	for i, idx := range targets {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		statuses[i].Name = t.Names[idx]
+		wg.Add(1)
+		go func(i int, dest StorDest, pr *io.PipeReader) {
+			defer wg.Done()
+			o := &SyncObjectImp{
+				contentType: obj.GetContentType(),
+				length:      obj.GetContentLength(),
+				body:        pr,
+				metadata:    Metadata(obj),
+				exclusive:   isExclusive(obj),
+			}
+			var sum string
+			var err error
+			if cw, ok := dest.(ContentWriter); ok {
+				statuses[i].Content, err = cw.WriteContent(key, o)
+				if err == nil {
+					sum = statuses[i].Content.MD5
+				}
+			} else {
+				sum, err = dest.Write(key, o)
+			}
+			// unblock the tee if the destination gave up early
+			pr.CloseWithError(io.ErrClosedPipe)
+			statuses[i].MD5 = sum
+			statuses[i].Err = err
+		}(i, t.Dests[idx], pr)
+	}
+
+	hash := md5.New()
+	fw := &fanoutWriter{writers: writers}
+	_, copyErr := io.Copy(io.MultiWriter(hash, fw), body)
+	for _, w := range writers {
+		w.CloseWithError(copyErr)
+	}
+	wg.Wait()
+
+	if copyErr != nil && copyErr != errNoDestLeft {
+		return "", statuses, copyErr
+	}
+
+	var failed []string
+	for i := range statuses {
+		if statuses[i].Err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", statuses[i].Name, statuses[i].Err.Error()))
+		}
+	}
+	ok := len(statuses) - len(failed)
+	sum := fmt.Sprintf("\"%x\"", hash.Sum(nil))
+	if !t.policyMet(ok, len(statuses)) {
+		return sum, statuses, fmt.Errorf("%s policy not met (%d/%d): %s",
+			t.Policy, ok, len(statuses), strings.Join(failed, "; "))
+	}
+	return sum, statuses, nil
+}
+
+func (t *MultiStorage) policyMet(ok, total int) bool {
+	if t.Policy == PolicyQuorum {
+		return ok > total/2
+	}
+	return ok == total
+}
+
+// Read returns the object from the first destination holding it
+func (t *MultiStorage) Read(key string) (SyncObject, error) {
+	var err error
+	for _, d := range t.Dests {
+		var obj SyncObject
+		obj, err = d.Read(key)
+		if err == nil {
+			return obj, nil
+		}
+	}
+	return nil, err
+}
+
+// fanoutWriter writes to every pipe still alive, dropping the ones whose
+// reader went away so a single failed destination doesn't stall the others
+type fanoutWriter struct {
+	writers []*io.PipeWriter
+	dead    []bool
+}
+
+func (t *fanoutWriter) Write(p []byte) (int, error) {
+	if t.dead == nil {
+		t.dead = make([]bool, len(t.writers))
+	}
+	alive := 0
+	for i, w := range t.writers {
+		if t.dead[i] {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			t.dead[i] = true
+			continue
+		}
+		alive++
+	}
+	if alive == 0 && len(t.writers) > 0 {
+		return 0, errNoDestLeft
+	}
+	return len(p), nil
+}
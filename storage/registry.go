@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Opener opens the storage of a spec, parsed as an url
+type Opener func(spec *url.URL) (StorSrc, error)
+
+var (
+	openersMu sync.Mutex
+	openers   = map[string]Opener{}
+)
+
+// Register makes the backend of scheme available to Open, replacing the
+// one registered before
+func Register(scheme string, open Opener) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+	openers[scheme] = open
+}
+
+// Schemes returns the registered schemes, sorted
+func Schemes() []string {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+	schemes := make([]string, 0, len(openers))
+	for s := range openers {
+		schemes = append(schemes, s)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open opens the storage of an url-style spec by the backend registered for
+// its scheme:
+//
+//	wos://host:port
+//	s3://[ak:sk@]bucket[?endpoint=host:port&region=us-east-1]
+//
+// The storage is a StorDest when the backend can write, its other
+// operations found by asserting Statter, Deleter, Lister, RangeReader or
+// Copier.
+func Open(spec string) (StorSrc, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage %s: %s", spec, err.Error())
+	}
+	openersMu.Lock()
+	open := openers[u.Scheme]
+	openersMu.Unlock()
+	if open == nil {
+		return nil, fmt.Errorf("unknown storage scheme: %s", u.Scheme)
+	}
+	return open(u)
+}
+
+func init() {
+	Register("wos", openWos)
+	Register("s3", openS3)
+}
+
+func openWos(u *url.URL) (StorSrc, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing wos host: %s", u.String())
+	}
+	return NewWosStorage(u.Host), nil
+}
+
+// openS3 opens a bucket, with the credentials of the spec or else of the
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment. Without an
+// endpoint, the bucket is on aws over tls.
+func openS3(u *url.URL) (StorSrc, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing s3 bucket")
+	}
+	ak, sk := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if u.User != nil {
+		ak = u.User.Username()
+		sk, _ = u.User.Password()
+	}
+	if ak == "" || sk == "" {
+		return nil, fmt.Errorf("missing s3 credentials of bucket %s", u.Host)
+	}
+	q := u.Query()
+	s := NewS3Storage(q.Get("endpoint"), ak, sk, u.Host)
+	if s.Endpoint == "" {
+		s.Config.Endpoint = nil
+		s.Config.DisableSSL = aws.Bool(false)
+	}
+	if region := q.Get("region"); region != "" {
+		s.Config.Region = aws.String(region)
+	}
+	return s, nil
+}
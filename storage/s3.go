@@ -2,10 +2,17 @@ package storage
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -18,6 +25,11 @@ type S3Storage struct {
 	Sk       string
 	Bucket   string
 	Config   *aws.Config
+	// ContentPrefix stores the objects by content under this prefix, the
+	// written keys being pointers to it, when not empty
+	ContentPrefix string
+	// Lock is applied to the uploaded objects when not nil
+	Lock *ObjectLock
 }
 
 func NewS3Storage(endpoint, ak, sk, bucket string) *S3Storage {
@@ -32,15 +44,39 @@ func NewS3Storage(endpoint, ak, sk, bucket string) *S3Storage {
 			DisableSSL:       aws.Bool(true),          // removed?
 			S3ForcePathStyle: aws.Bool(true),
 		},
+		"",
+		nil,
 	}
 	c.Config = c.Config.WithCredentials(credentials.NewStaticCredentials(ak, sk, ""))
 	return &c
 }
 
 func (t *S3Storage) Write(key string, obj SyncObject) (string, error) {
+	if t.ContentPrefix != "" {
+		info, err := t.WriteContent(key, obj)
+		if err != nil {
+			return "", err
+		}
+		return info.MD5, nil
+	}
+	md5, _, err := t.upload(key, obj)
+	return md5, err
+}
+
+// upload streams obj to key, returning the md5 of its body and the version
+// id of a versioned bucket
+func (t *S3Storage) upload(key string, obj SyncObject) (string, string, error) {
+	return t.uploadLocked(key, obj, t.Lock)
+}
+
+// uploadLocked is upload applying lock instead of the storage one
+func (t *S3Storage) uploadLocked(key string, obj SyncObject, lock *ObjectLock) (string, string, error) {
+	l := ObjectLogger(t, key).WithFields(log.Fields{"phase": "write", "bucket": t.Bucket})
+	start := time.Now()
 	body := obj.GetBody()
 	pr, pw := io.Pipe()
-	tr := io.TeeReader(body, pw)
+	counter := &countingReader{r: body}
+	tr := io.TeeReader(counter, pw)
 	defer body.Close()
 
 	type Result struct {
@@ -50,6 +86,7 @@ func (t *S3Storage) Write(key string, obj SyncObject) (string, error) {
 	done := make(chan Result)
 	defer close(done)
 
+	var version string
 	go func() {
 		defer pw.Close()
 		uploader := s3manager.NewUploader(session.New(t.Config))
@@ -58,12 +95,30 @@ func (t *S3Storage) Write(key string, obj SyncObject) (string, error) {
 			Key:    aws.String(key),
 			Body:   tr,
 		}
+		if ct := obj.GetContentType(); ct != "" {
+			input.ContentType = aws.String(ct)
+		}
+		if meta := Metadata(obj); len(meta) > 0 {
+			input.Metadata = aws.StringMap(meta)
+		}
+		lock.apply(input)
+		var opts []func(*s3manager.Uploader)
+		if isExclusive(obj) {
+			opts = append(opts, s3manager.WithUploaderRequestOptions(ifNoneMatch))
+		}
 
-		_, err := uploader.Upload(input)
+		l.Debug("uploading")
+		out, err := uploader.UploadWithContext(ObjectContext(t, key), input, opts...)
+		if err == nil {
+			version = aws.StringValue(out.VersionID)
+		}
+		fields := log.Fields{"bytes": counter.n, "duration": time.Since(start).Seconds()}
 		if err != nil {
-			log.Debugf("Unable to upload %s to %s, %v", key, t.Bucket, err)
+			l.WithFields(fields).Debugf("unable to upload: %v", err)
+		} else {
+			l.WithFields(fields).Debug("uploaded")
 		}
-		done <- Result{"", err}
+		done <- Result{"", s3Error(err)}
 	}()
 	go func() {
 		md5, err := CalcMD5(pr)
@@ -82,26 +137,78 @@ func (t *S3Storage) Write(key string, obj SyncObject) (string, error) {
 			md5 = r.value
 		}
 	}
-	return md5, err
+	return md5, version, err
+}
+
+// ifNoneMatch makes the put of an object, or the completion of its multipart
+// upload, conditional on its key being free
+func ifNoneMatch(r *request.Request) {
+	switch r.Operation.Name {
+	case "PutObject", "CompleteMultipartUpload":
+		r.HTTPRequest.Header.Set("If-None-Match", "*")
+	}
 }
 
 func (t *S3Storage) Read(key string) (SyncObject, error) {
-	input := &s3.GetObjectInput{
+	return t.get(key, &s3.GetObjectInput{
 		Bucket: aws.String(t.Bucket),
 		Key:    aws.String(key),
+	})
+}
+
+// ReadRange returns length bytes of key from offset with a ranged get
+func (t *S3Storage) ReadRange(key string, offset, length int64) (SyncObject, error) {
+	if length == 0 {
+		// an empty range can't be requested
+		return &SyncObjectImp{body: ioutil.NopCloser(strings.NewReader(""))}, nil
 	}
+	return t.get(key, &s3.GetObjectInput{
+		Bucket: aws.String(t.Bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+}
 
-	svc := s3.New(session.New(t.Config))
-	output, err := svc.GetObject(input)
+// get returns the object of input, following a content pointer to the
+// object content
+func (t *S3Storage) get(key string, input *s3.GetObjectInput) (SyncObject, error) {
+	obj, err := t.getRaw(key, input)
 	if err != nil {
 		return nil, err
 	}
+	meta := Metadata(obj)
+	contentKey := meta[MetaContentKey]
+	if contentKey == "" {
+		return obj, nil
+	}
+	obj.GetBody().Close()
+	content, err := t.getRaw(key, &s3.GetObjectInput{
+		Bucket: aws.String(t.Bucket),
+		Key:    aws.String(contentKey),
+		Range:  input.Range,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content %s of %s: %w", contentKey, key, err)
+	}
+	c := content.(*SyncObjectImp)
+	// the pointer metadata describes the object
+	c.metadata = meta
+	return c, nil
+}
+
+func (t *S3Storage) getRaw(key string, input *s3.GetObjectInput) (SyncObject, error) {
+	svc := s3.New(session.New(t.Config))
+	output, err := svc.GetObjectWithContext(ObjectContext(t, key), input)
+	if err != nil {
+		return nil, s3Error(err)
+	}
 
 	if output.Body == nil {
 		return nil, errors.New("No body got from response")
 	}
 	s3Obj := SyncObjectImp{
-		body: output.Body,
+		body:     output.Body,
+		metadata: userMetadata(output.Metadata),
 	}
 
 	if output.ContentType != nil {
@@ -116,3 +223,229 @@ func (t *S3Storage) Read(key string) (SyncObject, error) {
 func (t *S3Storage) GetBucket() string {
 	return t.Bucket
 }
+
+// Stat returns the size, content type and etag of key, the size and etag
+// of its content when it's a content pointer
+func (t *S3Storage) Stat(key string) (*ObjectInfo, error) {
+	info, err := t.head(key)
+	if err != nil {
+		return nil, err
+	}
+	contentKey := info.Metadata[MetaContentKey]
+	if contentKey == "" {
+		return info, nil
+	}
+	content, err := t.head(contentKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat content %s of %s: %w", contentKey, key, err)
+	}
+	info.Size = content.Size
+	info.ETag = content.ETag
+	return info, nil
+}
+
+func (t *S3Storage) head(key string) (*ObjectInfo, error) {
+	svc := s3.New(session.New(t.Config))
+	output, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(t.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return &ObjectInfo{
+		Size:        aws.Int64Value(output.ContentLength),
+		ContentType: aws.StringValue(output.ContentType),
+		ETag:        aws.StringValue(output.ETag),
+		Metadata:    userMetadata(output.Metadata),
+	}, nil
+}
+
+// userMetadata returns the user metadata of a response with lowercase keys,
+// as they were written
+func userMetadata(m map[string]*string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	meta := make(map[string]string, len(m))
+	for k, v := range m {
+		meta[strings.ToLower(k)] = aws.StringValue(v)
+	}
+	return meta
+}
+
+// Probe checks the bucket is there and readable with the credentials,
+// returning the clock of the server, zero when it didn't answer
+func (t *S3Storage) Probe() (time.Time, error) {
+	svc := s3.New(session.New(t.Config))
+	req, _ := svc.HeadBucketRequest(&s3.HeadBucketInput{
+		Bucket: aws.String(t.Bucket),
+	})
+	err := req.Send()
+	var serverTime time.Time
+	if req.HTTPResponse != nil {
+		serverTime, _ = http.ParseTime(req.HTTPResponse.Header.Get("Date"))
+	}
+	return serverTime, s3Error(err)
+}
+
+// Exists tells whether key is in the bucket
+func (t *S3Storage) Exists(key string) (bool, error) {
+	return exists(t, key)
+}
+
+// List calls fn with the keys under prefix after marker in lexical order,
+// their size and etag, until fn returns false. A content pointer is listed
+// with the size of the pointer.
+func (t *S3Storage) List(prefix, marker string, fn func(key string, info *ObjectInfo) bool) error {
+	svc := s3.New(session.New(t.Config))
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(t.Bucket),
+		Prefix: aws.String(prefix),
+	}
+	if marker != "" {
+		input.StartAfter = aws.String(marker)
+	}
+	err := svc.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			info := &ObjectInfo{Size: aws.Int64Value(o.Size), ETag: aws.StringValue(o.ETag)}
+			if !fn(aws.StringValue(o.Key), info) {
+				return false
+			}
+		}
+		return true
+	})
+	return s3Error(err)
+}
+
+// Delete removes key from the bucket
+func (t *S3Storage) Delete(key string) error {
+	svc := s3.New(session.New(t.Config))
+	_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(t.Bucket),
+		Key:    aws.String(key),
+	})
+	return s3Error(err)
+}
+
+// Copy copies key to newKey in the bucket, replacing the metadata with meta
+// when it isn't nil
+func (t *S3Storage) Copy(key, newKey string, meta map[string]string) error {
+	src, err := t.head(key)
+	if err != nil {
+		return err
+	}
+	if meta != nil && src.Metadata[MetaContentKey] != "" {
+		// a copied content pointer keeps pointing to its content
+		meta[MetaContentKey] = src.Metadata[MetaContentKey]
+		meta[MetaContentSHA256] = src.Metadata[MetaContentSHA256]
+	}
+	return t.copyObject(key, newKey, src, meta, nil)
+}
+
+var (
+	// maxCopySize is the largest object copied by a single request, the
+	// larger ones being copied in parts of copyPartSize
+	maxCopySize  int64 = 5 << 30
+	copyPartSize int64 = 512 << 20
+)
+
+// copySource returns the copy source of key in bucket, its segments escaped
+func copySource(bucket, key string) string {
+	segments := strings.Split(bucket+"/"+key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// copyObject copies key, described by src, to newKey, replacing the metadata
+// with meta when it isn't nil and applying lock to the copy
+func (t *S3Storage) copyObject(key, newKey string, src *ObjectInfo, meta map[string]string, lock *ObjectLock) error {
+	if src.Size > maxCopySize {
+		if meta == nil {
+			meta = src.Metadata
+		}
+		return t.copyParts(key, newKey, src, meta, lock)
+	}
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(t.Bucket),
+		Key:        aws.String(newKey),
+		CopySource: aws.String(copySource(t.Bucket, key)),
+	}
+	if meta != nil {
+		input.Metadata = aws.StringMap(meta)
+		input.MetadataDirective = aws.String(s3.MetadataDirectiveReplace)
+		// the content type is replaced along with the metadata
+		if src.ContentType != "" {
+			input.ContentType = aws.String(src.ContentType)
+		}
+	}
+	lock.applyCopy(input)
+	svc := s3.New(session.New(t.Config))
+	_, err := svc.CopyObjectWithContext(ObjectContext(t, newKey), input)
+	return s3Error(err)
+}
+
+// copyParts copies key to newKey with a multipart upload of ranged part
+// copies, with the metadata meta
+func (t *S3Storage) copyParts(key, newKey string, src *ObjectInfo, meta map[string]string, lock *ObjectLock) error {
+	svc := s3.New(session.New(t.Config))
+	ctx := ObjectContext(t, newKey)
+	input := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(t.Bucket),
+		Key:    aws.String(newKey),
+	}
+	if len(meta) > 0 {
+		input.Metadata = aws.StringMap(meta)
+	}
+	if src.ContentType != "" {
+		input.ContentType = aws.String(src.ContentType)
+	}
+	lock.applyMultipart(input)
+	upload, err := svc.CreateMultipartUploadWithContext(ctx, input)
+	if err != nil {
+		return s3Error(err)
+	}
+	abort := func(err error) error {
+		_, aerr := svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(t.Bucket),
+			Key:      aws.String(newKey),
+			UploadId: upload.UploadId,
+		})
+		if aerr != nil {
+			ObjectLogger(t, newKey).Warnf("failed to abort the copy of %s: %s", key, aerr.Error())
+		}
+		return s3Error(err)
+	}
+
+	var parts []*s3.CompletedPart
+	for n, offset := int64(1), int64(0); offset < src.Size; n, offset = n+1, offset+copyPartSize {
+		end := offset + copyPartSize
+		if end > src.Size {
+			end = src.Size
+		}
+		out, err := svc.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(t.Bucket),
+			Key:             aws.String(newKey),
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int64(n),
+			CopySource:      aws.String(copySource(t.Bucket, key)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end-1)),
+		})
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: aws.Int64(n)})
+	}
+	_, err = svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(t.Bucket),
+		Key:             aws.String(newKey),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return abort(err)
+	}
+	return nil
+}
@@ -1,11 +1,11 @@
 package storage
 
 import (
+	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
-	"os"
-	"strconv"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -14,6 +14,17 @@ import (
 var (
 	WosWriteTimeout = 300 * time.Second
 	WosReadTimeout  = 300 * time.Second
+
+	// ObjectLogger returns the log entry of the requests of the storage s
+	// about key, set by the caller to correlate them with its own entries
+	ObjectLogger = func(s interface{}, key string) *log.Entry {
+		return log.WithField("oid", key)
+	}
+	// ObjectContext returns the context of the requests of the storage s
+	// transferring key, set by the caller to cancel them
+	ObjectContext = func(s interface{}, key string) context.Context {
+		return context.Background()
+	}
 )
 
 type StorDest interface {
@@ -31,10 +42,82 @@ type SyncObject interface {
 	GetBody() io.ReadCloser
 }
 
+// MetadataObject is a SyncObject carrying user metadata, stored along with
+// it by the destinations supporting it
+type MetadataObject interface {
+	GetMetadata() map[string]string
+}
+
+// Metadata returns the user metadata of obj, nil when it has none
+func Metadata(obj SyncObject) map[string]string {
+	if m, ok := obj.(MetadataObject); ok {
+		return m.GetMetadata()
+	}
+	return nil
+}
+
+// ExclusiveObject is a SyncObject written only when its key is free, the
+// write failing with ErrExists when the key holds an object
+type ExclusiveObject interface {
+	Exclusive() bool
+}
+
+// isExclusive tells whether obj is written only to a free key
+func isExclusive(obj SyncObject) bool {
+	e, ok := obj.(ExclusiveObject)
+	return ok && e.Exclusive()
+}
+
+// Statter looks an object up without reading its content
+type Statter interface {
+	Stat(key string) (*ObjectInfo, error)
+}
+
+// Deleter deletes objects, a missing one being an error of the backend
+type Deleter interface {
+	Delete(key string) error
+}
+
+// Lister lists the keys of the backends able to, in lexical order
+type Lister interface {
+	List(prefix, marker string, fn func(key string, info *ObjectInfo) bool) error
+}
+
+// RangeReader reads a part of an object
+type RangeReader interface {
+	ReadRange(key string, offset, length int64) (SyncObject, error)
+}
+
+// Copier copies an object within the backend without transferring it,
+// replacing its metadata with meta when not nil
+type Copier interface {
+	Copy(key, newKey string, meta map[string]string) error
+}
+
+// exists tells whether key is found by s, the errors other than ErrNotFound
+// being returned
+func exists(s Statter, key string) (bool, error) {
+	_, err := s.Stat(key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ObjectInfo describes a stored object without its content
+type ObjectInfo struct {
+	Size        int64
+	ContentType string
+	ETag        string
+	Metadata    map[string]string
+}
+
 type SyncObjectImp struct {
 	contentType string
 	length      int64
 	body        io.ReadCloser
+	metadata    map[string]string
+	exclusive   bool
 }
 
 func (t *SyncObjectImp) GetContentType() string {
@@ -49,6 +132,14 @@ func (t *SyncObjectImp) GetBody() io.ReadCloser {
 	return t.body
 }
 
+func (t *SyncObjectImp) GetMetadata() map[string]string {
+	return t.metadata
+}
+
+func (t *SyncObjectImp) Exclusive() bool {
+	return t.exclusive
+}
+
 func CalcMD5(data io.ReadCloser) (string, error) {
 	hash := md5.New()
 	if _, err := io.Copy(hash, data); err != nil {
@@ -58,15 +149,14 @@ func CalcMD5(data io.ReadCloser) (string, error) {
 	return sum, nil
 }
 
-func init() {
-	timeout := os.Getenv("APP_TIMEOUT")
-	if timeout != "" {
-		i, err := strconv.Atoi(timeout)
-		if err != nil {
-			log.Errorf("invalid timeout: %s, skip", timeout)
-		} else {
-			WosWriteTimeout = time.Duration(i) * time.Second
-			WosReadTimeout = time.Duration(i) * time.Second
-		}
-	}
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (t *countingReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+	return n, err
 }
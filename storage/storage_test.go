@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+// copyServer serves s3 with gofakes3, turning the object and part copies it
+// doesn't support into puts of the source bytes, and records the copy
+// sources as requested. It keeps the content types gofakes3 drops.
+type copyServer struct {
+	sync.Mutex
+	sources []string
+	types   map[string]string
+	handler http.Handler
+	backend gofakes3.Backend
+}
+
+func (t *copyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.Lock()
+	defer t.Unlock()
+	query := r.URL.Query()
+	src := r.Header.Get("X-Amz-Copy-Source")
+	switch {
+	case r.Method == "GET" || r.Method == "HEAD":
+		if ct := t.types[r.URL.Path]; ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+	case r.Method == "POST" && query.Get("uploadId") != "":
+		t.types[r.URL.Path] = t.types["uploads"+r.URL.Path]
+	case r.Method == "POST":
+		t.types["uploads"+r.URL.Path] = r.Header.Get("Content-Type")
+	case r.Method == "PUT" && src == "" && query.Get("uploadId") == "":
+		t.types[r.URL.Path] = r.Header.Get("Content-Type")
+	}
+	if r.Method != "PUT" || src == "" {
+		t.handler.ServeHTTP(w, r)
+		return
+	}
+	t.sources = append(t.sources, src)
+	path, err := url.PathUnescape(src)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	parts := strings.SplitN(path, "/", 2)
+	obj, err := t.backend.GetObject(parts[0], parts[1], nil)
+	if err != nil {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+	data, _ := ioutil.ReadAll(obj.Contents)
+	obj.Contents.Close()
+
+	header := http.Header{}
+	if rng := r.Header.Get("X-Amz-Copy-Source-Range"); rng != "" {
+		var start, end int
+		fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+		data = data[start : end+1]
+	} else if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		for k, v := range r.Header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") {
+				header[k] = v
+			}
+		}
+		t.types[r.URL.Path] = r.Header.Get("Content-Type")
+	} else {
+		for k, v := range obj.Metadata {
+			header.Set(k, v)
+		}
+		t.types[r.URL.Path] = t.types["/"+parts[0]+"/"+parts[1]]
+	}
+	put, _ := http.NewRequest("PUT", r.URL.String(), bytes.NewReader(data))
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	put.Header = header
+	put.ContentLength = int64(len(data))
+	rec := httptest.NewRecorder()
+	t.handler.ServeHTTP(rec, put)
+	if rec.Code != http.StatusOK {
+		http.Error(w, rec.Body.String(), rec.Code)
+		return
+	}
+	etag := rec.Header().Get("ETag")
+	if r.URL.Query().Get("uploadId") != "" {
+		fmt.Fprintf(w, "<CopyPartResult><ETag>%s</ETag></CopyPartResult>", etag)
+		return
+	}
+	fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>", etag)
+}
+
+// setupS3 returns a storage on a new test bucket with its server
+func setupS3(t *testing.T, bucket string) (*S3Storage, *copyServer, func()) {
+	backend := s3mem.New()
+	cs := &copyServer{types: map[string]string{}, handler: gofakes3.New(backend).Server(), backend: backend}
+	ts := httptest.NewServer(cs)
+	s := NewS3Storage(ts.URL, "u1", "s1", bucket)
+	svc := s3.New(session.New(s.Config))
+	if _, err := svc.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		t.Fatalf("failed to create bucket: %s", err.Error())
+	}
+	return s, cs, ts.Close
+}
+
+func putObject(s *S3Storage, key, data string, meta map[string]string) error {
+	_, err := s.Write(key, &SyncObjectImp{
+		contentType: "application/x-test",
+		length:      int64(len(data)),
+		body:        ioutil.NopCloser(strings.NewReader(data)),
+		metadata:    meta,
+	})
+	return err
+}
+
+func TestErrNotFound(t *testing.T) {
+	failure := func(code string, status int) awserr.RequestFailure {
+		return awserr.NewRequestFailure(awserr.New(code, "failed", nil), status, "id")
+	}
+	cases := []struct {
+		name     string
+		err      error
+		notFound bool
+		exists   bool
+	}{
+		{"wos 404", &WosStatusError{HTTPCode: 404}, true, false},
+		{"wos 205", &WosStatusError{HTTPCode: 200, DDNStatus: "205 NoSuchObject"}, true, false},
+		{"wos 500", &WosStatusError{HTTPCode: 500, DDNStatus: "203 InternalError"}, false, false},
+		{"s3 404", s3Error(failure("NoSuchKey", 404)), true, false},
+		{"s3 403", s3Error(failure("AccessDenied", 403)), false, false},
+		{"s3 412", s3Error(failure("PreconditionFailed", 412)), false, true},
+		{"s3 409", s3Error(failure("ConditionalRequestConflict", 409)), false, true},
+		{"s3 409 bucket", s3Error(failure("BucketNotEmpty", 409)), false, false},
+		{"multipart 412", s3Error(awserr.New("MultipartUpload", "upload multipart failed", failure("PreconditionFailed", 412))), false, true},
+		{"wrapped", fmt.Errorf("failed to read content: %w", s3Error(failure("NoSuchKey", 404))), true, false},
+		{"other", errors.New("not found"), false, false},
+		{"nil", s3Error(nil), false, false},
+	}
+	for _, c := range cases {
+		if errors.Is(c.err, ErrNotFound) != c.notFound || errors.Is(c.err, ErrExists) != c.exists {
+			t.Errorf("%s: unexpected match of %v", c.name, c.err)
+		}
+	}
+	if _, ok := s3Error(failure("NoSuchKey", 404)).(awserr.RequestFailure); !ok {
+		t.Errorf("s3 not found error isn't a request failure")
+	}
+}
+
+func TestExists(t *testing.T) {
+	s, _, done := setupS3(t, "bucket1")
+	defer done()
+	if err := putObject(s, "k1", "k1 content", nil); err != nil {
+		t.Errorf("failed to write k1: %s", err.Error())
+		return
+	}
+	pointer := map[string]string{MetaContentKey: "content/missing"}
+	if err := putObject(s, "dangling", "{}", pointer); err != nil {
+		t.Errorf("failed to write dangling: %s", err.Error())
+		return
+	}
+	cases := []struct {
+		key    string
+		exists bool
+	}{
+		{"k1", true},
+		{"k2", false},
+		{"k1/k2", false},
+		{"dangling", false},
+	}
+	for _, c := range cases {
+		exists, err := s.Exists(c.key)
+		if err != nil || exists != c.exists {
+			t.Errorf("Exists(%s): %v, %v", c.key, exists, err)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	s, _, done := setupS3(t, "bucket1")
+	defer done()
+	keys := []string{"a/1", "a/2", "a/3", "b/1", "c"}
+	for _, k := range keys {
+		if err := putObject(s, k, k+" content", nil); err != nil {
+			t.Errorf("failed to write %s: %s", k, err.Error())
+			return
+		}
+	}
+	cases := []struct {
+		prefix string
+		marker string
+		limit  int
+		keys   []string
+	}{
+		{"", "", 0, keys},
+		{"a/", "", 0, []string{"a/1", "a/2", "a/3"}},
+		{"a/", "a/1", 0, []string{"a/2", "a/3"}},
+		{"", "a/3", 0, []string{"b/1", "c"}},
+		{"", "", 2, []string{"a/1", "a/2"}},
+		{"d", "", 0, nil},
+	}
+	for _, c := range cases {
+		var listed []string
+		err := s.List(c.prefix, c.marker, func(key string, info *ObjectInfo) bool {
+			if info.Size != int64(len(key+" content")) {
+				t.Errorf("unexpected size of %s: %d", key, info.Size)
+			}
+			listed = append(listed, key)
+			return c.limit == 0 || len(listed) < c.limit
+		})
+		if err != nil || !reflect.DeepEqual(listed, c.keys) {
+			t.Errorf("List(%q, %q): %v, %v", c.prefix, c.marker, listed, err)
+		}
+	}
+
+	other := NewS3Storage(s.Endpoint, "u1", "s1", "missing")
+	err := other.List("", "", func(string, *ObjectInfo) bool { return true })
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("List on missing bucket: %v", err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	defer func(size, part int64) {
+		maxCopySize, copyPartSize = size, part
+	}(maxCopySize, copyPartSize)
+	maxCopySize, copyPartSize = 16, 10
+
+	s, cs, done := setupS3(t, "bucket1")
+	defer done()
+	cases := []struct {
+		key    string
+		data   string
+		meta   map[string]string
+		source string
+	}{
+		{"a b/c+d", "small", nil, "bucket1/a%20b/c+d"},
+		{"x/y%z", "small", map[string]string{"quarantined": "true"}, "bucket1/x/y%25z"},
+		{"large/1", "a content of 36 bytes, in 4 parts", nil, "bucket1/large/1"},
+		{"large/2", "a content of 36 bytes, in 4 parts", map[string]string{"quarantined": "true"}, "bucket1/large/2"},
+	}
+	for _, c := range cases {
+		if err := putObject(s, c.key, c.data, map[string]string{"origin": "test"}); err != nil {
+			t.Errorf("failed to write %s: %s", c.key, err.Error())
+			return
+		}
+		cs.sources = nil
+		newKey := "copy/" + c.key
+		if err := s.Copy(c.key, newKey, c.meta); err != nil {
+			t.Errorf("Copy(%s): %s", c.key, err.Error())
+			continue
+		}
+		if len(cs.sources) == 0 || cs.sources[0] != c.source {
+			t.Errorf("unexpected copy source of %s: %v", c.key, cs.sources)
+		}
+		if len(c.data) > 16 && len(cs.sources) != 4 {
+			t.Errorf("unexpected part copies of %s: %d", c.key, len(cs.sources))
+		}
+		obj, err := s.Read(newKey)
+		if err != nil {
+			t.Errorf("failed to read %s: %s", newKey, err.Error())
+			continue
+		}
+		data, _ := ioutil.ReadAll(obj.GetBody())
+		obj.GetBody().Close()
+		meta := c.meta
+		if meta == nil {
+			meta = map[string]string{"origin": "test"}
+		}
+		if string(data) != c.data || obj.GetContentType() != "application/x-test" || !reflect.DeepEqual(Metadata(obj), meta) {
+			t.Errorf("unexpected copy of %s: %q, %s, %v", c.key, data, obj.GetContentType(), Metadata(obj))
+		}
+	}
+
+	if err := s.Copy("missing", "copy/missing", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("copy of a missing object: %v", err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	defer func(ak, sk string) {
+		os.Setenv("AWS_ACCESS_KEY_ID", ak)
+		os.Setenv("AWS_SECRET_ACCESS_KEY", sk)
+	}(os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	os.Setenv("AWS_ACCESS_KEY_ID", "")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+	Register("mem", func(u *url.URL) (StorSrc, error) {
+		return NewWosStorage(u.Host), nil
+	})
+	defer func() {
+		openersMu.Lock()
+		delete(openers, "mem")
+		openersMu.Unlock()
+	}()
+	if schemes := Schemes(); !reflect.DeepEqual(schemes, []string{"mem", "s3", "wos"}) {
+		t.Errorf("unexpected schemes: %v", schemes)
+	}
+
+	cases := []struct {
+		spec     string
+		ok       bool
+		bucket   string
+		endpoint string
+	}{
+		{"wos://10.0.0.1:8080", true, "", ""},
+		{"wos://", false, "", ""},
+		{"mem://host", true, "", ""},
+		{"s3://ak:sk@bucket1?endpoint=10.0.0.2:9000", true, "bucket1", "10.0.0.2:9000"},
+		{"s3://ak:sk@bucket1?region=eu-west-1", true, "bucket1", ""},
+		{"s3://bucket1", false, "", ""},
+		{"s3://ak:sk@", false, "", ""},
+		{"gcs://bucket1", false, "", ""},
+		{"%gh", false, "", ""},
+	}
+	for _, c := range cases {
+		s, err := Open(c.spec)
+		if (err == nil) != c.ok {
+			t.Errorf("Open(%s): %v", c.spec, err)
+			continue
+		}
+		if s3s, ok := s.(*S3Storage); ok && (s3s.Bucket != c.bucket || aws.StringValue(s3s.Config.Endpoint) != c.endpoint) {
+			t.Errorf("Open(%s): bucket %s, endpoint %s", c.spec, s3s.Bucket, aws.StringValue(s3s.Config.Endpoint))
+		}
+	}
+}
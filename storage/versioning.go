@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// ObjectLock is the object lock retention and legal hold of the uploaded
+// objects, the bucket having object lock enabled
+type ObjectLock struct {
+	// Mode is GOVERNANCE or COMPLIANCE, no retention when empty
+	Mode string
+	// Retention is how long the objects are retained from their upload
+	Retention time.Duration
+	LegalHold bool
+}
+
+func (t *ObjectLock) apply(input *s3manager.UploadInput) {
+	if t == nil {
+		return
+	}
+	if t.Mode != "" {
+		input.ObjectLockMode = aws.String(t.Mode)
+		input.ObjectLockRetainUntilDate = aws.Time(time.Now().Add(t.Retention).UTC())
+	}
+	if t.LegalHold {
+		input.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+}
+
+func (t *ObjectLock) applyMultipart(input *s3.CreateMultipartUploadInput) {
+	if t == nil {
+		return
+	}
+	if t.Mode != "" {
+		input.ObjectLockMode = aws.String(t.Mode)
+		input.ObjectLockRetainUntilDate = aws.Time(time.Now().Add(t.Retention).UTC())
+	}
+	if t.LegalHold {
+		input.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+}
+
+func (t *ObjectLock) applyCopy(input *s3.CopyObjectInput) {
+	if t == nil {
+		return
+	}
+	if t.Mode != "" {
+		input.ObjectLockMode = aws.String(t.Mode)
+		input.ObjectLockRetainUntilDate = aws.Time(time.Now().Add(t.Retention).UTC())
+	}
+	if t.LegalHold {
+		input.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+}
+
+// Versioning returns the versioning status of the bucket, Enabled or
+// Suspended, empty when it was never enabled
+func (t *S3Storage) Versioning() (string, error) {
+	svc := s3.New(session.New(t.Config))
+	out, err := svc.GetBucketVersioning(&s3.GetBucketVersioningInput{
+		Bucket: aws.String(t.Bucket),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.Status), nil
+}
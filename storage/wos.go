@@ -1,14 +1,42 @@
 package storage
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
+// WosStatusError is returned when wos fails a request, DDNStatus being the
+// x-ddn-status header, e.g. "205 InvalidObjId", when there is one
+type WosStatusError struct {
+	Op        string
+	Key       string
+	HTTPCode  int
+	DDNStatus string
+	Msg       string
+}
+
+func (e *WosStatusError) Error() string {
+	return fmt.Sprintf("wos %s error %s: %s", e.Op, e.Key, e.Msg)
+}
+
+// Code returns the x-ddn-status code, or the http status code without one
+func (e *WosStatusError) Code() string {
+	if e.DDNStatus != "" {
+		return strings.SplitN(e.DDNStatus, " ", 2)[0]
+	}
+	if e.HTTPCode != 0 {
+		return strconv.Itoa(e.HTTPCode)
+	}
+	return ""
+}
+
 type WosStorage struct {
 	host          string
 	readUrlPrefix string
@@ -26,15 +54,28 @@ func NewWosStorage(host string) *WosStorage {
 
 // Read read the wos server and create a wos object
 // remember to close the object body after use
-func (t *WosStorage) Read(key string) (SyncObject, error) {
+func (t *WosStorage) Read(key string) (obj SyncObject, err error) {
 	client := http.Client{
 		Timeout: time.Duration(WosReadTimeout),
 	}
+	l := ObjectLogger(t, key).WithFields(log.Fields{"phase": "read", "host": t.host})
+	start := time.Now()
+	l.Debug("wos get")
+	defer func() {
+		fields := log.Fields{"bytes": int64(0), "duration": time.Since(start).Seconds()}
+		if err != nil {
+			l.WithFields(fields).Debugf("wos get failed: %s", err.Error())
+			return
+		}
+		fields["bytes"] = obj.GetContentLength()
+		l.WithFields(fields).Debug("wos get headers")
+	}()
 
 	req, err := http.NewRequest("GET", t.readUrlPrefix+key, nil)
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(ObjectContext(t, key))
 	//req.Header.Set("content-type", "application/octet-stream")
 	resp, err := client.Do(req)
 	if err != nil {
@@ -43,7 +84,9 @@ func (t *WosStorage) Read(key string) (SyncObject, error) {
 
 	if resp.StatusCode != 200 {
 		resp.Body.Close()
-		return nil, fmt.Errorf("wos read error %s: http failed code: %d", key, resp.StatusCode)
+		return nil, &WosStatusError{Op: "read", Key: key, HTTPCode: resp.StatusCode,
+			DDNStatus: resp.Header.Get("x-ddn-status"),
+			Msg:       fmt.Sprintf("http failed code: %d", resp.StatusCode)}
 	}
 
 	wo := SyncObjectImp{
@@ -68,14 +111,15 @@ func (t *WosStorage) Read(key string) (SyncObject, error) {
 
 	if ddnStatus == "" {
 		resp.Body.Close()
-		return nil, fmt.Errorf("wos read error %s: not found x-ddn-status", key)
+		return nil, &WosStatusError{Op: "read", Key: key, HTTPCode: resp.StatusCode,
+			Msg: "not found x-ddn-status"}
 	}
 
 	if ddnStatus != "0 ok" {
 		resp.Body.Close()
-		return nil, fmt.Errorf(
-			"wos read error %s: failed x-ddn-status code: %s",
-			key, ddnStatus)
+		return nil, &WosStatusError{Op: "read", Key: key, HTTPCode: resp.StatusCode,
+			DDNStatus: ddnStatus,
+			Msg:       fmt.Sprintf("failed x-ddn-status code: %s", ddnStatus)}
 	}
 
 	if wo.contentType == "" {
@@ -92,6 +136,106 @@ func (t *WosStorage) Read(key string) (SyncObject, error) {
 	return &wo, nil
 }
 
+// Stat returns the size, content type and metadata of key with a range 0-0
+// GET, so that no content is transferred
+func (t *WosStorage) Stat(key string) (*ObjectInfo, error) {
+	client := http.Client{
+		Timeout: time.Duration(WosReadTimeout),
+	}
+
+	req, err := http.NewRequest("GET", t.readUrlPrefix+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	ddnStatus := resp.Header.Get("x-ddn-status")
+	if resp.StatusCode != 200 && resp.StatusCode != 206 {
+		return nil, &WosStatusError{Op: "stat", Key: key, HTTPCode: resp.StatusCode,
+			DDNStatus: ddnStatus,
+			Msg:       fmt.Sprintf("http failed code: %d", resp.StatusCode)}
+	}
+	if ddnStatus != "0 ok" {
+		return nil, &WosStatusError{Op: "stat", Key: key, HTTPCode: resp.StatusCode,
+			DDNStatus: ddnStatus,
+			Msg:       fmt.Sprintf("failed x-ddn-status code: %s", ddnStatus)}
+	}
+
+	info := &ObjectInfo{
+		ContentType: resp.Header.Get("Content-Type"),
+		Size:        -1,
+		Metadata:    parseDDNMeta(resp.Header.Get("x-ddn-meta")),
+	}
+	// bytes 0-0/<size> when the range is served, the whole length otherwise
+	if cr := resp.Header.Get("Content-Range"); cr != "" {
+		if i := strings.LastIndex(cr, "/"); i >= 0 {
+			info.Size, err = strconv.ParseInt(cr[i+1:], 10, 64)
+		}
+	} else if resp.StatusCode == 200 {
+		info.Size, err = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	}
+	if err != nil || info.Size < 0 {
+		return nil, fmt.Errorf("wos stat error %s: not found length", key)
+	}
+	return info, nil
+}
+
+// parseDDNMeta parses the x-ddn-meta header, "name":"value" pairs separated
+// by commas, nil when there are none or they can't be parsed
+func parseDDNMeta(header string) map[string]string {
+	if strings.TrimSpace(header) == "" {
+		return nil
+	}
+	var meta map[string]string
+	if err := json.Unmarshal([]byte("{"+header+"}"), &meta); err != nil {
+		log.Debugf("unparsable x-ddn-meta %s: %s", header, err.Error())
+		return nil
+	}
+	return meta
+}
+
+// Exists tells whether key is in wos
+func (t *WosStorage) Exists(key string) (bool, error) {
+	return exists(t, key)
+}
+
+// Delete deletes key from wos
+func (t *WosStorage) Delete(key string) error {
+	client := http.Client{
+		Timeout: time.Duration(WosWriteTimeout),
+	}
+
+	u := url.URL{Scheme: "http", Host: t.host, Path: "/cmd/delete"}
+	req, err := http.NewRequest("POST", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ddn-oid", key)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	ddnStatus := resp.Header.Get("x-ddn-status")
+	if resp.StatusCode != 200 {
+		return &WosStatusError{Op: "delete", Key: key, HTTPCode: resp.StatusCode,
+			DDNStatus: ddnStatus,
+			Msg:       fmt.Sprintf("http failed code: %d", resp.StatusCode)}
+	}
+	if ddnStatus != "0 ok" {
+		return &WosStatusError{Op: "delete", Key: key, HTTPCode: resp.StatusCode,
+			DDNStatus: ddnStatus,
+			Msg:       fmt.Sprintf("failed x-ddn-status code: %s", ddnStatus)}
+	}
+	return nil
+}
+
 // func (t *WosStorage) Verify(key, checksum string) (bool, error) {
 // 	if checksum == "" {
 // 		log.Warnf("no checksum for key: %s", key)
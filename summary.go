@@ -0,0 +1,402 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"s3sync/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// SummarySlowest is how many of the slowest objects the summary lists
+	SummarySlowest = 10
+	// SummaryRejects is how many rejected input lines the summary lists
+	SummaryRejects = 1000
+)
+
+// summaryReporter passes the results on to the report while gathering the
+// statistics of the run summary
+type summaryReporter struct {
+	sync.Mutex
+	reporter
+	start time.Time
+
+	ok         int
+	mismatch   int
+	partial    int
+	fail       int
+	bytes      int64
+	transforms map[string]int
+	// transformed and stored are the bytes of the transformed objects
+	// before and after their transform
+	transformed int64
+	stored      int64
+	// packed counts the packed objects, bundles their bundles
+	packed  int
+	bundles map[string]bool
+	// deduped and dedupedBytes are the objects whose content was already
+	// stored and the bytes not stored again
+	deduped      int
+	dedupedBytes int64
+	throughput   logHistogram
+	slowest      slowHeap
+
+	errClasses map[string]int
+	wosStatus  map[string]int
+	errCodes   map[string]int
+}
+
+func newSummaryReporter(rep reporter) *summaryReporter {
+	return &summaryReporter{
+		reporter:   rep,
+		start:      time.Now(),
+		errClasses: map[string]int{},
+		transforms: map[string]int{},
+		bundles:    map[string]bool{},
+		wosStatus:  map[string]int{},
+		errCodes:   map[string]int{},
+	}
+}
+
+func (t *summaryReporter) record(r *syncResult) {
+	t.reporter.record(r)
+
+	t.Lock()
+	defer t.Unlock()
+	switch e := r.reportEntry(); {
+	case r.errClass == errClassMismatch:
+		t.mismatch++
+		return
+	case r.err != nil:
+		t.fail++
+		t.errClasses[r.errClass]++
+		code := errorCode(r.err)
+		var wosErr *storage.WosStatusError
+		if errors.As(r.err, &wosErr) || (r.errClass == errClassRead && code != "") {
+			t.wosStatus[code]++
+		} else if code != "" {
+			t.errCodes[code]++
+		}
+		return
+	case e.status == "partial":
+		t.partial++
+	case !r.verified:
+		t.mismatch++
+	default:
+		t.ok++
+	}
+
+	t.bytes += r.size
+	if r.transform != "" {
+		t.transforms[r.transform]++
+		t.transformed += r.size
+		t.stored += r.storedSize
+	}
+	if r.deduped {
+		t.deduped++
+		if r.transform != "" {
+			t.dedupedBytes += r.storedSize
+		} else {
+			t.dedupedBytes += r.size
+		}
+	}
+	if r.bundle != nil {
+		t.packed++
+		t.bundles[r.bundle.Key] = true
+	}
+	if r.totalTime > 0 {
+		t.throughput.add(float64(r.size) / r.totalTime.Seconds())
+	}
+	heap.Push(&t.slowest, slowObject{OID: r.oldKey, Size: r.size, DurationMs: durationMs(r.totalTime)})
+	if t.slowest.Len() > SummarySlowest {
+		heap.Pop(&t.slowest)
+	}
+}
+
+type slowObject struct {
+	OID        string  `json:"oid"`
+	Size       int64   `json:"size"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// slowHeap is a min heap keeping the slowest objects
+type slowHeap []slowObject
+
+func (h slowHeap) Len() int            { return len(h) }
+func (h slowHeap) Less(i, j int) bool  { return h[i].DurationMs < h[j].DurationMs }
+func (h slowHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *slowHeap) Push(x interface{}) { *h = append(*h, x.(slowObject)) }
+func (h *slowHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// logHistogram counts values in buckets growing by 2^(1/8), ~9% apart, to
+// estimate percentiles without keeping every value
+type logHistogram struct {
+	buckets map[int]int
+	count   int
+}
+
+func (t *logHistogram) add(v float64) {
+	if t.buckets == nil {
+		t.buckets = map[int]int{}
+	}
+	b := math.MinInt32
+	if v > 0 {
+		b = int(math.Floor(math.Log2(v) * 8))
+	}
+	t.buckets[b]++
+	t.count++
+}
+
+// percentile returns the upper bound of the bucket holding the p-th value
+func (t *logHistogram) percentile(p float64) float64 {
+	if t.count == 0 {
+		return 0
+	}
+	keys := make([]int, 0, len(t.buckets))
+	for k := range t.buckets {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	rank := int(math.Ceil(p / 100 * float64(t.count)))
+	seen := 0
+	for _, k := range keys {
+		seen += t.buckets[k]
+		if seen >= rank {
+			if k == math.MinInt32 {
+				return 0
+			}
+			return math.Pow(2, float64(k+1)/8)
+		}
+	}
+	return 0
+}
+
+// runSummary is the summary artefact of a run
+type runSummary struct {
+	RunID    string    `json:"run_id"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration_s"`
+
+	Total    int `json:"total"`
+	OK       int `json:"ok"`
+	Mismatch int `json:"verify_mismatch"`
+	Partial  int `json:"partial"`
+	Fail     int `json:"fail"`
+
+	Bytes      int64              `json:"bytes"`
+	Throughput float64            `json:"throughput_bps"`
+	ObjectBps  map[string]float64 `json:"object_throughput_bps"`
+	Slowest    []slowObject       `json:"slowest"`
+
+	Transformed *transformSummary `json:"transformed,omitempty"`
+	Packed      *packSummary      `json:"packed,omitempty"`
+	Deduped     *dedupSummary     `json:"deduped,omitempty"`
+
+	ErrorsByClass     map[string]int `json:"errors_by_class"`
+	ErrorsByWosStatus map[string]int `json:"errors_by_wos_status"`
+	ErrorsByCode      map[string]int `json:"errors_by_code"`
+
+	Prescan        *prescanSummary `json:"prescan,omitempty"`
+	Rejected       int             `json:"rejected"`
+	RejectedInputs []string        `json:"rejected_inputs"`
+}
+
+type transformSummary struct {
+	Objects     map[string]int `json:"objects"`
+	Bytes       int64          `json:"bytes"`
+	StoredBytes int64          `json:"stored_bytes"`
+}
+
+type packSummary struct {
+	Objects int `json:"objects"`
+	Bundles int `json:"bundles"`
+}
+
+// dedupSummary is the storage savings of the content deduplication, the
+// skipped bytes being uploaded to the staging key all the same
+type dedupSummary struct {
+	Objects      int   `json:"objects"`
+	SkippedBytes int64 `json:"skipped_bytes"`
+}
+
+type prescanSummary struct {
+	Total      int `json:"total"`
+	Invalid    int `json:"invalid"`
+	Duplicates int `json:"duplicates"`
+	Queued     int `json:"queued"`
+}
+
+// summary builds the run summary, rejects and prescan may be nil
+func (t *summaryReporter) summary(rejects *rejectWriter, prescan *prescanStats) *runSummary {
+	t.Lock()
+	defer t.Unlock()
+	end := time.Now()
+	s := &runSummary{
+		RunID:             runID,
+		Start:             t.start,
+		End:               end,
+		Duration:          end.Sub(t.start).Seconds(),
+		OK:                t.ok,
+		Mismatch:          t.mismatch,
+		Partial:           t.partial,
+		Fail:              t.fail,
+		Total:             t.ok + t.mismatch + t.partial + t.fail,
+		Bytes:             t.bytes,
+		ErrorsByClass:     t.errClasses,
+		ErrorsByWosStatus: t.wosStatus,
+		ErrorsByCode:      t.errCodes,
+		ObjectBps: map[string]float64{
+			"p50": t.throughput.percentile(50),
+			"p90": t.throughput.percentile(90),
+			"p99": t.throughput.percentile(99),
+		},
+		Rejected:       rejects.rejected(),
+		RejectedInputs: rejects.lines(),
+	}
+	if s.Duration > 0 {
+		s.Throughput = float64(t.bytes) / s.Duration
+	}
+	s.Slowest = append([]slowObject{}, t.slowest...)
+	sort.Slice(s.Slowest, func(i, j int) bool {
+		return s.Slowest[i].DurationMs > s.Slowest[j].DurationMs
+	})
+	if len(t.transforms) > 0 {
+		s.Transformed = &transformSummary{
+			Objects:     t.transforms,
+			Bytes:       t.transformed,
+			StoredBytes: t.stored,
+		}
+	}
+	if t.packed > 0 {
+		s.Packed = &packSummary{Objects: t.packed, Bundles: len(t.bundles)}
+	}
+	if t.deduped > 0 {
+		s.Deduped = &dedupSummary{Objects: t.deduped, SkippedBytes: t.dedupedBytes}
+	}
+	if prescan != nil {
+		s.Prescan = &prescanSummary{
+			Total:      prescan.total,
+			Invalid:    prescan.invalid,
+			Duplicates: prescan.duplicates,
+			Queued:     prescan.queued,
+		}
+	}
+	return s
+}
+
+func (t *runSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Run %s: %s - %s (%.0fs)\n", t.RunID,
+		t.Start.Format(time.RFC3339), t.End.Format(time.RFC3339), t.Duration)
+	fmt.Fprintf(&b, "Objects: %d\n", t.Total)
+	fmt.Fprintf(&b, "  ok: %d\n", t.OK)
+	fmt.Fprintf(&b, "  verify mismatch: %d\n", t.Mismatch)
+	fmt.Fprintf(&b, "  partial: %d\n", t.Partial)
+	fmt.Fprintf(&b, "  fail: %d\n", t.Fail)
+	fmt.Fprintf(&b, "Transferred: %s, %s/s\n", formatBytes(float64(t.Bytes)), formatBytes(t.Throughput))
+	fmt.Fprintf(&b, "Object throughput: p50 %s/s, p90 %s/s, p99 %s/s\n",
+		formatBytes(t.ObjectBps["p50"]), formatBytes(t.ObjectBps["p90"]), formatBytes(t.ObjectBps["p99"]))
+	if len(t.Slowest) > 0 {
+		b.WriteString("Slowest objects:\n")
+		for _, o := range t.Slowest {
+			fmt.Fprintf(&b, "  %s %s %.0fms\n", o.OID, formatBytes(float64(o.Size)), o.DurationMs)
+		}
+	}
+	if t.Transformed != nil {
+		writeHistogram(&b, fmt.Sprintf("Transformed, %s stored as %s",
+			formatBytes(float64(t.Transformed.Bytes)), formatBytes(float64(t.Transformed.StoredBytes))),
+			t.Transformed.Objects)
+	}
+	if t.Packed != nil {
+		fmt.Fprintf(&b, "Packed: %d objects in %d bundles\n", t.Packed.Objects, t.Packed.Bundles)
+	}
+	if t.Deduped != nil {
+		fmt.Fprintf(&b, "Deduplicated: %d objects, %s not stored again\n",
+			t.Deduped.Objects, formatBytes(float64(t.Deduped.SkippedBytes)))
+	}
+	writeHistogram(&b, "Errors by class", t.ErrorsByClass)
+	writeHistogram(&b, "Errors by wos status", t.ErrorsByWosStatus)
+	writeHistogram(&b, "Errors by code", t.ErrorsByCode)
+	if t.Prescan != nil {
+		fmt.Fprintf(&b, "Prescan: %d objects, %d invalid, %d duplicated, %d queued\n",
+			t.Prescan.Total, t.Prescan.Invalid, t.Prescan.Duplicates, t.Prescan.Queued)
+	}
+	if t.Rejected > 0 {
+		fmt.Fprintf(&b, "Rejected inputs: %d\n", t.Rejected)
+		for _, l := range t.RejectedInputs {
+			fmt.Fprintf(&b, "  %s\n", l)
+		}
+		if t.Rejected > len(t.RejectedInputs) {
+			fmt.Fprintf(&b, "  ...\n")
+		}
+	}
+	return b.String()
+}
+
+func writeHistogram(b *strings.Builder, title string, h map[string]int) {
+	if len(h) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return h[keys[i]] > h[keys[j]] || (h[keys[i]] == h[keys[j]] && keys[i] < keys[j])
+	})
+	fmt.Fprintf(b, "%s:\n", title)
+	for _, k := range keys {
+		name := k
+		if name == "" {
+			name = "unknown"
+		}
+		fmt.Fprintf(b, "  %s: %d\n", name, h[k])
+	}
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
+
+// writeSummary logs the summary and writes it to path.json and path.txt
+// when path isn't empty
+func writeSummary(s *runSummary, path string) {
+	text := s.String()
+	log.Info(text)
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Errorf("failed to encode summary: %s", err.Error())
+		return
+	}
+	if err := ioutil.WriteFile(path+".json", data, 0644); err != nil {
+		log.Errorf("failed to write summary %s.json: %s", path, err.Error())
+	}
+	if err := ioutil.WriteFile(path+".txt", []byte(text), 0644); err != nil {
+		log.Errorf("failed to write summary %s.txt: %s", path, err.Error())
+	}
+}
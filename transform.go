@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/md5"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"s3sync/storage"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// transforms applied to the selected objects between the source and the
+// destination
+const (
+	transformGzip = "gzip"
+	transformZstd = "zstd"
+	// transformDecompress stores the gzip or zstd compressed objects
+	// decompressed, recorded as gunzip or unzstd
+	transformDecompress = "decompress"
+)
+
+// metadata recording the transform of a stored object
+const (
+	metaTransform = "s3sync-transform"
+	// metaOriginalSize is the size of the source object
+	metaOriginalSize = "s3sync-original-size"
+)
+
+var (
+	// Transform is applied to the selected objects, none when empty
+	Transform = ""
+	// TransformTypes selects the objects by content type prefix, comma
+	// separated, all when empty
+	TransformTypes = ""
+	// TransformMinSize selects the objects of at least this many bytes
+	TransformMinSize int64 = 0
+	// TransformKeys selects the oids matching this regexp, all when empty
+	TransformKeys = ""
+
+	objectTransform *transformer
+)
+
+func addTransformFlags(fs *flag.FlagSet) {
+	fs.StringVar(&Transform, "transform", Transform, "transform of the selected objects: gzip, zstd or decompress, none when empty")
+	fs.StringVar(&TransformTypes, "transformtypes", TransformTypes, "only transform these content types, comma separated prefixes")
+	fs.Int64Var(&TransformMinSize, "transformminsize", TransformMinSize, "only transform objects of at least this many bytes")
+	fs.StringVar(&TransformKeys, "transformkeys", TransformKeys, "only transform oids matching this regexp")
+}
+
+// setupTransform checks the transform flags and sets the transform of the
+// migrated objects
+func setupTransform() error {
+	objectTransform = nil
+	if Transform == "" {
+		return nil
+	}
+	switch Transform {
+	case transformGzip, transformZstd, transformDecompress:
+	default:
+		return fmt.Errorf("unknown transform: %s", Transform)
+	}
+	t := &transformer{op: Transform, minSize: TransformMinSize}
+	for _, p := range strings.Split(TransformTypes, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			t.types = append(t.types, p)
+		}
+	}
+	if TransformKeys != "" {
+		re, err := regexp.Compile(TransformKeys)
+		if err != nil {
+			return fmt.Errorf("invalid transform key pattern: %s", err.Error())
+		}
+		t.keys = re
+	}
+	objectTransform = t
+	return nil
+}
+
+// transformer selects the objects to transform and transforms them
+type transformer struct {
+	op      string
+	types   []string
+	minSize int64
+	keys    *regexp.Regexp
+}
+
+// selects tells whether the object key of contentType and size is
+// transformed
+func (t *transformer) selects(key, contentType string, size int64) bool {
+	if t == nil || size < t.minSize {
+		return false
+	}
+	if t.keys != nil && !t.keys.MatchString(key) {
+		return false
+	}
+	if len(t.types) == 0 {
+		return true
+	}
+	for _, p := range t.types {
+		if strings.HasPrefix(contentType, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns obj transformed, nil when it isn't selected. A selected
+// object already compressed isn't compressed again, nor an uncompressed one
+// decompressed, its transform being empty.
+func (t *transformer) apply(key string, obj storage.SyncObject) (*transformedObject, error) {
+	if !t.selects(key, obj.GetContentType(), obj.GetContentLength()) {
+		return nil, nil
+	}
+	source := obj.GetBody()
+	// the raw bytes of a decompressed object are its source md5
+	raw := md5.New()
+	br := bufio.NewReader(io.TeeReader(source, raw))
+	magic, _ := br.Peek(4)
+	format := compression(magic)
+	o := &transformedObject{
+		contentType:  obj.GetContentType(),
+		originalSize: obj.GetContentLength(),
+		sum:          md5.New(),
+		source:       source,
+		done:         make(chan struct{}),
+	}
+
+	switch {
+	case t.op == transformDecompress && format != "":
+		zr, err := decompress(format, br)
+		if err != nil {
+			source.Close()
+			return nil, fmt.Errorf("failed to read %s object: %s", format, err.Error())
+		}
+		o.op = map[string]string{"gzip": "gunzip", "zstd": "unzstd"}[format]
+		o.output = &countingReader{r: io.TeeReader(zr, o.sum)}
+		o.raw, o.rest = raw, br
+		o.closers = []io.Closer{zr}
+		close(o.done)
+	case t.op != transformDecompress && format == "":
+		o.op = t.op
+		pr, pw := io.Pipe()
+		o.output = &countingReader{r: pr}
+		o.closers = []io.Closer{pr}
+		go func() {
+			defer close(o.done)
+			pw.CloseWithError(compress(t.op, pw, io.TeeReader(br, o.sum)))
+		}()
+	default:
+		o.output = &countingReader{r: io.TeeReader(br, o.sum)}
+		close(o.done)
+	}
+	return o, nil
+}
+
+// compress writes the content of r to w compressed with format
+func compress(format string, w io.Writer, r io.Reader) error {
+	var zw io.WriteCloser
+	switch format {
+	case transformGzip:
+		zw = gzip.NewWriter(w)
+	case transformZstd:
+		e, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		zw = e
+	default:
+		return fmt.Errorf("unknown compression: %s", format)
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// transformedObject is an object transformed on its way to the destination.
+// Its content, the bytes a copy is verified against, are the original bytes
+// of a compressed object and the decompressed bytes of a decompressed one.
+type transformedObject struct {
+	// op is the transform applied, empty when the object is stored as is
+	op           string
+	contentType  string
+	originalSize int64
+	// sum hashes the content as it is read
+	sum hash.Hash
+	// raw hashes the source bytes of a decompressed object, rest being the
+	// source left once its content is read
+	raw     hash.Hash
+	rest    io.Reader
+	source  io.ReadCloser
+	output  *countingReader
+	closers []io.Closer
+	// done is closed once the content is hashed
+	done chan struct{}
+}
+
+func (t *transformedObject) GetContentType() string {
+	return t.contentType
+}
+
+// GetContentLength is unknown once transformed
+func (t *transformedObject) GetContentLength() int64 {
+	if t.op == "" {
+		return t.originalSize
+	}
+	return -1
+}
+
+func (t *transformedObject) GetBody() io.ReadCloser {
+	return t
+}
+
+func (t *transformedObject) GetMetadata() map[string]string {
+	if t.op == "" {
+		return nil
+	}
+	meta := map[string]string{metaTransform: t.op}
+	if t.originalSize >= 0 {
+		meta[metaOriginalSize] = strconv.FormatInt(t.originalSize, 10)
+	}
+	return meta
+}
+
+func (t *transformedObject) Read(p []byte) (int, error) {
+	n, err := t.output.Read(p)
+	if err == io.EOF && t.rest != nil {
+		// the bytes following the compressed stream are hashed too
+		if _, rerr := io.Copy(ioutil.Discard, t.rest); rerr != nil {
+			return n, rerr
+		}
+		t.rest = nil
+	}
+	return n, err
+}
+
+// Close stops the transform and closes the source
+func (t *transformedObject) Close() error {
+	for _, c := range t.closers {
+		c.Close()
+	}
+	return t.source.Close()
+}
+
+// md5 returns the md5 of the content, quoted like storage.CalcMD5, once the
+// object was read through
+func (t *transformedObject) md5() string {
+	<-t.done
+	return fmt.Sprintf("\"%x\"", t.sum.Sum(nil))
+}
+
+// sourceMD5 returns the md5 of the source bytes once the object was read
+// through, the one of the content unless the object was decompressed
+func (t *transformedObject) sourceMD5() string {
+	if t.raw == nil {
+		return t.md5()
+	}
+	return fmt.Sprintf("\"%x\"", t.raw.Sum(nil))
+}
+
+// storedSize returns the bytes read from the object
+func (t *transformedObject) storedSize() int64 {
+	return t.output.n
+}
+
+// restoreBody returns the original content of a stored object body, given
+// its metadata, decrypting an encrypted object and decompressing a
+// compressed one
+func restoreBody(meta map[string]string, body io.ReadCloser) (io.ReadCloser, error) {
+	if meta[metaEncryption] != "" {
+		plain, err := decryptBody(meta, body)
+		if err != nil {
+			return nil, err
+		}
+		body = plain
+	}
+	switch op := meta[metaTransform]; op {
+	case transformGzip, transformZstd:
+		zr, err := decompress(op, body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s object: %s", op, err.Error())
+		}
+		return &input{Reader: zr, closers: []io.Closer{body, zr}}, nil
+	}
+	return body, nil
+}
+
+// sourceChecksums reads a source body, returning the md5 of its bytes and
+// the one of its content, decompressed when it's gzip or zstd compressed
+func sourceChecksums(body io.Reader) (string, string, error) {
+	raw := md5.New()
+	br := bufio.NewReader(io.TeeReader(body, raw))
+	magic, _ := br.Peek(4)
+	content := md5.New()
+	// the bytes following a compressed stream are only part of the source
+	var rest io.Writer = content
+	if format := compression(magic); format != "" {
+		zr, err := decompress(format, br)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read %s object: %s", format, err.Error())
+		}
+		defer zr.Close()
+		if _, err := io.Copy(content, zr); err != nil {
+			return "", "", err
+		}
+		rest = ioutil.Discard
+	}
+	if _, err := io.Copy(rest, br); err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("\"%x\"", raw.Sum(nil)), fmt.Sprintf("\"%x\"", content.Sum(nil)), nil
+}
+
+// isDecompressed tells whether a stored object, given its metadata, was
+// decompressed on its way
+func isDecompressed(meta map[string]string) bool {
+	op := meta[metaTransform]
+	return op == "gunzip" || op == "unzstd"
+}
+
+// originalSize returns the size of the source of a stored object of size,
+// given its metadata
+func originalSize(meta map[string]string, size int64) int64 {
+	if s, err := strconv.ParseInt(meta[metaOriginalSize], 10, 64); err == nil {
+		return s
+	}
+	return size
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (t *countingReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"s3sync/storage"
+)
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to compress: %s", err.Error())
+	}
+	return b.Bytes()
+}
+
+func TestTransform(t *testing.T) {
+	defer func() {
+		Transform, TransformMinSize, KeyPrefix = "", 0, ""
+		setupTransform()
+	}()
+
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	dest := storage.NewS3Storage(s3Server.URL, "u1", "s1", bucket)
+
+	logs := []byte(strings.Repeat("GET /index.html 200\n", 1000))
+	source := newMemStorage(0)
+	source.objects["log"] = logs
+	source.objects["gz"] = gzipData(t, logs)
+	source.objects["small"] = []byte("small content")
+
+	steps := []struct {
+		transform string
+		prefix    string
+		want      map[string]string
+	}{
+		// the compressed object isn't compressed again, the small one isn't
+		// selected
+		{transformGzip, "", map[string]string{"log": "gzip", "gz": "", "small": ""}},
+		{transformZstd, "zstd/", map[string]string{"log": "zstd", "gz": "", "small": ""}},
+		{transformDecompress, "plain/", map[string]string{"log": "", "gz": "gunzip", "small": ""}},
+	}
+	for _, step := range steps {
+		Transform, TransformMinSize, KeyPrefix = step.transform, 100, step.prefix
+		if err := setupTransform(); err != nil {
+			t.Errorf("failed to set up %s: %s", step.transform, err.Error())
+			return
+		}
+		report := &memWriter{}
+		migrate(dest, source, &jsonReporter{w: bufio.NewWriter(report)},
+			&listEnumerator{r: strings.NewReader("log\ngz\nsmall\n")})
+
+		for _, l := range strings.Split(strings.TrimSpace(string(report.data)), "\n") {
+			var line jsonReportLine
+			if err := json.Unmarshal([]byte(l), &line); err != nil {
+				t.Errorf("invalid report line %s: %s", l, err.Error())
+				return
+			}
+			original := source.objects[line.OID]
+			// the source md5 of a decompressed object is the one of its
+			// compressed bytes
+			if line.Status != "ok" || !line.Verified || line.Transform != step.want[line.OID] ||
+				line.Size != int64(len(original)) || (line.Transform != "") != (line.StoredSize > 0) ||
+				line.SourceMD5 != fmt.Sprintf("%x", md5.Sum(original)) {
+				t.Errorf("%s: unexpected report of %s: %s", step.transform, line.OID, l)
+				return
+			}
+		}
+
+		obj, err := dest.Read(step.prefix + "log")
+		if err != nil {
+			t.Errorf("%s: failed to read log: %s", step.transform, err.Error())
+			return
+		}
+		meta := storage.Metadata(obj)
+		body, err := restoreBody(meta, obj.GetBody())
+		if err != nil {
+			t.Errorf("%s: failed to restore log: %s", step.transform, err.Error())
+			return
+		}
+		data, _ := ioutil.ReadAll(body)
+		body.Close()
+		if !bytes.Equal(data, logs) || meta[metaTransform] != step.want["log"] ||
+			(step.want["log"] != "" && originalSize(meta, 0) != int64(len(logs))) {
+			t.Errorf("%s: unexpected copy of log: %v, %d bytes", step.transform, meta, len(data))
+			return
+		}
+	}
+
+	// the source of a decompressed copy is deleted once checked again
+	KeyPrefix = "plain/"
+	o := stateObject{oid: "gz", size: int64(len(source.objects["gz"])), verify: verifyDecompressed,
+		srcMD5: fmt.Sprintf("%x", md5.Sum(source.objects["gz"])), dstMD5: fmt.Sprintf("%x", md5.Sum(logs))}
+	d := &sourceDeleter{opts: deleteOptions{reverify: true}, source: source, dest: dest}
+	if reason := d.check(o); reason != "" {
+		t.Errorf("unexpected check of the decompressed gz: %s", reason)
+	}
+	changed := o
+	changed.srcMD5 = fmt.Sprintf("%x", md5.Sum(logs))
+	if reason := d.check(changed); !strings.HasPrefix(reason, "source changed since the copy") {
+		t.Errorf("unexpected check of a changed source: %s", reason)
+	}
+	changed = o
+	changed.dstMD5 = changed.srcMD5
+	if reason := d.check(changed); !strings.HasPrefix(reason, "recorded checksum differs from the decompressed source") {
+		t.Errorf("unexpected check of a wrong copy: %s", reason)
+	}
+
+	// the audit compares the transformed copies to their source content
+	dir, err := ioutil.TempDir("", "transform")
+	if err != nil {
+		t.Errorf("failed to create temp dir: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "report.csv")
+	ioutil.WriteFile(input, []byte("1,ok,true,log\n1,ok,true,gz\n1,ok,true,small\n"), 0644)
+	for _, prefix := range []string{"", "zstd/", "plain/"} {
+		KeyPrefix = prefix
+		for _, mode := range []string{auditFull, auditSize} {
+			opts := auditOptions{mode: mode, sample: 1, confidence: 0.95, margin: 0.05, seed: "s"}
+			var out bytes.Buffer
+			s, _, err := runAudit(reportKeys(input), opts, source, dest, &out, []byte("secret"))
+			if err != nil || s.Checked != 3 || s.Matched != 3 {
+				t.Errorf("unexpected %s audit of %q: %+v, %v\n%s", mode, prefix, s, err, out.String())
+			}
+		}
+	}
+}
+
+func TestTransformSelect(t *testing.T) {
+	defer func() {
+		Transform, TransformTypes, TransformMinSize, TransformKeys = "", "", 0, ""
+		setupTransform()
+	}()
+	Transform, TransformTypes, TransformMinSize, TransformKeys = transformGzip, "text/, application/json", 10, `\.log$`
+	if err := setupTransform(); err != nil {
+		t.Errorf("failed to set up transform: %s", err.Error())
+		return
+	}
+	cases := []struct {
+		key         string
+		contentType string
+		size        int64
+		want        bool
+	}{
+		{"a.log", "text/plain", 100, true},
+		{"a.log", "application/json; charset=utf-8", 100, true},
+		{"a.log", "image/png", 100, false},
+		{"a.log", "text/plain", 5, false},
+		{"a.bin", "text/plain", 100, false},
+	}
+	for _, c := range cases {
+		if got := objectTransform.selects(c.key, c.contentType, c.size); got != c.want {
+			t.Errorf("selects(%s, %s, %d): want %v", c.key, c.contentType, c.size, c.want)
+		}
+	}
+
+	Transform = "lz4"
+	if err := setupTransform(); err == nil {
+		t.Errorf("unknown transform accepted")
+	}
+}
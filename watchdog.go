@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// WatchdogInterval is how often the watchdog checks the transfers
+	WatchdogInterval = 5 * time.Second
+	// WatchdogRequeues is how many times an object whose transfer was
+	// cancelled is requeued before failing
+	WatchdogRequeues = 2
+)
+
+// stalledError fails a transfer cancelled by the watchdog
+type stalledError struct {
+	reason string
+	err    error
+}
+
+func (t *stalledError) Error() string {
+	if t.err == nil {
+		return "transfer cancelled: " + t.reason
+	}
+	return fmt.Sprintf("transfer cancelled: %s: %s", t.reason, t.err.Error())
+}
+
+func (t *stalledError) Code() string {
+	return "stalled"
+}
+
+// watchdogOptions configures the watchdog, a zero value disabling a check
+type watchdogOptions struct {
+	// minRate is the minimum transfer rate in bytes/s of an object over window
+	minRate float64
+	window  time.Duration
+	// maxTransfer is the longest an object transfer may take
+	maxTransfer time.Duration
+	// deadline is the longest the run may go without progress
+	deadline time.Duration
+}
+
+func addWatchdogFlags(fs *flag.FlagSet, o *watchdogOptions) {
+	fs.Float64Var(&o.minRate, "minrate", 0, "bytes/s an object transfer is cancelled and requeued under, 0 to disable")
+	fs.DurationVar(&o.window, "ratewindow", time.Minute, "window the transfer rate is measured over")
+	fs.DurationVar(&o.maxTransfer, "maxtransfer", 0, "time an object transfer is cancelled and requeued after, 0 to disable")
+	fs.DurationVar(&o.deadline, "deadline", time.Hour, "time without progress the run is aborted after, 0 to disable")
+	fs.IntVar(&WatchdogRequeues, "stallrequeues", WatchdogRequeues, "requeues of a cancelled transfer before it fails")
+}
+
+// watchdog cancels the slow or hung transfers and aborts a run making no
+// progress
+type watchdog struct {
+	opts watchdogOptions
+	ctl  *runControl
+
+	lastBytes      int64
+	lastDispatched int
+	lastFinished   int
+	lastProgress   time.Time
+}
+
+func newWatchdog(opts watchdogOptions, ctl *runControl) *watchdog {
+	return &watchdog{opts: opts, ctl: ctl, lastProgress: time.Now()}
+}
+
+// check cancels the transfers too slow or too long at now, and aborts the
+// run without progress since the deadline. The enumeration of the objects
+// counts as progress, the deadline only running once an object was
+// dispatched, so a slow listing or prescan doesn't abort the run.
+func (t *watchdog) check(now time.Time) {
+	var bytes int64
+	inflight.Lock()
+	type cancellation struct {
+		o      *inflightObject
+		reason string
+	}
+	var cancels []cancellation
+	for k, o := range inflight.objects {
+		if k.run != t.ctl {
+			continue
+		}
+		read := atomic.LoadInt64(&o.read)
+		bytes += read
+		if o.reason != "" {
+			continue
+		}
+		o.samples = append(o.samples, progressSample{at: now, bytes: read})
+		// keep a single sample older than the window, the window start
+		for len(o.samples) > 1 && now.Sub(o.samples[1].at) >= t.opts.window {
+			o.samples = o.samples[1:]
+		}
+		elapsed := now.Sub(o.Start)
+		if t.opts.maxTransfer > 0 && elapsed > t.opts.maxTransfer {
+			cancels = append(cancels, cancellation{o,
+				fmt.Sprintf("transfer longer than %s", t.opts.maxTransfer)})
+			continue
+		}
+		first := o.samples[0]
+		if t.opts.minRate > 0 && elapsed >= t.opts.window && now.Sub(first.at) >= t.opts.window {
+			rate := float64(read-first.bytes) / now.Sub(first.at).Seconds()
+			if rate < t.opts.minRate {
+				cancels = append(cancels, cancellation{o,
+					fmt.Sprintf("%s/s under %s/s", formatBytes(rate), formatBytes(t.opts.minRate))})
+			}
+		}
+	}
+	inflight.Unlock()
+	for _, c := range cancels {
+		inflight.logger(c.o, c.o.OID).Warnf("cancelling transfer: %s", c.reason)
+		inflight.cancel(c.o, c.reason)
+	}
+
+	dispatched, finished := t.ctl.progress()
+	if dispatched == 0 || bytes != t.lastBytes || dispatched != t.lastDispatched || finished != t.lastFinished {
+		t.lastBytes = bytes
+		t.lastDispatched = dispatched
+		t.lastFinished = finished
+		t.lastProgress = now
+		return
+	}
+	if t.ctl.status().Paused {
+		t.lastProgress = now
+		return
+	}
+	if t.opts.deadline > 0 && now.Sub(t.lastProgress) >= t.opts.deadline {
+		t.ctl.giveUp(fmt.Sprintf("no progress for %s", t.opts.deadline))
+		inflight.cancelRun(t.ctl, "run aborted")
+	}
+}
+
+// run checks the transfers until stop is closed
+func (t *watchdog) run(stop <-chan struct{}) {
+	if t.opts.minRate <= 0 && t.opts.maxTransfer <= 0 && t.opts.deadline <= 0 {
+		return
+	}
+	tick := time.NewTicker(WatchdogInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			t.check(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// startWatchdog watches the run controlled by ctl, the returned function
+// stopping the watchdog
+func startWatchdog(opts watchdogOptions, ctl *runControl) func() {
+	stop := make(chan struct{})
+	go newWatchdog(opts, ctl).run(stop)
+	return func() {
+		close(stop)
+	}
+}
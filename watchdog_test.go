@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"s3sync/storage"
+)
+
+// setupStallingWosServer serves oids like setupWosServer, trickling a byte
+// of the object slow then hanging, and hanging before answering hung
+func setupStallingWosServer(t *testing.T, oids []string) (*httptest.Server, func(oid string) int) {
+	wos := setupWosServer(t, oids)
+	var mu sync.Mutex
+	gets := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		oid := strings.TrimPrefix(r.URL.Path, "/objects/")
+		mu.Lock()
+		gets[oid]++
+		mu.Unlock()
+		switch oid {
+		case "slow":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", "1000")
+			w.Header().Set("x-ddn-status", "0 ok")
+			w.Write([]byte("s"))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		case "hung":
+			<-r.Context().Done()
+		default:
+			wos.Config.Handler.ServeHTTP(w, r)
+		}
+	}))
+	return server, func(oid string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return gets[oid]
+	}
+}
+
+func TestWatchdogRequeue(t *testing.T) {
+	interval, requeues := WatchdogInterval, WatchdogRequeues
+	WatchdogInterval, WatchdogRequeues = 20*time.Millisecond, 1
+	defer func() { WatchdogInterval, WatchdogRequeues = interval, requeues }()
+
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	wos, gets := setupStallingWosServer(t, []string{"k1"})
+	defer wos.Close()
+	dest := storage.NewS3Storage(s3Server.URL, "u1", "s1", bucket)
+	source := storage.NewWosStorage(strings.TrimPrefix(wos.URL, "http://"))
+
+	ctl := newRunControl(2)
+	stop := startWatchdog(watchdogOptions{minRate: 1000, window: 100 * time.Millisecond}, ctl)
+	defer stop()
+	report := &memWriter{}
+	done := make(chan struct{})
+	go func() {
+		runMigration(ctl, dest, source, &csvReporter{w: bufio.NewWriter(report)},
+			&listEnumerator{r: strings.NewReader("k1\nslow\n")})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Errorf("migration with a stalled transfer didn't complete")
+		return
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(report.data)), "\n")
+	if len(lines) != 2 {
+		t.Errorf("want 2 report lines, got: %s", report.data)
+		return
+	}
+	for _, line := range lines {
+		if strings.Contains(line, ",slow,") && !strings.Contains(line, "fail,false,slow,transfer cancelled") {
+			t.Errorf("slow object not cancelled: %s", line)
+		}
+		if strings.Contains(line, ",k1") && !strings.Contains(line, "ok,true,k1") {
+			t.Errorf("k1 not migrated: %s", line)
+		}
+	}
+	if gets("slow") != 2 {
+		t.Errorf("want the slow object read twice, got %d", gets("slow"))
+	}
+}
+
+func TestWatchdogDeadline(t *testing.T) {
+	interval := WatchdogInterval
+	WatchdogInterval = 20 * time.Millisecond
+	defer func() { WatchdogInterval = interval }()
+
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	wos, _ := setupStallingWosServer(t, []string{"k1"})
+	defer wos.Close()
+	dest := storage.NewS3Storage(s3Server.URL, "u1", "s1", bucket)
+	source := storage.NewWosStorage(strings.TrimPrefix(wos.URL, "http://"))
+
+	ctl := newRunControl(1)
+	stop := startWatchdog(watchdogOptions{deadline: 200 * time.Millisecond}, ctl)
+	defer stop()
+	done := make(chan struct{})
+	go func() {
+		runMigration(ctl, dest, source, &csvReporter{w: bufio.NewWriter(&memWriter{})},
+			&listEnumerator{r: strings.NewReader("k1\nhung\n")})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Errorf("migration without progress wasn't aborted")
+		return
+	}
+	s := ctl.status()
+	// the hung transfer is cancelled, failing
+	if s.Aborted != "no progress for 200ms" || s.Pass != 1 || s.Fail != 1 {
+		t.Errorf("unexpected aborted status: %+v", s)
+	}
+}
+
+// slowEnumerator lists its keys after a delay, like a long prescan
+type slowEnumerator struct {
+	delay time.Duration
+	keys  []string
+}
+
+func (t *slowEnumerator) enumerate(emit func(syncObjItem) bool) error {
+	time.Sleep(t.delay)
+	for _, key := range t.keys {
+		if !emit(syncObjItem{key: key}) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestWatchdogSlowEnumeration(t *testing.T) {
+	interval := WatchdogInterval
+	WatchdogInterval = 20 * time.Millisecond
+	defer func() { WatchdogInterval = interval }()
+
+	bucket := "bucket1"
+	s3Server, err := setupS3Server(bucket)
+	if err != nil {
+		t.Errorf("failed to prepare test data: %s", err.Error())
+		return
+	}
+	defer s3Server.Close()
+	wos := setupWosServer(t, []string{"k1"})
+	defer wos.Close()
+	dest := storage.NewS3Storage(s3Server.URL, "u1", "s1", bucket)
+	source := storage.NewWosStorage(strings.TrimPrefix(wos.URL, "http://"))
+
+	// nothing dispatched for longer than the deadline isn't a stall
+	ctl := newRunControl(1)
+	stop := startWatchdog(watchdogOptions{deadline: 100 * time.Millisecond}, ctl)
+	defer stop()
+	runMigration(ctl, dest, source, &csvReporter{w: bufio.NewWriter(&memWriter{})},
+		&slowEnumerator{delay: 300 * time.Millisecond, keys: []string{"k1"}})
+	if s := ctl.status(); s.Aborted != "" || s.Pass != 1 {
+		t.Errorf("slow enumeration aborted the run: %+v", s)
+	}
+}
+
+func TestInflightRuns(t *testing.T) {
+	d1, d2 := newMemStorage(0), newMemStorage(0)
+	source := newMemStorage(0)
+	r1, r2 := newRunControl(1), newRunControl(1)
+	o1 := inflight.start(r1, d1, source, "k1", "worker-0", 1)
+	o2 := inflight.start(r2, d2, source, "k1", "worker-0", 1)
+	defer inflight.done(o1)
+	defer inflight.done(o2)
+
+	if s1, s2 := inflight.snapshot(r1), inflight.snapshot(r2); len(s1) != 1 || len(s2) != 1 {
+		t.Errorf("unexpected snapshots: %v %v", s1, s2)
+	}
+	if inflight.context(d2, "k1") != o2.ctx || inflight.context(d1, "k1") != o1.ctx {
+		t.Errorf("requests of a destination got the context of another run")
+	}
+	inflight.cancelRun(r1, "run aborted")
+	if o1.ctx.Err() == nil || o2.ctx.Err() != nil {
+		t.Errorf("cancelling a run cancelled the wrong transfers: %v %v", o1.ctx.Err(), o2.ctx.Err())
+	}
+}
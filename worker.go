@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"s3sync/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	WorkerPollInterval = 5 * time.Second
+	WorkerMaxRetries   = 10
+)
+
+// workerClient talks to the coordinator of a distributed migration
+type workerClient struct {
+	url    string
+	id     string
+	client http.Client
+}
+
+func newWorkerClient(url, id string) *workerClient {
+	return &workerClient{
+		url:    strings.TrimSuffix(url, "/"),
+		id:     id,
+		client: http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// post sends req and decodes the response into resp when there is one,
+// returning the http status code
+func (t *workerClient) post(path string, req, resp interface{}) (int, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	r, err := t.client.Post(t.url+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode == http.StatusOK && resp != nil {
+		if err := json.NewDecoder(r.Body).Decode(resp); err != nil {
+			return r.StatusCode, err
+		}
+	}
+	return r.StatusCode, nil
+}
+
+// get decodes the response to a GET of path into resp
+func (t *workerClient) get(path string, resp interface{}) error {
+	r, err := t.client.Get(t.url + path)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("http failed code: %d", r.StatusCode)
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// runWorker leases batches from the coordinator and migrates them until the
+// coordinator says the migration is over
+func runWorker(c *workerClient, batch int, dest storage.StorDest, source storage.StorSrc) error {
+	if Pack != "" {
+		var status coordinatorStatus
+		if err := c.get("/status", &status); err != nil {
+			return fmt.Errorf("failed to get the coordinator status: %s", err.Error())
+		}
+		if err := checkPackReport(status.ReportFormat); err != nil {
+			return fmt.Errorf("coordinator report: %s", err.Error())
+		}
+	}
+	pk := newPacker(dest)
+	leases := newWorkerLeases(c)
+	defer leases.close()
+	failures := 0
+	for {
+		var l leaseResponse
+		status, err := c.post("/lease", leaseRequest{Worker: c.id, Max: batch}, &l)
+		if err == nil && status != http.StatusOK && status != http.StatusNoContent &&
+			status != http.StatusGone {
+			err = fmt.Errorf("http failed code: %d", status)
+		}
+		if err != nil {
+			failures++
+			if failures > WorkerMaxRetries {
+				return fmt.Errorf("failed to lease objects: %s", err.Error())
+			}
+			log.Errorf("failed to lease objects: %s, retrying", err.Error())
+			time.Sleep(WorkerPollInterval)
+			continue
+		}
+		failures = 0
+
+		switch status {
+		case http.StatusGone:
+			log.Infof("Worker %s: migration is over", c.id)
+			return nil
+		case http.StatusNoContent:
+			// nothing left to lease for now, the bundle being filled
+			// mustn't hold the objects of its leases until the next batch
+			leases.post(pk.flush())
+			time.Sleep(WorkerPollInterval)
+			continue
+		}
+
+		log.Debugf("worker %s leased %d objects: %s", c.id, len(l.Objects), l.Lease)
+		wl := leases.add(l)
+		leases.post(processLease(c.id, leases, wl, l, pk, dest, source))
+	}
+}
+
+// processLease migrates the objects of a lease with SyncWorkerCnt workers,
+// returning the results known once they are done, the packed objects of
+// this lease and the earlier ones coming with the bundles pk writes. It stops
+// taking the objects of a lease the coordinator revoked.
+func processLease(id string, leases *workerLeases, wl *workerLease, l leaseResponse,
+	pk *packer, dest storage.StorDest, source storage.StorSrc) []syncResult {
+	items := make(chan syncObjItem)
+	var mu sync.Mutex
+	var results []syncResult
+	var wg sync.WaitGroup
+	for i := 0; i < SyncWorkerCnt; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			for item := range items {
+				packed := pk.add(runObject(nil, id, item, dest, source))
+				mu.Lock()
+				results = append(results, packed...)
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("%s/%d", id, i))
+	}
+	for _, o := range l.Objects {
+		if !leases.active(wl) {
+			log.Warnf("lease %s was revoked, skipping its remaining objects", l.Lease)
+			break
+		}
+		items <- syncObjItem{key: o.Key, dests: o.Dests, attempts: o.Attempts}
+	}
+	close(items)
+	wg.Wait()
+	return results
+}
+
+// workerLease is a lease of a worker, open until the results of all of its
+// objects are posted or the coordinator revokes it
+type workerLease struct {
+	id   string
+	left int
+	done chan struct{}
+}
+
+// workerLeases renews the open leases of a worker and posts the results of
+// their objects, a lease staying open while its objects wait in a bundle
+type workerLeases struct {
+	sync.Mutex
+	c      *workerClient
+	leases map[string]*workerLease
+	keys   map[string]*workerLease
+}
+
+func newWorkerLeases(c *workerClient) *workerLeases {
+	return &workerLeases{
+		c:      c,
+		leases: map[string]*workerLease{},
+		keys:   map[string]*workerLease{},
+	}
+}
+
+// add opens l, renewing it every third of its ttl until it is closed
+func (t *workerLeases) add(l leaseResponse) *workerLease {
+	wl := &workerLease{id: l.Lease, left: len(l.Objects), done: make(chan struct{})}
+	t.Lock()
+	t.leases[wl.id] = wl
+	for _, o := range l.Objects {
+		t.keys[o.Key] = wl
+	}
+	t.Unlock()
+
+	interval := time.Duration(l.TTL * float64(time.Second) / 3)
+	if interval <= 0 {
+		interval = time.Second
+	}
+	go t.renew(wl, interval)
+	return wl
+}
+
+func (t *workerLeases) renew(wl *workerLease, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			status, err := t.c.post("/renew", renewRequest{Lease: wl.id}, nil)
+			if err == nil && status == http.StatusConflict {
+				log.Warnf("lease %s expired on the coordinator, dropping it", wl.id)
+				t.drop(wl)
+				return
+			}
+			if err != nil || status != http.StatusOK {
+				log.Warnf("failed to renew lease %s: %v %d", wl.id, err, status)
+			}
+		case <-wl.done:
+			return
+		}
+	}
+}
+
+// active tells whether wl is still open
+func (t *workerLeases) active(wl *workerLease) bool {
+	select {
+	case <-wl.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// drop closes wl, the results of its objects are no longer posted
+func (t *workerLeases) drop(wl *workerLease) {
+	t.Lock()
+	defer t.Unlock()
+	t.closeLease(wl)
+}
+
+// closeLease must be called with the lock held
+func (t *workerLeases) closeLease(wl *workerLease) {
+	if _, ok := t.leases[wl.id]; !ok {
+		return
+	}
+	delete(t.leases, wl.id)
+	for key, l := range t.keys {
+		if l == wl {
+			delete(t.keys, key)
+		}
+	}
+	close(wl.done)
+}
+
+// post posts results to the leases of their objects, a lease failing to
+// take them is dropped and expires on the coordinator
+func (t *workerLeases) post(results []syncResult) {
+	var order []*workerLease
+	byLease := map[*workerLease][]wireResult{}
+	t.Lock()
+	for _, r := range results {
+		wl, ok := t.keys[r.oldKey]
+		if !ok {
+			log.Warnf("dropping the result of %s, its lease is gone", r.oldKey)
+			continue
+		}
+		delete(t.keys, r.oldKey)
+		if _, ok := byLease[wl]; !ok {
+			order = append(order, wl)
+		}
+		byLease[wl] = append(byLease[wl], toWireResult(r))
+	}
+	t.Unlock()
+
+	for _, wl := range order {
+		wires := byLease[wl]
+		status, err := t.c.post("/results", resultRequest{Lease: wl.id, Worker: t.c.id, Results: wires}, nil)
+		if err == nil && status != http.StatusOK {
+			err = fmt.Errorf("http failed code: %d", status)
+		}
+		t.Lock()
+		if err != nil {
+			log.Errorf("failed to report results of lease %s: %s", wl.id, err.Error())
+			t.closeLease(wl)
+		} else if wl.left -= len(wires); wl.left <= 0 {
+			t.closeLease(wl)
+		}
+		t.Unlock()
+	}
+}
+
+// close stops renewing the open leases
+func (t *workerLeases) close() {
+	t.Lock()
+	defer t.Unlock()
+	for _, wl := range t.leases {
+		t.closeLease(wl)
+	}
+}
+
+// workerCommand runs a worker of a distributed migration:
+//
+//	worker -coordinator http://coordinator:8080 -ak ... -wos ...
+func workerCommand(args []string) {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	cfg := addConfigFlags(fs)
+	coordinatorURL := fs.String("coordinator", "", "coordinator url")
+	hostname, _ := os.Hostname()
+	id := fs.String("id", fmt.Sprintf("%s-%d", hostname, os.Getpid()), "worker id")
+	batch := fs.Int("batch", 100, "objects leased at once")
+	storOpts := storOptions{}
+	addStorFlags(fs, &storOpts)
+	addMismatchFlags(fs)
+	addTransformFlags(fs)
+	addPackFlags(fs)
+	addDedupFlags(fs)
+	addProtectFlags(fs)
+	encOpts := encryptionOptions{}
+	addEncryptionFlags(fs, &encOpts)
+	checkOpts := preflightOptions{}
+	fs.BoolVar(&checkOpts.skip, "nopreflight", false, "skip the checks run before the migration")
+	addPreflightFlags(fs, &checkOpts)
+	fs.Parse(args)
+	if err := cfg.load(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if *coordinatorURL == "" || !storOpts.complete() {
+		fs.Usage()
+		log.Fatal("missing coordinator, access key, secret key, endpoint, bucket or source")
+	}
+	if _, err := parseMismatchPolicy(MismatchPolicy); err != nil {
+		fs.Usage()
+		log.Fatal(err.Error())
+	}
+	if err := setupTransform(); err != nil {
+		fs.Usage()
+		log.Fatal(err.Error())
+	}
+	if err := setupEncryption(encOpts); err != nil {
+		fs.Usage()
+		log.Fatal(err.Error())
+	}
+	if err := setupPacking(); err != nil {
+		fs.Usage()
+		log.Fatal(err.Error())
+	}
+	if err := setupDedup(); err != nil {
+		fs.Usage()
+		log.Fatal(err.Error())
+	}
+	if err := setupProtection(); err != nil {
+		fs.Usage()
+		log.Fatal(err.Error())
+	}
+
+	dest, err := storOpts.dest()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	source, err := storOpts.source()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if !checkOpts.skip {
+		checks := runPreflight(checkOpts, enumOptions{}, source, dest, spoolDirs(enumOptions{}))
+		checks.log()
+		if n := checks.failed(); n > 0 {
+			log.Fatalf("%d pre-flight checks failed, -nopreflight skips them", n)
+		}
+	}
+	setContentPrefix(dest)
+	setProtection(dest)
+	log.Infof("Worker %s migrating from %s to %s with %d worker...",
+		*id, storOpts.sourceName(), storOpts.destName(), SyncWorkerCnt)
+	if err := runWorker(newWorkerClient(*coordinatorURL, *id), *batch, dest, source); err != nil {
+		log.Fatal(err.Error())
+	}
+}